@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/config"
+	store "github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/abesheknarayan/go-caskdb/pkg/http_server"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/memcached_server"
+	"github.com/abesheknarayan/go-caskdb/pkg/replication"
+	"github.com/abesheknarayan/go-caskdb/pkg/resp_server"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	- serves one db directory over the network, e.g. caskdb-server --dir ./data/books --resp-addr :6379 --http-addr :8080 --memcached-addr :11211
+	- an empty address turns that server off, at least one has to be on
+	- --replication-addr streams the db's writes to followers, --replicate-from runs a read only follower of a primary
+	- SIGINT or SIGTERM shut the servers down gracefully and close the db
+*/
+
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+func run(args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("caskdb-server", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", "", "path of the db directory, created if needed")
+	respAddr := flags.String("resp-addr", ":6379", "address to serve the redis protocol on, empty to turn it off")
+	httpAddr := flags.String("http-addr", "", "address to serve the http api on, empty to turn it off")
+	memcachedAddr := flags.String("memcached-addr", "", "address to serve the memcached text protocol on, empty to turn it off")
+	httpMaxBody := flags.Int64("http-max-body", http_server.DEFAULT_MAX_BODY_BYTES, "largest http request body in bytes")
+	httpMaxScan := flags.Int("http-max-scan-limit", http_server.DEFAULT_MAX_SCAN_LIMIT, "most items an http scan returns")
+	replicationAddr := flags.String("replication-addr", "", "address to stream writes to followers on, empty to turn it off")
+	replicateFrom := flags.String("replicate-from", "", "replication address of a primary to follow, the db is read only then")
+	syncWAL := flags.Bool("sync-wal", false, "fsync the write ahead log after every write, so writes survive the machine crashing")
+	verbose := flags.Bool("verbose", false, "log debug messages")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" || flags.NArg() != 0 || (*respAddr == "" && *httpAddr == "" && *memcachedAddr == "") || *httpMaxBody < 1 || *httpMaxScan < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	l := logrus.New()
+	l.SetOutput(stderr)
+	if *verbose {
+		l.SetLevel(logrus.DebugLevel)
+	}
+	log := logger.NewLogrusLogger(l)
+
+	// the db logs every single operation, it only gets the logger with --verbose
+	dbLog := logger.NewNopLogger()
+	if *verbose {
+		dbLog = log
+	}
+	d, err := openDb(*dir, dbLog, *replicateFrom != "", *syncWAL)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer d.CloseDB()
+
+	errs := make(chan error, 4)
+	var primary *replication.Primary
+	if *replicationAddr != "" {
+		primary = replication.NewPrimary(d)
+		primary.Logger = log
+		go func() {
+			errs <- primary.ListenAndServe(*replicationAddr)
+		}()
+	}
+	followerCtx, stopFollower := context.WithCancel(context.Background())
+	followerDone := make(chan struct{})
+	if *replicateFrom != "" {
+		follower := replication.NewFollower(d, *replicateFrom)
+		follower.Logger = log
+		go func() {
+			follower.Run(followerCtx)
+			close(followerDone)
+		}()
+	} else {
+		close(followerDone)
+	}
+	var respServer *resp_server.Server
+	if *respAddr != "" {
+		respServer = resp_server.NewServer(d)
+		respServer.Logger = log
+		go func() {
+			errs <- respServer.ListenAndServe(*respAddr)
+		}()
+	}
+	var memcachedServer *memcached_server.Server
+	if *memcachedAddr != "" {
+		memcachedServer = memcached_server.NewServer(d)
+		memcachedServer.Logger = log
+		go func() {
+			errs <- memcachedServer.ListenAndServe(*memcachedAddr)
+		}()
+	}
+	var httpServer *http.Server
+	if *httpAddr != "" {
+		handler := http_server.NewServer(d)
+		handler.Logger = log
+		handler.MaxBodyBytes = *httpMaxBody
+		handler.MaxScanLimit = *httpMaxScan
+		httpServer = &http.Server{Addr: *httpAddr, Handler: handler}
+		log.Infof("Serving http api on %s", *httpAddr)
+		go func() {
+			errs <- httpServer.ListenAndServe()
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	code := 0
+	select {
+	case err := <-errs:
+		// one server failing takes the other one down as well
+		fmt.Fprintln(stderr, err)
+		code = 1
+	case sig := <-signals:
+		log.Infof("Got %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if respServer != nil {
+		if err := respServer.Shutdown(ctx); err != nil {
+			log.Warnf("Redis protocol connections were cut off: %v", err)
+		}
+	}
+	if memcachedServer != nil {
+		if err := memcachedServer.Shutdown(ctx); err != nil {
+			log.Warnf("Memcached protocol connections were cut off: %v", err)
+		}
+	}
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Warnf("Http connections were cut off: %v", err)
+		}
+	}
+	if primary != nil {
+		if err := primary.Shutdown(ctx); err != nil {
+			log.Warnf("Followers were cut off: %v", err)
+		}
+	}
+	stopFollower()
+	<-followerDone
+	return code
+}
+
+func openDb(dir string, log logger.Logger, readOnly bool, syncWAL bool) (*store.DiskStore, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	config.Config = config.NewDefaultConfig("Prod", filepath.Dir(absDir))
+
+	options := store.DefaultOptions()
+	options.Logger = log
+	options.ReadOnly = readOnly
+	options.SyncWAL = syncWAL
+	return store.InitDbWithOptions(filepath.Base(absDir), options)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	store "github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+)
+
+var errProblemsFound = errors.New("problems found")
+
+// prints every record of a segment file followed by a summary of the file
+func dumpSegment(args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	path := args[0]
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "offset\ttimestamp\tkind\tkey size\tvalue size\tkey")
+	readErr := store.ReadSegmentFile(path, func(record format.Record) error {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%d\t%q\n", record.Offset, record.Timestamp, record.Kind, len(record.Key), len(record.Value), record.Key)
+		return nil
+	})
+	w.Flush()
+
+	report, err := store.InspectSegmentFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "\n%d records (%d tombstones), %d bytes, keys [%q .. %q]\n", report.Records, report.Tombstones, report.FileSize, report.SmallestKey, report.LargestKey)
+	if readErr == nil && len(report.Problems) == 0 {
+		fmt.Fprintln(stdout, "keys are sorted, no problems found")
+		return nil
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintln(stdout, "problem:", problem)
+	}
+	return errProblemsFound
+}
+
+// prints the levels of the manifest along with what the files on disk say and every discrepancy between the two
+func inspect(dir string, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	report, err := store.InspectDb(dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "db %s, %d levels, max segment id %d\n", report.Manifest.DbName, report.Manifest.NumberOfLevels, report.Manifest.MaxSegmentId)
+	for level, segmentLevel := range report.Manifest.SegmentLevels {
+		fmt.Fprintf(stdout, "--- level %d: %d segments ---\n", level, len(segmentLevel.Segments))
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "  segment\tcardinality\tsize\tfile size\tsmallest key\tlargest key")
+		for _, segment := range segmentLevel.Segments {
+			fileSize := "missing"
+			if file, ok := report.Segments[segment.SegmentId]; ok {
+				fileSize = fmt.Sprint(file.FileSize)
+			}
+			fmt.Fprintf(w, "  %d\t%d\t%d\t%s\t%q\t%q\n", segment.SegmentId, segment.Cardinality, segment.Size, fileSize, segment.SmallestKey, segment.LargestKey)
+		}
+		w.Flush()
+	}
+
+	if len(report.Problems) == 0 {
+		fmt.Fprintln(stdout, "manifest and files agree, no problems found")
+		return nil
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintln(stdout, "problem:", problem)
+	}
+	return errProblemsFound
+}
+
+// prints every problem found, nothing when the db is fine
+func verify(dir string, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	report, err := store.Verify(dir)
+	if report == nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintln(stdout, "problem:", problem)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "ok")
+	return nil
+}
+
+// repairs the db and prints what was done
+func repair(dir string, args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("no database at %s: %v", dir, err)
+	}
+	report, err := store.Repair(dir)
+	if err != nil {
+		return err
+	}
+	if report.ManifestRebuilt {
+		fmt.Fprintln(stdout, "manifest rebuilt from the segment files, every segment is in level 0")
+	}
+	if report.SequenceLost {
+		fmt.Fprintln(stdout, "last sequence is lost and starts over at 0, followers have to install a new snapshot")
+	}
+	damagedIds := make([]uint32, 0, len(report.SalvagedSegments))
+	for segmentId := range report.SalvagedSegments {
+		damagedIds = append(damagedIds, segmentId)
+	}
+	sort.Slice(damagedIds, func(i, j int) bool { return damagedIds[i] < damagedIds[j] })
+	for _, segmentId := range damagedIds {
+		fmt.Fprintf(stdout, "salvaged segment %d into segment %d\n", segmentId, report.SalvagedSegments[segmentId])
+	}
+	for _, segmentId := range report.DroppedSegments {
+		fmt.Fprintf(stdout, "dropped segment %d, it has no file\n", segmentId)
+	}
+	for _, path := range report.Quarantined {
+		fmt.Fprintln(stdout, "moved", path)
+	}
+	fmt.Fprintf(stdout, "%d records salvaged, max segment id %d\n", report.SalvagedRecords, report.MaxSegmentId)
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/config"
+	store "github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	- operates on a single db directory, e.g. caskdb --dir ./data/books get harry
+	- the db must not be open in another process while this runs, nothing stops two processes from writing the same files
+	- exit code 0 on success, 1 when the command failed (or the key wasn't found, or inspection or verification found problems), 2 on bad usage
+*/
+
+const usage = `usage: caskdb [--dir <db directory>] [--verbose] <command> [arguments]
+
+commands:
+  get <key>                                prints the value of the key
+  put <key> <value>                        sets the value of the key, creates the db if needed
+  delete <key>                             deletes the key
+  scan [--prefix p] [--start s] [--end e]  prints key<TAB>value of every key in the range, sorted by key
+  stats                                    prints levels, compactions, cache and stall statistics
+  compact [--start s] [--end e]            compacts the range (or the whole db) into the bottom most level
+  export [--format jsonl|csv] [--output f]
+                                           writes every key and value as json lines (default) or csv, to stdout by default
+  import [--format jsonl|csv] [--batch-size n] [--progress] <file>
+                                           puts every record of a file written by export, - reads stdin
+  ingest <segment file>...                 adds segment files built with format.SegmentWriter to the db
+  checkpoint <dest dir>                    writes a copy of the db that opens on its own to dest dir
+  backup <backup dir>                      adds a backup to backup dir, copying only segments it doesn't have yet
+  dump-manifest                            prints the manifest as indented json
+  inspect                                  prints the levels and checks the manifest against the segment files
+  dump-segment <file>                      prints every record of a segment file and checks its key order (no --dir)
+  verify                                   checks that every segment decodes cleanly and matches the manifest
+  repair                                   salvages damaged segments, moves bad files to lost/ and rewrites the manifest
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("caskdb", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	dir := flags.String("dir", "", "path of the db directory")
+	verbose := flags.Bool("verbose", false, "log to stderr")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	// dump-segment is the only command working on a single file instead of the db directory
+	if *dir == "" && command != "dump-segment" {
+		flags.Usage()
+		return 2
+	}
+	var err error
+	switch command {
+	case "dump-segment":
+		err = dumpSegment(commandArgs, stdout)
+	case "inspect":
+		err = inspect(*dir, commandArgs, stdout)
+	case "verify":
+		err = verify(*dir, commandArgs, stdout)
+	case "repair":
+		err = repair(*dir, commandArgs, stdout)
+	case "dump-manifest":
+		err = dumpManifest(*dir, stdout)
+	case "get", "put", "delete", "scan", "stats", "compact", "checkpoint", "backup", "export", "import", "ingest":
+		err = runOnDb(*dir, *verbose, command, commandArgs, stdout)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", command)
+		flags.Usage()
+		return 2
+	}
+
+	if errors.Is(err, errUsage) {
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+var (
+	errUsage       = errors.New("bad usage")
+	errKeyNotFound = errors.New("key not found")
+)
+
+func runOnDb(dir string, verbose bool, command string, args []string, stdout io.Writer) error {
+	// every command but put and import works on an existing db only, opening a missing one would create it
+	if command != "put" && command != "import" {
+		if _, err := os.Stat(filepath.Join(dir, store.MANIFEST_FILE_NAME)); err != nil {
+			return fmt.Errorf("no database at %s: %v", dir, err)
+		}
+	}
+
+	d, err := openDb(dir, verbose)
+	if err != nil {
+		return err
+	}
+	defer d.CloseDB()
+
+	switch command {
+	case "get":
+		if len(args) != 1 {
+			return errUsage
+		}
+		// an empty value is a value too
+		value, ok := d.Lookup(args[0])
+		if !ok {
+			return errKeyNotFound
+		}
+		fmt.Fprintln(stdout, value)
+	case "put":
+		if len(args) != 2 {
+			return errUsage
+		}
+		// Put only logs a failed write, the batch reports it
+		batch := store.NewWriteBatch()
+		batch.Put(args[0], args[1])
+		return d.Write(batch)
+	case "delete":
+		if len(args) != 1 {
+			return errUsage
+		}
+		batch := store.NewWriteBatch()
+		batch.Delete(args[0])
+		return d.Write(batch)
+	case "scan":
+		return scan(d, args, stdout)
+	case "stats":
+		if len(args) != 0 {
+			return errUsage
+		}
+		stats, _ := d.GetProperty("caskdb.stats")
+		segments, _ := d.GetProperty("caskdb.sstables")
+		fmt.Fprint(stdout, stats)
+		fmt.Fprint(stdout, segments)
+	case "compact":
+		return compact(d, args, stdout)
+	case "export":
+		return export(d, args, stdout)
+	case "import":
+		return importFile(d, args, stdout)
+	case "ingest":
+		if len(args) == 0 {
+			return errUsage
+		}
+		ingested, err := d.IngestSegments(args)
+		if err != nil {
+			return err
+		}
+		for _, segment := range ingested {
+			fmt.Fprintf(stdout, "%s: segment %d on level %d\n", segment.Path, segment.SegmentId, segment.Level)
+		}
+	case "checkpoint":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return d.Checkpoint(args[0])
+	case "backup":
+		if len(args) != 1 {
+			return errUsage
+		}
+		info, err := d.CreateBackup(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "backup %d: copied %d of %d segments (%d bytes)\n", info.BackupId, info.CopiedSegments, info.Segments, info.CopiedBytes)
+	}
+	return nil
+}
+
+func openDb(dir string, verbose bool) (*store.DiskStore, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	config.Config = config.NewDefaultConfig("Prod", filepath.Dir(absDir))
+
+	options := store.DefaultOptions()
+	if verbose {
+		l := logrus.New()
+		l.SetOutput(os.Stderr)
+		l.SetLevel(logrus.DebugLevel)
+		options.Logger = logger.NewLogrusLogger(l)
+		options.LogKeysAndValues = true
+	}
+	return store.InitDbWithOptions(filepath.Base(absDir), options)
+}
+
+func scan(d *store.DiskStore, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	prefix := flags.String("prefix", "", "")
+	start := flags.String("start", "", "")
+	end := flags.String("end", "", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	printEntry := func(key string, value string) bool {
+		fmt.Fprintf(stdout, "%s\t%s\n", key, value)
+		return true
+	}
+	if *prefix != "" {
+		return d.ScanPrefix(*prefix, func(key string, value string) bool {
+			if (*start != "" && key < *start) || (*end != "" && key > *end) {
+				return true
+			}
+			return printEntry(key, value)
+		})
+	}
+	return d.Scan(*start, *end, printEntry)
+}
+
+func compact(d *store.DiskStore, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	start := flags.String("start", "", "")
+	end := flags.String("end", "", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	stats, err := d.CompactRange(*start, *end)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "read %d segments (%d bytes), wrote %d segments (%d bytes) in %v\n",
+		stats.SegmentsRead, stats.BytesRead, stats.SegmentsWritten, stats.BytesWritten, stats.Duration)
+	return nil
+}
+
+// prints the manifest without opening the db, so it works even if the db can't be opened
+func dumpManifest(dir string, stdout io.Writer) error {
+	content, err := os.ReadFile(filepath.Join(dir, store.MANIFEST_FILE_NAME))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(content), "", "  "); err != nil {
+		return fmt.Errorf("manifest is not valid json: %v", err)
+	}
+	buf.WriteString("\n")
+	_, err = stdout.Write(buf.Bytes())
+	return err
+}
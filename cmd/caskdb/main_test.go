@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	store "github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	"github.com/stretchr/testify/assert"
+)
+
+// runs the cli and returns its exit code and stdout
+func runCli(t *testing.T, args ...string) (int, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	if code != 0 {
+		t.Log(stderr.String())
+	}
+	return code, stdout.String()
+}
+
+func TestCommands(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "caskdb_cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dir := filepath.Join(tempDir, "books")
+
+	code, _ := runCli(t, "--dir", dir, "get", "harry")
+	assert.Equal(t, 1, code, "get on a missing db has to fail")
+
+	for _, kv := range [][]string{{"book:1", "dune"}, {"book:2", "emma"}, {"film:1", "heat"}} {
+		code, _ = runCli(t, "--dir", dir, "put", kv[0], kv[1])
+		assert.Equal(t, 0, code)
+	}
+
+	code, out := runCli(t, "--dir", dir, "get", "book:2")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "emma\n", out)
+
+	code, _ = runCli(t, "--dir", dir, "delete", "book:2")
+	assert.Equal(t, 0, code)
+	code, _ = runCli(t, "--dir", dir, "get", "book:2")
+	assert.Equal(t, 1, code, "Deleted key was found")
+
+	code, out = runCli(t, "--dir", dir, "scan", "--prefix", "book:")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "book:1\tdune\n", out)
+
+	code, out = runCli(t, "--dir", dir, "compact")
+	assert.Equal(t, 0, code)
+	assert.True(t, strings.HasPrefix(out, "read "), out)
+
+	code, out = runCli(t, "--dir", dir, "scan")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "book:1\tdune\nfilm:1\theat\n", out, "Scan after compaction differs")
+
+	code, out = runCli(t, "--dir", dir, "stats")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "Compactions")
+
+	code, out = runCli(t, "--dir", dir, "dump-manifest")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "\"DbName\": \"books\"")
+
+	code, out = runCli(t, "--dir", dir, "inspect")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "no problems found")
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert.NotEmpty(t, segments)
+	code, out = runCli(t, "dump-segment", segments[0])
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "keys are sorted")
+
+	code, out = runCli(t, "--dir", dir, "verify")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "ok")
+
+	// lose the manifest, verify fails and repair brings the keys back
+	assert.Nil(t, os.Remove(filepath.Join(dir, store.MANIFEST_FILE_NAME)))
+	code, _ = runCli(t, "--dir", dir, "verify")
+	assert.Equal(t, 1, code)
+	code, out = runCli(t, "--dir", dir, "repair")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "manifest rebuilt")
+	code, _ = runCli(t, "--dir", dir, "verify")
+	assert.Equal(t, 0, code)
+	code, out = runCli(t, "--dir", dir, "get", "film:1")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "heat\n", out)
+
+	code, _ = runCli(t, "--dir", dir, "checkpoint", filepath.Join(tempDir, "books-copy"))
+	assert.Equal(t, 0, code)
+	code, out = runCli(t, "--dir", filepath.Join(tempDir, "books-copy"), "get", "film:1")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "heat\n", out, "Checkpoint differs")
+	code, out = runCli(t, "--dir", dir, "backup", filepath.Join(tempDir, "backups"))
+	assert.Equal(t, 0, code)
+	assert.True(t, strings.HasPrefix(out, "backup 1:"), out)
+
+	exportFile := filepath.Join(tempDir, "books.csv")
+	code, _ = runCli(t, "--dir", dir, "export", "--format", "csv", "--output", exportFile)
+	assert.Equal(t, 0, code)
+	code, out = runCli(t, "--dir", filepath.Join(tempDir, "imported"), "import", "--format", "csv", exportFile)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "imported 2 records\n", out)
+	code, out = runCli(t, "--dir", filepath.Join(tempDir, "imported"), "export")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "{\"key\":\"book:1\",\"value\":\"dune\"}\n{\"key\":\"film:1\",\"value\":\"heat\"}\n", out)
+
+	segments, _ = filepath.Glob(filepath.Join(tempDir, "books-copy", "*.seg"))
+	code, out = runCli(t, "--dir", filepath.Join(tempDir, "imported"), "ingest", segments[0])
+	assert.Equal(t, 0, code)
+	assert.Contains(t, out, "on level")
+
+	code, _ = runCli(t, "--dir", dir, "put", "only-key")
+	assert.Equal(t, 2, code, "Bad usage has to exit with 2")
+
+	// an empty value is still found, a write the db refuses fails the command
+	code, _ = runCli(t, "--dir", dir, "put", "blank", "")
+	assert.Equal(t, 0, code)
+	code, out = runCli(t, "--dir", dir, "get", "blank")
+	assert.Equal(t, 0, code, "Key with an empty value was not found")
+	assert.Equal(t, "\n", out)
+	code, _ = runCli(t, "--dir", dir, "put", strings.Repeat("k", int(format.MAX_KEY_SIZE)+1), "v")
+	assert.Equal(t, 1, code, "Failed write has to exit with 1")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	store "github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+)
+
+// writes every live key to --output (stdout by default) as json lines or csv
+func export(d *store.DiskStore, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	formatName := flags.String("format", "jsonl", "")
+	output := flags.String("output", "", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+	exportFormat, err := store.ParseExportFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	w := stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = d.Export(w, exportFormat)
+	return err
+}
+
+// puts every record of the file (stdin for -) written by export
+func importFile(d *store.DiskStore, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	formatName := flags.String("format", "jsonl", "")
+	batchSize := flags.Int("batch-size", store.DEFAULT_IMPORT_BATCH_SIZE, "")
+	progress := flags.Bool("progress", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	exportFormat, err := store.ParseExportFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	options := store.ImportOptions{BatchSize: *batchSize}
+	if *progress {
+		options.Progress = func(imported uint64) {
+			fmt.Fprintf(stdout, "imported %d records so far\n", imported)
+		}
+	}
+	imported, err := d.Import(r, exportFormat, options)
+	fmt.Fprintf(stdout, "imported %d records\n", imported)
+	return err
+}
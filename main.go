@@ -7,6 +7,7 @@ import (
 
 	config "github.com/abesheknarayan/go-caskdb/pkg/config"
 	store "github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
 	utils "github.com/abesheknarayan/go-caskdb/pkg/utils"
 )
 
@@ -78,7 +79,9 @@ func main() {
 	utils.InitLogger()
 	// utils.Logger.SetLevel(logrus.ErrorLevel)
 
-	booksDb, err := store.InitDb("test1")
+	options := store.DefaultOptions()
+	options.Logger = logger.NewLogrusLogger(utils.Logger)
+	booksDb, err := store.InitDbWithOptions("test1", options)
 	if err != nil {
 		log.Fatalf("Failed to initialize DB %v", err)
 	}
@@ -10,9 +10,12 @@ import (
 )
 
 type ConfigStruct struct {
-	Stage             string // Dev || Prod || Test
-	Path              string
-	MemtableSizeLimit uint64
+	Stage                    string // Dev || Prod || Test
+	Path                     string
+	MemtableSizeLimit        uint64
+	CompactionRateLimit      uint64 // bytes per second, can be changed at runtime with DiskStore.SetCompactionRateLimit
+	MaxBackgroundCompactions int
+	TableCacheSize           int // number of segments
 }
 
 var Config *ConfigStruct
@@ -39,11 +42,19 @@ func LoadConfigFromEnv() {
 			path, _ = os.LookupEnv("DB_PATH") // will be empty if DB_PATH is empty [In case of tests above func will be used to set path]
 		}
 	}
-	Config = &ConfigStruct{
-		Stage:             stage,
-		Path:              path,
-		MemtableSizeLimit: MAX_MEMTABLE_SIZE,
-	}
+	Config = NewDefaultConfig(stage, path)
 	fmt.Println(Config)
 
 }
+
+// config with the default limits, for using the db without a .env file (like from cmd/caskdb)
+func NewDefaultConfig(stage string, path string) *ConfigStruct {
+	return &ConfigStruct{
+		Stage:                    stage,
+		Path:                     path,
+		MemtableSizeLimit:        MAX_MEMTABLE_SIZE,
+		CompactionRateLimit:      DEFAULT_COMPACTION_RATE_LIMIT,
+		MaxBackgroundCompactions: MAX_BACKGROUND_COMPACTIONS,
+		TableCacheSize:           TABLE_CACHE_SIZE,
+	}
+}
@@ -1,3 +1,11 @@
 package config
 
 const MAX_MEMTABLE_SIZE uint64 = 4 * 1024 // maximum allowed size of memtable in bytes
+
+const DEFAULT_COMPACTION_RATE_LIMIT uint64 = 0 // bytes per second allowed for memtable flushes and merge compaction, 0 means unlimited
+
+const MAX_BACKGROUND_COMPACTIONS int = 2 // maximum number of merge compactions running in parallel
+
+const LEVEL0_STOP_WRITES_TRIGGER int = 8 // writes wait for compaction once level 0 has these many segments
+
+const TABLE_CACHE_SIZE int = 32 // number of segments kept in memory for reads, 0 disables the cache
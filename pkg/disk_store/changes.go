@@ -0,0 +1,111 @@
+package disk_store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+)
+
+/*
+	- change events are read off the replication log, every operation of a batch becomes one event with the batch's
+	  sequence, so a subscriber resumes with the sequence after the last one it has fully handled
+	- batches older than the replication log are read from the write ahead log, so a subscriber can resume after a
+	  restart. Once its batch is gone from both (the write ahead log keeps Options.WALRetentionSize bytes of flushed
+	  batches), or after an ingest or a snapshot install, Next fails with ErrSequenceUnavailable and the subscriber
+	  has to scan the db and subscribe again from LastSequence() + 1
+*/
+
+// one put or delete of a key
+type ChangeEvent struct {
+	Sequence  uint64 // of the write batch the change was part of
+	Key       string
+	Value     string // empty for deletes
+	Deleted   bool
+	Merge     bool      // Value is an operand for the merge operator rather than the new value
+	ExpiresAt time.Time // zero unless the value was put with a ttl
+}
+
+// the changes of keys with some prefix, in commit order
+type ChangeSubscription struct {
+	prefix      string
+	replication *ReplicationSubscription
+	pending     []ChangeEvent // rest of the batch read last
+}
+
+// Returns a subscription to the changes of keys starting with prefix (empty for all keys) from sequence
+// fromSequence on, which must be closed. fromSequence 0 means from the next write. Fails with ErrSequenceUnavailable if neither the
+// replication log nor the write ahead log have that batch (anymore)
+func (d *DiskStore) Subscribe(prefix string, fromSequence uint64) (*ChangeSubscription, error) {
+	if fromSequence == 0 {
+		// a write can't slip in between, both happen under the replication log's lock
+		d.replication.Mu.Lock()
+		fromSequence = d.replication.lastSequence + 1
+		subscription := d.newReplicationSubscription(fromSequence)
+		d.replication.Mu.Unlock()
+		return &ChangeSubscription{prefix: prefix, replication: subscription}, nil
+	}
+	subscription, err := d.SubscribeReplication(fromSequence)
+	if err != nil {
+		return nil, err
+	}
+	return &ChangeSubscription{prefix: prefix, replication: subscription}, nil
+}
+
+// Returns the next change, waiting for it to be committed. Fails like ReplicationSubscription.Next
+func (s *ChangeSubscription) Next(ctx context.Context) (ChangeEvent, error) {
+	for len(s.pending) == 0 {
+		replicated, err := s.replication.Next(ctx)
+		if err != nil {
+			return ChangeEvent{}, err
+		}
+		batch, err := DecodeWriteBatch(replicated.Data)
+		if err != nil {
+			return ChangeEvent{}, err
+		}
+		for _, operation := range batch.operations {
+			if !strings.HasPrefix(operation.key, s.prefix) {
+				continue
+			}
+			event := ChangeEvent{
+				Sequence: replicated.Sequence,
+				Key:      operation.key,
+				Value:    operation.value,
+				Deleted:  operation.kind == format.RECORD_KIND_TOMBSTONE,
+				Merge:    operation.kind == format.RECORD_KIND_MERGE_OPERAND,
+			}
+			if operation.kind == format.RECORD_KIND_EXPIRING_VALUE {
+				event.ExpiresAt = time.UnixMilli(operation.expiresAt)
+			}
+			s.pending = append(s.pending, event)
+		}
+	}
+	event := s.pending[0]
+	s.pending = s.pending[1:]
+	return event, nil
+}
+
+// closes the write ahead log file the subscription may be reading, see ReplicationSubscription.Close
+func (s *ChangeSubscription) Close() {
+	s.replication.Close()
+}
+
+// Blocks until key is written or deleted from sequence fromSequence on (0 for from the next write) and returns the
+// change. To not miss a change between reading a key and watching it, pass LastSequence() + 1 taken before the read
+func (d *DiskStore) WatchKey(ctx context.Context, key string, fromSequence uint64) (ChangeEvent, error) {
+	subscription, err := d.Subscribe(key, fromSequence)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+	defer subscription.Close()
+	for {
+		event, err := subscription.Next(ctx)
+		if err != nil {
+			return ChangeEvent{}, err
+		}
+		if event.Key == key {
+			return event, nil
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package disk_store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/utils"
+)
+
+/*
+	- segment files are never modified once written, so a checkpoint is just the set of segments of the manifest at
+	  one point in time plus a manifest listing them
+	- the segments are pinned while they are linked, a compaction retiring one of them meanwhile only deletes its file
+	  once the last pin is gone
+	- hard links cost no space, files are copied when the destination is on another filesystem
+	- backups keep every segment once in <backup dir>/shared and a manifest per backup in <backup dir>/<backup id>, so
+	  a backup only copies the segments the previous ones don't have. Segment ids start over after Cleanup, backups
+	  of a cleaned up db must go to a new backup dir
+*/
+
+const SHARED_BACKUP_DIR_NAME = "shared"
+
+// segments in use by checkpoints, compaction defers deleting their files till they are unpinned
+type segmentPins struct {
+	count    map[uint32]int
+	obsolete map[uint32]bool // not in the manifest anymore, file is deleted on the last unpin
+	Mu       *sync.Mutex
+}
+
+func newSegmentPins() *segmentPins {
+	return &segmentPins{
+		count:    make(map[uint32]int),
+		obsolete: make(map[uint32]bool),
+		Mu:       &sync.Mutex{},
+	}
+}
+
+// returns true if the segment is pinned, its file must then be left alone till it's unpinned
+func (p *segmentPins) deferDelete(segmentId uint32) bool {
+	p.Mu.Lock()
+	defer p.Mu.Unlock()
+	if p.count[segmentId] == 0 {
+		return false
+	}
+	p.obsolete[segmentId] = true
+	return true
+}
+
+// returns a copy of the manifest with all its segments pinned, the returned func unpins them
+func (d *DiskStore) pinCurrentSegments() (*Manifest, func()) {
+	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+	snapshot := &Manifest{
+		DbName:         d.Manifest.DbName,
+		NumberOfLevels: d.Manifest.NumberOfLevels,
+		SegmentLevels:  make([]SegmentLevelMetadata, len(d.Manifest.SegmentLevels)),
+		MaxSegmentId:   d.Manifest.MaxSegmentId,
+		LastSequence:   d.Manifest.LastSequence,
+	}
+	levels, unpin := d.pinSegmentsLocked(func(segment SegmentMetadata) bool {
+		return true
+	})
+	for i, segments := range levels {
+		snapshot.SegmentLevels[i].Segments = segments
+	}
+	return snapshot, unpin
+}
+
+// pins the segments for which include returns true and returns them level by level, the returned func unpins them.
+// Caller must hold d.Manifest.Mu
+func (d *DiskStore) pinSegmentsLocked(include func(segment SegmentMetadata) bool) ([][]SegmentMetadata, func()) {
+	levels := make([][]SegmentMetadata, len(d.Manifest.SegmentLevels))
+	var pinned []uint32
+	d.pins.Mu.Lock()
+	for i := range d.Manifest.SegmentLevels {
+		d.Manifest.SegmentLevels[i].Mu.Lock()
+		segments := make([]SegmentMetadata, 0, len(d.Manifest.SegmentLevels[i].Segments))
+		for _, segment := range d.Manifest.SegmentLevels[i].Segments {
+			if include(segment) {
+				segments = append(segments, segment)
+			}
+		}
+		d.Manifest.SegmentLevels[i].Mu.Unlock()
+		levels[i] = segments
+		for _, segment := range segments {
+			d.pins.count[segment.SegmentId]++
+			pinned = append(pinned, segment.SegmentId)
+		}
+	}
+	d.pins.Mu.Unlock()
+
+	return levels, func() { d.unpinSegments(pinned) }
+}
+
+func (d *DiskStore) unpinSegments(segmentIds []uint32) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "unpinSegments",
+	})
+	d.pins.Mu.Lock()
+	var obsolete []uint32
+	for _, segmentId := range segmentIds {
+		d.pins.count[segmentId]--
+		if d.pins.count[segmentId] > 0 {
+			continue
+		}
+		delete(d.pins.count, segmentId)
+		if d.pins.obsolete[segmentId] {
+			delete(d.pins.obsolete, segmentId)
+			obsolete = append(obsolete, segmentId)
+		}
+	}
+	d.pins.Mu.Unlock()
+
+	for _, segmentId := range obsolete {
+		if err := utils.DeleteFile(d.segmentFilePath(segmentId)); err != nil {
+			l.Errorf("error while deleting file %d.seg: %v", segmentId, err)
+		}
+	}
+	if len(obsolete) > 0 {
+		if err := utils.SyncDir(d.dirPath()); err != nil {
+			l.Errorln(err)
+		}
+	}
+}
+
+// Writes a copy of the db to destDir which opens as an independent db named after the directory. Runs alongside
+// reads, writes and compactions, the copy holds everything written before Checkpoint was called. destDir must not
+// exist yet
+func (d *DiskStore) Checkpoint(destDir string) error {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":        "Checkpoint",
+		"param_destDir": destDir,
+	})
+	l.Infoln("Attempting to create a checkpoint")
+
+	if _, err := os.Stat(destDir); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("checkpoint destination %s already exists", destDir)
+	}
+
+	d.Flush()
+	snapshot, unpin := d.pinCurrentSegments()
+	defer unpin()
+
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return err
+	}
+	err := d.linkSegments(snapshot, func(segmentId uint32) string {
+		return filepath.Join(destDir, fmt.Sprintf("%d%s", segmentId, SEGMENT_FILE_EXTENSION))
+	})
+	if err != nil {
+		l.Errorln(err)
+		os.RemoveAll(destDir)
+		return err
+	}
+
+	snapshot.DbName = filepath.Base(destDir)
+	if err := writeManifestFile(destDir, snapshot); err != nil {
+		l.Errorln(err)
+		os.RemoveAll(destDir)
+		return err
+	}
+	l.Infoln("Checkpoint created")
+	return nil
+}
+
+// links the segment files of the manifest to the paths given by dst, skipping the ones already there
+func (d *DiskStore) linkSegments(manifest *Manifest, dst func(segmentId uint32) string) error {
+	for _, segmentLevel := range manifest.SegmentLevels {
+		for _, segment := range segmentLevel.Segments {
+			path := dst(segment.SegmentId)
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+			if err := utils.LinkOrCopyFile(d.segmentFilePath(segment.SegmentId), path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type BackupInfo struct {
+	BackupId       uint32
+	Segments       int    // segments of the backup
+	CopiedSegments int    // segments that weren't in the backup dir yet
+	CopiedBytes    uint64 // size of the copied segments
+}
+
+// Backs the db up into backupDir, only the segments which no earlier backup in backupDir has are copied. Backups
+// are restored with RestoreBackup
+func (d *DiskStore) CreateBackup(backupDir string) (BackupInfo, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":          "CreateBackup",
+		"param_backupDir": backupDir,
+	})
+	l.Infoln("Attempting to create a backup")
+
+	var info BackupInfo
+	sharedDir := filepath.Join(backupDir, SHARED_BACKUP_DIR_NAME)
+	if err := os.MkdirAll(sharedDir, 0777); err != nil {
+		return info, err
+	}
+	backupIds, err := ListBackups(backupDir)
+	if err != nil {
+		return info, err
+	}
+	info.BackupId = 1
+	if len(backupIds) > 0 {
+		info.BackupId = backupIds[len(backupIds)-1] + 1
+	}
+
+	d.Flush()
+	snapshot, unpin := d.pinCurrentSegments()
+	defer unpin()
+
+	for _, segmentLevel := range snapshot.SegmentLevels {
+		for _, segment := range segmentLevel.Segments {
+			info.Segments++
+			if _, err := os.Stat(filepath.Join(sharedDir, fmt.Sprintf("%d%s", segment.SegmentId, SEGMENT_FILE_EXTENSION))); err != nil {
+				info.CopiedSegments++
+				info.CopiedBytes += segment.Size
+			}
+		}
+	}
+	err = d.linkSegments(snapshot, func(segmentId uint32) string {
+		return filepath.Join(sharedDir, fmt.Sprintf("%d%s", segmentId, SEGMENT_FILE_EXTENSION))
+	})
+	if err == nil {
+		err = utils.SyncDir(sharedDir)
+	}
+	if err != nil {
+		l.Errorln(err)
+		return info, err
+	}
+
+	// the backup only exists once its manifest is there, a failed backup leaves nothing but unreferenced shared files
+	manifestDir := filepath.Join(backupDir, fmt.Sprint(info.BackupId))
+	if err := os.Mkdir(manifestDir, 0777); err != nil {
+		return info, err
+	}
+	if err := writeManifestFile(manifestDir, snapshot); err != nil {
+		l.Errorln(err)
+		os.RemoveAll(manifestDir)
+		return info, err
+	}
+	l.Infof("Backup %d created, copied %d of %d segments", info.BackupId, info.CopiedSegments, info.Segments)
+	return info, nil
+}
+
+// returns the ids of the backups in backupDir, oldest first
+func ListBackups(backupDir string) ([]uint32, error) {
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	var backupIds []uint32
+	for _, entry := range entries {
+		backupId, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(backupDir, entry.Name(), MANIFEST_FILE_NAME)); err != nil {
+			continue
+		}
+		backupIds = append(backupIds, uint32(backupId))
+	}
+	sort.Slice(backupIds, func(i, j int) bool { return backupIds[i] < backupIds[j] })
+	return backupIds, nil
+}
+
+// Writes the backup to destDir as a db named after the directory. destDir must not exist yet
+func RestoreBackup(backupDir string, backupId uint32, destDir string) error {
+	if _, err := os.Stat(destDir); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("restore destination %s already exists", destDir)
+	}
+	manifest, err := readManifestFile(filepath.Join(backupDir, fmt.Sprint(backupId)))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return err
+	}
+	for _, segmentLevel := range manifest.SegmentLevels {
+		for _, segment := range segmentLevel.Segments {
+			name := fmt.Sprintf("%d%s", segment.SegmentId, SEGMENT_FILE_EXTENSION)
+			if err := utils.LinkOrCopyFile(filepath.Join(backupDir, SHARED_BACKUP_DIR_NAME, name), filepath.Join(destDir, name)); err != nil {
+				os.RemoveAll(destDir)
+				return err
+			}
+		}
+	}
+	manifest.DbName = filepath.Base(destDir)
+	if err := writeManifestFile(destDir, manifest); err != nil {
+		os.RemoveAll(destDir)
+		return err
+	}
+	return nil
+}
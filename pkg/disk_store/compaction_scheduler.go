@@ -0,0 +1,284 @@
+package disk_store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+/*
+	- every level gets a score = number of segments / MaxSizeForLevel(level), a level with score > 1 needs compaction
+	- a compaction of level L into L+1 touches both levels, so they are reserved while it runs. Compactions on
+	  non-overlapping pairs of levels (like L0->L1 and L2->L3) run in parallel, at most MaxWorkers of them
+	- most overfull level goes first
+	- whenever a compaction finishes (or a memtable is flushed) scores are computed again, so work cascades down the levels
+*/
+
+type CompactionScheduler struct {
+	d              *DiskStore
+	MaxWorkers     int
+	running        int             // number of background compactions in progress
+	reservedLevels map[uint32]bool // levels which are part of a running (background or manual) compaction
+	paused         bool
+	closed         bool
+	lastError      error // error of the last failed background compaction, cleared once one succeeds
+	ctx            context.Context
+	cancel         context.CancelFunc
+	Mu             *sync.Mutex
+	cond           *sync.Cond // broadcast whenever a compaction finishes or the state of the scheduler changes
+}
+
+type levelScore struct {
+	level uint32
+	score float64
+}
+
+func NewCompactionScheduler(d *DiskStore, maxWorkers int) *CompactionScheduler {
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &CompactionScheduler{
+		d:              d,
+		MaxWorkers:     maxWorkers,
+		reservedLevels: make(map[uint32]bool),
+		ctx:            ctx,
+		cancel:         cancel,
+		Mu:             &sync.Mutex{},
+	}
+	s.cond = sync.NewCond(s.Mu)
+	return s
+}
+
+// Looks for overfull levels and starts background compactions for them if there are free workers
+func (s *CompactionScheduler) MaybeScheduleCompaction() {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.scheduleLocked()
+}
+
+// caller must hold s.Mu
+func (s *CompactionScheduler) scheduleLocked() {
+	if s.paused || s.closed || s.running >= s.MaxWorkers {
+		return
+	}
+
+	for _, candidate := range s.d.levelScores() {
+		if s.running >= s.MaxWorkers {
+			return
+		}
+		if candidate.score <= 1 {
+			// sorted by score, nothing after this needs compaction
+			return
+		}
+		if s.reservedLevels[candidate.level] || s.reservedLevels[candidate.level+1] {
+			continue
+		}
+		s.reservedLevels[candidate.level] = true
+		s.reservedLevels[candidate.level+1] = true
+		s.running++
+		go s.runCompaction(candidate.level)
+	}
+}
+
+func (s *CompactionScheduler) runCompaction(level uint32) {
+	var l = s.d.Logger.WithFields(logger.Fields{
+		"method":      "runCompaction",
+		"param_level": level,
+	})
+
+	_, err := s.d.AddSegmentToLevelAndPerformCompaction(s.ctx, level+1)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		l.Errorln(err)
+		s.d.events.backgroundError(BACKGROUND_ERROR_COMPACTION, err)
+	}
+
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	delete(s.reservedLevels, level)
+	delete(s.reservedLevels, level+1)
+	s.running--
+	s.lastError = err
+	if err == nil {
+		// next level might be overfull now. Failed compactions are not retried right away, the next flush will
+		s.scheduleLocked()
+	}
+	s.cond.Broadcast()
+}
+
+// returns the score of every level, most overfull level first
+func (d *DiskStore) levelScores() []levelScore {
+	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+
+	var scores []levelScore
+	for i := range d.Manifest.SegmentLevels {
+		d.Manifest.SegmentLevels[i].Mu.Lock()
+		numberOfSegments := len(d.Manifest.SegmentLevels[i].Segments)
+		d.Manifest.SegmentLevels[i].Mu.Unlock()
+		scores = append(scores, levelScore{
+			level: uint32(i),
+			score: float64(numberOfSegments) / float64(MaxSizeForLevel(uint32(i))),
+		})
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].score > scores[j].score
+	})
+	return scores
+}
+
+// Blocks until the given levels are not part of any running compaction and reserves them, used by manual compactions
+// so that they never run on the same levels as a background compaction
+func (s *CompactionScheduler) ReserveLevels(ctx context.Context, levels ...uint32) error {
+	// cond.Wait can't be interrupted by a context, so wake the waiters up when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Mu.Lock()
+			s.cond.Broadcast()
+			s.Mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	for {
+		if s.closed {
+			return CustomError.ErrCompactionSchedulerClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		free := true
+		for _, level := range levels {
+			if s.reservedLevels[level] {
+				free = false
+				break
+			}
+		}
+		if free {
+			break
+		}
+		s.cond.Wait()
+	}
+	for _, level := range levels {
+		s.reservedLevels[level] = true
+	}
+	return nil
+}
+
+func (s *CompactionScheduler) ReleaseLevels(levels ...uint32) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	for _, level := range levels {
+		delete(s.reservedLevels, level)
+	}
+	s.scheduleLocked()
+	s.cond.Broadcast()
+}
+
+// Stops starting new background compactions, running ones are allowed to finish
+func (s *CompactionScheduler) Pause() {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.paused = true
+	s.cond.Broadcast()
+}
+
+func (s *CompactionScheduler) Resume() {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.paused = false
+	s.scheduleLocked()
+	s.cond.Broadcast()
+}
+
+// Blocks until no background compaction is running. Finished compactions schedule their follow ups before
+// they are accounted as done, so this also waits for everything they cascade into
+func (s *CompactionScheduler) WaitForIdle() {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	for s.running > 0 {
+		s.cond.Wait()
+	}
+}
+
+// Blocks until level 0 has less than `limit` segments, returns whether it had to wait. Returns right away if
+// compactions can't make progress (paused, closed or the last one failed) as waiting would never end then
+func (s *CompactionScheduler) WaitForLevel0Below(limit int) bool {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	waited := false
+	for {
+		if s.paused || s.closed || s.lastError != nil {
+			return waited
+		}
+		if s.d.numberOfSegmentsInLevel(0) < limit {
+			return waited
+		}
+		s.scheduleLocked()
+		if s.running == 0 {
+			// nothing could be scheduled, don't wait forever
+			return waited
+		}
+		waited = true
+		s.cond.Wait()
+	}
+}
+
+// Lets the running compactions finish along with whatever they cascade into and then stops the scheduler
+func (s *CompactionScheduler) Drain() {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.scheduleLocked()
+	for s.running > 0 {
+		s.cond.Wait()
+	}
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// Stops the scheduler, running compactions are cancelled (leaving the db as it was before them) and waited for
+func (s *CompactionScheduler) Cancel() {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.closed = true
+	s.cancel()
+	for s.running > 0 {
+		s.cond.Wait()
+	}
+	s.cond.Broadcast()
+}
+
+// returns the number of segments in a level, 0 if the level doesn't exist
+func (d *DiskStore) numberOfSegmentsInLevel(level uint32) int {
+	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+	if int(level) >= len(d.Manifest.SegmentLevels) {
+		return 0
+	}
+	d.Manifest.SegmentLevels[level].Mu.Lock()
+	defer d.Manifest.SegmentLevels[level].Mu.Unlock()
+	return len(d.Manifest.SegmentLevels[level].Segments)
+}
+
+// Stops starting new background compactions until ResumeCompactions is called
+func (d *DiskStore) PauseCompactions() {
+	d.CompactionScheduler.Pause()
+}
+
+func (d *DiskStore) ResumeCompactions() {
+	d.CompactionScheduler.Resume()
+}
+
+// Cancels running background compactions and doesn't start any new ones, CloseDB won't wait for compactions afterwards
+func (d *DiskStore) CancelCompactions() {
+	d.CompactionScheduler.Cancel()
+}
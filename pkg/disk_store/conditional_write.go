@@ -0,0 +1,158 @@
+package disk_store
+
+import (
+	"time"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	KeyEntry "github.com/abesheknarayan/go-caskdb/pkg/key_entry"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/metrics"
+)
+
+/*
+	- every write commits under d.writeMu, so a condition checked under it can't be invalidated before the write lands
+	- the condition is checked against what Lookup sees: the newest version across the memtables and the levels, with
+	  deleted and expired keys counting as missing
+	- the values written never expire, whatever the ttl of the value they replace was
+	- the version of a key comes from the sequence of the write batch which wrote it, or the last sequence of the
+	  segment holding it. Every write makes it larger, so a version compare can't be fooled by a value changed and
+	  changed back (which a value compare can). Flushes and compactions may raise it without the value changing, a
+	  WriteIfVersion then fails even though nothing was written in between
+*/
+
+// a value along with its version
+type VersionedValue struct {
+	Value     string
+	Version   uint64    // never 0, that's the version of missing keys
+	ExpiresAt time.Time // zero if the value never expires
+}
+
+// Replaces the value of the key with newValue if its current value is expected. Returns whether it did, a missing key
+// never matches
+func (d *DiskStore) CompareAndSwap(key string, expected string, newValue string) (bool, error) {
+	batch := NewWriteBatch()
+	batch.Put(key, newValue)
+	return d.writeIf("CompareAndSwap", key, batch, func(entry KeyEntry.KeyEntry, exists bool) bool {
+		return exists && entry.Value == expected
+	})
+}
+
+// Puts the value if the key is missing. Returns whether it did
+func (d *DiskStore) PutIfAbsent(key string, value string) (bool, error) {
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+	return d.writeIf("PutIfAbsent", key, batch, func(entry KeyEntry.KeyEntry, exists bool) bool {
+		return !exists
+	})
+}
+
+// Deletes the key if its current value is expected. Returns whether it did
+func (d *DiskStore) DeleteIfEquals(key string, expected string) (bool, error) {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return d.writeIf("DeleteIfEquals", key, batch, func(entry KeyEntry.KeyEntry, exists bool) bool {
+		return exists && entry.Value == expected
+	})
+}
+
+// Deletes the keys which exist and returns how many did, each key counts once however often it is passed
+func (d *DiskStore) DeleteExisting(keys ...string) (int, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":     "DeleteExisting",
+		"param_keys": len(keys),
+	})
+	l.Infoln("Deleting existing keys")
+
+	startTime := time.Now()
+	defer func() {
+		d.Metrics.ObserveOperation(metrics.OPERATION_CONDITIONAL, time.Since(startTime))
+	}()
+
+	if d.Options.ReadOnly {
+		return 0, CustomError.ErrReadOnly
+	}
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	batch := NewWriteBatch()
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if _, exists := d.lookupEntry(key); exists {
+			batch.Delete(key)
+		}
+	}
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	d.counters.recordUserWrite(batch.bytes)
+	if err := d.commitLocked(batch, d.LastSequence()+1); err != nil {
+		l.Errorln(err)
+		return 0, err
+	}
+	return batch.Len(), nil
+}
+
+// Returns the value of the key along with its version, false if the key is missing (deleted or expired)
+func (d *DiskStore) LookupVersion(key string) (VersionedValue, bool) {
+	entry, exists := d.lookupEntry(key)
+	if !exists {
+		return VersionedValue{}, false
+	}
+	value := VersionedValue{Value: entry.Value, Version: entryVersion(entry, true)}
+	if entry.Kind == format.RECORD_KIND_EXPIRING_VALUE {
+		value.ExpiresAt = time.UnixMilli(entry.ExpiresAt)
+	}
+	return value, true
+}
+
+// Commits batch if key is still at version, as returned by LookupVersion. Version 0 means the key has to be missing.
+// Returns whether it did
+func (d *DiskStore) WriteIfVersion(key string, version uint64, batch *WriteBatch) (bool, error) {
+	return d.writeIf("WriteIfVersion", key, batch, func(entry KeyEntry.KeyEntry, exists bool) bool {
+		return entryVersion(entry, exists) == version
+	})
+}
+
+func entryVersion(entry KeyEntry.KeyEntry, exists bool) uint64 {
+	if !exists {
+		return 0
+	}
+	return entry.Sequence + 1
+}
+
+// commits batch if condition holds for the current value of key
+func (d *DiskStore) writeIf(method string, key string, batch *WriteBatch, condition func(entry KeyEntry.KeyEntry, exists bool) bool) (bool, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":    method,
+		"param_key": d.loggable(key),
+	})
+	l.Infoln("Attempting a conditional write")
+
+	startTime := time.Now()
+	defer func() {
+		d.Metrics.ObserveOperation(metrics.OPERATION_CONDITIONAL, time.Since(startTime))
+	}()
+
+	if d.Options.ReadOnly {
+		return false, CustomError.ErrReadOnly
+	}
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	entry, exists := d.lookupEntry(key)
+	if !condition(entry, exists) {
+		l.Debugln("Condition doesn't hold")
+		return false, nil
+	}
+	d.counters.recordUserWrite(batch.bytes)
+	if err := d.commitLocked(batch, d.LastSequence()+1); err != nil {
+		l.Errorln(err)
+		return false, err
+	}
+	return true, nil
+}
@@ -5,25 +5,57 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/abesheknarayan/go-caskdb/pkg/config"
 	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
 	KeyEntry "github.com/abesheknarayan/go-caskdb/pkg/key_entry"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
 	"github.com/abesheknarayan/go-caskdb/pkg/memtable"
+	"github.com/abesheknarayan/go-caskdb/pkg/metrics"
+	"github.com/abesheknarayan/go-caskdb/pkg/rate_limiter"
 	"github.com/abesheknarayan/go-caskdb/pkg/utils"
-	"github.com/sirupsen/logrus"
 )
 
 // // for now, support keys and values only with string type
 
+const (
+	MANIFEST_FILE_NAME      = "manifest.json"
+	MANIFEST_TEMP_FILE_NAME = "manifest.json.tmp" // manifest is written here first and then renamed over MANIFEST_FILE_NAME
+	SEGMENT_FILE_EXTENSION  = ".seg"
+)
+
+// returned by TTL for keys which never expire
+const NO_EXPIRY time.Duration = -1
+
 // contains the metadata of segment files which goes in the manifest file
 type SegmentMetadata struct {
-	SegmentId   uint32
-	Cardinality uint32      // no of keys it contains
-	Mu          *sync.Mutex `json:"-"`
+	SegmentId    uint32
+	Cardinality  uint32 // no of keys it contains
+	SmallestKey  string // key range of the segment, both empty for segments written before key ranges were tracked
+	LargestKey   string
+	Size         uint64      // size of the segment file in bytes, 0 for segments written before sizes were tracked
+	LastSequence uint64      // last write batch it may hold, the sequence reads report for its entries. 0 if unknown
+	Mu           *sync.Mutex `json:"-"`
+}
+
+// checks if the key range of the segment intersects with [start, end], empty start or end means unbounded
+func (s SegmentMetadata) OverlapsRange(start string, end string) bool {
+	if s.SmallestKey == "" && s.LargestKey == "" {
+		// key range is unknown, have to assume it overlaps
+		return true
+	}
+	if start != "" && s.LargestKey < start {
+		return false
+	}
+	if end != "" && s.SmallestKey > end {
+		return false
+	}
+	return true
 }
 
 type SegmentLevelMetadata struct {
@@ -37,25 +69,46 @@ type Manifest struct {
 	NumberOfLevels uint32                 // levels start from 0 to NumberOfLevels - 1
 	SegmentLevels  []SegmentLevelMetadata // should always be sorted according to SegmentId
 	MaxSegmentId   uint32                 // maximum segmend id of all segments to get newer segment ids easily
+	LastSequence   uint64                 // sequence of the last write batch which is in a segment file
 	Mu             *sync.Mutex            `json:"-"` // omit the field for json
 }
 
 type HashIndex map[string]KeyEntry.KeyEntry
 
 type DiskStore struct {
-	Manifest          *Manifest
-	ManifestFile      *os.File  // holding the file to prevent unnecessary opening and closing everytime [subject to change in future]
-	HashIndex         HashIndex // map of any value type
-	Memtable          *memtable.MemTable
-	AuxillaryMemtable *memtable.MemTable // memtable is copied to this while its being written asynchronously to disk
-	MergeCompactor    []MergeCompactor
-	MergeCompactorWg  *sync.WaitGroup
+	Manifest            *Manifest
+	ManifestFile        *os.File  // holding the file to prevent unnecessary opening and closing everytime [subject to change in future]
+	HashIndex           HashIndex // map of any value type
+	Memtable            *memtable.MemTable
+	AuxillaryMemtable   *memtable.MemTable // memtable is copied to this while its being written asynchronously to disk
+	MergeCompactor      []MergeCompactor
+	CompactionScheduler *CompactionScheduler
+	RateLimiter         *rate_limiter.RateLimiter // shared by memtable flushes and merge compaction
+	TableCache          *TableCache               // segments recently loaded by reads
+	Metrics             *metrics.Metrics          // nil unless metrics are enabled, set it before using the db
+	Options             Options
+	Logger              logger.Logger // from Options, no-op unless a logger was passed
+	counters            *storeCounters
+	events              *eventNotifier
+	pins                *segmentPins  // segments in use by checkpoints and backups
+	writeMu             *sync.Mutex   // serializes writes to the memtable with its rotation
+	memtablesMu         *sync.RWMutex // guards the Memtable and AuxillaryMemtable pointers, which readers grab together
+	replication         *replicationLog
+	wal                 *writeAheadLog
 }
 
 // creates a new db and returns the object ref
 func InitDb(dbName string) (*DiskStore, error) {
+	return InitDbWithOptions(dbName, DefaultOptions())
+}
+
+// same as InitDb with per db options
+func InitDbWithOptions(dbName string, options Options) (*DiskStore, error) {
+	if options.Logger == nil {
+		options.Logger = logger.NewNopLogger()
+	}
 
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = options.Logger.WithFields(logger.Fields{
 		"method": "InitDb",
 	})
 
@@ -76,11 +129,11 @@ func InitDb(dbName string) (*DiskStore, error) {
 	}
 
 	// if db manifest file is already present load it or else create new db
-	manifestFile := fmt.Sprintf("%s/manifest.json", dirPath)
+	manifestFile := fmt.Sprintf("%s/%s", dirPath, MANIFEST_FILE_NAME)
 
 	if _, err := os.Stat(manifestFile); errors.Is(err, os.ErrNotExist) {
 		l.Infoln("file doesn't exist !!")
-		return createDb(dbName, dirPath)
+		return createDb(dbName, dirPath, options)
 	}
 
 	// open manifest file in rw mode
@@ -91,16 +144,25 @@ func InitDb(dbName string) (*DiskStore, error) {
 		return nil, err
 	}
 
-	manifest := LoadManifest(f)
+	manifest := LoadManifest(f, options.Logger)
 
 	d := &DiskStore{
 		Manifest:          manifest,
 		ManifestFile:      f,
 		HashIndex:         HashIndex{},
-		Memtable:          memtable.GetNewMemTable(dbName, int32(manifest.MaxSegmentId)),
 		AuxillaryMemtable: nil,
 		MergeCompactor:    []MergeCompactor{},
-		MergeCompactorWg:  &sync.WaitGroup{},
+		RateLimiter:       rate_limiter.NewRateLimiter(config.Config.CompactionRateLimit),
+		TableCache:        NewTableCache(config.Config.TableCacheSize),
+		Metrics:           options.Metrics,
+		Options:           options,
+		Logger:            options.Logger,
+		counters:          newStoreCounters(),
+		events:            newEventNotifier(options.EventListeners),
+		pins:              newSegmentPins(),
+		writeMu:           &sync.Mutex{},
+		memtablesMu:       &sync.RWMutex{},
+		replication:       newReplicationLog(options.ReplicationLogSize, manifest.LastSequence),
 	}
 
 	// initiate sync.Mutex locks for segement leveels and segments and merge comparator for each level
@@ -114,17 +176,29 @@ func InitDb(dbName string) (*DiskStore, error) {
 		}
 	}
 
-	// load the level 0 segment file if it exists
-	if d.Manifest.NumberOfLevels > 0 {
-		d.Memtable.LoadFromSegmentFile(d.Manifest.SegmentLevels[0].Segments[len(d.Manifest.SegmentLevels[0].Segments)-1].SegmentId)
+	d.CompactionScheduler = NewCompactionScheduler(d, config.Config.MaxBackgroundCompactions)
+
+	// remove whatever an interrupted flush or compaction left behind before handing out new segment ids
+	if err := d.DeleteObsoleteFiles(); err != nil {
+		l.Errorf("Error while deleting obsolete files %v", err)
+		return nil, err
+	}
+
+	// segments are never rewritten in place, so the memtable always starts empty with a fresh segment id
+	d.Memtable = d.newMemtable(int32(d.GetNewSegmentId()))
+
+	// the batches which didn't make it into a segment file before the db was closed
+	if err := d.openWAL(); err != nil {
+		l.Errorf("Error while replaying the write ahead log %v", err)
+		return nil, err
 	}
 
 	return d, nil
 }
 
-func LoadManifest(f *os.File) *Manifest {
+func LoadManifest(f *os.File, log logger.Logger) *Manifest {
 
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = log.WithFields(logger.Fields{
 		"method": "LoadManifest",
 	})
 
@@ -144,9 +218,9 @@ func LoadManifest(f *os.File) *Manifest {
 }
 
 // create new db
-func createDb(dbName string, dbPath string) (*DiskStore, error) {
+func createDb(dbName string, dbPath string, options Options) (*DiskStore, error) {
 
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = options.Logger.WithFields(logger.Fields{
 		"method":       "createDb",
 		"param_dbName": dbName,
 		"param_path":   dbPath,
@@ -154,7 +228,7 @@ func createDb(dbName string, dbPath string) (*DiskStore, error) {
 	l.Infoln("Attempting to create a database")
 
 	// first create manifest file
-	filename := fmt.Sprintf("%s/manifest.json", dbPath)
+	filename := fmt.Sprintf("%s/%s", dbPath, MANIFEST_FILE_NAME)
 	l.Infof("creating new file %s\n", filename)
 	manifestFile, err := os.Create(filename)
 
@@ -181,10 +255,27 @@ func createDb(dbName string, dbPath string) (*DiskStore, error) {
 		Manifest:          manifest,
 		ManifestFile:      manifestFile,
 		HashIndex:         HashIndex{},
-		Memtable:          memtable.GetNewMemTable(dbName, 1),
 		AuxillaryMemtable: nil,
 		MergeCompactor:    []MergeCompactor{},
-		MergeCompactorWg:  &sync.WaitGroup{},
+		RateLimiter:       rate_limiter.NewRateLimiter(config.Config.CompactionRateLimit),
+		TableCache:        NewTableCache(config.Config.TableCacheSize),
+		Metrics:           options.Metrics,
+		Options:           options,
+		Logger:            options.Logger,
+		counters:          newStoreCounters(),
+		events:            newEventNotifier(options.EventListeners),
+		pins:              newSegmentPins(),
+		writeMu:           &sync.Mutex{},
+		memtablesMu:       &sync.RWMutex{},
+		replication:       newReplicationLog(options.ReplicationLogSize, 0),
+	}
+	d.Memtable = d.newMemtable(1)
+	d.CompactionScheduler = NewCompactionScheduler(d, config.Config.MaxBackgroundCompactions)
+
+	// a write ahead log can be left behind by a db whose manifest got lost
+	if err := d.openWAL(); err != nil {
+		l.Errorf("Error while replaying the write ahead log %v", err)
+		return nil, err
 	}
 
 	return d, nil
@@ -192,97 +283,265 @@ func createDb(dbName string, dbPath string) (*DiskStore, error) {
 
 func (d *DiskStore) Put(key string, value string) {
 
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = d.Logger.WithFields(logger.Fields{
 		"method":      "Put",
-		"param_key":   key,
-		"param_value": value,
+		"param_key":   d.loggable(key),
+		"param_value": d.loggable(value),
 	})
 	l.Infof("Attempting to set a key")
+	d.counters.recordUserWrite(len(key) + len(value))
+
+	startTime := time.Now()
+	defer func() {
+		d.Metrics.ObserveOperation(metrics.OPERATION_PUT, time.Since(startTime))
+	}()
+
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+	if err := d.commit(batch); err != nil {
+		l.Errorln(err)
+	}
+}
+
+// Same as Put, but the key reads as missing once ttl passed. The space it takes is reclaimed by compactions
+func (d *DiskStore) PutWithTTL(key string, value string, ttl time.Duration) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":      "PutWithTTL",
+		"param_key":   d.loggable(key),
+		"param_value": d.loggable(value),
+		"param_ttl":   ttl,
+	})
+	l.Infof("Attempting to set a key with a ttl")
+	d.counters.recordUserWrite(len(key) + len(value))
+
+	startTime := time.Now()
+	defer func() {
+		d.Metrics.ObserveOperation(metrics.OPERATION_PUT, time.Since(startTime))
+	}()
+
+	batch := NewWriteBatch()
+	batch.PutWithTTL(key, value, ttl)
+	if err := d.commit(batch); err != nil {
+		l.Errorln(err)
+	}
+}
+
+// Hides the key from reads by writing a tombstone for it. The space taken by its older values is reclaimed once the
+// tombstone is compacted into the bottom most level
+func (d *DiskStore) Delete(key string) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":    "Delete",
+		"param_key": d.loggable(key),
+	})
+	l.Infof("Attempting to delete a key")
+	d.counters.recordUserWrite(len(key))
+
+	startTime := time.Now()
+	defer func() {
+		d.Metrics.ObserveOperation(metrics.OPERATION_DELETE, time.Since(startTime))
+	}()
+
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	if err := d.commit(batch); err != nil {
+		l.Errorln(err)
+	}
+}
+
+// applies write to the memtable, rotating the memtable first if it's full. Caller must hold d.writeMu
+func (d *DiskStore) writeToMemtableLocked(write func(mt *memtable.MemTable) error) error {
+	if err := write(d.Memtable); !errors.Is(err, CustomError.ErrMaxSizeExceeded) {
+		return err
+	}
+	// copy memtable to aux memtable
+	// since it's a pointer just change the pointers
+	d.RotateMemtable()
+
+	// again call write
+	return write(d.Memtable)
+}
+
+// Moves the contents of the memtable to the auxillary memtable, starts a fresh memtable and writes the auxillary memtable
+// to disk in the background. Returns the auxillary memtable whose ExWaitGroup is done once it is on disk
+func (d *DiskStore) RotateMemtable() *memtable.MemTable {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "RotateMemtable",
+	})
+
+	// if its not nil then before auxillary memtable is waiting to write its contents to file and got blocked because of file write. So we block the main go routine so that, the auxillary file write finishes before executing further
+	// Important point to note here is that, during the time between auxillary go routine waiting to write to this step in the next run, all writes and reads are supported using memtable and aux memtable so no issues with reads and writes
+	stallStartTime := time.Now()
+	d.WaitForAuxillaryMemtableFlush()
+
+	// stall writes while compaction catches up with flushes, otherwise reads keep getting slower with every level 0 segment
+	if d.numberOfSegmentsInLevel(0) >= config.LEVEL0_STOP_WRITES_TRIGGER {
+		d.events.stallConditionChanged(d.Manifest.DbName, STALL_CONDITION_STOPPED)
+	}
+	stalled := d.CompactionScheduler.WaitForLevel0Below(config.LEVEL0_STOP_WRITES_TRIGGER)
+	d.events.stallConditionChanged(d.Manifest.DbName, STALL_CONDITION_NORMAL)
+	stallTime := time.Since(stallStartTime)
+	d.counters.recordStall(stallTime, stalled)
+	d.Metrics.ObserveStall(stallTime, stalled)
+
+	l.Infoln("Writing memtable to aux")
+	// a fresh aux memtable every time, readers might still be looking at the previous one
+	auxMemtable := d.newMemtable(d.Memtable.SegmentId)
+	auxMemtable.CopyMemtable(d.Memtable)
+	auxMemtable.LastSequence = d.Memtable.LastSequence
+	auxMemtable.RateLimiter = d.RateLimiter
+	auxMemtable.Metrics = d.Metrics
+	newMemtable := d.newMemtable(int32(d.GetNewSegmentId()))
+	d.memtablesMu.Lock()
+	d.AuxillaryMemtable = auxMemtable
+	d.Memtable = newMemtable
+	d.memtablesMu.Unlock()
+
+	// the batches of the new memtable go to a new log file, older files can go once their memtables are flushed
+	d.Manifest.Mu.Lock()
+	flushedSequence := d.Manifest.LastSequence
+	d.Manifest.Mu.Unlock()
+	if err := d.wal.rotate(d.LastSequence()+1, flushedSequence, d.Options.WALRetentionSize); err != nil {
+		l.Errorf("Error while rotating the write ahead log %v", err)
+	}
+
+	// added before spawning the go routine so that the next flush can never miss it and overwrite the aux memtable
+	auxMemtable.ExWaitGroup.Mu.Lock()
+	auxMemtable.ExWaitGroup.Wg.Add(1)
+	auxMemtable.ExWaitGroup.Mu.Unlock()
+
+	go func() {
+		defer auxMemtable.ExWaitGroup.Wg.Done()
 
-	if err := d.Memtable.Put(key, value); errors.Is(err, CustomError.ErrMaxSizeExceeded) {
-		// copy memtable to aux memtable
-		// since it's a pointer just change the pointers
-
-		// if its not nil then before auxillary memtable is waiting to write its contents to file and got blocked because of file write. So we block the main go routine so that, the auxillary file write finishes before executing further
-		// Important point to note here is that, during the time between auxillary go routine waiting to write to this step in the next run, all writes and reads are supported using memtable and aux memtable so no issues with reads and writes
-		if d.AuxillaryMemtable != nil {
-			l.Infoln("Waiting for aux memtable write to disk to finish")
-			// d.AuxillaryMemtable.Mu.Lock()
-			d.AuxillaryMemtable.ExWaitGroup.Mu.Lock()
-			d.AuxillaryMemtable.ExWaitGroup.Wg.Wait()
-			d.AuxillaryMemtable.ExWaitGroup.Mu.Unlock()
-			// d.AuxillaryMemtable.Mu.Unlock()
+		l.Infoln("Writing Auxillary memtable to disk")
+		err := d.FlushMemtableToLevel0(auxMemtable)
+		if err != nil {
+			d.events.backgroundError(BACKGROUND_ERROR_FLUSH, err)
+			// the memtable is lost if it can't be written, there is no way to carry on from here
+			l.Errorln(err)
+			panic(err)
 		}
-		l.Infoln("Writing memtable to aux")
-		if d.AuxillaryMemtable == nil {
-			d.AuxillaryMemtable = memtable.GetNewMemTable(d.Manifest.DbName, d.Memtable.SegmentId)
+
+		d.CompactionScheduler.MaybeScheduleCompaction()
+	}()
+
+	return auxMemtable
+}
+
+// blocks until the auxillary memtable (if any) is written to disk
+func (d *DiskStore) WaitForAuxillaryMemtableFlush() {
+	if d.AuxillaryMemtable == nil {
+		return
+	}
+	d.AuxillaryMemtable.ExWaitGroup.Mu.Lock()
+	d.AuxillaryMemtable.ExWaitGroup.Wg.Wait()
+	d.AuxillaryMemtable.ExWaitGroup.Mu.Unlock()
+}
+
+// Writes the contents of the memtable to a level 0 segment and waits till it is on disk
+func (d *DiskStore) Flush() {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	d.flushLocked()
+}
+
+// returns the memtable and the auxillary memtable (nil if there is none) as of the same moment
+func (d *DiskStore) memtables() (*memtable.MemTable, *memtable.MemTable) {
+	d.memtablesMu.RLock()
+	defer d.memtablesMu.RUnlock()
+	return d.Memtable, d.AuxillaryMemtable
+}
+
+// same as Flush, caller must hold d.writeMu
+func (d *DiskStore) flushLocked() {
+	if d.Memtable.Size() > 0 {
+		d.RotateMemtable()
+	}
+	d.WaitForAuxillaryMemtableFlush()
+
+	// batches without operations leave nothing to flush, their sequences still have to make it to the manifest
+	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+	if d.Memtable.LastSequence > d.Manifest.LastSequence {
+		d.advanceLastSequence(d.Memtable.LastSequence)
+		if err := d.persistManifest(); err != nil {
+			d.Logger.Errorf("Error in writing to manifest file %v", err)
 		}
-		d.AuxillaryMemtable.Mu.Lock()
-		d.AuxillaryMemtable.CopyMemtable(d.Memtable)
-		d.AuxillaryMemtable.Mu.Unlock()
-		d.Memtable = memtable.GetNewMemTable(d.Manifest.DbName, int32(d.GetNewSegmentId()))
-
-		go func() {
-			// find segment id
-			l.Infoln("Writing Auxillary memtable to disk")
-
-			d.AuxillaryMemtable.ExWaitGroup.Mu.Lock()
-			d.AuxillaryMemtable.ExWaitGroup.Wg.Add(1)
-
-			d.Manifest.Mu.Lock()
-			if d.Manifest.NumberOfLevels == 0 {
-				d.Manifest.NumberOfLevels = 1
-				d.Manifest.SegmentLevels = append(d.Manifest.SegmentLevels, SegmentLevelMetadata{
-					Segments: []SegmentMetadata{},
-					Mu:       &sync.Mutex{},
-				})
-				d.InitMergeCompactor(0)
-			}
-			d.Manifest.Mu.Unlock()
-			l.Debugln("here 2")
+	}
+}
 
-			// send a compaction signal to level 0 channel which will be listening somewhere
-			cardinality, exists, err := d.AuxillaryMemtable.WriteMemtableToDisk() // this is the writing to disk function
-			if err != nil {
-				l.Fatalln(err)
-			}
-			l.Debugln("here 3")
-
-			// append only if its newly added file
-			if !exists {
-				l.Debugln("here 4")
-				d.Manifest.Mu.Lock()
-				d.Manifest.SegmentLevels[0].Mu.Lock()
-				d.Manifest.SegmentLevels[0].Segments = append(d.Manifest.SegmentLevels[0].Segments, SegmentMetadata{
-					SegmentId:   uint32(d.AuxillaryMemtable.SegmentId),
-					Cardinality: cardinality,
-					Mu:          &sync.Mutex{},
-				})
-				d.Manifest.SegmentLevels[0].Mu.Unlock()
-
-				// unlock specifically here because next function locks it
-				d.Manifest.Mu.Unlock()
-
-				// perform merge compaction manually here
-				d.WatchLevelForSizeLimitExceed(0)
-			} else {
-				// just update cardinality but we have to find the segment cuz it might not be in level 0
-				d.FindForSegmendAndUpdate(uint32(d.AuxillaryMemtable.SegmentId), cardinality)
-			}
-			l.Debugln("here 5")
-			d.ChangeNumberOfSegmentsInManifest()
-			d.AuxillaryMemtable.ExWaitGroup.Wg.Done()
-			d.AuxillaryMemtable.ExWaitGroup.Mu.Unlock()
+// writes the memtable to its segment file and publishes the segment on level 0 of the manifest
+func (d *DiskStore) FlushMemtableToLevel0(mt *memtable.MemTable) error {
+	info := FlushJobInfo{DbName: d.Manifest.DbName, SegmentId: uint32(mt.SegmentId)}
+	d.events.flushBegin(info)
+	startTime := time.Now()
+
+	segment, created, err := d.flushMemtableToLevel0(mt)
+
+	info.Duration = time.Since(startTime)
+	info.Cardinality = segment.Cardinality
+	info.BytesWritten = segment.Size
+	info.Err = err
+	if err == nil && created {
+		d.events.segmentCreated(SegmentInfo{DbName: d.Manifest.DbName, SegmentId: segment.SegmentId, Level: 0, Size: segment.Size})
+	}
+	d.events.flushCompleted(info)
+	return err
+}
+
+// writes the memtable to disk and adds it to level 0, returns the metadata of the segment and whether the segment is new
+func (d *DiskStore) flushMemtableToLevel0(mt *memtable.MemTable) (SegmentMetadata, bool, error) {
+	d.Manifest.Mu.Lock()
+	if d.Manifest.NumberOfLevels == 0 {
+		d.Manifest.NumberOfLevels = 1
+		d.Manifest.SegmentLevels = append(d.Manifest.SegmentLevels, SegmentLevelMetadata{
+			Segments: []SegmentMetadata{},
+			Mu:       &sync.Mutex{},
+		})
+		d.InitMergeCompactor(0)
+	}
+	d.Manifest.Mu.Unlock()
 
-		}()
+	// the segment file is complete and synced before the manifest refers to it
+	smallestKey, largestKey := mt.KeyRange()
+	cardinality, exists, err := mt.WriteMemtableToDisk()
+	if err != nil {
+		return SegmentMetadata{}, false, err
+	}
 
-		// again call Put
-		d.Memtable.Put(key, value)
+	size := d.segmentFileSize(uint32(mt.SegmentId))
+	d.counters.recordFlush(size)
+
+	segment := SegmentMetadata{
+		SegmentId:    uint32(mt.SegmentId),
+		Cardinality:  cardinality,
+		SmallestKey:  smallestKey,
+		LargestKey:   largestKey,
+		Size:         size,
+		LastSequence: mt.LastSequence,
+		Mu:           &sync.Mutex{},
 	}
+
+	if exists {
+		// just update cardinality but we have to find the segment cuz it might not be in level 0
+		d.FindForSegmendAndUpdate(uint32(mt.SegmentId), cardinality, mt.LastSequence)
+		d.Manifest.Mu.Lock()
+		defer d.Manifest.Mu.Unlock()
+		d.advanceLastSequence(mt.LastSequence)
+		return segment, false, d.persistManifest()
+	}
+
+	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+	d.advanceLastSequence(mt.LastSequence)
+	d.Manifest.SegmentLevels[0].Mu.Lock()
+	d.Manifest.SegmentLevels[0].Segments = append(d.Manifest.SegmentLevels[0].Segments, segment)
+	d.Manifest.SegmentLevels[0].Mu.Unlock()
+
+	return segment, true, d.persistManifest()
 }
 
 // finds the segment object using the segment id and update its cardinality
-func (d *DiskStore) FindForSegmendAndUpdate(segmentId uint32, cardinality uint32) {
+func (d *DiskStore) FindForSegmendAndUpdate(segmentId uint32, cardinality uint32, lastSequence uint64) {
 	d.Manifest.Mu.Lock()
 	for i := 0; i < int(d.Manifest.NumberOfLevels); i++ {
 		for j := 0; j < len(d.Manifest.SegmentLevels[i].Segments); j++ {
@@ -290,6 +549,7 @@ func (d *DiskStore) FindForSegmendAndUpdate(segmentId uint32, cardinality uint32
 			if d.Manifest.SegmentLevels[i].Segments[j].SegmentId == segmentId {
 				d.Manifest.SegmentLevels[i].Segments[j].Mu.Lock()
 				d.Manifest.SegmentLevels[i].Segments[j].Cardinality = cardinality
+				d.Manifest.SegmentLevels[i].Segments[j].LastSequence = lastSequence
 				d.Manifest.SegmentLevels[i].Segments[j].Mu.Unlock()
 			}
 			d.Manifest.SegmentLevels[i].Mu.Unlock()
@@ -300,78 +560,180 @@ func (d *DiskStore) FindForSegmendAndUpdate(segmentId uint32, cardinality uint32
 }
 
 func (d *DiskStore) Get(key string) string {
-	var l = utils.Logger.WithFields(logrus.Fields{
+	value, _ := d.Lookup(key)
+	return value
+}
+
+// same as Get, but tells a missing (deleted or expired) key apart from an empty value
+func (d *DiskStore) Lookup(key string) (string, bool) {
+	startTime := time.Now()
+	defer func() {
+		d.RateLimiter.RecordForegroundLatency(time.Since(startTime))
+		d.Metrics.ObserveOperation(metrics.OPERATION_GET, time.Since(startTime))
+	}()
+
+	entry, ok := d.lookupEntry(key)
+	return entry.Value, ok
+}
+
+// Returns how long the key has left before it expires, NO_EXPIRY if it never does. False if the key is missing,
+// deleted or already expired
+func (d *DiskStore) TTL(key string) (time.Duration, bool) {
+	entry, ok := d.lookupEntry(key)
+	if !ok {
+		return 0, false
+	}
+	if entry.Kind != format.RECORD_KIND_EXPIRING_VALUE {
+		return NO_EXPIRY, true
+	}
+	return time.Until(time.UnixMilli(entry.ExpiresAt)), true
+}
+
+// returns the newest live entry of the key, with the merge operands above it applied
+func (d *DiskStore) lookupEntry(key string) (KeyEntry.KeyEntry, bool) {
+	var l = d.Logger.WithFields(logger.Fields{
 		"method":    "Get",
-		"param_key": key,
+		"param_key": d.loggable(key),
 	})
 	l.Infoln("Attempting to get value for key")
-	value, err := d.Memtable.Get(key)
 
-	if err == nil {
-		l.Debugf("got value: %s for key %s from memtable", value, key)
-		return value
+	mt, auxMt := d.memtables()
+	entry, err := d.findEntry(key, mt, auxMt, false)
+	if errors.Is(err, errMergeOperandInMemtable) {
+		// a memtable flushed in the meantime is read once more from its segment, which is fine for values but not for
+		// merge operands. Flushes can't publish their segments while the manifest is locked
+		d.Manifest.Mu.Lock()
+		mt, auxMt = d.unflushedMemtablesLocked()
+		entry, err = d.findEntry(key, mt, auxMt, true)
+		d.Manifest.Mu.Unlock()
+	}
+	if err != nil {
+		if !errors.Is(err, CustomError.ErrKeyDoesNotExist) && !errors.Is(err, CustomError.ErrKeyDeleted) {
+			l.Errorln(err)
+		}
+		return KeyEntry.KeyEntry{}, false
 	}
+	l.Debugf("got value: %s for key %s", d.loggable(entry.Value), d.loggable(key))
+	return entry, true
+}
 
-	if err != nil && errors.Is(err, CustomError.ErrKeyDoesNotExist) {
-		// check auxillary memtable
+// returned by findEntry when it meets a merge operand in a memtable without holding the manifest lock
+var errMergeOperandInMemtable = errors.New("merge operand in a memtable")
+
+// Looks for the key in the memtable, the auxillary memtable (if not nil) and then all the segments one by one from the
+// most recent. With manifestLocked the caller holds d.Manifest.Mu, otherwise merge operands found in the memtables
+// fail with errMergeOperandInMemtable
+func (d *DiskStore) findEntry(key string, mt *memtable.MemTable, auxMt *memtable.MemTable, manifestLocked bool) (KeyEntry.KeyEntry, error) {
+	reads := []func() (KeyEntry.KeyEntry, error){
+		func() (KeyEntry.KeyEntry, error) {
+			return mt.GetEntry(key)
+		},
+		func() (KeyEntry.KeyEntry, error) {
+			if auxMt == nil {
+				return KeyEntry.KeyEntry{}, CustomError.ErrKeyDoesNotExist
+			}
+			return auxMt.GetEntry(key)
+		},
+		func() (KeyEntry.KeyEntry, error) {
+			if manifestLocked {
+				return d.readLevelByLevelLocked(key)
+			}
+			return d.ReadLevelByLevel(key)
+		},
+	}
 
-		if d.AuxillaryMemtable != nil {
-			value, err = d.AuxillaryMemtable.Get(key)
+	// the merge operands found so far, combined into one
+	var operand KeyEntry.KeyEntry
+	hasOperand := false
+	for i, read := range reads {
+		entry, err := read()
+		if errors.Is(err, CustomError.ErrKeyDoesNotExist) {
+			continue
 		}
-
-		if err == nil {
-			l.Debugf("got value: %s for key %s from Auxillary table", value, key)
-			return value
+		if hasOperand {
+			entry, err = d.applyMergeOperand(key, operand, entry, err)
 		}
+		if err != nil || entry.Kind != format.RECORD_KIND_MERGE_OPERAND {
+			return entry, err
+		}
+		if !manifestLocked && i < len(reads)-1 {
+			return KeyEntry.KeyEntry{}, errMergeOperandInMemtable
+		}
+		// older data decides what the operands apply to
+		operand, hasOperand = entry, true
+	}
 
-		if err != nil && errors.Is(err, CustomError.ErrKeyDoesNotExist) {
-			// check all the segments one by one from the most recent
-
-			value, err = d.ReadLevelByLevel(key)
+	if !hasOperand {
+		return KeyEntry.KeyEntry{}, CustomError.ErrKeyDoesNotExist
+	}
+	return d.applyMergeOperand(key, operand, KeyEntry.KeyEntry{}, CustomError.ErrKeyDoesNotExist)
+}
 
-			if err != nil && errors.Is(err, CustomError.ErrKeyDoesNotExist) {
-				return ""
-			}
-			return value
-		}
+// returns the memtable and the auxillary memtable, nil if there is none or it's already in a segment of the manifest.
+// Caller must hold d.Manifest.Mu
+func (d *DiskStore) unflushedMemtablesLocked() (*memtable.MemTable, *memtable.MemTable) {
+	mt, auxMt := d.memtables()
+	// a flush publishes the segment and the sequence of its memtable together
+	if auxMt != nil && auxMt.LastSequence <= d.Manifest.LastSequence {
+		auxMt = nil
 	}
-	return value
+	return mt, auxMt
 }
 
-// Reads the Segment files level by level starting from L0 to LN (where N is a variable)
-func (d *DiskStore) ReadLevelByLevel(key string) (string, error) {
-	var l = utils.Logger.WithFields(logrus.Fields{
+// Reads the Segment files level by level starting from L0 to LN (where N is a variable). Returns the merge operands
+// of the key combined into one if there is nothing below them
+func (d *DiskStore) ReadLevelByLevel(key string) (KeyEntry.KeyEntry, error) {
+	var l = d.Logger.WithFields(logger.Fields{
 		"method":    "ReadLevelByLevel",
-		"param_key": key,
+		"param_key": d.loggable(key),
 	})
-	l.Infof("Reading level by level for key: %s\n", key)
+	l.Infoln("Reading level by level for key")
 	d.Manifest.Mu.Lock()
 	defer d.Manifest.Mu.Unlock()
+	return d.readLevelByLevelLocked(key)
+}
+
+// same as ReadLevelByLevel, caller must hold d.Manifest.Mu
+func (d *DiskStore) readLevelByLevelLocked(key string) (KeyEntry.KeyEntry, error) {
+	var operand KeyEntry.KeyEntry
+	hasOperand := false
 	for i := uint32(0); i < uint32(d.Manifest.NumberOfLevels); i++ {
 		d.Manifest.SegmentLevels[i].Mu.Lock()
 		numberOfSegmentsInCurrentLevel := len(d.Manifest.SegmentLevels[i].Segments)
 		d.Manifest.SegmentLevels[i].Mu.Unlock()
 
-		val, err := d.CheckALevelForAKey(key, i, numberOfSegmentsInCurrentLevel-1)
+		entry, err := d.CheckALevelForAKey(key, i, numberOfSegmentsInCurrentLevel-1)
 		if err != nil && errors.Is(err, CustomError.ErrKeyDoesNotExist) {
 			continue
 		}
-		return val, nil
+		if hasOperand {
+			entry, err = d.applyMergeOperand(key, operand, entry, err)
+		}
+		if err == nil && entry.Kind == format.RECORD_KIND_MERGE_OPERAND {
+			operand, hasOperand = entry, true
+			continue
+		}
+		// ErrKeyDeleted stops the search as well, older levels might still have values of the key
+		return entry, err
+	}
+	if hasOperand {
+		return operand, nil
 	}
-	return "", CustomError.ErrKeyDoesNotExist
+	return KeyEntry.KeyEntry{}, CustomError.ErrKeyDoesNotExist
 }
 
-// checks the segments of a level from most recent to least recent
-func (d *DiskStore) CheckALevelForAKey(key string, level uint32, segmentIndex int) (string, error) {
+// checks the segments of a level from most recent to least recent. Merge operands are applied to what the older
+// segments of the level have, if they have nothing the operands are returned
+func (d *DiskStore) CheckALevelForAKey(key string, level uint32, segmentIndex int) (KeyEntry.KeyEntry, error) {
 
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = d.Logger.WithFields(logger.Fields{
 		"method":              "CheckALevelForAKey",
 		"param_level":         level,
-		"param_key":           key,
+		"param_key":           d.loggable(key),
 		"param_segmentNumber": segmentIndex,
 	})
 	if segmentIndex < 0 {
-		return "", CustomError.ErrKeyDoesNotExist
+		return KeyEntry.KeyEntry{}, CustomError.ErrKeyDoesNotExist
 	}
 	d.Manifest.SegmentLevels[level].Mu.Lock()
 	sz := len(d.Manifest.SegmentLevels[level].Segments)
@@ -381,20 +743,62 @@ func (d *DiskStore) CheckALevelForAKey(key string, level uint32, segmentIndex in
 	}
 
 	d.Manifest.SegmentLevels[level].Mu.Lock()
-	l.Infof("Attempting to check segment file %d for key %s", d.Manifest.SegmentLevels[level].Segments[segmentIndex].SegmentId, key)
-	memtable := memtable.GetNewMemTable(d.Manifest.DbName, -1) // passing -1 cuz segmentId will be updated in the next line
-	l.Debugln(d.Manifest.SegmentLevels[level].Segments[segmentIndex])
-	memtable.LoadFromSegmentFile(d.Manifest.SegmentLevels[level].Segments[segmentIndex].SegmentId)
+	segment := d.Manifest.SegmentLevels[level].Segments[segmentIndex]
+	l.Infof("Attempting to check segment file %d for key", segment.SegmentId)
+	memtable, err := d.LoadSegment(segment.SegmentId)
 	d.Manifest.SegmentLevels[level].Mu.Unlock()
+	if err != nil {
+		return KeyEntry.KeyEntry{}, err
+	}
 
-	value, err := memtable.Get(key)
-	l.Debugf("Got value :%s,%v", value, err)
+	entry, err := memtable.GetEntry(key)
+	entry.Sequence = segment.LastSequence
+	l.Debugf("Got value :%s,%v", d.loggable(entry.Value), err)
 	if err != nil && errors.Is(err, CustomError.ErrKeyDoesNotExist) {
 		// check before segment file recursively
 		return d.CheckALevelForAKey(key, level, segmentIndex-1)
 	}
+	if err == nil && entry.Kind == format.RECORD_KIND_MERGE_OPERAND {
+		older, err := d.CheckALevelForAKey(key, level, segmentIndex-1)
+		if errors.Is(err, CustomError.ErrKeyDoesNotExist) {
+			return entry, nil
+		}
+		return d.applyMergeOperand(key, entry, older, err)
+	}
 
-	return value, nil
+	return entry, err
+}
+
+// returns the segment loaded into a memtable, from the table cache if it's there. The returned memtable is shared and
+// must not be modified
+func (d *DiskStore) LoadSegment(segmentId uint32) (*memtable.MemTable, error) {
+	mt, ok := d.TableCache.Get(segmentId)
+	d.Metrics.ObserveTableCacheLookup(ok)
+	if ok {
+		return mt, nil
+	}
+	mt = d.newMemtable(-1) // passing -1 cuz segmentId will be updated while loading
+	err := mt.LoadFromSegmentFile(segmentId)
+	if err != nil {
+		return nil, err
+	}
+	d.TableCache.Add(segmentId, mt)
+	return mt, nil
+}
+
+// returns s if keys and values may be logged, a placeholder otherwise
+func (d *DiskStore) loggable(s string) string {
+	if d.Options.LogKeysAndValues {
+		return s
+	}
+	return "<redacted>"
+}
+
+// returns an empty memtable of the db
+func (d *DiskStore) newMemtable(segmentId int32) *memtable.MemTable {
+	mt := memtable.GetNewMemTable(d.Manifest.DbName, segmentId)
+	mt.Logger = d.Logger
+	return mt
 }
 
 // Returns the most recent segment id plus 1 from the disk store
@@ -403,13 +807,115 @@ func (d *DiskStore) GetNewSegmentId() uint32 {
 	defer func() {
 		d.Manifest.Mu.Unlock()
 	}()
+	return d.nextSegmentId()
+}
+
+// Changes the number of bytes per second memtable flushes and merge compaction are allowed to write, 0 means unlimited
+func (d *DiskStore) SetCompactionRateLimit(bytesPerSecond uint64) {
+	d.RateLimiter.SetBytesPerSecond(bytesPerSecond)
+}
+
+// same as GetNewSegmentId, caller must hold d.Manifest.Mu
+func (d *DiskStore) nextSegmentId() uint32 {
 	d.Manifest.MaxSegmentId += 1
 	return d.Manifest.MaxSegmentId
 }
 
+// returns the path of the db directory
+func (d *DiskStore) dirPath() string {
+	return fmt.Sprintf("%s/%s", config.Config.Path, d.Manifest.DbName)
+}
+
+// opens the write ahead log, replays the batches which aren't in segment files and starts a new log file
+func (d *DiskStore) openWAL() error {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "openWAL",
+	})
+
+	wal, err := openWriteAheadLog(fmt.Sprintf("%s/%s", d.dirPath(), WAL_DIR_NAME), d.Options.SyncWAL)
+	if err != nil {
+		return err
+	}
+	d.wal = wal
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	flushedSequence := d.LastSequence()
+	lastSequence, err := wal.replay(flushedSequence, func(record walRecord) error {
+		if record.recordType == WAL_RECORD_RESET {
+			d.Memtable.LastSequence = record.sequence
+			d.replication.reset(record.sequence)
+			return nil
+		}
+		batch, err := DecodeWriteBatch(record.data)
+		if err != nil {
+			return err
+		}
+		return d.applyLocked(batch, record.sequence, record.data)
+	})
+	if err != nil {
+		return err
+	}
+	if lastSequence > flushedSequence {
+		l.Infof("Replayed the write ahead log from sequence %d to %d", flushedSequence+1, lastSequence)
+	}
+	return wal.start(lastSequence + 1)
+}
+
+// returns the path of the segment file with the given id
+func (d *DiskStore) segmentFilePath(segmentId uint32) string {
+	return fmt.Sprintf("%s/%d%s", d.dirPath(), segmentId, SEGMENT_FILE_EXTENSION)
+}
+
+// Deletes segment files which are not referenced by the manifest along with any stale temporary manifest.
+// These are left behind when the db crashes in the middle of a flush or a compaction, before the manifest edit
+// publishing (or retiring) them got committed
+func (d *DiskStore) DeleteObsoleteFiles() error {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "DeleteObsoleteFiles",
+	})
+
+	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+
+	liveSegments := make(map[string]bool)
+	for i := 0; i < len(d.Manifest.SegmentLevels); i++ {
+		for _, segment := range d.Manifest.SegmentLevels[i].Segments {
+			liveSegments[fmt.Sprintf("%d%s", segment.SegmentId, SEGMENT_FILE_EXTENSION)] = true
+		}
+	}
+
+	entries, err := os.ReadDir(d.dirPath())
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		obsolete := name == MANIFEST_TEMP_FILE_NAME
+		if strings.HasSuffix(name, SEGMENT_FILE_EXTENSION) && !liveSegments[name] {
+			obsolete = true
+		}
+		if !obsolete {
+			continue
+		}
+		l.Infof("Deleting obsolete file %s", name)
+		if err := utils.DeleteFile(fmt.Sprintf("%s/%s", d.dirPath(), name)); err != nil {
+			return err
+		}
+		deleted++
+	}
+
+	if deleted > 0 {
+		return utils.SyncDir(d.dirPath())
+	}
+	return nil
+}
+
 // clears the db
 func (d *DiskStore) Cleanup() {
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = d.Logger.WithFields(logger.Fields{
 		"method": "Cleanup",
 	})
 	l.Infoln("Cleaning up the database")
@@ -424,7 +930,7 @@ func (d *DiskStore) Cleanup() {
 	}
 
 	// wait for merge compactor process
-	d.MergeCompactorWg.Wait()
+	d.CompactionScheduler.WaitForIdle()
 
 	// clear the segments slice
 	d.Manifest.Mu.Lock()
@@ -433,12 +939,16 @@ func (d *DiskStore) Cleanup() {
 	// segment levels maybe locked in merge compaction
 	d.Manifest.SegmentLevels = []SegmentLevelMetadata{}
 
-	d.Memtable = memtable.GetNewMemTable(d.Manifest.DbName, 1)
+	d.Memtable = d.newMemtable(1)
 	d.AuxillaryMemtable = nil
 	d.HashIndex = HashIndex{}
 	d.MergeCompactor = []MergeCompactor{}
+	d.CompactionScheduler = NewCompactionScheduler(d, config.Config.MaxBackgroundCompactions)
+	// segment ids start over, cached segments would shadow the new ones
+	d.TableCache.Clear()
 
-	// delete everything including manifest file
+	// delete everything including manifest file and the write ahead log
+	d.wal.close()
 
 	path := config.Config.Path
 	dirPath := fmt.Sprintf("%s/%s", path, d.Manifest.DbName)
@@ -451,41 +961,70 @@ func (d *DiskStore) Cleanup() {
 }
 
 func (d *DiskStore) ChangeNumberOfSegmentsInManifest() {
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = d.Logger.WithFields(logger.Fields{
 		"method": "ChangeNumberOfSegmentsInManifest",
 	})
-	err := d.ManifestFile.Truncate(0)
 
+	err := d.persistManifestWithLock()
 	if err != nil {
-		l.Panicf("Error in truncating manifest file %v", err)
+		l.Errorf("Error in writing to manifest file %v", err)
+		panic(err)
 	}
+}
 
+func (d *DiskStore) persistManifestWithLock() error {
 	d.Manifest.Mu.Lock()
 	defer func() {
 		d.Manifest.Mu.Unlock()
 	}()
+	return d.persistManifest()
+}
+
+// Atomically replaces the manifest file with the current in memory manifest. The manifest is written and synced to
+// a temporary file which is then renamed over the old one, so a crash leaves either the old or the new manifest
+// on disk but never a partially written one. Caller must hold d.Manifest.Mu
+func (d *DiskStore) persistManifest() error {
+	return writeManifestFile(d.dirPath(), d.Manifest)
+}
+
+// writes the manifest to the temporary manifest file of the directory and renames it over the manifest file
+func writeManifestFile(dirPath string, manifest *Manifest) error {
+	marshalledManifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("error in marshalling manifest object: %v", err)
+	}
 
-	marshalledManifestData, err := json.Marshal(d.Manifest)
+	tempManifestFile := fmt.Sprintf("%s/%s", dirPath, MANIFEST_TEMP_FILE_NAME)
+	f, err := os.OpenFile(tempManifestFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
-		l.Panicf("Error in marshalling  manifest obejct %v", err)
+		return err
 	}
 
-	manifestFile := fmt.Sprintf("%s/%s/manifest.json", config.Config.Path, d.Manifest.DbName)
-	// err = encoder.Encode(manifest)
-	err = ioutil.WriteFile(manifestFile, marshalledManifestData, 0666)
+	_, err = f.Write(marshalledManifestData)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
 
+	err = os.Rename(tempManifestFile, fmt.Sprintf("%s/%s", dirPath, MANIFEST_FILE_NAME))
 	if err != nil {
-		l.Panicf("Error in writing to manifest file %v", err)
+		return err
 	}
 
+	return utils.SyncDir(dirPath)
 }
 
 // Deletes the contents of memtable
 func (d *DiskStore) CloseDB() {
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = d.Logger.WithFields(logger.Fields{
 		"method": "CloseDB",
 	})
 	l.Infoln("Closing the database")
+	// wakes up followers waiting for new batches
+	d.replication.close()
 
 	// wait for any memtable disk writes to finish
 	if d.AuxillaryMemtable != nil {
@@ -494,46 +1033,26 @@ func (d *DiskStore) CloseDB() {
 		d.AuxillaryMemtable.ExWaitGroup.Wg.Wait()
 		d.AuxillaryMemtable.ExWaitGroup.Mu.Unlock()
 	}
-	d.MergeCompactorWg.Wait()
+	d.CompactionScheduler.WaitForIdle()
 
-	// write memtable to segment file and clear it
-
-	// newly created db closed without actually writing to disk
-	if d.Manifest.NumberOfLevels == 0 {
-		d.Manifest.Mu.Lock()
-		// add the new segment level 0 to manifest
-		d.Manifest.NumberOfLevels = 1
-		d.Manifest.SegmentLevels = append(d.Manifest.SegmentLevels, SegmentLevelMetadata{
-			Segments: []SegmentMetadata{},
-			Mu:       &sync.Mutex{},
-		})
-		d.Manifest.Mu.Unlock()
-		d.InitMergeCompactor(0)
-	}
-
-	cardinality, exists, err := d.Memtable.WriteMemtableToDisk()
-	if err != nil {
-		l.Fatalf("Error while writing memtable to disk %v", err)
+	// write memtable to segment file and clear it, an empty memtable would only leave an empty segment behind
+	if d.Memtable.Size() > 0 {
+		d.Memtable.Metrics = d.Metrics
+		err := d.FlushMemtableToLevel0(d.Memtable)
+		if err != nil {
+			l.Errorf("Error while writing memtable to disk %v", err)
+			panic(err)
+		}
 	}
-	// append only if its newly added file
-	if !exists {
-		d.Manifest.Mu.Lock()
-		d.Manifest.SegmentLevels[0].Segments = append(d.Manifest.SegmentLevels[0].Segments, SegmentMetadata{
-			SegmentId:   uint32(d.Memtable.SegmentId),
-			Cardinality: cardinality,
-			Mu:          &sync.Mutex{},
-		})
+	// finish the compactions this flush requires (unless they were cancelled) and stop the scheduler
+	d.CompactionScheduler.Drain()
 
-		// unlock specifically here because next function locks it
-		d.Manifest.Mu.Unlock()
-		// only do merge compaction if segment doesnt exist already
-		d.WatchLevelForSizeLimitExceed(0)
-	} else {
-		// just update cardinality
-		d.FindForSegmendAndUpdate(uint32(d.Memtable.SegmentId), cardinality)
-	}
+	d.Manifest.Mu.Lock()
+	d.advanceLastSequence(d.Memtable.LastSequence)
+	d.Manifest.Mu.Unlock()
 	d.ChangeNumberOfSegmentsInManifest()
 	d.Memtable.Clear()
+	d.wal.close()
 
 	// close manifest file
 	d.ManifestFile.Close()
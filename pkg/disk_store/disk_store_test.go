@@ -1,14 +1,26 @@
 package disk_store
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"math/rand"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/abesheknarayan/go-caskdb/pkg/config"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/memtable"
+	"github.com/abesheknarayan/go-caskdb/pkg/merge_operator"
+	"github.com/abesheknarayan/go-caskdb/pkg/metrics"
 	"github.com/abesheknarayan/go-caskdb/pkg/utils"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -43,6 +55,8 @@ func InsertAndRead(N int, t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// background compactions must be done before the next test changes the config
+	defer t_db.CloseDB()
 	m := make(map[string]string)
 	allKeys := make([]string, N)
 	for i := 0; i < N; i++ {
@@ -84,6 +98,7 @@ func InsertWithConcurrentReads(N int, M int, t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer t_db.CloseDB()
 
 	for i := 0; i < N; i++ {
 		x := rand.Int() % 2
@@ -181,6 +196,154 @@ func Test_DbCleanup(t *testing.T) {
 	assert.Equal(t, "", db.Get("name"), "Expected empty value")
 }
 
+// returns the set of segment ids referenced by the manifest and the set of segment files present on disk
+func segmentIdsInManifestAndOnDisk(t *testing.T, d *DiskStore) (map[string]bool, map[string]bool) {
+	inManifest := make(map[string]bool)
+	for _, level := range d.Manifest.SegmentLevels {
+		for _, segment := range level.Segments {
+			inManifest[fmt.Sprintf("%d.seg", segment.SegmentId)] = true
+		}
+	}
+	entries, err := os.ReadDir(d.dirPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk := make(map[string]bool)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), SEGMENT_FILE_EXTENSION) {
+			onDisk[entry.Name()] = true
+		}
+	}
+	return inManifest, onDisk
+}
+
+func Test_CompactionKeepsManifestAndFilesInSync(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	dbName := fmt.Sprintf("compactionDb%d", time.Now().UnixNano())
+	t_db, err := InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("Key: %d", rand.Int()%1000)
+		value := utils.GetRandomString(rand.Int()%10 + 5)
+		m[key] = value
+		t_db.Put(key, value)
+	}
+	t_db.CloseDB()
+
+	inManifest, onDisk := segmentIdsInManifestAndOnDisk(t, t_db)
+	assert.Equal(t, inManifest, onDisk, "Segment files on disk differ from the manifest")
+
+	// simulate leftovers of a compaction and a manifest write interrupted by a crash
+	dirPath := t_db.dirPath()
+	orphan := fmt.Sprintf("%s/%d.seg", dirPath, t_db.Manifest.MaxSegmentId+10)
+	assert.Nil(t, os.WriteFile(orphan, []byte("half written"), 0666))
+	assert.Nil(t, os.WriteFile(fmt.Sprintf("%s/%s", dirPath, MANIFEST_TEMP_FILE_NAME), []byte("{"), 0666))
+
+	t_db, err = InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err), "Orphan segment was not garbage collected")
+	_, err = os.Stat(fmt.Sprintf("%s/%s", dirPath, MANIFEST_TEMP_FILE_NAME))
+	assert.True(t, os.IsNotExist(err), "Temporary manifest was not garbage collected")
+
+	for key, value := range m {
+		assert.Equal(t, value, t_db.Get(key), "Values are not equal!!")
+	}
+	t_db.CloseDB()
+}
+
+func Test_CompactRangeAndCompactAll(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	t_db, err := InitDb(fmt.Sprintf("manualCompactionDb%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("Key: %04d", rand.Int()%2000)
+		value := utils.GetRandomString(rand.Int()%10 + 5)
+		m[key] = value
+		t_db.Put(key, value)
+	}
+
+	// background compactions would keep reshuffling the levels while we look at them
+	t_db.PauseCompactions()
+	t_db.CompactionScheduler.WaitForIdle()
+
+	start, end := "Key: 0500", "Key: 0999"
+	stats, err := t_db.CompactRange(start, end)
+	assert.Nil(t, err)
+	assert.NotZero(t, stats.BytesWritten, "Compaction didn't write anything")
+
+	bottomLevel := len(t_db.Manifest.SegmentLevels) - 1
+	for level := 0; level < bottomLevel; level++ {
+		for _, segment := range t_db.Manifest.SegmentLevels[level].Segments {
+			assert.False(t, segment.OverlapsRange(start, end), "Segment %d on level %d overlaps the compacted range", segment.SegmentId, level)
+		}
+	}
+
+	_, err = t_db.CompactAll()
+	assert.Nil(t, err)
+	bottomLevel = len(t_db.Manifest.SegmentLevels) - 1
+	for level := 0; level < bottomLevel; level++ {
+		assert.Empty(t, t_db.Manifest.SegmentLevels[level].Segments, "Level %d is not empty after full compaction", level)
+	}
+
+	for key, value := range m {
+		assert.Equal(t, value, t_db.Get(key), "Values are not equal!!")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = t_db.CompactRangeWithContext(ctx, "", "")
+	assert.ErrorIs(t, err, context.Canceled)
+	t_db.ResumeCompactions()
+	t_db.CloseDB()
+}
+
+func Test_CompactionSchedulerPauseResumeAndCancel(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	dbName := fmt.Sprintf("schedulerDb%d", time.Now().UnixNano())
+	t_db, err := InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t_db.PauseCompactions()
+	m := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("Key: %d", rand.Int()%1500)
+		value := utils.GetRandomString(rand.Int()%10 + 5)
+		m[key] = value
+		t_db.Put(key, value)
+	}
+	t_db.Flush()
+	assert.Greater(t, t_db.numberOfSegmentsInLevel(0), 1, "Level 0 got compacted while compactions were paused")
+
+	t_db.ResumeCompactions()
+	t_db.CompactionScheduler.WaitForIdle()
+	for _, score := range t_db.levelScores() {
+		assert.LessOrEqual(t, score.score, float64(1), "Level %d is still overfull", score.level)
+	}
+
+	// cancelling makes CloseDB skip compactions, the data has to survive anyway
+	t_db.CancelCompactions()
+	t_db.CloseDB()
+	t_db, err = InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range m {
+		assert.Equal(t, value, t_db.Get(key), "Values are not equal!!")
+	}
+	t_db.CloseDB()
+}
+
 // tests for many number of randomly generated keys so that many segment files are created and looked up
 
 func setupTests(t *testing.T) {
@@ -198,6 +361,1543 @@ func setupTests(t *testing.T) {
 }
 
 // all setup is done here as this runs first, call all tests from here
+func Test_Stats(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	t_db, err := InitDb(fmt.Sprintf("statsDb%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		t_db.Put(fmt.Sprintf("Key: %04d", i), utils.GetRandomString(10))
+	}
+	t_db.PauseCompactions()
+	t_db.CompactionScheduler.WaitForIdle()
+	t_db.Flush()
+
+	stats := t_db.Stats()
+	assert.NotZero(t, stats.Flushes, "No flush was recorded")
+	assert.NotZero(t, stats.UserBytesWritten)
+	assert.GreaterOrEqual(t, stats.WriteAmplification, 1.0, "Everything written has to reach disk at least once")
+	for _, level := range stats.Levels {
+		value, ok := t_db.GetProperty(fmt.Sprintf("caskdb.num-files-at-level%d", level.Level))
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprint(level.NumberOfSegments), value, "Property doesn't match the stats of level %d", level.Level)
+	}
+
+	// same key read twice has to hit the table cache the second time
+	t_db.Get("Key: 0000")
+	_, missesBefore := t_db.TableCache.HitsAndMisses()
+	t_db.Get("Key: 0000")
+	hits, misses := t_db.TableCache.HitsAndMisses()
+	assert.NotZero(t, hits, "Table cache was never hit")
+	assert.Equal(t, missesBefore, misses, "Cached segment was loaded again")
+
+	// the flushed batches are kept in the write ahead log for subscribers
+	assert.NotZero(t, stats.WALFiles)
+	assert.NotZero(t, stats.WALBytes)
+	value, ok := t_db.GetProperty("caskdb.total-wal-size")
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprint(stats.WALBytes), value)
+
+	summary, ok := t_db.GetProperty("caskdb.stats")
+	assert.True(t, ok)
+	assert.Contains(t, summary, "Table cache:")
+	assert.Contains(t, summary, "WAL:")
+	_, ok = t_db.GetProperty("caskdb.no-such-property")
+	assert.False(t, ok)
+
+	t_db.ResumeCompactions()
+	t_db.CloseDB()
+}
+
+func Test_TableCache(t *testing.T) {
+	cache := NewTableCache(2)
+	segments := make([]*memtable.MemTable, 3)
+	for i := range segments {
+		segments[i] = memtable.GetNewMemTable("tableCacheDb", int32(i+1))
+	}
+	cache.Add(1, segments[0])
+	cache.Add(2, segments[1])
+	// reading segment 1 leaves 2 as the least recently used, the next segment pushes it out
+	mt, ok := cache.Get(1)
+	assert.True(t, ok)
+	assert.Same(t, segments[0], mt)
+	cache.Add(3, segments[2])
+	assert.Equal(t, 2, cache.Len())
+	_, ok = cache.Get(2)
+	assert.False(t, ok, "Least recently used segment wasn't evicted")
+	_, ok = cache.Get(1)
+	assert.True(t, ok)
+	cache.Evict(1)
+	_, ok = cache.Get(1)
+	assert.False(t, ok, "Evicted segment is still cached")
+	hits, misses := cache.HitsAndMisses()
+	assert.Equal(t, uint64(2), hits)
+	assert.Equal(t, uint64(2), misses)
+	cache.Clear()
+	assert.Equal(t, 0, cache.Len())
+	hits, _ = cache.HitsAndMisses()
+	assert.Equal(t, uint64(2), hits, "Clear reset the hit count")
+
+	disabled := NewTableCache(0)
+	disabled.Add(1, segments[0])
+	assert.Equal(t, 0, disabled.Len(), "Cache of capacity 0 kept a segment")
+
+	// compaction drops the segments it deletes from the cache, reads never see a stale segment
+	config.Config.MemtableSizeLimit = 4 * 1024
+	t_db, err := InitDb(fmt.Sprintf("tableCacheDb%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t_db.Cleanup()
+	for i := 0; i < 1000; i++ {
+		t_db.Put(fmt.Sprintf("Key: %04d", i), "old")
+	}
+	t_db.Flush()
+	for i := 0; i < 1000; i += 100 {
+		assert.Equal(t, "old", t_db.Get(fmt.Sprintf("Key: %04d", i)))
+	}
+	assert.NotZero(t, t_db.TableCache.Len())
+	for i := 0; i < 1000; i++ {
+		t_db.Put(fmt.Sprintf("Key: %04d", i), "new")
+	}
+	t_db.Flush()
+	_, err = t_db.CompactAll()
+	assert.Nil(t, err)
+	t_db.CompactionScheduler.WaitForIdle()
+
+	live := make(map[uint32]bool)
+	t_db.Manifest.Mu.Lock()
+	for _, level := range t_db.Manifest.SegmentLevels {
+		for _, segment := range level.Segments {
+			live[segment.SegmentId] = true
+		}
+	}
+	t_db.Manifest.Mu.Unlock()
+	t_db.TableCache.Mu.Lock()
+	for segmentId := range t_db.TableCache.entries {
+		assert.True(t, live[segmentId], "Deleted segment %d is still cached", segmentId)
+	}
+	t_db.TableCache.Mu.Unlock()
+	for i := 0; i < 1000; i += 100 {
+		assert.Equal(t, "new", t_db.Get(fmt.Sprintf("Key: %04d", i)))
+	}
+}
+
+func Test_Metrics(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	t_db, err := InitDb(fmt.Sprintf("metricsDb%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t_db.Metrics = metrics.New()
+	for i := 0; i < 1000; i++ {
+		t_db.Put(fmt.Sprintf("Key: %04d", i), utils.GetRandomString(10))
+	}
+	t_db.Flush()
+	t_db.Get("Key: 0000")
+	t_db.Get("Key: 0000")
+
+	assert.Equal(t, uint64(1000), t_db.Metrics.OperationLatency.Count(metrics.OPERATION_PUT))
+	assert.Equal(t, uint64(2), t_db.Metrics.OperationLatency.Count(metrics.OPERATION_GET))
+	assert.Equal(t, float64(t_db.Stats().Flushes), t_db.Metrics.MemtableFlushes.Value(), "Flush counts differ from Stats")
+	assert.NotZero(t, t_db.Metrics.BytesWritten.Value("0"))
+	assert.NotZero(t, t_db.Metrics.TableCacheHits.Value())
+
+	t_db.CompactionScheduler.WaitForIdle()
+	t_db.CloseDB()
+}
+
+type recordingEventListener struct {
+	NoopEventListener
+	flushesBegun     int
+	flushesCompleted []FlushJobInfo
+	compactions      []CompactionJobInfo
+	segmentsCreated  map[uint32]bool
+	segmentsDeleted  map[uint32]bool
+	backgroundErrors int
+	mu               sync.Mutex
+}
+
+func (r *recordingEventListener) OnFlushBegin(info FlushJobInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushesBegun++
+}
+
+func (r *recordingEventListener) OnFlushCompleted(info FlushJobInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushesCompleted = append(r.flushesCompleted, info)
+}
+
+func (r *recordingEventListener) OnCompactionCompleted(info CompactionJobInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compactions = append(r.compactions, info)
+}
+
+func (r *recordingEventListener) OnSegmentCreated(info SegmentInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.segmentsCreated[info.SegmentId] = true
+}
+
+func (r *recordingEventListener) OnSegmentDeleted(info SegmentInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.segmentsDeleted[info.SegmentId] = true
+}
+
+func (r *recordingEventListener) OnBackgroundError(reason BackgroundErrorReason, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backgroundErrors++
+}
+
+func Test_EventListener(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	listener := &recordingEventListener{segmentsCreated: map[uint32]bool{}, segmentsDeleted: map[uint32]bool{}}
+	options := DefaultOptions()
+	options.EventListeners = []EventListener{listener}
+	t_db, err := InitDbWithOptions(fmt.Sprintf("eventListenerDb%d", time.Now().UnixNano()), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		t_db.Put(fmt.Sprintf("Key: %04d", rand.Int()%2000), utils.GetRandomString(10))
+	}
+	_, err = t_db.CompactAll()
+	assert.Nil(t, err)
+	t_db.CompactionScheduler.WaitForIdle()
+
+	listener.mu.Lock()
+	assert.Equal(t, listener.flushesBegun, len(listener.flushesCompleted), "Every flush which began has to complete")
+	assert.NotEmpty(t, listener.flushesCompleted)
+	for _, info := range listener.flushesCompleted {
+		assert.Nil(t, info.Err)
+		assert.NotZero(t, info.BytesWritten)
+	}
+	assert.NotEmpty(t, listener.compactions, "No compaction was reported")
+	for _, info := range listener.compactions {
+		assert.Equal(t, info.InputLevel+1, info.OutputLevel)
+		assert.NotEmpty(t, info.InputSegments)
+	}
+	assert.Zero(t, listener.backgroundErrors)
+
+	// segments which are alive must have been created and not deleted, everything else must have been deleted
+	live := map[uint32]bool{}
+	for _, level := range t_db.Manifest.SegmentLevels {
+		for _, segment := range level.Segments {
+			live[segment.SegmentId] = true
+			assert.True(t, listener.segmentsCreated[segment.SegmentId], "Creation of segment %d was not reported", segment.SegmentId)
+			assert.False(t, listener.segmentsDeleted[segment.SegmentId], "Live segment %d was reported as deleted", segment.SegmentId)
+		}
+	}
+	for segmentId := range listener.segmentsCreated {
+		if !live[segmentId] {
+			assert.True(t, listener.segmentsDeleted[segmentId], "Deletion of segment %d was not reported", segmentId)
+		}
+	}
+	listener.mu.Unlock()
+
+	t_db.CloseDB()
+}
+
+func Test_LoggerRedactsKeysAndValues(t *testing.T) {
+	var buf bytes.Buffer
+	logrusLogger := logrus.New()
+	logrusLogger.SetOutput(&buf)
+	logrusLogger.SetLevel(logrus.DebugLevel)
+
+	options := DefaultOptions()
+	options.Logger = logger.NewLogrusLogger(logrusLogger)
+	t_db, err := InitDbWithOptions(fmt.Sprintf("loggerDb%d", time.Now().UnixNano()), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t_db.Put("secret-key", "secret-value")
+	assert.Equal(t, "secret-value", t_db.Get("secret-key"))
+	assert.NotEmpty(t, buf.String(), "Nothing was logged")
+	assert.NotContains(t, buf.String(), "secret", "Keys or values were logged")
+
+	t_db.Options.LogKeysAndValues = true
+	t_db.Put("secret-key", "secret-value")
+	assert.Contains(t, buf.String(), "secret-value", "Values were not logged with LogKeysAndValues")
+	t_db.CloseDB()
+}
+
+func Test_DeleteAndScan(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	dbName := fmt.Sprintf("deleteAndScanDb%d", time.Now().UnixNano())
+	t_db, err := InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("Key: %04d", rand.Int()%1000)
+		if rand.Int()%4 == 0 {
+			t_db.Delete(key)
+			delete(m, key)
+			continue
+		}
+		value := utils.GetRandomString(rand.Int()%10 + 5)
+		t_db.Put(key, value)
+		m[key] = value
+	}
+
+	check := func() {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("Key: %04d", i)
+			assert.Equal(t, m[key], t_db.Get(key), "Values are not equal for %s", key)
+		}
+		var scanned []string
+		err := t_db.Scan("Key: 0100", "Key: 0199", func(key string, value string) bool {
+			assert.Equal(t, m[key], value, "Scanned value is not equal for %s", key)
+			scanned = append(scanned, key)
+			return true
+		})
+		assert.Nil(t, err)
+		var expected []string
+		for i := 100; i < 200; i++ {
+			if key := fmt.Sprintf("Key: %04d", i); m[key] != "" {
+				expected = append(expected, key)
+			}
+		}
+		assert.Equal(t, expected, scanned, "Scan returned different keys")
+	}
+	check()
+
+	// tombstones have to survive flushes, compactions and reopening
+	t_db.CloseDB()
+	t_db, err = InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+	_, err = t_db.CompactAll()
+	assert.Nil(t, err)
+	check()
+
+	count := 0
+	t_db.ScanPrefix("Key: 00", func(key string, value string) bool {
+		count++
+		return count < 5
+	})
+	assert.LessOrEqual(t, count, 5, "Scan didn't stop when asked to")
+	t_db.CloseDB()
+}
+
+func Test_Iterator(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	options := DefaultOptions()
+	options.MergeOperator = merge_operator.NewStringAppendOperator(",")
+	t_db, err := InitDbWithOptions(fmt.Sprintf("iteratorDb%d", time.Now().UnixNano()), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("Key: %04d", rand.Int()%500)
+		switch rand.Int() % 5 {
+		case 0:
+			t_db.Delete(key)
+			delete(m, key)
+		case 1:
+			t_db.Merge(key, "m")
+			if _, ok := m[key]; ok {
+				m[key] += ",m"
+			} else {
+				m[key] = "m"
+			}
+		default:
+			value := utils.GetRandomString(10)
+			t_db.Put(key, value)
+			m[key] = value
+		}
+	}
+
+	it := t_db.NewIterator("Key: 0100", "Key: 0299")
+	defer it.Close()
+
+	// none of this shows up in the iterator, and compactions don't wait for it to be closed
+	for i := 100; i < 300; i++ {
+		t_db.Put(fmt.Sprintf("Key: %04d", i), "new")
+		t_db.Merge(fmt.Sprintf("Key: %04d", i), "new")
+	}
+	t_db.Flush()
+	_, err = t_db.CompactAll()
+	assert.Nil(t, err)
+
+	var scanned []string
+	for it.Next() {
+		assert.Equal(t, m[it.Key()], it.Value(), "Iterated value is not equal for %s", it.Key())
+		scanned = append(scanned, it.Key())
+	}
+	assert.Nil(t, it.Err())
+	var expected []string
+	for i := 100; i < 300; i++ {
+		if key := fmt.Sprintf("Key: %04d", i); m[key] != "" {
+			expected = append(expected, key)
+		}
+	}
+	assert.Equal(t, expected, scanned, "Iterator returned different keys")
+
+	assert.Nil(t, t_db.Scan("Key: 0100", "Key: 0299", func(key string, value string) bool {
+		assert.Equal(t, "new,new", value, "Scan doesn't see the latest value of %s", key)
+		return true
+	}))
+	t_db.CloseDB()
+}
+
+func Test_InspectDb(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	dbName := fmt.Sprintf("inspectDb%d", time.Now().UnixNano())
+	t_db, err := InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		t_db.Put(fmt.Sprintf("Key: %04d", rand.Int()%1000), utils.GetRandomString(10))
+	}
+	t_db.CloseDB()
+
+	dirPath := fmt.Sprintf("%s/%s", config.Config.Path, dbName)
+	report, err := InspectDb(dirPath)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems, "Clean db has problems")
+	live := 0
+	for _, level := range report.Manifest.SegmentLevels {
+		live += len(level.Segments)
+	}
+	assert.Equal(t, live, len(report.Segments), "Number of segment files differs from the manifest")
+
+	// lose a segment and leave an orphan behind
+	segmentId := report.Manifest.SegmentLevels[len(report.Manifest.SegmentLevels)-1].Segments[0].SegmentId
+	assert.Nil(t, os.Rename(fmt.Sprintf("%s/%d.seg", dirPath, segmentId), fmt.Sprintf("%s/%d.seg", dirPath, report.Manifest.MaxSegmentId+1)))
+	report, err = InspectDb(dirPath)
+	assert.Nil(t, err)
+	assert.Len(t, report.Problems, 2, "Missing and orphan segment weren't both reported")
+}
+
+func Test_VerifyAndRepair(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	dbName := fmt.Sprintf("repairDb%d", time.Now().UnixNano())
+	t_db, err := InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every key is written once, so no matter how the levels get rebuilt each key has a single value
+	m := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("Key: %04d", i)
+		m[key] = utils.GetRandomString(10)
+		t_db.Put(key, m[key])
+	}
+	t_db.CloseDB()
+
+	dirPath := fmt.Sprintf("%s/%s", config.Config.Path, dbName)
+	report, err := Verify(dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2000), report.Manifest.LastSequence)
+
+	// the sequence survives repairing a db with a readable manifest
+	repairReport, err := Repair(dirPath)
+	assert.Nil(t, err)
+	assert.False(t, repairReport.SequenceLost)
+	report, err = Verify(dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2000), report.Manifest.LastSequence, "Repair dropped the last sequence")
+
+	// cut the last record of a segment short and lose the manifest
+	var segment SegmentMetadata
+	for _, level := range report.Manifest.SegmentLevels {
+		if len(level.Segments) > 0 {
+			segment = level.Segments[0]
+			break
+		}
+	}
+	segmentPath := fmt.Sprintf("%s/%d.seg", dirPath, segment.SegmentId)
+	assert.Nil(t, os.Truncate(segmentPath, int64(segment.Size)-3))
+	assert.Nil(t, os.Remove(fmt.Sprintf("%s/%s", dirPath, MANIFEST_FILE_NAME)))
+	_, err = Verify(dirPath)
+	assert.ErrorIs(t, err, CustomError.ErrVerificationFailed)
+
+	repairReport, err = Repair(dirPath)
+	assert.Nil(t, err)
+	assert.True(t, repairReport.ManifestRebuilt)
+	assert.True(t, repairReport.SequenceLost)
+	assert.Equal(t, segment.Cardinality-1, repairReport.SalvagedRecords)
+	assert.Contains(t, repairReport.Quarantined, fmt.Sprintf("%s/%d.seg", LOST_DIR_NAME, segment.SegmentId))
+	_, err = os.Stat(fmt.Sprintf("%s/%s/%d.seg", dirPath, LOST_DIR_NAME, segment.SegmentId))
+	assert.Nil(t, err, "Damaged segment wasn't quarantined")
+	_, err = Verify(dirPath)
+	assert.Nil(t, err, "Repaired db doesn't verify")
+
+	t_db, err = InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t_db.Cleanup()
+	// the write ahead log still has every batch from sequence 1 on, replaying it brings back the truncated record
+	assert.Equal(t, uint64(2000), t_db.LastSequence())
+	for key, value := range m {
+		assert.Equal(t, value, t_db.Get(key), "Salvaged value differs")
+	}
+}
+
+func Test_CheckpointAndBackup(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	t_db, err := InitDb(fmt.Sprintf("checkpointDb%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t_db.Cleanup()
+	m := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("Key: %04d", rand.Int()%1000)
+		m[key] = utils.GetRandomString(10)
+		t_db.Put(key, m[key])
+	}
+
+	// keep writing and compacting while the checkpoint is taken
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				t_db.Put(fmt.Sprintf("Other: %04d", i%1000), utils.GetRandomString(10))
+			}
+		}
+	}()
+	checkpointName := fmt.Sprintf("checkpoint%d", time.Now().UnixNano())
+	err = t_db.Checkpoint(fmt.Sprintf("%s/%s", config.Config.Path, checkpointName))
+	close(done)
+	wg.Wait()
+	assert.Nil(t, err)
+	assert.NotNil(t, t_db.Checkpoint(fmt.Sprintf("%s/%s", config.Config.Path, checkpointName)), "Checkpoint overwrote a directory")
+
+	_, err = Verify(fmt.Sprintf("%s/%s", config.Config.Path, checkpointName))
+	assert.Nil(t, err)
+	checkpoint, err := InitDb(checkpointName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range m {
+		assert.Equal(t, value, checkpoint.Get(key), "Checkpoint lost a value")
+	}
+	checkpoint.Cleanup()
+
+	// a pinned segment outlives compaction
+	t_db.CompactionScheduler.WaitForIdle()
+	snapshot, unpin := t_db.pinCurrentSegments()
+	segment := snapshot.SegmentLevels[len(snapshot.SegmentLevels)-1].Segments[0]
+	t_db.deleteSegmentFiles([]SegmentMetadata{segment})
+	_, err = os.Stat(t_db.segmentFilePath(segment.SegmentId))
+	assert.Nil(t, err, "Pinned segment was deleted")
+	unpin()
+	_, err = os.Stat(t_db.segmentFilePath(segment.SegmentId))
+	assert.True(t, os.IsNotExist(err), "Segment wasn't deleted once unpinned")
+
+	// backups only copy the segments the backup dir doesn't have yet
+	t_db, err = InitDb(checkpointName + "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t_db.Cleanup()
+	for key, value := range m {
+		t_db.Put(key, value)
+	}
+	t_db.Flush()
+	t_db.CompactionScheduler.WaitForIdle()
+	backupDir := t.TempDir()
+	info, err := t_db.CreateBackup(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), info.BackupId)
+	assert.Equal(t, info.Segments, info.CopiedSegments)
+	info, err = t_db.CreateBackup(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), info.BackupId)
+	assert.Equal(t, 0, info.CopiedSegments, "Unchanged segments were copied again")
+	backupIds, err := ListBackups(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{1, 2}, backupIds)
+
+	restoredName := fmt.Sprintf("restored%d", time.Now().UnixNano())
+	assert.Nil(t, RestoreBackup(backupDir, 1, fmt.Sprintf("%s/%s", config.Config.Path, restoredName)))
+	restored, err := InitDb(restoredName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Cleanup()
+	for key, value := range m {
+		assert.Equal(t, value, restored.Get(key), "Restored backup lost a value")
+	}
+}
+
+func Test_WriteBatch(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	t_db, err := InitDb(fmt.Sprintf("batchDb%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t_db.Cleanup()
+
+	t_db.Put("gone", "soon")
+	batch := NewWriteBatch()
+	for i := 0; i < 1000; i++ {
+		batch.Put(fmt.Sprintf("Key: %04d", i), fmt.Sprintf("Value: %d", i))
+	}
+	batch.Delete("gone")
+	batch.Put("Key: 0000", "last write wins")
+	assert.Equal(t, 1002, batch.Len())
+	assert.Nil(t, t_db.Write(batch))
+
+	assert.Equal(t, "", t_db.Get("gone"))
+	assert.Equal(t, "last write wins", t_db.Get("Key: 0000"))
+	assert.Equal(t, "Value: 999", t_db.Get("Key: 0999"))
+	// the batch is larger than a memtable and still went to a single one
+	assert.Equal(t, 1001, t_db.Memtable.Size())
+
+	batch.Clear()
+	assert.Equal(t, 0, batch.Len())
+	assert.Nil(t, t_db.Write(batch))
+
+	// readers never see half a batch, not even while memtables rotate
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 300; i++ {
+			batch := NewWriteBatch()
+			batch.Put("pair:a", strconv.Itoa(i))
+			batch.Put("pair:b", strconv.Itoa(i))
+			batch.Put(fmt.Sprintf("padding:%03d", i), strings.Repeat("x", 100))
+			assert.Nil(t, t_db.Write(batch))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		values := make(map[string]string)
+		assert.Nil(t, t_db.ScanPrefix("pair:", func(key string, value string) bool {
+			values[key] = value
+			return true
+		}))
+		assert.Equal(t, values["pair:a"], values["pair:b"])
+	}
+}
+
+func Test_ExportAndImport(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	source, err := InitDb(fmt.Sprintf("exportDb%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Cleanup()
+	m := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("Key: %04d", i)
+		m[key] = utils.GetRandomString(10)
+		source.Put(key, m[key])
+	}
+	// needs quoting in csv, and isn't utf-8
+	m["comma, \"quote\"\nnewline"] = "value, with comma"
+	m["binary\xff\x00"] = "\x01\x02\xfe"
+	for key, value := range m {
+		source.Put(key, value)
+	}
+	source.Put("deleted", "value")
+	source.Delete("deleted")
+
+	for _, name := range []string{"jsonl", "csv"} {
+		exportFormat, err := ParseExportFormat(name)
+		assert.Nil(t, err)
+		var buf bytes.Buffer
+		exported, err := source.Export(&buf, exportFormat)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(len(m)), exported)
+
+		target, err := InitDb(fmt.Sprintf("importDb%s%d", name, time.Now().UnixNano()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var progress []uint64
+		imported, err := target.Import(&buf, exportFormat, ImportOptions{
+			BatchSize: 100,
+			Progress:  func(imported uint64) { progress = append(progress, imported) },
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(len(m)), imported)
+		assert.Len(t, progress, (len(m)+99)/100, "Progress wasn't reported after every batch")
+		for key, value := range m {
+			assert.Equal(t, value, target.Get(key), "Imported value differs")
+		}
+		assert.Equal(t, "", target.Get("deleted"))
+		target.Cleanup()
+	}
+
+	// writes made while the export runs don't show up in it
+	deleting := &writerFunc{write: func(p []byte) {
+		for key := range m {
+			source.Delete(key)
+		}
+	}}
+	exported, err := source.Export(deleting, EXPORT_FORMAT_JSON_LINES)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(len(m)), exported)
+	assert.Equal(t, len(m), strings.Count(deleting.buf.String(), "\n"))
+
+	_, err = ParseExportFormat("xml")
+	assert.NotNil(t, err)
+	imported, err := source.Import(strings.NewReader("{\"key\": \"a\", \"value\": \"b\"}\nnot json\n"), EXPORT_FORMAT_JSON_LINES, ImportOptions{})
+	assert.NotNil(t, err, "Malformed line was imported")
+	assert.Equal(t, uint64(1), imported, "Records before the malformed line weren't imported")
+}
+
+// io.Writer calling write before buffering every write
+type writerFunc struct {
+	buf   bytes.Buffer
+	write func(p []byte)
+}
+
+func (w *writerFunc) Write(p []byte) (int, error) {
+	w.write(p)
+	return w.buf.Write(p)
+}
+
+// writes the keys (which must be sorted) to a segment file outside the db, every value is value
+func writeExternalSegment(t *testing.T, path string, keys []string, value string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writer := format.NewSegmentWriter(f)
+	for _, key := range keys {
+		assert.Nil(t, writer.Put(key, value))
+	}
+	assert.Nil(t, writer.Flush())
+}
+
+func Test_IngestSegments(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	dbName := fmt.Sprintf("ingestDb%d", time.Now().UnixNano())
+	t_db, err := InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer t_db.Cleanup()
+	for i := 0; i < 1000; i++ {
+		t_db.Put(fmt.Sprintf("Key: %04d", i), "old")
+	}
+	t_db.Flush()
+	t_db.CompactionScheduler.WaitForIdle()
+
+	externalDir := t.TempDir()
+	var disjointKeys, overlappingKeys []string
+	for i := 0; i < 500; i++ {
+		disjointKeys = append(disjointKeys, fmt.Sprintf("Zeta: %04d", i))
+		overlappingKeys = append(overlappingKeys, fmt.Sprintf("Key: %04d", i*2))
+	}
+	writeExternalSegment(t, externalDir+"/disjoint.seg", disjointKeys, "ingested")
+	writeExternalSegment(t, externalDir+"/overlapping.seg", overlappingKeys, "new")
+
+	ingested, err := t_db.IngestSegments([]string{externalDir + "/disjoint.seg"})
+	assert.Nil(t, err)
+	assert.Equal(t, t_db.Manifest.NumberOfLevels-1, ingested[0].Level, "Disjoint segment wasn't placed at the bottom")
+	ingested, err = t_db.IngestSegments([]string{externalDir + "/overlapping.seg"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), ingested[0].Level, "Overlapping segment has to go to level 0")
+
+	assert.Equal(t, "ingested", t_db.Get("Zeta: 0042"))
+	assert.Equal(t, "new", t_db.Get("Key: 0042"))
+	assert.Equal(t, "old", t_db.Get("Key: 0043"))
+
+	// the memtable is flushed first when it holds keys of the ingested range
+	t_db.Put("Mem: 1", "memtable")
+	writeExternalSegment(t, externalDir+"/memtable.seg", []string{"Mem: 1"}, "ingested")
+	_, err = t_db.IngestSegments([]string{externalDir + "/memtable.seg"})
+	assert.Nil(t, err)
+	assert.Equal(t, "ingested", t_db.Get("Mem: 1"))
+
+	// an unsorted file is rejected and nothing gets ingested
+	var unsorted []byte
+	for _, key := range []string{"b", "a"} {
+		_, data := format.EncodeKeyValue(1, key, "value")
+		unsorted = append(unsorted, data...)
+	}
+	assert.Nil(t, os.WriteFile(externalDir+"/unsorted.seg", unsorted, 0666))
+	writeExternalSegment(t, externalDir+"/valid.seg", []string{"valid"}, "value")
+	_, err = t_db.IngestSegments([]string{externalDir + "/valid.seg", externalDir + "/unsorted.seg"})
+	assert.NotNil(t, err)
+	assert.Equal(t, "", t_db.Get("valid"))
+
+	t_db.CloseDB()
+	report, err := InspectDb(fmt.Sprintf("%s/%s", config.Config.Path, dbName))
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+	t_db, err = InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "new", t_db.Get("Key: 0042"))
+}
+
+func Test_Replication(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	dbName := fmt.Sprintf("primaryDb%d", time.Now().UnixNano())
+	options := DefaultOptions()
+	options.ReplicationLogSize = 100
+	primary, err := InitDbWithOptions(dbName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Cleanup()
+	followerOptions := DefaultOptions()
+	followerOptions.ReadOnly = true
+	follower, err := InitDbWithOptions(fmt.Sprintf("followerDb%d", time.Now().UnixNano()), followerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Cleanup()
+
+	// every write batch takes the next sequence
+	assert.Equal(t, uint64(0), primary.LastSequence())
+	primary.Put("a", "1")
+	primary.Delete("a")
+	batch := NewWriteBatch()
+	batch.Put("b", "2")
+	batch.Put("c", "3")
+	assert.Nil(t, primary.Write(batch))
+	assert.Equal(t, uint64(3), primary.LastSequence())
+
+	subscription, err := primary.SubscribeReplication(1)
+	assert.Nil(t, err)
+	for sequence := uint64(1); sequence <= 3; sequence++ {
+		replicated, err := subscription.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, sequence, replicated.Sequence)
+		assert.Nil(t, follower.ApplyReplicatedBatch(replicated))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = subscription.Next(ctx)
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	subscription.Close()
+	assert.Equal(t, "", follower.Get("a"))
+	assert.Equal(t, "3", follower.Get("c"))
+
+	// a follower only takes batches in order and nothing else
+	assert.ErrorIs(t, follower.ApplyReplicatedBatch(ReplicatedBatch{Sequence: 5, Data: NewWriteBatch().Encode()}), CustomError.ErrSequenceGap)
+	assert.ErrorIs(t, follower.Write(batch), CustomError.ErrReadOnly)
+	assert.Equal(t, "", follower.Get("d"))
+
+	// batches the replication log dropped are read from the write ahead log
+	for i := 0; i < 1000; i++ {
+		primary.Put(fmt.Sprintf("Key: %04d", i), fmt.Sprintf("Value: %d", i))
+	}
+	subscription, err = primary.SubscribeReplication(4)
+	assert.Nil(t, err)
+	for sequence := uint64(4); sequence <= 6; sequence++ {
+		replicated, err := subscription.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, sequence, replicated.Sequence)
+		assert.Nil(t, follower.ApplyReplicatedBatch(replicated))
+	}
+	assert.Equal(t, "Value: 2", follower.Get("Key: 0002"))
+	subscription.Close()
+
+	// once the write ahead log dropped them as well, the follower takes a snapshot instead
+	primary.Options.WALRetentionSize = 0
+	primary.Flush()
+	primary.Put("d", "4")
+	primary.Flush()
+	_, err = primary.SubscribeReplication(4)
+	assert.ErrorIs(t, err, CustomError.ErrSequenceUnavailable)
+	_, err = primary.SubscribeReplication(primary.LastSequence() + 2)
+	assert.ErrorIs(t, err, CustomError.ErrSequenceUnavailable)
+
+	snapshot := primary.CreateReplicationSnapshot()
+	assert.Equal(t, primary.LastSequence(), snapshot.Sequence)
+	levels := make([][]string, len(snapshot.Levels))
+	for level, segments := range snapshot.Levels {
+		for _, segment := range segments {
+			levels[level] = append(levels[level], snapshot.SegmentPath(segment.SegmentId))
+		}
+	}
+	assert.Nil(t, follower.InstallSnapshot(snapshot.Sequence, levels))
+	snapshot.Release()
+	assert.Equal(t, snapshot.Sequence, follower.LastSequence())
+	assert.Equal(t, "Value: 42", follower.Get("Key: 0042"))
+	assert.Equal(t, "2", follower.Get("b"))
+
+	// sequences continue where they left off after a restart
+	primary.Put("last", "write")
+	sequence := primary.LastSequence()
+	primary.CloseDB()
+	primary, err = InitDbWithOptions(dbName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sequence, primary.LastSequence())
+	primary.Put("after", "restart")
+	assert.Equal(t, sequence+1, primary.LastSequence())
+}
+
+func Test_WriteAheadLog(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	dbName := fmt.Sprintf("walDb%d", time.Now().UnixNano())
+	// every batch comes from the write ahead log
+	options := DefaultOptions()
+	options.ReplicationLogSize = 0
+	d, err := InitDbWithOptions(dbName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { d.Cleanup() }()
+
+	d.Put("a", "1")
+	batch := NewWriteBatch()
+	batch.Put("b", "2")
+	batch.Delete("a")
+	assert.Nil(t, d.Write(batch))
+	d.PutWithTTL("c", "3", time.Hour)
+	subscription, err := d.SubscribeReplication(1)
+	assert.Nil(t, err)
+	for sequence := uint64(1); sequence <= 3; sequence++ {
+		replicated, err := subscription.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, sequence, replicated.Sequence)
+	}
+	// a subscriber giving up while it reads from the write ahead log closes the file with the subscription
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = subscription.Next(ctx)
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotNil(t, subscription.wal.file)
+	subscription.Close()
+	assert.Nil(t, subscription.wal.file, "Close left the log file open")
+
+	// crash without flushing the memtable and leave a torn record behind
+	d.wal.close()
+	d.ManifestFile.Close()
+	walDir := fmt.Sprintf("%s/%s/%s", config.Config.Path, dbName, WAL_DIR_NAME)
+	entries, err := os.ReadDir(walDir)
+	assert.Nil(t, err)
+	f, err := os.OpenFile(fmt.Sprintf("%s/%s", walDir, entries[len(entries)-1].Name()), os.O_WRONLY|os.O_APPEND, 0666)
+	assert.Nil(t, err)
+	_, err = f.Write(encodeWALRecord(walRecord{sequence: 4, recordType: WAL_RECORD_BATCH, data: []byte("torn")})[:10])
+	assert.Nil(t, err)
+	f.Close()
+
+	d, err = InitDbWithOptions(dbName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(3), d.LastSequence())
+	assert.Equal(t, "", d.Get("a"))
+	assert.Equal(t, "2", d.Get("b"))
+	assert.Equal(t, "3", d.Get("c"))
+	ttl, exists := d.TTL("c")
+	assert.True(t, exists)
+	assert.True(t, ttl > 0, "Replayed value lost its ttl")
+
+	// writes go on after the torn record and survive the next crash as well
+	d.Put("d", "4")
+	d.wal.close()
+	d.ManifestFile.Close()
+	d, err = InitDbWithOptions(dbName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(4), d.LastSequence())
+	assert.Equal(t, "4", d.Get("d"))
+	subscription, err = d.SubscribeReplication(1)
+	assert.Nil(t, err)
+	for sequence := uint64(1); sequence <= 4; sequence++ {
+		replicated, err := subscription.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, sequence, replicated.Sequence)
+	}
+	subscription.Close()
+
+	// batches before an ingestion can't be streamed past it
+	segmentPath := fmt.Sprintf("%s/walIngest%d.seg", config.Config.Path, time.Now().UnixNano())
+	writeExternalSegment(t, segmentPath, []string{"e"}, "5")
+	defer os.Remove(segmentPath)
+	_, err = d.IngestSegments([]string{segmentPath})
+	assert.Nil(t, err)
+	d.Put("f", "6")
+	subscription, err = d.SubscribeReplication(4)
+	assert.Nil(t, err)
+	replicated, err := subscription.Next(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), replicated.Sequence)
+	_, err = subscription.Next(context.Background())
+	assert.ErrorIs(t, err, CustomError.ErrSequenceUnavailable)
+	subscription.Close()
+
+	// the ingestion's sequence is replayed without a batch
+	d.wal.close()
+	d.ManifestFile.Close()
+	d, err = InitDbWithOptions(dbName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(6), d.LastSequence())
+	assert.Equal(t, "5", d.Get("e"))
+	assert.Equal(t, "6", d.Get("f"))
+}
+
+func Test_ChangeFeed(t *testing.T) {
+	d, err := InitDbWithOptions(fmt.Sprintf("changeFeedDb%d", time.Now().UnixNano()), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { d.Cleanup() }()
+
+	d.Put("other", "x")
+	from := d.LastSequence() + 1
+	d.Put("user:1", "harry")
+	batch := NewWriteBatch()
+	batch.Put("user:2", "ron")
+	batch.Put("other", "y")
+	batch.Delete("user:1")
+	assert.Nil(t, d.Write(batch))
+
+	subscription, err := d.Subscribe("user:", from)
+	assert.Nil(t, err)
+	expected := []ChangeEvent{
+		{Sequence: from, Key: "user:1", Value: "harry"},
+		{Sequence: from + 1, Key: "user:2", Value: "ron"},
+		{Sequence: from + 1, Key: "user:1", Deleted: true},
+	}
+	for _, event := range expected {
+		got, err := subscription.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, event, got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = subscription.Next(ctx)
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	subscription.Close()
+
+	// resuming from the sequence after the last one handled
+	subscription, err = d.Subscribe("", from+1)
+	assert.Nil(t, err)
+	event, err := subscription.Next(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, ChangeEvent{Sequence: from + 1, Key: "user:2", Value: "ron"}, event)
+	subscription.Close()
+
+	// watching a key only wakes up for that key
+	watched := make(chan ChangeEvent)
+	go func() {
+		event, err := d.WatchKey(context.Background(), "user:3", 0)
+		assert.Nil(t, err)
+		watched <- event
+	}()
+	assert.Eventually(t, func() bool {
+		d.Put("user:30", "not this one")
+		d.Put("user:3", "hermione")
+		select {
+		case event := <-watched:
+			return event.Key == "user:3" && event.Value == "hermione"
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, time.Second, 20*time.Millisecond)
+
+	// subscribers resume after a restart, the batches are read from the write ahead log
+	d.CloseDB()
+	d, err = InitDbWithOptions(d.Manifest.DbName, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ron", d.Get("user:2"))
+	subscription, err = d.Subscribe("user:", from)
+	assert.Nil(t, err)
+	for _, event := range expected {
+		got, err := subscription.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, event, got)
+	}
+	subscription.Close()
+
+	// nothing to resume from once the write ahead log dropped the batches
+	d.Options.WALRetentionSize = 0
+	d.Put("user:4", "neville")
+	d.Flush()
+	d.Put("user:5", "luna")
+	d.Flush()
+	_, err = d.Subscribe("", from)
+	assert.ErrorIs(t, err, CustomError.ErrSequenceUnavailable)
+}
+
+func Test_TTL(t *testing.T) {
+	dbName := fmt.Sprintf("ttlDb%d", time.Now().UnixNano())
+	d, err := InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { d.Cleanup() }()
+
+	// an expired value hides the older value of the key in a segment
+	d.Put("session", "old")
+	d.Put("permanent", "value")
+	d.Flush()
+	d.PutWithTTL("session", "token", 100*time.Millisecond)
+	batch := NewWriteBatch()
+	batch.PutWithTTL("counter", "1", time.Hour)
+	assert.Nil(t, d.Write(batch))
+
+	assert.Equal(t, "token", d.Get("session"))
+	ttl, ok := d.TTL("session")
+	assert.True(t, ok)
+	assert.True(t, ttl > 0 && ttl <= 100*time.Millisecond, "unexpected ttl %v", ttl)
+	ttl, ok = d.TTL("permanent")
+	assert.True(t, ok)
+	assert.Equal(t, NO_EXPIRY, ttl)
+	_, ok = d.TTL("missing")
+	assert.False(t, ok)
+
+	// expiries survive flushes and restarts
+	d.Flush()
+	d.CloseDB()
+	d, err = InitDb(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl, ok = d.TTL("counter")
+	assert.True(t, ok)
+	assert.Greater(t, ttl, 59*time.Minute)
+
+	time.Sleep(150 * time.Millisecond)
+	_, ok = d.Lookup("session")
+	assert.False(t, ok)
+	_, ok = d.TTL("session")
+	assert.False(t, ok)
+	var keys []string
+	assert.Nil(t, d.Scan("", "", func(key string, value string) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	assert.Equal(t, []string{"counter", "permanent"}, keys)
+
+	// compactions drop expired values for good
+	_, err = d.CompactAll()
+	assert.Nil(t, err)
+	assert.Equal(t, "", d.Get("session"))
+	report, err := InspectDb(fmt.Sprintf("%s/%s", config.Config.Path, dbName))
+	assert.Nil(t, err)
+	for segmentId := range report.Segments {
+		assert.Nil(t, ReadSegmentFile(d.segmentFilePath(segmentId), func(record format.Record) error {
+			assert.NotEqual(t, "session", record.Key)
+			return nil
+		}))
+	}
+}
+
+func Test_ConditionalWrites(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	d, err := InitDb(fmt.Sprintf("conditionalDb%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Cleanup()
+
+	ok, err := d.PutIfAbsent("harry", "potter")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = d.PutIfAbsent("harry", "styles")
+	assert.False(t, ok)
+	ok, _ = d.CompareAndSwap("ron", "", "weasley")
+	assert.False(t, ok, "Missing key matched")
+	assert.Equal(t, "", d.Get("ron"))
+
+	// conditions see values which made it to the segments
+	d.Flush()
+	ok, _ = d.CompareAndSwap("harry", "styles", "granger")
+	assert.False(t, ok)
+	ok, _ = d.CompareAndSwap("harry", "potter", "james")
+	assert.True(t, ok)
+	assert.Equal(t, "james", d.Get("harry"))
+	ok, _ = d.DeleteIfEquals("harry", "potter")
+	assert.False(t, ok)
+	ok, _ = d.DeleteIfEquals("harry", "james")
+	assert.True(t, ok)
+	ok, _ = d.PutIfAbsent("harry", "again")
+	assert.True(t, ok, "Deleted key isn't absent")
+
+	// each existing key counts once
+	d.Put("hermione", "granger")
+	deleted, err := d.DeleteExisting("harry", "hermione", "harry", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.Equal(t, "", d.Get("hermione"))
+	deleted, _ = d.DeleteExisting("harry", "hermione")
+	assert.Equal(t, 0, deleted)
+
+	// racing increments, none of them is lost
+	var wg sync.WaitGroup
+	d.Put("counter", "0")
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				for {
+					current := d.Get("counter")
+					n, _ := strconv.Atoi(current)
+					ok, err := d.CompareAndSwap("counter", current, strconv.Itoa(n+1))
+					assert.Nil(t, err)
+					if ok {
+						break
+					}
+				}
+				// something to flush now and then
+				d.Put(fmt.Sprintf("filler:%d", rand.Int()%500), utils.GetRandomString(20))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "400", d.Get("counter"))
+
+	// versions see a value changed and changed back
+	put := func(key string, value string) uint64 {
+		batch := NewWriteBatch()
+		batch.Put(key, value)
+		assert.Nil(t, d.Write(batch))
+		current, ok := d.LookupVersion(key)
+		assert.True(t, ok)
+		assert.Equal(t, value, current.Value)
+		return current.Version
+	}
+	first := put("aba", "a")
+	second := put("aba", "b")
+	assert.Greater(t, second, first)
+	batch := NewWriteBatch()
+	batch.Put("aba", "a")
+	ok, err = d.WriteIfVersion("aba", second, batch)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = d.WriteIfVersion("aba", first, batch)
+	assert.False(t, ok, "Value changed and changed back went unnoticed")
+
+	// a version read from a segment is still good, and still changes with the next write
+	d.Flush()
+	d.CompactAll()
+	current, _ := d.LookupVersion("aba")
+	assert.Greater(t, current.Version, second)
+	ok, _ = d.WriteIfVersion("aba", current.Version, batch)
+	assert.True(t, ok)
+	after, _ := d.LookupVersion("aba")
+	assert.Greater(t, after.Version, current.Version)
+
+	// version 0 is a missing key
+	_, ok = d.LookupVersion("missing")
+	assert.False(t, ok)
+	batch = NewWriteBatch()
+	batch.Put("missing", "there")
+	ok, _ = d.WriteIfVersion("missing", 0, batch)
+	assert.True(t, ok)
+	ok, _ = d.WriteIfVersion("missing", 0, batch)
+	assert.False(t, ok)
+	expiring := NewWriteBatch()
+	expiring.PutWithTTL("expiring", "value", time.Hour)
+	assert.Nil(t, d.Write(expiring))
+	current, _ = d.LookupVersion("expiring")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), current.ExpiresAt, time.Minute)
+}
+
+func Test_Transactions(t *testing.T) {
+	config.Config.MemtableSizeLimit = 4 * 1024
+	options := DefaultOptions()
+	options.ReplicationLogSize = 100
+	d, err := InitDbWithOptions(fmt.Sprintf("txnDb%d", time.Now().UnixNano()), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Cleanup()
+	d.Put("a", "1")
+	d.Put("b", "2")
+	d.Put("c", "3")
+
+	// reads see the transaction's own writes, nothing is visible outside before the commit
+	txn := d.Begin()
+	txn.Put("a", "10")
+	txn.Delete("b")
+	txn.Put("d", "4")
+	assert.Equal(t, "10", txn.Get("a"))
+	_, ok := txn.Lookup("b")
+	assert.False(t, ok)
+	assert.Equal(t, "2", d.Get("b"))
+	var keys []string
+	it := txn.Iterator("", "c")
+	for it.Next() {
+		keys = append(keys, it.Key()+"="+it.Value())
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, []string{"a=10", "c=3"}, keys)
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, "10", d.Get("a"))
+	assert.Equal(t, "", d.Get("b"))
+	assert.Equal(t, "4", d.Get("d"))
+	assert.ErrorIs(t, txn.Commit(), CustomError.ErrTxnClosed)
+
+	// a key read by the transaction changed
+	txn = d.Begin()
+	txn.Put("c", txn.Get("a")+"!")
+	d.Put("a", "11")
+	assert.ErrorIs(t, txn.Commit(), CustomError.ErrConflict)
+	assert.Equal(t, "3", d.Get("c"))
+
+	// blind writes don't conflict, neither do writes of keys nobody read
+	txn = d.Begin()
+	txn.Get("c")
+	txn.Put("a", "12")
+	d.Put("a", "13")
+	d.Put("e", "5")
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, "12", d.Get("a"))
+
+	// a key showing up in an iterated range
+	txn = d.Begin()
+	for it := txn.Iterator("f", "h"); it.Next(); {
+	}
+	d.Put("g", "7")
+	txn.Put("f", "6")
+	assert.ErrorIs(t, txn.Commit(), CustomError.ErrConflict)
+
+	// the replication log keeps the last 100 batches, the ones before are checked in the write ahead log
+	for _, writes := range []int{options.ReplicationLogSize, options.ReplicationLogSize + 1, 200} {
+		txn = d.Begin()
+		txn.Get("a")
+		txn.Put("c", "14")
+		for i := 0; i < writes; i++ {
+			d.Put(fmt.Sprintf("filler:%03d", i), "x")
+		}
+		assert.Nil(t, txn.Commit(), "%d writes since Begin conflicted", writes)
+
+		txn = d.Begin()
+		txn.Get("a")
+		txn.Put("c", "15")
+		d.Put("a", "14")
+		for i := 1; i < writes; i++ {
+			d.Put(fmt.Sprintf("filler:%03d", i), "x")
+		}
+		assert.ErrorIs(t, txn.Commit(), CustomError.ErrConflict, "Write of a read key missed after %d writes", writes)
+	}
+
+	// no telling once the write ahead log deleted the batches as well
+	d.Options.WALRetentionSize = 0
+	txn = d.Begin()
+	txn.Get("a")
+	for i := 0; i < 200; i++ {
+		d.Put(fmt.Sprintf("filler:%03d", i), "y")
+	}
+	d.Flush()
+	d.Put("filler:200", "y")
+	d.Flush()
+	assert.ErrorIs(t, txn.Commit(), CustomError.ErrConflict)
+	d.Options.WALRetentionSize = DEFAULT_WAL_RETENTION_SIZE
+
+	// nor past an ingestion
+	segmentPath := fmt.Sprintf("%s/txnIngest%d.seg", config.Config.Path, time.Now().UnixNano())
+	writeExternalSegment(t, segmentPath, []string{"ingested"}, "x")
+	defer os.Remove(segmentPath)
+	txn = d.Begin()
+	txn.Get("a")
+	_, err = d.IngestSegments([]string{segmentPath})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, txn.Commit(), CustomError.ErrConflict)
+
+	// with a replication log of size 0 every batch comes from the write ahead log
+	noLogOptions := DefaultOptions()
+	noLogOptions.ReplicationLogSize = 0
+	noLog, err := InitDbWithOptions(fmt.Sprintf("txnNoLogDb%d", time.Now().UnixNano()), noLogOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noLog.Cleanup()
+	noLog.Put("a", "1")
+	txn = noLog.Begin()
+	txn.Get("a")
+	txn.Put("b", "1")
+	assert.Nil(t, txn.Commit())
+	txn = noLog.Begin()
+	txn.Get("a")
+	noLog.Put("c", "1")
+	txn.Put("b", "2")
+	assert.Nil(t, txn.Commit())
+	txn = noLog.Begin()
+	txn.Get("a")
+	noLog.Put("a", "2")
+	txn.Put("b", "3")
+	assert.ErrorIs(t, txn.Commit(), CustomError.ErrConflict)
+	assert.Equal(t, "2", noLog.Get("b"))
+
+	// racing transfers keep the total
+	for i := 0; i < 5; i++ {
+		d.Put(fmt.Sprintf("account:%d", i), "100")
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				from, to := fmt.Sprintf("account:%d", (w+i)%5), fmt.Sprintf("account:%d", (w+i+1)%5)
+				for {
+					txn := d.Begin()
+					fromBalance, _ := strconv.Atoi(txn.Get(from))
+					toBalance, _ := strconv.Atoi(txn.Get(to))
+					txn.Put(from, strconv.Itoa(fromBalance-1))
+					txn.Put(to, strconv.Itoa(toBalance+1))
+					err := txn.Commit()
+					if err == nil {
+						break
+					}
+					assert.ErrorIs(t, err, CustomError.ErrConflict)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	total := 0
+	assert.Nil(t, d.ScanPrefix("account:", func(key string, value string) bool {
+		balance, _ := strconv.Atoi(value)
+		total += balance
+		return true
+	}))
+	assert.Equal(t, 500, total)
+}
+
+func Test_MergeOperator(t *testing.T) {
+	// merges fail as a whole without an operator
+	plain, err := InitDb(fmt.Sprintf("plainDb%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Cleanup()
+	assert.ErrorIs(t, plain.Merge("counter", "1"), CustomError.ErrNoMergeOperator)
+	batch := NewWriteBatch()
+	batch.Put("key", "value")
+	batch.Merge("counter", "1")
+	assert.ErrorIs(t, plain.Write(batch), CustomError.ErrNoMergeOperator)
+	_, ok := plain.Lookup("key")
+	assert.False(t, ok)
+
+	dbName := fmt.Sprintf("mergeDb%d", time.Now().UnixNano())
+	options := DefaultOptions()
+	options.MergeOperator = merge_operator.NewUint64AddOperator()
+	d, err := InitDbWithOptions(dbName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { d.Cleanup() }()
+
+	subscription, err := d.Subscribe("counter", 0)
+	assert.Nil(t, err)
+	defer subscription.Close()
+
+	// operands end up spread over the memtable and several segments, reads apply them all
+	d.Put("total", "10")
+	d.Put("gone", "100")
+	d.Flush()
+	d.Delete("gone")
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, d.Merge("counter", "1"))
+	}
+	d.Flush()
+	assert.Nil(t, d.Merge("counter", "2"))
+	assert.Nil(t, d.Merge("total", "5"))
+	d.Flush()
+	assert.Nil(t, d.Merge("gone", "7"))
+	d.PutWithTTL("visits", "1", time.Hour)
+	assert.Nil(t, d.Merge("visits", "1"))
+
+	assert.Equal(t, "5", d.Get("counter"))
+	assert.Equal(t, "15", d.Get("total"))
+	assert.Equal(t, "7", d.Get("gone"))
+	assert.Equal(t, "2", d.Get("visits"))
+	ttl, ok := d.TTL("visits")
+	assert.True(t, ok)
+	assert.Greater(t, ttl, 59*time.Minute)
+
+	event, err := subscription.Next(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, ChangeEvent{Sequence: event.Sequence, Key: "counter", Value: "1", Merge: true}, event)
+
+	values := make(map[string]string)
+	assert.Nil(t, d.Scan("", "", func(key string, value string) bool {
+		values[key] = value
+		return true
+	}))
+	assert.Equal(t, map[string]string{"counter": "5", "gone": "7", "total": "15", "visits": "2"}, values)
+
+	// concurrent merges don't lose increments, and reads racing with flushes never count one twice
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				assert.Nil(t, d.Merge("hits", "1"))
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			d.Flush()
+		}
+	}()
+	last := 0
+	for i := 0; i < 200; i++ {
+		hits, _ := strconv.Atoi(d.Get("hits"))
+		assert.GreaterOrEqual(t, hits, last)
+		assert.LessOrEqual(t, hits, 800)
+		last = hits
+	}
+	wg.Wait()
+	<-done
+	assert.Equal(t, "800", d.Get("hits"))
+
+	// compactions fold the operands into values, which survive a restart
+	d.Flush()
+	_, err = d.CompactAll()
+	assert.Nil(t, err)
+	d.CloseDB()
+	d, err = InitDbWithOptions(dbName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "5", d.Get("counter"))
+	assert.Equal(t, "15", d.Get("total"))
+	assert.Equal(t, "7", d.Get("gone"))
+	assert.Equal(t, "800", d.Get("hits"))
+	report, err := InspectDb(fmt.Sprintf("%s/%s", config.Config.Path, dbName))
+	assert.Nil(t, err)
+	for segmentId := range report.Segments {
+		assert.Nil(t, ReadSegmentFile(d.segmentFilePath(segmentId), func(record format.Record) error {
+			assert.NotEqual(t, format.RECORD_KIND_MERGE_OPERAND, record.Kind, record.Key)
+			return nil
+		}))
+	}
+}
+
 func TestMain(m *testing.M) {
 	setupTests(&testing.T{})
 	exit := m.Run()
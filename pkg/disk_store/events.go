@@ -0,0 +1,181 @@
+package disk_store
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	- listeners get called synchronously from the goroutine doing the work (flush goroutine, compaction workers,
+	  the writer when it stalls), so they should return quickly and must not wait for flushes or compactions
+	- they are never called while the manifest is locked, so calling back into the db (like Stats) is fine
+*/
+
+type FlushJobInfo struct {
+	DbName       string
+	SegmentId    uint32
+	Cardinality  uint32 // set once the flush is completed
+	BytesWritten uint64 // set once the flush is completed
+	Duration     time.Duration
+	Err          error // nil if the flush succeeded
+}
+
+type CompactionJobInfo struct {
+	DbName         string
+	InputLevel     uint32
+	OutputLevel    uint32
+	InputSegments  []uint32 // segment of the input level followed by all the segments of the output level
+	OutputSegments []uint32 // set once the compaction is completed
+	BytesRead      uint64
+	BytesWritten   uint64
+	Duration       time.Duration
+	Err            error // nil if the compaction succeeded, the db is left as it was before the compaction otherwise
+}
+
+type SegmentInfo struct {
+	DbName    string
+	SegmentId uint32
+	Level     uint32
+	Size      uint64
+}
+
+type StallCondition int
+
+const (
+	STALL_CONDITION_NORMAL  StallCondition = iota
+	STALL_CONDITION_STOPPED                // level 0 has LEVEL0_STOP_WRITES_TRIGGER segments, writes wait for compactions
+)
+
+func (s StallCondition) String() string {
+	switch s {
+	case STALL_CONDITION_NORMAL:
+		return "normal"
+	case STALL_CONDITION_STOPPED:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+type StallConditionInfo struct {
+	DbName   string
+	Previous StallCondition
+	Current  StallCondition
+}
+
+type BackgroundErrorReason int
+
+const (
+	BACKGROUND_ERROR_FLUSH BackgroundErrorReason = iota
+	BACKGROUND_ERROR_COMPACTION
+)
+
+func (r BackgroundErrorReason) String() string {
+	switch r {
+	case BACKGROUND_ERROR_FLUSH:
+		return "flush"
+	case BACKGROUND_ERROR_COMPACTION:
+		return "compaction"
+	}
+	return "unknown"
+}
+
+type EventListener interface {
+	OnFlushBegin(info FlushJobInfo)
+	OnFlushCompleted(info FlushJobInfo)
+	OnCompactionBegin(info CompactionJobInfo)
+	OnCompactionCompleted(info CompactionJobInfo)
+	OnSegmentCreated(info SegmentInfo)
+	OnSegmentDeleted(info SegmentInfo)
+	OnStallConditionChanged(info StallConditionInfo)
+	OnBackgroundError(reason BackgroundErrorReason, err error)
+}
+
+// implements every callback as a no-op, embed it to only implement the callbacks you need
+type NoopEventListener struct{}
+
+func (NoopEventListener) OnFlushBegin(info FlushJobInfo)                            {}
+func (NoopEventListener) OnFlushCompleted(info FlushJobInfo)                        {}
+func (NoopEventListener) OnCompactionBegin(info CompactionJobInfo)                  {}
+func (NoopEventListener) OnCompactionCompleted(info CompactionJobInfo)              {}
+func (NoopEventListener) OnSegmentCreated(info SegmentInfo)                         {}
+func (NoopEventListener) OnSegmentDeleted(info SegmentInfo)                         {}
+func (NoopEventListener) OnStallConditionChanged(info StallConditionInfo)           {}
+func (NoopEventListener) OnBackgroundError(reason BackgroundErrorReason, err error) {}
+
+// fans events out to the listeners of the db and keeps the state needed to only report changes
+type eventNotifier struct {
+	listeners      []EventListener
+	stallCondition StallCondition
+	Mu             *sync.Mutex
+}
+
+func newEventNotifier(listeners []EventListener) *eventNotifier {
+	return &eventNotifier{
+		listeners: listeners,
+		Mu:        &sync.Mutex{},
+	}
+}
+
+func (e *eventNotifier) flushBegin(info FlushJobInfo) {
+	for _, listener := range e.listeners {
+		listener.OnFlushBegin(info)
+	}
+}
+
+func (e *eventNotifier) flushCompleted(info FlushJobInfo) {
+	for _, listener := range e.listeners {
+		listener.OnFlushCompleted(info)
+	}
+}
+
+func (e *eventNotifier) compactionBegin(info CompactionJobInfo) {
+	for _, listener := range e.listeners {
+		listener.OnCompactionBegin(info)
+	}
+}
+
+func (e *eventNotifier) compactionCompleted(info CompactionJobInfo) {
+	for _, listener := range e.listeners {
+		listener.OnCompactionCompleted(info)
+	}
+}
+
+func (e *eventNotifier) segmentCreated(info SegmentInfo) {
+	for _, listener := range e.listeners {
+		listener.OnSegmentCreated(info)
+	}
+}
+
+func (e *eventNotifier) segmentDeleted(info SegmentInfo) {
+	for _, listener := range e.listeners {
+		listener.OnSegmentDeleted(info)
+	}
+}
+
+// notifies the listeners only if the condition is different from the last one
+func (e *eventNotifier) stallConditionChanged(dbName string, condition StallCondition) {
+	e.Mu.Lock()
+	previous := e.stallCondition
+	e.stallCondition = condition
+	e.Mu.Unlock()
+	if previous == condition {
+		return
+	}
+	for _, listener := range e.listeners {
+		listener.OnStallConditionChanged(StallConditionInfo{DbName: dbName, Previous: previous, Current: condition})
+	}
+}
+
+func (e *eventNotifier) backgroundError(reason BackgroundErrorReason, err error) {
+	for _, listener := range e.listeners {
+		listener.OnBackgroundError(reason, err)
+	}
+}
+
+func segmentIds(segments []SegmentMetadata) []uint32 {
+	ids := make([]uint32, 0, len(segments))
+	for _, segment := range segments {
+		ids = append(ids, segment.SegmentId)
+	}
+	return ids
+}
@@ -0,0 +1,248 @@
+package disk_store
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+/*
+	- one record per live key: {"key": ..., "value": ...} per line for json lines, key,value,encoding rows after a
+	  header for csv
+	- json and csv can only carry text, so when the key or the value is not valid utf-8 both are base64 encoded and
+	  encoding is "base64"
+	- export streams an Iterator, it sees the db as it was when it started and holds at most one record in memory
+	  besides the buffered output and the memtable copy of the iterator
+*/
+
+type ExportFormat int
+
+const (
+	EXPORT_FORMAT_JSON_LINES ExportFormat = iota
+	EXPORT_FORMAT_CSV
+)
+
+const (
+	ENCODING_BASE64           = "base64"
+	DEFAULT_IMPORT_BATCH_SIZE = 1000
+)
+
+var csvHeader = []string{"key", "value", "encoding"}
+
+// returns the format for "jsonl" (or "json") and "csv"
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch name {
+	case "jsonl", "json":
+		return EXPORT_FORMAT_JSON_LINES, nil
+	case "csv":
+		return EXPORT_FORMAT_CSV, nil
+	}
+	return 0, fmt.Errorf("unknown export format %q", name)
+}
+
+type exportRecord struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func newExportRecord(key string, value string) exportRecord {
+	if utf8.ValidString(key) && utf8.ValidString(value) {
+		return exportRecord{Key: key, Value: value}
+	}
+	return exportRecord{
+		Key:      base64.StdEncoding.EncodeToString([]byte(key)),
+		Value:    base64.StdEncoding.EncodeToString([]byte(value)),
+		Encoding: ENCODING_BASE64,
+	}
+}
+
+// returns the raw key and value of the record
+func (r exportRecord) decode() (string, string, error) {
+	switch r.Encoding {
+	case "":
+		return r.Key, r.Value, nil
+	case ENCODING_BASE64:
+		key, err := base64.StdEncoding.DecodeString(r.Key)
+		if err != nil {
+			return "", "", err
+		}
+		value, err := base64.StdEncoding.DecodeString(r.Value)
+		if err != nil {
+			return "", "", err
+		}
+		return string(key), string(value), nil
+	}
+	return "", "", fmt.Errorf("unknown encoding %q", r.Encoding)
+}
+
+// Writes every live key and its value to w in the given format, sorted by key. Returns the number of keys written
+func (d *DiskStore) Export(w io.Writer, format ExportFormat) (uint64, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "Export",
+	})
+	l.Infoln("Attempting to export the db")
+
+	bw := bufio.NewWriter(w)
+	var write func(record exportRecord) error
+	switch format {
+	case EXPORT_FORMAT_JSON_LINES:
+		encoder := json.NewEncoder(bw)
+		encoder.SetEscapeHTML(false)
+		write = func(record exportRecord) error {
+			return encoder.Encode(record)
+		}
+	case EXPORT_FORMAT_CSV:
+		csvWriter := csv.NewWriter(bw)
+		if err := csvWriter.Write(csvHeader); err != nil {
+			return 0, err
+		}
+		write = func(record exportRecord) error {
+			if err := csvWriter.Write([]string{record.Key, record.Value, record.Encoding}); err != nil {
+				return err
+			}
+			// csv.Writer buffers on its own, flushing it into bw every record costs next to nothing
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %d", format)
+	}
+
+	it := d.NewIterator("", "")
+	defer it.Close()
+	var exported uint64
+	var err error
+	for err == nil && it.Next() {
+		if err = write(newExportRecord(it.Key(), it.Value())); err == nil {
+			exported++
+		}
+	}
+	if err == nil {
+		err = it.Err()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		l.Errorln(err)
+		return exported, err
+	}
+	l.Infof("Exported %d keys", exported)
+	return exported, nil
+}
+
+type ImportOptions struct {
+	BatchSize int                   // records per write batch, DEFAULT_IMPORT_BATCH_SIZE if 0
+	Progress  func(imported uint64) // called after every batch with the number of records imported so far, optional
+}
+
+// Puts every record read from r, written by Export in the same format, through write batches. Returns the number of
+// records imported, the records before a malformed one stay imported
+func (d *DiskStore) Import(r io.Reader, format ExportFormat, options ImportOptions) (uint64, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "Import",
+	})
+	l.Infoln("Attempting to import into the db")
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = DEFAULT_IMPORT_BATCH_SIZE
+	}
+
+	var read func() (exportRecord, error) // returns io.EOF after the last record
+	line := 0
+	switch format {
+	case EXPORT_FORMAT_JSON_LINES:
+		decoder := json.NewDecoder(bufio.NewReader(r))
+		decoder.DisallowUnknownFields()
+		read = func() (exportRecord, error) {
+			var record exportRecord
+			line++
+			err := decoder.Decode(&record)
+			return record, err
+		}
+	case EXPORT_FORMAT_CSV:
+		csvReader := csv.NewReader(bufio.NewReader(r))
+		csvReader.FieldsPerRecord = len(csvHeader)
+		csvReader.ReuseRecord = true
+		header, err := csvReader.Read()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if header[0] != csvHeader[0] || header[1] != csvHeader[1] || header[2] != csvHeader[2] {
+			return 0, fmt.Errorf("csv header has to be %v, got %v", csvHeader, header)
+		}
+		line++
+		read = func() (exportRecord, error) {
+			line++
+			row, err := csvReader.Read()
+			if err != nil {
+				return exportRecord{}, err
+			}
+			return exportRecord{Key: row[0], Value: row[1], Encoding: row[2]}, nil
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %d", format)
+	}
+
+	var imported uint64
+	batch := NewWriteBatch()
+	writeBatch := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		if err := d.Write(batch); err != nil {
+			return err
+		}
+		imported += uint64(batch.Len())
+		batch.Clear()
+		if options.Progress != nil {
+			options.Progress(imported)
+		}
+		return nil
+	}
+
+	for {
+		record, err := read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			var key, value string
+			key, value, err = record.decode()
+			if err == nil {
+				batch.Put(key, value)
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("line %d: %v", line, err)
+			if batchErr := writeBatch(); batchErr != nil {
+				err = batchErr
+			}
+			l.Errorln(err)
+			return imported, err
+		}
+		if batch.Len() >= options.BatchSize {
+			if err := writeBatch(); err != nil {
+				l.Errorln(err)
+				return imported, err
+			}
+		}
+	}
+	if err := writeBatch(); err != nil {
+		l.Errorln(err)
+		return imported, err
+	}
+	l.Infof("Imported %d records", imported)
+	return imported, nil
+}
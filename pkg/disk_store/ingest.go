@@ -0,0 +1,192 @@
+package disk_store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/utils"
+)
+
+/*
+	- ingested segments are built outside the db with format.SegmentWriter and skip the memtable and compaction
+	- ingested data is newer than anything in the db, so a segment can only go below level 0 if no level above it
+	  (memtable included) holds keys of its range. It goes to the deepest such level, where it must not overlap the
+	  segments of that level either
+	- ingested segments overlapping each other all go to level 0, later paths win on duplicate keys
+	- the files are hard linked into the db (copied across filesystems), they must not be changed afterwards
+	- ingestion takes up a sequence number, which becomes the last sequence of the ingested segments, but doesn't go
+	  through the replication log. Followers have to take a snapshot to get ingested data
+*/
+
+// where an ingested segment file ended up
+type IngestedSegment struct {
+	Path      string
+	SegmentId uint32
+	Level     uint32
+}
+
+// Validates the segment files, links them into the db under new segment ids and publishes all of them with a single
+// manifest edit. Nothing is ingested if any of the files isn't a valid segment
+func (d *DiskStore) IngestSegments(paths []string) ([]IngestedSegment, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":      "IngestSegments",
+		"param_paths": paths,
+	})
+	l.Infoln("Attempting to ingest segments")
+	if d.Options.ReadOnly {
+		return nil, CustomError.ErrReadOnly
+	}
+
+	segments := make([]SegmentMetadata, len(paths))
+	for i, path := range paths {
+		report, err := InspectSegmentFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(report.Problems) > 0 {
+			return nil, fmt.Errorf("%s is not a valid segment: %s", path, report.Problems[0])
+		}
+		if report.Records == 0 {
+			return nil, fmt.Errorf("%s has no records", path)
+		}
+		segments[i] = SegmentMetadata{
+			Cardinality: report.Records,
+			SmallestKey: report.SmallestKey,
+			LargestKey:  report.LargestKey,
+			Size:        report.FileSize,
+			Mu:          &sync.Mutex{},
+		}
+	}
+
+	// writes wait till the ingestion is done, newer values of the keys must not end up below the ingested ones
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	// a flush still running would put its older segment on top of the ingested ones
+	d.WaitForAuxillaryMemtableFlush()
+	for _, segment := range segments {
+		if d.memtableOverlaps(segment.SmallestKey, segment.LargestKey) {
+			d.flushLocked()
+			break
+		}
+	}
+	// the auxillary memtable is on disk by now, but reads look at it before the segments and it would hide ingested keys
+	d.memtablesMu.Lock()
+	d.AuxillaryMemtable = nil
+	d.memtablesMu.Unlock()
+
+	sequence := d.LastSequence() + 1
+	for i, path := range paths {
+		segments[i].SegmentId = d.GetNewSegmentId()
+		segments[i].LastSequence = sequence
+		if err := utils.LinkOrCopyFile(path, d.segmentFilePath(segments[i].SegmentId)); err != nil {
+			d.deleteSegmentFiles(segments[:i])
+			l.Errorln(err)
+			return nil, err
+		}
+	}
+	if err := utils.SyncDir(d.dirPath()); err != nil {
+		d.deleteSegmentFiles(segments)
+		return nil, err
+	}
+
+	ingested, err := d.publishIngestedSegments(paths, segments)
+	if err != nil {
+		d.deleteSegmentFiles(segments)
+		l.Errorln(err)
+		return nil, err
+	}
+	// the sequence has no batch, replay and subscribers must not wait for one
+	if err := d.wal.append(walRecord{sequence: sequence, recordType: WAL_RECORD_RESET}); err != nil {
+		l.Errorf("Error while appending to the write ahead log %v", err)
+	}
+	// the memtable goes on from the sequence, so that it's recorded in the manifest with the next flush
+	d.Memtable.LastSequence = sequence
+	d.replication.reset(sequence)
+	for i, segment := range ingested {
+		d.events.segmentCreated(SegmentInfo{DbName: d.Manifest.DbName, SegmentId: segment.SegmentId, Level: segment.Level, Size: segments[i].Size})
+	}
+	d.CompactionScheduler.MaybeScheduleCompaction()
+	l.Infof("Ingested %d segments", len(ingested))
+	return ingested, nil
+}
+
+// picks the level of every segment and commits them to the manifest
+func (d *DiskStore) publishIngestedSegments(paths []string, segments []SegmentMetadata) ([]IngestedSegment, error) {
+	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+
+	overlapEachOther := false
+	for i := range segments {
+		for j := i + 1; j < len(segments); j++ {
+			if segments[i].OverlapsRange(segments[j].SmallestKey, segments[j].LargestKey) {
+				overlapEachOther = true
+			}
+		}
+	}
+
+	d.addLevelsUpTo(0)
+	oldLevels := make([][]SegmentMetadata, len(d.Manifest.SegmentLevels))
+	for level := range d.Manifest.SegmentLevels {
+		oldLevels[level] = d.Manifest.SegmentLevels[level].Segments
+	}
+
+	ingested := make([]IngestedSegment, len(segments))
+	for i, segment := range segments {
+		level := uint32(0)
+		if !overlapEachOther {
+			level = d.deepestLevelWithoutOverlap(segment.SmallestKey, segment.LargestKey)
+		}
+		d.Manifest.SegmentLevels[level].Mu.Lock()
+		levelSegments := append([]SegmentMetadata{}, d.Manifest.SegmentLevels[level].Segments...)
+		if level == 0 {
+			levelSegments = append(levelSegments, segment)
+		} else {
+			// segments below level 0 are kept sorted by key
+			index := sort.Search(len(levelSegments), func(j int) bool {
+				return levelSegments[j].SmallestKey > segment.LargestKey
+			})
+			levelSegments = append(levelSegments[:index], append([]SegmentMetadata{segment}, levelSegments[index:]...)...)
+		}
+		d.Manifest.SegmentLevels[level].Segments = levelSegments
+		d.Manifest.SegmentLevels[level].Mu.Unlock()
+		ingested[i] = IngestedSegment{Path: paths[i], SegmentId: segment.SegmentId, Level: level}
+	}
+
+	if err := d.persistManifest(); err != nil {
+		for level := range oldLevels {
+			d.Manifest.SegmentLevels[level].Segments = oldLevels[level]
+		}
+		return nil, err
+	}
+	return ingested, nil
+}
+
+// returns the deepest level such that neither it nor any level above it has a segment overlapping [start, end], 0 if
+// level 0 overlaps. Caller must hold d.Manifest.Mu
+func (d *DiskStore) deepestLevelWithoutOverlap(start string, end string) uint32 {
+	deepest := uint32(0)
+	for level := range d.Manifest.SegmentLevels {
+		d.Manifest.SegmentLevels[level].Mu.Lock()
+		segments := d.Manifest.SegmentLevels[level].Segments
+		d.Manifest.SegmentLevels[level].Mu.Unlock()
+		for _, segment := range segments {
+			if segment.OverlapsRange(start, end) {
+				return deepest
+			}
+		}
+		deepest = uint32(level)
+	}
+	return deepest
+}
+
+// checks if the memtable has a key in [start, end]
+func (d *DiskStore) memtableOverlaps(start string, end string) bool {
+	if d.Memtable.Size() == 0 {
+		return false
+	}
+	smallestKey, largestKey := d.Memtable.KeyRange()
+	return smallestKey <= end && largestKey >= start
+}
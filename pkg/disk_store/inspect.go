@@ -0,0 +1,171 @@
+package disk_store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+)
+
+/*
+	- inspection works on the files only, the db must not be open (or at least not be writing) while it runs
+	- nothing is modified, problems are only reported
+*/
+
+// what was found in a segment file
+type SegmentFileReport struct {
+	SegmentId   uint32
+	FileSize    uint64
+	Records     uint32
+	Tombstones  uint32
+	SmallestKey string
+	LargestKey  string
+	Problems    []string // unsorted keys, corruption, ...
+}
+
+// what was found in a db directory
+type InspectionReport struct {
+	Manifest *Manifest
+	Segments map[uint32]SegmentFileReport // every segment file in the directory, referenced by the manifest or not
+	Problems []string                     // all the problems, the ones of the segments included
+}
+
+// returns every record of a segment file, stops at the first corrupted one
+func ReadSegmentFile(path string, fn func(record format.Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return format.ReadSegment(f, fn)
+}
+
+// reads a whole segment file and checks that its keys are sorted and unique
+func InspectSegmentFile(path string) (SegmentFileReport, error) {
+	var report SegmentFileReport
+	id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), SEGMENT_FILE_EXTENSION), 10, 32)
+	if err == nil {
+		report.SegmentId = uint32(id)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return report, err
+	}
+	report.FileSize = uint64(info.Size())
+
+	previousKey := ""
+	err = ReadSegmentFile(path, func(record format.Record) error {
+		if report.Records > 0 && record.Key <= previousKey {
+			report.Problems = append(report.Problems, fmt.Sprintf("key %q at offset %d is not after the previous key %q", record.Key, record.Offset, previousKey))
+		}
+		if report.Records == 0 || record.Key < report.SmallestKey {
+			report.SmallestKey = record.Key
+		}
+		if report.Records == 0 || record.Key > report.LargestKey {
+			report.LargestKey = record.Key
+		}
+		if record.Kind == format.RECORD_KIND_TOMBSTONE {
+			report.Tombstones++
+		}
+		report.Records++
+		previousKey = record.Key
+		return nil
+	})
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+	}
+	return report, nil
+}
+
+// reads the manifest and every segment file of the db directory and reports where they disagree
+func InspectDb(dirPath string) (*InspectionReport, error) {
+	manifest, err := readManifestFile(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &InspectionReport{
+		Manifest: manifest,
+		Segments: make(map[uint32]SegmentFileReport),
+	}
+	problem := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == MANIFEST_TEMP_FILE_NAME {
+			problem("leftover %s from an interrupted manifest write", MANIFEST_TEMP_FILE_NAME)
+		}
+		if !strings.HasSuffix(name, SEGMENT_FILE_EXTENSION) {
+			continue
+		}
+		segmentReport, err := InspectSegmentFile(filepath.Join(dirPath, name))
+		if err != nil {
+			return nil, err
+		}
+		report.Segments[segmentReport.SegmentId] = segmentReport
+		for _, segmentProblem := range segmentReport.Problems {
+			problem("segment %d: %s", segmentReport.SegmentId, segmentProblem)
+		}
+	}
+
+	if int(manifest.NumberOfLevels) != len(manifest.SegmentLevels) {
+		problem("manifest says there are %d levels but has %d", manifest.NumberOfLevels, len(manifest.SegmentLevels))
+	}
+
+	referenced := make(map[uint32]int) // segment id -> level
+	for level, segmentLevel := range manifest.SegmentLevels {
+		for i, segment := range segmentLevel.Segments {
+			if previousLevel, ok := referenced[segment.SegmentId]; ok {
+				problem("segment %d is referenced on level %d and on level %d", segment.SegmentId, previousLevel, level)
+			}
+			referenced[segment.SegmentId] = level
+
+			if segment.SegmentId > manifest.MaxSegmentId {
+				problem("segment %d is above MaxSegmentId %d", segment.SegmentId, manifest.MaxSegmentId)
+			}
+			// segments of level > 0 must be sorted by key and not overlap
+			if level > 0 && i > 0 && segment.SmallestKey != "" && segmentLevel.Segments[i-1].LargestKey >= segment.SmallestKey {
+				problem("segments %d and %d of level %d overlap", segmentLevel.Segments[i-1].SegmentId, segment.SegmentId, level)
+			}
+
+			file, ok := report.Segments[segment.SegmentId]
+			if !ok {
+				problem("segment %d of level %d has no file", segment.SegmentId, level)
+				continue
+			}
+			if segment.Size > 0 && segment.Size != file.FileSize {
+				problem("segment %d: manifest size %d, file size %d", segment.SegmentId, segment.Size, file.FileSize)
+			}
+			if segment.Cardinality != file.Records {
+				problem("segment %d: manifest cardinality %d, file has %d records", segment.SegmentId, segment.Cardinality, file.Records)
+			}
+			if (segment.SmallestKey != "" || segment.LargestKey != "") && (segment.SmallestKey != file.SmallestKey || segment.LargestKey != file.LargestKey) {
+				problem("segment %d: manifest key range [%q, %q], file key range [%q, %q]", segment.SegmentId, segment.SmallestKey, segment.LargestKey, file.SmallestKey, file.LargestKey)
+			}
+		}
+	}
+
+	var orphans []uint32
+	for segmentId := range report.Segments {
+		if _, ok := referenced[segmentId]; !ok {
+			orphans = append(orphans, segmentId)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i] < orphans[j] })
+	for _, segmentId := range orphans {
+		problem("segment file %d%s is not referenced by the manifest", segmentId, SEGMENT_FILE_EXTENSION)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,298 @@
+package disk_store
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	KeyEntry "github.com/abesheknarayan/go-caskdb/pkg/key_entry"
+	"github.com/abesheknarayan/go-caskdb/pkg/memtable"
+)
+
+/*
+	- an iterator reads a snapshot of the db: a copy of the memtable's entries in its range, the auxillary memtable
+	  (it takes no more writes) and the segments overlapping its range, pinned so that compactions can't delete their
+	  files before the iterator is closed
+	- the snapshot is taken under the manifest lock so that no flush publishes its segment in between, the lock is
+	  only held for taking it. Segments are read afterwards, flushes and compactions go on in the meantime
+	- segment files are sorted by key, so they are streamed and merged instead of loaded. Segments of a level below 0
+	  don't overlap, the whole level is one stream and a segment is only opened once the iterator gets to it
+	- for every key the newest entry wins, merge operands are applied to the entries below them
+*/
+
+// Iterates over the live keys of a range of the db in sorted order, as they were when the iterator was created. Must
+// be closed
+type Iterator struct {
+	d       *DiskStore
+	sources iteratorSourceHeap
+	now     int64
+	key     string
+	value   string
+	err     error
+	unpin   func()
+}
+
+// Returns an iterator over the live keys in [start, end], empty start or end means the range is unbounded on that side
+func (d *DiskStore) NewIterator(start string, end string) *Iterator {
+	inRange := func(key string) bool {
+		return (start == "" || key >= start) && (end == "" || key <= end)
+	}
+
+	d.Manifest.Mu.Lock()
+	mt, auxMt := d.unflushedMemtablesLocked()
+	// newest data first: the memtables, level 0 from its newest segment on, then the levels below
+	var sources []iteratorSource
+	for _, m := range []*memtable.MemTable{mt, auxMt} {
+		if m != nil {
+			sources = append(sources, newMemtableSource(m, inRange))
+		}
+	}
+	levels, unpin := d.pinSegmentsLocked(func(segment SegmentMetadata) bool {
+		return segment.OverlapsRange(start, end)
+	})
+	d.Manifest.Mu.Unlock()
+
+	for level, segments := range levels {
+		if level == 0 {
+			for i := len(segments) - 1; i >= 0; i-- {
+				sources = append(sources, &segmentSource{d: d, segments: segments[i : i+1], start: start, end: end})
+			}
+		} else if len(segments) > 0 {
+			sources = append(sources, &segmentSource{d: d, segments: segments, start: start, end: end})
+		}
+	}
+
+	it := &Iterator{d: d, now: time.Now().UnixMilli(), unpin: unpin}
+	for rank, source := range sources {
+		head := &iteratorHead{source: source, rank: rank}
+		if it.advance(head) {
+			it.sources = append(it.sources, head)
+		}
+	}
+	heap.Init(&it.sources)
+	return it
+}
+
+// Moves to the next live key, false once the range is exhausted or on error (see Err)
+func (it *Iterator) Next() bool {
+	for it.err == nil && len(it.sources) > 0 {
+		key := it.sources[0].key
+		// every entry of the key, newest first
+		var entries []KeyEntry.KeyEntry
+		for len(it.sources) > 0 && it.sources[0].key == key {
+			head := it.sources[0]
+			entries = append(entries, head.entry)
+			if it.advance(head) {
+				heap.Fix(&it.sources, 0)
+			} else {
+				heap.Pop(&it.sources)
+			}
+		}
+		if it.err != nil {
+			return false
+		}
+
+		entry, err := it.resolve(key, entries)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if entry.Kind != format.RECORD_KIND_TOMBSTONE && !entry.Expired(it.now) {
+			it.key, it.value = key, entry.Value
+			return true
+		}
+	}
+	return false
+}
+
+// key the iterator is at
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// value of the key the iterator is at
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// the error that stopped the iterator, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// closes the open segment files and unpins the segments, the iterator can't be used afterwards
+func (it *Iterator) Close() {
+	for _, head := range it.sources {
+		head.source.close()
+	}
+	it.sources = nil
+	if it.unpin != nil {
+		it.unpin()
+		it.unpin = nil
+	}
+}
+
+// moves head to the next entry of its source, false if the source is exhausted or failed
+func (it *Iterator) advance(head *iteratorHead) bool {
+	key, entry, ok, err := head.source.next()
+	if err != nil {
+		it.err = err
+	}
+	if !ok || err != nil {
+		head.source.close()
+		return false
+	}
+	head.key, head.entry = key, entry
+	return true
+}
+
+// combines the entries of a key (newest first) into the one a read would see
+func (it *Iterator) resolve(key string, entries []KeyEntry.KeyEntry) (KeyEntry.KeyEntry, error) {
+	i := 0
+	for i < len(entries) && entries[i].Kind == format.RECORD_KIND_MERGE_OPERAND {
+		i++
+	}
+	if i == 0 {
+		return entries[0], nil
+	}
+	var entry KeyEntry.KeyEntry
+	var err error = CustomError.ErrKeyDoesNotExist
+	if i < len(entries) {
+		entry, err = entries[i], nil
+	}
+	// operands apply to the entries below them
+	for j := i - 1; j >= 0; j-- {
+		if entry, err = it.d.applyMergeOperand(key, entries[j], entry, err); err != nil {
+			return KeyEntry.KeyEntry{}, err
+		}
+	}
+	return entry, nil
+}
+
+// a stream of entries sorted by key, each key at most once
+type iteratorSource interface {
+	// returns the next entry, ok is false once the stream ended
+	next() (key string, entry KeyEntry.KeyEntry, ok bool, err error)
+	close()
+}
+
+type iteratorHead struct {
+	source iteratorSource
+	rank   int // lower is newer
+	key    string
+	entry  KeyEntry.KeyEntry
+}
+
+// heads ordered by key, the newest source first for the same key
+type iteratorSourceHeap []*iteratorHead
+
+func (h iteratorSourceHeap) Len() int { return len(h) }
+func (h iteratorSourceHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].rank < h[j].rank
+}
+func (h iteratorSourceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *iteratorSourceHeap) Push(x interface{}) { *h = append(*h, x.(*iteratorHead)) }
+func (h *iteratorSourceHeap) Pop() interface{} {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+// sorted copy of the entries of a memtable in range
+type memtableSource struct {
+	keys    []string
+	entries map[string]KeyEntry.KeyEntry
+	pos     int
+}
+
+func newMemtableSource(mt *memtable.MemTable, inRange func(key string) bool) *memtableSource {
+	s := &memtableSource{entries: make(map[string]KeyEntry.KeyEntry)}
+	mt.ForEach(func(key string, entry KeyEntry.KeyEntry) {
+		if inRange(key) {
+			s.keys = append(s.keys, key)
+			s.entries[key] = entry
+		}
+	})
+	sort.Strings(s.keys)
+	return s
+}
+
+func (s *memtableSource) next() (string, KeyEntry.KeyEntry, bool, error) {
+	if s.pos == len(s.keys) {
+		return "", KeyEntry.KeyEntry{}, false, nil
+	}
+	key := s.keys[s.pos]
+	s.pos++
+	return key, s.entries[key], true, nil
+}
+
+func (s *memtableSource) close() {}
+
+// streams segments one after the other, they must not overlap and be in key order
+type segmentSource struct {
+	d        *DiskStore
+	segments []SegmentMetadata
+	start    string
+	end      string
+	file     *os.File
+	reader   *format.SegmentReader
+}
+
+func (s *segmentSource) next() (string, KeyEntry.KeyEntry, bool, error) {
+	for {
+		if s.reader == nil {
+			if len(s.segments) == 0 {
+				return "", KeyEntry.KeyEntry{}, false, nil
+			}
+			f, err := os.Open(s.d.segmentFilePath(s.segments[0].SegmentId))
+			if err != nil {
+				return "", KeyEntry.KeyEntry{}, false, fmt.Errorf("%w: %v", CustomError.ErrOpeningSegmentFile, err)
+			}
+			s.file, s.reader = f, format.NewSegmentReader(f)
+		}
+		record, err := s.reader.Next()
+		if err == io.EOF {
+			s.closeFile()
+			s.segments = s.segments[1:]
+			continue
+		}
+		if err != nil {
+			return "", KeyEntry.KeyEntry{}, false, fmt.Errorf("segment %d: %w", s.segments[0].SegmentId, err)
+		}
+		if s.start != "" && record.Key < s.start {
+			continue
+		}
+		if s.end != "" && record.Key > s.end {
+			// the segments after this one only hold larger keys
+			s.close()
+			return "", KeyEntry.KeyEntry{}, false, nil
+		}
+		return record.Key, KeyEntry.KeyEntry{
+			Timestamp: record.Timestamp,
+			Value:     record.Value,
+			Kind:      record.Kind,
+			ExpiresAt: record.ExpiresAt,
+		}, true, nil
+	}
+}
+
+func (s *segmentSource) closeFile() {
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, s.reader = nil, nil
+}
+
+func (s *segmentSource) close() {
+	s.closeFile()
+	s.segments = nil
+}
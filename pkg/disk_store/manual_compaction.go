@@ -0,0 +1,126 @@
+package disk_store
+
+import (
+	"context"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+// summary of the work done by a compaction
+type CompactionStats struct {
+	BytesRead       uint64 // size of all the input segment files
+	BytesWritten    uint64 // size of all the output segment files
+	SegmentsRead    int
+	SegmentsWritten int
+	Duration        time.Duration
+}
+
+func (c *CompactionStats) add(other CompactionStats) {
+	c.BytesRead += other.BytesRead
+	c.BytesWritten += other.BytesWritten
+	c.SegmentsRead += other.SegmentsRead
+	c.SegmentsWritten += other.SegmentsWritten
+}
+
+// Flushes the memtable and pushes every segment whose key range overlaps [start, end] down to the bottom most level.
+// Empty start or end means the range is unbounded on that side. Blocks until the compaction is complete
+func (d *DiskStore) CompactRange(start string, end string) (CompactionStats, error) {
+	return d.CompactRangeWithContext(context.Background(), start, end)
+}
+
+// Compacts the whole db, i.e. pushes every segment down to the bottom most level
+func (d *DiskStore) CompactAll() (CompactionStats, error) {
+	return d.CompactRange("", "")
+}
+
+// Same as CompactRange but stops between two merges once ctx is done. Merges that already completed stay committed
+func (d *DiskStore) CompactRangeWithContext(ctx context.Context, start string, end string) (CompactionStats, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":      "CompactRange",
+		"param_start": d.loggable(start),
+		"param_end":   d.loggable(end),
+	})
+	l.Infoln("Attempting to compact range")
+
+	var stats CompactionStats
+	startTime := time.Now()
+
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+
+	d.Flush()
+
+	d.Manifest.Mu.Lock()
+	if d.Manifest.NumberOfLevels == 0 {
+		// nothing was ever written
+		d.Manifest.Mu.Unlock()
+		return stats, nil
+	}
+	// even if everything lives in level 0 it has to be merged into level 1, level 0 segments overlap each other
+	bottomLevel := d.Manifest.NumberOfLevels - 1
+	if bottomLevel < 1 {
+		bottomLevel = 1
+	}
+	d.addLevelsUpTo(bottomLevel)
+	d.Manifest.Mu.Unlock()
+
+	for level := uint32(0); level < bottomLevel; level++ {
+		for {
+			if err := ctx.Err(); err != nil {
+				stats.Duration = time.Since(startTime)
+				return stats, err
+			}
+			// keep background compactions off the two levels while merging
+			if err := d.CompactionScheduler.ReserveLevels(ctx, level, level+1); err != nil {
+				stats.Duration = time.Since(startTime)
+				return stats, err
+			}
+			segment, found := d.nextSegmentToPushDown(level, start, end)
+			if !found {
+				d.CompactionScheduler.ReleaseLevels(level, level+1)
+				break
+			}
+			mergeStats, err := d.mergeCompact(ctx, segment, level+1)
+			d.CompactionScheduler.ReleaseLevels(level, level+1)
+			stats.add(mergeStats)
+			if err != nil {
+				stats.Duration = time.Since(startTime)
+				return stats, err
+			}
+		}
+	}
+
+	stats.Duration = time.Since(startTime)
+	l.Infof("Compacted range in %v, read %d bytes and wrote %d bytes", stats.Duration, stats.BytesRead, stats.BytesWritten)
+
+	return stats, nil
+}
+
+// returns the segment of `level` which has to be merged into the next level for the range [start, end] to be pushed
+// down. Segments of level 0 overlap each other, so every segment older than an overlapping one has to go down before it
+func (d *DiskStore) nextSegmentToPushDown(level uint32, start string, end string) (SegmentMetadata, bool) {
+	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+	d.Manifest.SegmentLevels[level].Mu.Lock()
+	defer d.Manifest.SegmentLevels[level].Mu.Unlock()
+
+	segments := d.Manifest.SegmentLevels[level].Segments
+
+	if level == 0 {
+		for i := len(segments) - 1; i >= 0; i-- {
+			if segments[i].OverlapsRange(start, end) {
+				return segments[0], true
+			}
+		}
+		return SegmentMetadata{}, false
+	}
+
+	for _, segment := range segments {
+		if segment.OverlapsRange(start, end) {
+			return segment, true
+		}
+	}
+	return SegmentMetadata{}, false
+}
@@ -0,0 +1,59 @@
+package disk_store
+
+import (
+	"errors"
+	"time"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	KeyEntry "github.com/abesheknarayan/go-caskdb/pkg/key_entry"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/merge_operator"
+	"github.com/abesheknarayan/go-caskdb/pkg/metrics"
+)
+
+/*
+	- Merge writes a merge operand record instead of reading the value, it costs as much as a Put
+	- the memtable holds one entry per key, so an operand is combined with the memtable's entry of the key when it's
+	  written, nothing is read from disk for that. Operands over older data are flushed as operands
+	- reads go from the newest data to the oldest, combining the operands they meet until they hit a value, a
+	  tombstone or run out of data, then apply them. Iterators do the same with all the entries of a key they merge
+	- compactions combine operands with the older entries of the segments they merge, left over operands become values
+	  in the bottom most level where nothing is below them anymore
+*/
+
+// Combines operand with the current value of the key using Options.MergeOperator, without reading the value. Fails
+// with ErrNoMergeOperator if the db has no merge operator
+func (d *DiskStore) Merge(key string, operand string) error {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":        "Merge",
+		"param_key":     d.loggable(key),
+		"param_operand": d.loggable(operand),
+	})
+	l.Infof("Attempting to merge into a key")
+	d.counters.recordUserWrite(len(key) + len(operand))
+
+	startTime := time.Now()
+	defer func() {
+		d.Metrics.ObserveOperation(metrics.OPERATION_MERGE, time.Since(startTime))
+	}()
+
+	batch := NewWriteBatch()
+	batch.Merge(key, operand)
+	if err := d.commit(batch); err != nil {
+		l.Errorln(err)
+		return err
+	}
+	return nil
+}
+
+// applies the merge operand to what a read of the older data of the key returned: its entry (which might be an operand
+// too), ErrKeyDeleted or ErrKeyDoesNotExist
+func (d *DiskStore) applyMergeOperand(key string, operand KeyEntry.KeyEntry, older KeyEntry.KeyEntry, err error) (KeyEntry.KeyEntry, error) {
+	if err != nil && !errors.Is(err, CustomError.ErrKeyDeleted) && !errors.Is(err, CustomError.ErrKeyDoesNotExist) {
+		return KeyEntry.KeyEntry{}, err
+	}
+	if d.Options.MergeOperator == nil {
+		return KeyEntry.KeyEntry{}, CustomError.ErrNoMergeOperator
+	}
+	return merge_operator.Apply(d.Options.MergeOperator, key, operand, older, err == nil, time.Now().UnixMilli()), nil
+}
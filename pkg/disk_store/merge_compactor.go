@@ -1,17 +1,19 @@
 package disk_store
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"os"
 	"sort"
 	"sync"
+	"time"
 
-	"github.com/abesheknarayan/go-caskdb/pkg/config"
 	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
 	"github.com/abesheknarayan/go-caskdb/pkg/key_entry"
-	"github.com/abesheknarayan/go-caskdb/pkg/memtable"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
 	"github.com/abesheknarayan/go-caskdb/pkg/utils"
-	"github.com/sirupsen/logrus"
 )
 
 // this struct is maintained for each level
@@ -26,239 +28,386 @@ func (d *DiskStore) InitMergeCompactor(level uint32) {
 	})
 }
 
-// watches the particular manifest level every X(configurable) seconds and initiates compaction strategy if necessary
-func (d *DiskStore) WatchLevelForSizeLimitExceed(level uint32) {
-	var l = utils.Logger.WithFields(logrus.Fields{
-		"method": "WatchLevelForSizeLimitExceed",
+// This function takes the least recent segment of the previous level and merges it with passed level.
+// Levels `nextLevel - 1` and `nextLevel` must be reserved by the caller (see CompactionScheduler)
+func (d *DiskStore) AddSegmentToLevelAndPerformCompaction(ctx context.Context, nextLevel uint32) (CompactionStats, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "AddSegmentToLevelAndPerformCompaction",
 	})
+	l.Infof("Attempting to perform merge compaction from level %d to level %d", nextLevel-1, nextLevel)
+
+	currentLevel := nextLevel - 1
 
-	// check for size exceeded case
 	d.Manifest.Mu.Lock()
-	if len(d.Manifest.SegmentLevels) <= int(level) {
+
+	// check if next level exists
+	d.addLevelsUpTo(nextLevel)
+
+	d.Manifest.SegmentLevels[currentLevel].Mu.Lock()
+	sz := len(d.Manifest.SegmentLevels[currentLevel].Segments)
+	if sz == 0 {
+		d.Manifest.SegmentLevels[currentLevel].Mu.Unlock()
 		d.Manifest.Mu.Unlock()
-		return
+		return CompactionStats{}, CustomError.ErrSegmentLevelEmpty
 	}
-	d.Manifest.SegmentLevels[level].Mu.Lock()
-	sizeOfCurrentLevel := len(d.Manifest.SegmentLevels[level].Segments)
-	d.Manifest.SegmentLevels[level].Mu.Unlock()
+	// pick the first segment, it is popped from the level by MergeCompact
+	leastRecentSegmentOnCurrentLevel := d.Manifest.SegmentLevels[currentLevel].Segments[0]
+	d.Manifest.SegmentLevels[currentLevel].Mu.Unlock()
 	d.Manifest.Mu.Unlock()
 
-	if sizeOfCurrentLevel > int(MaxSizeForLevel(level)) {
-		l.Debugln("Sending true to level", level)
-		err := d.AddSegmentToLevelAndPerformCompaction(level + 1)
-
-		if err != nil {
-			l.Errorln(err)
-		}
+	/*
+	  - merging all segments from smaller to bigger
+	*/
+	stats, err := d.mergeCompact(ctx, leastRecentSegmentOnCurrentLevel, nextLevel)
+	if err != nil {
+		return stats, err
 	}
-}
+	l.Infoln("Finished merging onto level", nextLevel, "from level ", nextLevel-1)
 
-// This function takes the file with the passed segment id and merges with passed level
-func (d *DiskStore) AddSegmentToLevelAndPerformCompaction(nextLevel uint32) error {
-	var l = utils.Logger.WithFields(logrus.Fields{
-		"method": "AddSegmentToLevelAndPerformCompaction",
-	})
-	l.Infof("Attempting to perform merge compaction from level %d to level %d", nextLevel-1, nextLevel)
-
-	currentLevel := nextLevel - 1
-
-	d.MergeCompactorWg.Add(1)
-
-	d.Manifest.Mu.Lock()
+	return stats, nil
+}
 
-	// check if next level exists
-	if len(d.MergeCompactor) <= int(nextLevel) {
-		// initiate next level
+// initiates all levels up to and including `level` which do not exist yet. Caller must hold d.Manifest.Mu
+func (d *DiskStore) addLevelsUpTo(level uint32) {
+	for len(d.MergeCompactor) <= int(level) {
 		d.Manifest.NumberOfLevels += 1
 		d.Manifest.SegmentLevels = append(d.Manifest.SegmentLevels, SegmentLevelMetadata{
 			Segments: []SegmentMetadata{},
 			Mu:       &sync.Mutex{},
 		})
-		d.InitMergeCompactor(nextLevel)
+		d.InitMergeCompactor(uint32(len(d.MergeCompactor)))
 	}
+}
 
-	sz := len(d.Manifest.SegmentLevels[currentLevel].Segments)
-	if sz > 0 {
-		// pop the first segment
-		d.Manifest.SegmentLevels[currentLevel].Mu.Lock()
-		leastRecentSegmentOnCurrentLevel := d.Manifest.SegmentLevels[currentLevel].Segments[0]
-		d.Manifest.SegmentLevels[currentLevel].Mu.Unlock()
-		d.Manifest.Mu.Unlock()
-		/*
-		  - merging all segments from smaller to bigger
-		*/
-		err := d.MergeCompact(leastRecentSegmentOnCurrentLevel, nextLevel)
-		l.Infoln("Finished merging onto level", nextLevel, "from level ", nextLevel-1)
-		d.MergeCompactorWg.Done()
+// performs merge compaction of segment (which lives on level `level - 1`) onto level `level`
+//
+// The merged contents are written to segments with fresh ids and synced, then a single manifest edit swaps the
+// inputs for the outputs, and only once that edit is durable the input files are deleted. A crash or an error at
+// any point before the manifest edit leaves the old manifest and all the input files untouched; the new files are
+// then unreferenced and get removed by DeleteObsoleteFiles on the next startup.
+func (d *DiskStore) MergeCompact(mergingSegment SegmentMetadata, level uint32) error {
+	_, err := d.mergeCompact(context.Background(), mergingSegment, level)
+	return err
+}
 
-		if err != nil {
-			return err
+// same as MergeCompact, also reports the amount of work done. Gives up (leaving everything as it was) once ctx is done
+func (d *DiskStore) mergeCompact(ctx context.Context, mergingSegment SegmentMetadata, level uint32) (CompactionStats, error) {
+	info := CompactionJobInfo{DbName: d.Manifest.DbName, InputLevel: level - 1, OutputLevel: level}
+	stats, inputSegments, outputSegments, err := d.runMergeCompaction(ctx, mergingSegment, level, &info)
+	if len(info.InputSegments) == 0 {
+		// compaction never began, nothing to report
+		return stats, err
+	}
+
+	if err == nil {
+		for _, segment := range outputSegments {
+			d.events.segmentCreated(SegmentInfo{DbName: d.Manifest.DbName, SegmentId: segment.SegmentId, Level: level, Size: segment.Size})
+		}
+		for i, segment := range inputSegments {
+			inputLevel := level
+			if i == 0 {
+				inputLevel = level - 1
+			}
+			d.events.segmentDeleted(SegmentInfo{DbName: d.Manifest.DbName, SegmentId: segment.SegmentId, Level: inputLevel, Size: d.segmentBytes(segment)})
 		}
+		info.OutputSegments = segmentIds(outputSegments)
+	}
+	info.BytesRead = stats.BytesRead
+	info.BytesWritten = stats.BytesWritten
+	info.Duration = stats.Duration
+	info.Err = err
+	d.events.compactionCompleted(info)
+	return stats, err
+}
 
-		// trigger everytime an insertion at next level happens
-		d.Manifest.Mu.Lock()
-		d.Manifest.SegmentLevels[currentLevel].Mu.Lock()
-		d.Manifest.SegmentLevels[currentLevel].Segments = d.Manifest.SegmentLevels[currentLevel].Segments[1:]
-		d.Manifest.SegmentLevels[currentLevel].Mu.Unlock()
-		d.Manifest.Mu.Unlock()
+// does the work of mergeCompact, returns the input and output segments along with the stats. Notifies the listeners
+// of the beginning of the compaction (and fills info.InputSegments) once the inputs are known
+func (d *DiskStore) runMergeCompaction(ctx context.Context, mergingSegment SegmentMetadata, level uint32, info *CompactionJobInfo) (CompactionStats, []SegmentMetadata, []SegmentMetadata, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "MergeCompact",
+	})
+	l.Infof("Attempting to merge segment %d.seg to level %d", mergingSegment.SegmentId, level)
 
-		go d.WatchLevelForSizeLimitExceed(nextLevel)
-	} else {
+	var stats CompactionStats
+	startTime := time.Now()
 
-		d.Manifest.SegmentLevels[currentLevel].Mu.Unlock()
+	upperLevel := level - 1
+
+	d.Manifest.Mu.Lock()
+	// the segment might have already been merged by another compaction
+	if indexOfSegment(d.Manifest.SegmentLevels[upperLevel].Segments, mergingSegment.SegmentId) < 0 {
 		d.Manifest.Mu.Unlock()
-		return CustomError.ErrSegmentLevelEmpty
+		l.Infof("Segment %d.seg is no longer present in level %d, skipping", mergingSegment.SegmentId, upperLevel)
+		return stats, nil, nil, nil
 	}
 
-	return nil
-}
+	// segment from the upper level holds newer data than everything on `level`, so it goes first and wins on duplicate keys
+	var inputSegments []SegmentMetadata
+	inputSegments = append(inputSegments, mergingSegment)
+	inputSegments = append(inputSegments, d.Manifest.SegmentLevels[level].Segments...)
+	// levels below can't change while `level` is reserved, compactions into them need it as well
+	isBottomMostLevel := true
+	for i := int(level) + 1; i < len(d.Manifest.SegmentLevels); i++ {
+		if len(d.Manifest.SegmentLevels[i].Segments) > 0 {
+			isBottomMostLevel = false
+		}
+	}
+	d.Manifest.Mu.Unlock()
 
-// performs merge compaction of segment onto level `level`
-func (d *DiskStore) MergeCompact(mergingSegment SegmentMetadata, level uint32) error {
-	var l = utils.Logger.WithFields(logrus.Fields{
-		"method": "MergeCompact",
-	})
-	l.Infof("Attempting to merge segment %d.seg to level %d", mergingSegment.SegmentId, level)
+	info.InputSegments = segmentIds(inputSegments)
+	d.events.compactionBegin(*info)
+
+	// both levels are reserved for this compaction, so inputs are read and outputs are written without holding the
+	// manifest lock, reads keep going in the meantime
+	for _, segment := range inputSegments {
+		stats.BytesRead += d.segmentBytes(segment)
+	}
+
+	mergedEntries, err := d.mergeSegments(inputSegments)
+	if err != nil {
+		return stats, inputSegments, nil, fmt.Errorf("error while performing merge compaction of segment %d onto level %d: %v", mergingSegment.SegmentId, level, err)
+	}
+	now := time.Now().UnixMilli()
+	for key, entry := range mergedEntries {
+		if isBottomMostLevel && entry.Kind == format.RECORD_KIND_MERGE_OPERAND {
+			// nothing is left below the operands, they apply to a missing value
+			if entry, err = d.applyMergeOperand(key, entry, key_entry.KeyEntry{}, CustomError.ErrKeyDoesNotExist); err != nil {
+				return stats, inputSegments, nil, err
+			}
+			mergedEntries[key] = entry
+		}
+		if isBottomMostLevel && (entry.Kind == format.RECORD_KIND_TOMBSTONE || entry.Expired(now)) {
+			// nothing older is left for the tombstones (or expired values) to hide
+			delete(mergedEntries, key)
+		} else if entry.Expired(now) {
+			// the value is dropped, older values of the key in the levels below still have to stay hidden
+			mergedEntries[key] = key_entry.KeyEntry{Timestamp: entry.Timestamp, Kind: format.RECORD_KIND_TOMBSTONE}
+		}
+	}
 
-	var allSegments []SegmentMetadata
+	outputSegments, err := d.writeMergedSegments(ctx, mergedEntries)
+	if err != nil {
+		stats.Duration = time.Since(startTime)
+		return stats, inputSegments, nil, err
+	}
+	// the outputs hold entries of any of the inputs
+	lastSequence := uint64(0)
+	for _, segment := range inputSegments {
+		if segment.LastSequence > lastSequence {
+			lastSequence = segment.LastSequence
+		}
+	}
+	for i := range outputSegments {
+		outputSegments[i].LastSequence = lastSequence
+		stats.BytesWritten += outputSegments[i].Size
+	}
 
 	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+
+	// flushes might have appended to level 0 meanwhile, so look up the merging segment again
+	mergingSegmentIndex := indexOfSegment(d.Manifest.SegmentLevels[upperLevel].Segments, mergingSegment.SegmentId)
+	if mergingSegmentIndex < 0 || !sameSegments(d.Manifest.SegmentLevels[level].Segments, inputSegments[1:]) {
+		d.deleteSegmentFiles(outputSegments)
+		return stats, inputSegments, nil, CustomError.ErrCompactionInputsChanged
+	}
+
+	// single manifest edit swapping inputs for outputs
+	oldUpperLevelSegments := d.Manifest.SegmentLevels[upperLevel].Segments
+	oldLevelSegments := d.Manifest.SegmentLevels[level].Segments
+
+	newUpperLevelSegments := make([]SegmentMetadata, 0, len(oldUpperLevelSegments)-1)
+	newUpperLevelSegments = append(newUpperLevelSegments, oldUpperLevelSegments[:mergingSegmentIndex]...)
+	newUpperLevelSegments = append(newUpperLevelSegments, oldUpperLevelSegments[mergingSegmentIndex+1:]...)
+
+	d.Manifest.SegmentLevels[upperLevel].Mu.Lock()
 	d.Manifest.SegmentLevels[level].Mu.Lock()
-	l.Debugln("here 1")
-	defer func() {
-		d.Manifest.SegmentLevels[level].Mu.Unlock()
-		d.Manifest.Mu.Unlock()
-	}()
+	d.Manifest.SegmentLevels[upperLevel].Segments = newUpperLevelSegments
+	d.Manifest.SegmentLevels[level].Segments = outputSegments
+	d.Manifest.SegmentLevels[level].Mu.Unlock()
+	d.Manifest.SegmentLevels[upperLevel].Mu.Unlock()
+
+	err = d.persistManifest()
+	if err != nil {
+		// roll back the in memory edit, input files are still intact on disk
+		d.Manifest.SegmentLevels[upperLevel].Segments = oldUpperLevelSegments
+		d.Manifest.SegmentLevels[level].Segments = oldLevelSegments
+		d.deleteSegmentFiles(outputSegments)
+		return stats, inputSegments, nil, fmt.Errorf("error while committing merge compaction onto level %d: %v", level, err)
+	}
 
-	allSegments = append(allSegments, mergingSegment)
-	allSegments = append(allSegments, d.Manifest.SegmentLevels[level].Segments...)
+	// inputs are not referenced by the manifest anymore, it's finally safe to delete them
+	d.deleteSegmentFiles(inputSegments)
 
-	// sort `allSegments` to lowest cardinality first order
-	sort.Slice(allSegments, func(i, j int) bool {
-		return allSegments[i].SegmentId > allSegments[j].SegmentId
-	})
+	stats.SegmentsRead = len(inputSegments)
+	stats.SegmentsWritten = len(outputSegments)
+	stats.Duration = time.Since(startTime)
+	d.counters.recordCompaction(level, stats)
+	d.Metrics.ObserveCompaction(level, stats.BytesRead, stats.BytesWritten, stats.Duration)
+
+	l.Infof("Merge Compaction of level %d is complete!!\n", level)
+
+	return stats, inputSegments, outputSegments, nil
+}
 
-	// one big memtable :o
-	mergedMemtable := memtable.MemTable{
-		DbName:        d.Manifest.DbName,
-		BytesOccupied: 0,
-		Map:           &memtable.HashMap{M: make(map[string]key_entry.KeyEntry), Mu: &sync.Mutex{}},
-		Mu:            &sync.Mutex{},
-		ExWaitGroup:   &memtable.ExclusiveWaitGroup{Wg: &sync.WaitGroup{}, Mu: &sync.Mutex{}},
+// returns the index of the segment with the given id, -1 if it isn't present
+func indexOfSegment(segments []SegmentMetadata, segmentId uint32) int {
+	for i, segment := range segments {
+		if segment.SegmentId == segmentId {
+			return i
+		}
 	}
+	return -1
+}
 
-	for _, segment := range allSegments {
-		tempMemtable := memtable.MemTable{
-			DbName:        d.Manifest.DbName,
-			BytesOccupied: 0,
-			Map:           &memtable.HashMap{M: make(map[string]key_entry.KeyEntry), Mu: &sync.Mutex{}},
-			Mu:            &sync.Mutex{},
-			ExWaitGroup:   &memtable.ExclusiveWaitGroup{Wg: &sync.WaitGroup{}, Mu: &sync.Mutex{}},
+// checks if both slices hold the same segments in the same order
+func sameSegments(a []SegmentMetadata, b []SegmentMetadata) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].SegmentId != b[i].SegmentId {
+			return false
 		}
+	}
+	return true
+}
+
+// loads the given segments and merges them into one map, segments earlier in the slice take precedence on duplicate keys
+// and their merge operands are applied to the entries of the later ones
+func (d *DiskStore) mergeSegments(segments []SegmentMetadata) (map[string]key_entry.KeyEntry, error) {
+	merged := make(map[string]key_entry.KeyEntry)
+
+	for _, segment := range segments {
+		tempMemtable := d.newMemtable(-1)
 		err := tempMemtable.LoadFromSegmentFile(segment.SegmentId)
 		if err != nil {
-			return fmt.Errorf("error while performing merge compaction of segment %d onto level %d", segment.SegmentId, level)
+			return nil, err
 		}
 		for key, keyEntry := range tempMemtable.Map.M {
-			if mergedMemtable.Contains(key) {
-				// // insert only if key_entry from merged memtable is older
-				// mergedKeyEntry := mergedMemtable.Map.M[key]
-				// l.Debugln(mergedKeyEntry.Timestamp, keyEntry.Timestamp)
-				// if mergedKeyEntry.Timestamp < keyEntry.Timestamp {
-				// 	// change value and timestamp in mergedMemtable
-
-				// 	// note not using `Put` method here to prevent the size exceeded error
-				// 	mergedMemtable.Map.M[key] = keyEntry
-				// }
-			} else {
-				mergedMemtable.Map.M[key] = keyEntry
+			newer, exists := merged[key]
+			if !exists {
+				merged[key] = keyEntry
+			} else if newer.Kind == format.RECORD_KIND_MERGE_OPERAND {
+				// segments come newest first, the operands land on what's below them
+				if merged[key], err = d.applyMergeOperand(key, newer, keyEntry, nil); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
 
-	// split everything into multiple files
-	// make sure of giving proper segment ids
-	// number of merged segemnts <= already present segments
-	var segmentIds []uint32
+	return merged, nil
+}
+
+// splits the merged entries in sorted key order into segments of at most MemtableSizeLimit bytes and writes each one
+// to a segment file with a fresh segment id. On error (or once ctx is done) every file written so far is removed
+func (d *DiskStore) writeMergedSegments(ctx context.Context, entries map[string]key_entry.KeyEntry) ([]SegmentMetadata, error) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "writeMergedSegments",
+	})
 
-	for _, segment := range d.Manifest.SegmentLevels[level].Segments {
-		segmentIds = append(segmentIds, segment.SegmentId)
+	sortedKeys := make([]string, 0, len(entries))
+	for key := range entries {
+		sortedKeys = append(sortedKeys, key)
 	}
-	segmentIds = append(segmentIds, mergingSegment.SegmentId)
+	sort.Strings(sortedKeys)
 
-	segmendIndex := len(segmentIds) - 1
+	var outputSegments []SegmentMetadata
 
 	// using temporary Memtable
-	tempMemtable := memtable.MemTable{
-		DbName:        d.Manifest.DbName,
-		SegmentId:     int32(segmentIds[segmendIndex]),
-		BytesOccupied: 0,
-		Map:           &memtable.HashMap{M: make(map[string]key_entry.KeyEntry), Mu: &sync.Mutex{}},
-		Mu:            &sync.Mutex{},
-		ExWaitGroup:   &memtable.ExclusiveWaitGroup{Wg: &sync.WaitGroup{}, Mu: &sync.Mutex{}},
-	}
-
-	// delete all segments already present
+	tempMemtable := d.newMemtable(int32(d.GetNewSegmentId()))
+	tempMemtable.RateLimiter = d.RateLimiter
 
-	for _, id := range segmentIds {
-		err := utils.DeleteFile(fmt.Sprintf("%s/%s/%d.seg", config.Config.Path, d.Manifest.DbName, id))
+	writeTempMemtable := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		smallestKey, largestKey := tempMemtable.KeyRange()
+		cardinality, _, err := tempMemtable.WriteMemtableToDisk()
 		if err != nil {
-			return fmt.Errorf("error while deleting file %d.seg: %v", id, err)
+			return fmt.Errorf("error while writing temporary memtable to disk: %v", err)
 		}
+		l.Infof("Successfully written the temporary memtable to disk with cardinality: %d", cardinality)
+		outputSegments = append(outputSegments, SegmentMetadata{
+			SegmentId:   uint32(tempMemtable.SegmentId),
+			Cardinality: cardinality,
+			SmallestKey: smallestKey,
+			LargestKey:  largestKey,
+			Size:        d.segmentFileSize(uint32(tempMemtable.SegmentId)),
+			Mu:          &sync.Mutex{},
+		})
+		return nil
 	}
 
-	// clear manifest level
-	d.Manifest.SegmentLevels[level].Segments = d.Manifest.SegmentLevels[level].Segments[:0]
-
-	for key, keyEntry := range mergedMemtable.Map.M {
+	for _, key := range sortedKeys {
+		keyEntry := entries[key]
 		err := tempMemtable.Put(key, keyEntry.Value)
-		if err == CustomError.ErrMaxSizeExceeded {
-			if segmendIndex == 0 {
-				tempMemtable.Map.M[key] = keyEntry
-				continue
+		if err == CustomError.ErrMaxSizeExceeded && len(tempMemtable.Map.M) > 0 {
+			if err := writeTempMemtable(); err != nil {
+				d.deleteSegmentFiles(outputSegments)
+				// the failed file may have been partially written
+				utils.DeleteFile(d.segmentFilePath(uint32(tempMemtable.SegmentId)))
+				return nil, err
 			}
-			cardinality, _, err := tempMemtable.WriteMemtableToDisk()
-			if err != nil {
-				return fmt.Errorf("error while writing temporary memtable to disk")
-			}
-			l.Infof("Successfully written the temporary memtable to disk with cardinality: %d", cardinality)
-
-			// add into manifest level
-			d.Manifest.SegmentLevels[level].Segments = append(d.Manifest.SegmentLevels[level].Segments, SegmentMetadata{
-				SegmentId:   uint32(tempMemtable.SegmentId),
-				Cardinality: cardinality,
-				Mu:          &sync.Mutex{},
-			})
 
 			// update memtable for next step
 			tempMemtable.Clear()
-			segmendIndex--
-			tempMemtable.SegmentId = int32(segmentIds[segmendIndex])
+			tempMemtable.SegmentId = int32(d.GetNewSegmentId())
 
 			// put again, this time there wont be any error
 			tempMemtable.Put(key, keyEntry.Value)
 		}
+		// keep the original timestamp of the entry (and the entry itself in case it alone exceeds the size limit)
+		tempMemtable.Map.M[key] = keyEntry
 	}
 
 	// write leftover temp memtable elements onto disk
-	if tempMemtable.BytesOccupied > 0 {
-		cardinality, _, err := tempMemtable.WriteMemtableToDisk()
-		if err != nil {
-			return fmt.Errorf("error while writing temporary memtable to disk")
+	if len(tempMemtable.Map.M) > 0 {
+		if err := writeTempMemtable(); err != nil {
+			d.deleteSegmentFiles(outputSegments)
+			utils.DeleteFile(d.segmentFilePath(uint32(tempMemtable.SegmentId)))
+			return nil, err
 		}
-		l.Infof("Successfully written the temporary memtable to disk with cardinality: %d\n", cardinality)
+	}
 
-		// add into manifest level
-		d.Manifest.SegmentLevels[level].Segments = append(d.Manifest.SegmentLevels[level].Segments, SegmentMetadata{
-			SegmentId:   uint32(tempMemtable.SegmentId),
-			Cardinality: cardinality,
-			Mu:          &sync.Mutex{},
-		})
+	// make the creation of the new files durable before the manifest starts referring to them
+	if err := utils.SyncDir(d.dirPath()); err != nil {
+		d.deleteSegmentFiles(outputSegments)
+		return nil, err
 	}
 
-	l.Infof("Merge Compaction of level %d is complete!!\n", level)
+	return outputSegments, nil
+}
 
-	return nil
+// best effort deletion of segment files, anything left behind is cleaned up by DeleteObsoleteFiles on next startup
+func (d *DiskStore) deleteSegmentFiles(segments []SegmentMetadata) {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method": "deleteSegmentFiles",
+	})
+	for _, segment := range segments {
+		d.TableCache.Evict(segment.SegmentId)
+		if d.pins.deferDelete(segment.SegmentId) {
+			// a checkpoint is still linking it
+			continue
+		}
+		err := utils.DeleteFile(d.segmentFilePath(segment.SegmentId))
+		if err != nil {
+			l.Errorf("error while deleting file %d.seg: %v", segment.SegmentId, err)
+		}
+	}
+	if err := utils.SyncDir(d.dirPath()); err != nil {
+		l.Errorln(err)
+	}
+}
+
+// returns the size of a segment file in bytes, 0 if it can't be determined
+func (d *DiskStore) segmentFileSize(segmentId uint32) uint64 {
+	info, err := os.Stat(d.segmentFilePath(segmentId))
+	if err != nil {
+		return 0
+	}
+	return uint64(info.Size())
 }
 
 func MaxSizeForLevel(level uint32) uint64 {
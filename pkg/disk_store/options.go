@@ -0,0 +1,40 @@
+package disk_store
+
+import (
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/merge_operator"
+	"github.com/abesheknarayan/go-caskdb/pkg/metrics"
+)
+
+// per db settings passed to InitDbWithOptions, process wide settings stay in config.Config
+type Options struct {
+	EventListeners []EventListener  // notified of flushes, compactions, segment files, stalls and background errors
+	Metrics        *metrics.Metrics // nil disables metrics
+	Logger         logger.Logger    // nil means no logging
+	// keys and values are left out of the logs unless this is set, they may hold data which must not end up in logs
+	LogKeysAndValues bool
+	// writes other than ApplyReplicatedBatch and InstallSnapshot fail with ErrReadOnly, for followers
+	ReadOnly bool
+	// number of recent write batches kept in memory for followers, older ones are read from the write ahead log
+	ReplicationLogSize int
+	// fsync the write ahead log after every write batch, otherwise batches are only safe from the process crashing
+	SyncWAL bool
+	// bytes of write ahead log files kept after their batches are in segment files, for followers and change
+	// subscribers which are behind. A follower further behind copies the segments
+	WALRetentionSize uint64
+	// combines the operands of Merge with the values of keys, nil means Merge fails with ErrNoMergeOperator. A db with
+	// merge operands on disk has to be opened with the same operator every time
+	MergeOperator merge_operator.MergeOperator
+}
+
+const (
+	DEFAULT_REPLICATION_LOG_SIZE = 4096
+	DEFAULT_WAL_RETENTION_SIZE   = 64 * 1024 * 1024
+)
+
+func DefaultOptions() Options {
+	return Options{
+		ReplicationLogSize: DEFAULT_REPLICATION_LOG_SIZE,
+		WALRetentionSize:   DEFAULT_WAL_RETENTION_SIZE,
+	}
+}
@@ -0,0 +1,355 @@
+package disk_store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	"github.com/abesheknarayan/go-caskdb/pkg/utils"
+)
+
+/*
+	- Verify and Repair work on the files only, the db must not be open while they run
+	- Repair never deletes anything, damaged and unreferenced files are moved to lost/ so they can still be looked at
+	- a damaged segment is one that stops decoding somewhere or whose keys are not sorted, the records that do decode
+	  are written to a new segment which takes its place in the manifest
+	- when the manifest is usable the levels are kept as they are. Otherwise every segment goes to level 0, ordered by
+	  the newest timestamp it holds so that segments with newer data are looked at first. Timestamps are in seconds,
+	  so a key written twice in the same second might come back with its older value
+	- the last sequence comes from the manifest too, records don't carry their sequence. Without a readable manifest
+	  the db starts over at sequence 0 and its followers have to install a new snapshot. The write ahead log is left
+	  alone, if it still has every batch from sequence 1 on they are all replayed when the db is opened
+*/
+
+const LOST_DIR_NAME = "lost" // Repair moves damaged and unreferenced files here
+
+// what Repair did
+type RepairReport struct {
+	ManifestRebuilt  bool              // manifest was missing or unusable and got rebuilt from the segment files alone
+	SalvagedSegments map[uint32]uint32 // damaged segment id -> id of the new segment holding its decodable records
+	SalvagedRecords  uint32            // records written to the new segments
+	DroppedSegments  []uint32          // referenced by the manifest but had no file
+	Quarantined      []string          // files moved to lost/
+	MaxSegmentId     uint32
+	SequenceLost     bool // manifest couldn't be read, so LastSequence starts over at 0
+}
+
+// Checks that every segment file decodes cleanly and matches the manifest. Returns an error wrapping
+// ErrVerificationFailed if the manifest can't be read or any problem is found, the report lists the problems
+func Verify(dirPath string) (*InspectionReport, error) {
+	report, err := InspectDb(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", CustomError.ErrVerificationFailed, err)
+	}
+	if len(report.Problems) > 0 {
+		return report, fmt.Errorf("%w: %d problems found", CustomError.ErrVerificationFailed, len(report.Problems))
+	}
+	return report, nil
+}
+
+// segment file as Repair found it
+type repairedSegment struct {
+	metadata        SegmentMetadata
+	newestTimestamp int64
+}
+
+// Makes the db directory openable again: salvages the decodable records of damaged segments, quarantines damaged
+// and unreferenced files into lost/ and writes a manifest matching the segment files
+func Repair(dirPath string) (*RepairReport, error) {
+	report := &RepairReport{SalvagedSegments: make(map[uint32]uint32)}
+
+	manifest, err := readManifestFile(dirPath)
+	if err != nil {
+		manifest = nil
+		report.ManifestRebuilt = true
+	}
+
+	// a leftover temporary manifest was never committed, the manifest file (if any) is the one that counts
+	if err := os.Remove(filepath.Join(dirPath, MANIFEST_TEMP_FILE_NAME)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	quarantine := func(name string) error {
+		if err := os.MkdirAll(filepath.Join(dirPath, LOST_DIR_NAME), 0777); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(dirPath, name), filepath.Join(dirPath, LOST_DIR_NAME, name)); err != nil {
+			return err
+		}
+		report.Quarantined = append(report.Quarantined, filepath.Join(LOST_DIR_NAME, name))
+		return nil
+	}
+
+	if manifest != nil {
+		report.MaxSegmentId = manifest.MaxSegmentId
+	}
+	type segmentFile struct {
+		id      uint32
+		name    string
+		records []format.Record
+		damaged bool
+	}
+	var files []segmentFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, SEGMENT_FILE_EXTENSION) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, SEGMENT_FILE_EXTENSION), 10, 32)
+		if err != nil {
+			// not a segment written by the db
+			if err := quarantine(name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		records, damaged, err := readSegmentRecords(filepath.Join(dirPath, name))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, segmentFile{id: uint32(id), name: name, records: records, damaged: damaged})
+		if uint32(id) > report.MaxSegmentId {
+			report.MaxSegmentId = uint32(id)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].id < files[j].id })
+
+	// segment id the manifest might reference -> the healthy segment now holding its records
+	live := make(map[uint32]repairedSegment)
+	for _, file := range files {
+		if !file.damaged {
+			live[file.id] = newRepairedSegment(file.id, file.records, segmentSize(file.records))
+			continue
+		}
+		if err := quarantine(file.name); err != nil {
+			return nil, err
+		}
+		if len(file.records) == 0 {
+			continue
+		}
+		records := sortRecords(file.records)
+		report.MaxSegmentId++
+		salvagedId := report.MaxSegmentId
+		if err := writeSegmentFile(filepath.Join(dirPath, fmt.Sprintf("%d%s", salvagedId, SEGMENT_FILE_EXTENSION)), records); err != nil {
+			return nil, err
+		}
+		live[file.id] = newRepairedSegment(salvagedId, records, segmentSize(records))
+		report.SalvagedSegments[file.id] = salvagedId
+		report.SalvagedRecords += uint32(len(records))
+	}
+
+	var levels []SegmentLevelMetadata
+	referenced := make(map[uint32]bool)
+	if manifest != nil {
+		levels, report.DroppedSegments, referenced = keepLevels(manifest, live)
+		if levels == nil {
+			report.ManifestRebuilt = true
+		}
+	}
+	if levels == nil {
+		levels, referenced = levelsFromSegments(live)
+		report.DroppedSegments = nil
+	}
+
+	// segments the manifest doesn't know of are leftovers of interrupted flushes and compactions
+	for _, file := range files {
+		segment, ok := live[file.id]
+		if !ok || referenced[segment.metadata.SegmentId] {
+			continue
+		}
+		if err := quarantine(fmt.Sprintf("%d%s", segment.metadata.SegmentId, SEGMENT_FILE_EXTENSION)); err != nil {
+			return nil, err
+		}
+	}
+
+	dbName := filepath.Base(dirPath)
+	if manifest != nil && manifest.DbName != "" {
+		dbName = manifest.DbName
+	}
+	if report.MaxSegmentId == 0 {
+		report.MaxSegmentId = 1 // same as a new db
+	}
+	repaired := &Manifest{
+		DbName:         dbName,
+		NumberOfLevels: uint32(len(levels)),
+		SegmentLevels:  levels,
+		MaxSegmentId:   report.MaxSegmentId,
+	}
+	if manifest != nil {
+		repaired.LastSequence = manifest.LastSequence
+	} else {
+		report.SequenceLost = true
+	}
+	if err := utils.SyncDir(dirPath); err != nil {
+		return nil, err
+	}
+	if err := writeManifestFile(dirPath, repaired); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// returns the manifest of the directory, errors if it's missing or isn't valid json
+func readManifestFile(dirPath string) (*Manifest, error) {
+	content, err := os.ReadFile(filepath.Join(dirPath, MANIFEST_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("manifest is not valid json: %v", err)
+	}
+	return manifest, nil
+}
+
+// returns the records of a segment file up to the first corrupted one and whether the file is damaged
+func readSegmentRecords(path string) ([]format.Record, bool, error) {
+	var records []format.Record
+	damaged := false
+	err := ReadSegmentFile(path, func(record format.Record) error {
+		if len(records) > 0 && record.Key <= records[len(records)-1].Key {
+			damaged = true
+		}
+		records = append(records, record)
+		return nil
+	})
+	if errors.Is(err, CustomError.ErrCorruptedSegment) {
+		return records, true, nil
+	}
+	return records, damaged, err
+}
+
+// sorts the records by key and keeps the newest record of every key
+func sortRecords(records []format.Record) []format.Record {
+	newest := make(map[string]format.Record)
+	for _, record := range records {
+		if previous, ok := newest[record.Key]; !ok || record.Timestamp >= previous.Timestamp {
+			newest[record.Key] = record
+		}
+	}
+	sorted := make([]format.Record, 0, len(newest))
+	for _, record := range newest {
+		sorted = append(sorted, record)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted
+}
+
+func segmentSize(records []format.Record) uint64 {
+	size := uint64(0)
+	for _, record := range records {
+		size += uint64(record.Size())
+	}
+	return size
+}
+
+// writes the records, which must be sorted by key, to a new segment file
+func writeSegmentFile(path string, records []format.Record) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	writer := format.NewSegmentWriter(f)
+	for _, record := range records {
+		if err = writer.Write(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	return err
+}
+
+func newRepairedSegment(segmentId uint32, records []format.Record, size uint64) repairedSegment {
+	segment := repairedSegment{metadata: SegmentMetadata{
+		SegmentId:   segmentId,
+		Cardinality: uint32(len(records)),
+		Size:        size,
+	}}
+	if len(records) > 0 {
+		segment.metadata.SmallestKey = records[0].Key
+		segment.metadata.LargestKey = records[len(records)-1].Key
+	}
+	for _, record := range records {
+		if record.Timestamp > segment.newestTimestamp {
+			segment.newestTimestamp = record.Timestamp
+		}
+	}
+	return segment
+}
+
+// the levels of the manifest with every segment replaced by the one now holding its records. Returns nil levels if
+// the manifest can't be trusted (segments referenced twice or overlapping within a level > 0)
+func keepLevels(manifest *Manifest, live map[uint32]repairedSegment) ([]SegmentLevelMetadata, []uint32, map[uint32]bool) {
+	if int(manifest.NumberOfLevels) != len(manifest.SegmentLevels) {
+		return nil, nil, nil
+	}
+	var dropped []uint32
+	referenced := make(map[uint32]bool)
+	levels := make([]SegmentLevelMetadata, len(manifest.SegmentLevels))
+	for level, segmentLevel := range manifest.SegmentLevels {
+		levels[level].Segments = []SegmentMetadata{}
+		for _, segment := range segmentLevel.Segments {
+			repaired, ok := live[segment.SegmentId]
+			if !ok {
+				dropped = append(dropped, segment.SegmentId)
+				continue
+			}
+			if referenced[repaired.metadata.SegmentId] {
+				return nil, nil, nil
+			}
+			referenced[repaired.metadata.SegmentId] = true
+			segments := levels[level].Segments
+			if level > 0 && len(segments) > 0 && repaired.metadata.Cardinality > 0 && segments[len(segments)-1].LargestKey >= repaired.metadata.SmallestKey {
+				return nil, nil, nil
+			}
+			// a salvaged segment holds the records of the damaged one
+			metadata := repaired.metadata
+			metadata.LastSequence = segment.LastSequence
+			levels[level].Segments = append(segments, metadata)
+		}
+	}
+	return levels, dropped, referenced
+}
+
+// puts every segment in level 0, the ones holding newer data last
+func levelsFromSegments(live map[uint32]repairedSegment) ([]SegmentLevelMetadata, map[uint32]bool) {
+	segments := make([]repairedSegment, 0, len(live))
+	for _, segment := range live {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].newestTimestamp != segments[j].newestTimestamp {
+			return segments[i].newestTimestamp < segments[j].newestTimestamp
+		}
+		return segments[i].metadata.SegmentId < segments[j].metadata.SegmentId
+	})
+
+	referenced := make(map[uint32]bool)
+	if len(segments) == 0 {
+		return []SegmentLevelMetadata{}, referenced
+	}
+	level := SegmentLevelMetadata{Segments: []SegmentMetadata{}}
+	for _, segment := range segments {
+		level.Segments = append(level.Segments, segment.metadata)
+		referenced[segment.metadata.SegmentId] = true
+	}
+	return []SegmentLevelMetadata{level}, referenced
+}
@@ -0,0 +1,409 @@
+package disk_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/utils"
+)
+
+/*
+	- the most recent write batches are kept encoded in memory, in the replication log, for followers to stream. Older
+	  batches are read from the write ahead log (see wal.go), as long as its files are kept
+	- the manifest records the sequence of the last batch which made it into a segment file, the batches after it are
+	  replayed from the write ahead log when the db is opened and sequence numbers continue from the last one
+	- a follower which needs batches neither log has anymore gets a snapshot instead: the primary flushes, pins its
+	  segments and the follower swaps all of its data for copies of them with InstallSnapshot
+	- ingested segments never go through the logs, ingestion empties the replication log and leaves a reset record in
+	  the write ahead log to make every follower behind it take a snapshot
+*/
+
+// a committed write batch along with its sequence number
+type ReplicatedBatch struct {
+	Sequence uint64
+	Data     []byte // WriteBatch.Encode of the batch
+}
+
+type replicationLog struct {
+	capacity        int
+	batches         []ReplicatedBatch // oldest first, at most capacity of them
+	lastSequence    uint64            // of the last committed batch, tracked even when nothing is kept
+	primarySequence uint64            // followers only, the last sequence their primary reported
+	appended        chan struct{}     // closed and replaced whenever a batch is appended
+	closed          bool
+	Mu              *sync.Mutex
+}
+
+func newReplicationLog(capacity int, lastSequence uint64) *replicationLog {
+	return &replicationLog{
+		capacity:     capacity,
+		lastSequence: lastSequence,
+		appended:     make(chan struct{}),
+		Mu:           &sync.Mutex{},
+	}
+}
+
+func (r *replicationLog) append(sequence uint64, data []byte) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.lastSequence = sequence
+	if r.capacity > 0 {
+		if len(r.batches) == r.capacity {
+			r.batches = r.batches[1:]
+		}
+		r.batches = append(r.batches, ReplicatedBatch{Sequence: sequence, Data: data})
+	}
+	close(r.appended)
+	r.appended = make(chan struct{})
+}
+
+// drops every batch and continues at sequence, subscribers still behind it lose their place
+func (r *replicationLog) reset(sequence uint64) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.batches = nil
+	r.lastSequence = sequence
+	close(r.appended)
+	r.appended = make(chan struct{})
+}
+
+func (r *replicationLog) close() {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.appended)
+	}
+}
+
+// sequence of the oldest batch the log has, caller must hold r.Mu
+func (r *replicationLog) firstSequence() uint64 {
+	if len(r.batches) == 0 {
+		return r.lastSequence + 1
+	}
+	return r.batches[0].Sequence
+}
+
+// returns every batch committed after sequence `after`. Fails with ErrSequenceUnavailable if the log doesn't have all
+// of them anymore
+func (r *replicationLog) batchesAfter(after uint64) ([]ReplicatedBatch, error) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if after >= r.lastSequence {
+		return nil, nil
+	}
+	first := r.firstSequence()
+	if after+1 < first {
+		return nil, fmt.Errorf("%w: asked for %d, log has %d to %d", CustomError.ErrSequenceUnavailable, after+1, first, r.lastSequence)
+	}
+	return append([]ReplicatedBatch(nil), r.batches[after+1-first:]...), nil
+}
+
+// Returns every batch committed after sequence `after`, the ones the replication log dropped are read from the write
+// ahead log. Fails with ErrSequenceUnavailable if neither has all of them anymore. Caller must hold d.writeMu, so that
+// the replication log doesn't move on while the write ahead log is read
+func (d *DiskStore) batchesAfter(after uint64) ([]ReplicatedBatch, error) {
+	batches, err := d.replication.batchesAfter(after)
+	if !errors.Is(err, CustomError.ErrSequenceUnavailable) {
+		return batches, err
+	}
+	d.replication.Mu.Lock()
+	first := d.replication.firstSequence()
+	d.replication.Mu.Unlock()
+
+	reader := &walReader{wal: d.wal}
+	defer reader.close()
+	for sequence := after + 1; sequence < first; sequence++ {
+		batch, err := reader.read(sequence)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+	rest, err := d.replication.batchesAfter(first - 1)
+	if err != nil {
+		return nil, err
+	}
+	return append(batches, rest...), nil
+}
+
+// returns the sequence of the last committed write batch, 0 if nothing was ever written
+func (d *DiskStore) LastSequence() uint64 {
+	d.replication.Mu.Lock()
+	defer d.replication.Mu.Unlock()
+	return d.replication.lastSequence
+}
+
+// records the last sequence of the primary a follower replicates from, Stats reports how far behind it the db is
+func (d *DiskStore) ReportPrimarySequence(sequence uint64) {
+	d.replication.Mu.Lock()
+	defer d.replication.Mu.Unlock()
+	d.replication.primarySequence = sequence
+}
+
+// batches of the replication log from some sequence on, in order. Batches the replication log doesn't have are read
+// from the write ahead log
+type ReplicationSubscription struct {
+	log  *replicationLog
+	wal  *walReader
+	next uint64
+}
+
+func (d *DiskStore) newReplicationSubscription(next uint64) *ReplicationSubscription {
+	return &ReplicationSubscription{log: d.replication, wal: &walReader{wal: d.wal}, next: next}
+}
+
+// Returns a subscription to every batch starting from sequence `from`, which must be closed. Fails with
+// ErrSequenceUnavailable if neither the replication log nor the write ahead log have that batch anymore, or if `from`
+// is past the next sequence to be written
+func (d *DiskStore) SubscribeReplication(from uint64) (*ReplicationSubscription, error) {
+	walFirst, hasWAL := d.wal.firstSequence()
+	d.replication.Mu.Lock()
+	defer d.replication.Mu.Unlock()
+	first := d.replication.firstSequence()
+	if hasWAL && walFirst < first {
+		first = walFirst
+	}
+	if from < first || from > d.replication.lastSequence+1 {
+		return nil, fmt.Errorf("%w: asked for %d, log has %d to %d", CustomError.ErrSequenceUnavailable, from, first, d.replication.lastSequence)
+	}
+	return d.newReplicationSubscription(from), nil
+}
+
+// Returns the next batch, waiting for it to be committed. Fails with ErrSequenceUnavailable once the subscriber falls
+// so far behind that neither log has the batch, with ErrDbClosed once the db is closed and with ctx's error once ctx
+// is done
+func (s *ReplicationSubscription) Next(ctx context.Context) (ReplicatedBatch, error) {
+	for {
+		s.log.Mu.Lock()
+		if s.log.closed {
+			s.log.Mu.Unlock()
+			s.wal.close()
+			return ReplicatedBatch{}, CustomError.ErrDbClosed
+		}
+		if s.next <= s.log.lastSequence {
+			first := s.log.firstSequence()
+			if s.next < first {
+				s.log.Mu.Unlock()
+				// committed, so its record is complete in the write ahead log (if it is still there)
+				batch, err := s.wal.read(s.next)
+				if err != nil {
+					s.wal.close()
+					return ReplicatedBatch{}, err
+				}
+				s.next++
+				return batch, nil
+			}
+			batch := s.log.batches[s.next-first]
+			s.next++
+			s.log.Mu.Unlock()
+			// caught up with the replication log
+			s.wal.close()
+			return batch, nil
+		}
+		appended := s.log.appended
+		s.log.Mu.Unlock()
+
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ReplicatedBatch{}, ctx.Err()
+		}
+	}
+}
+
+// the sequence of the batch Next returns next
+func (s *ReplicationSubscription) NextSequence() uint64 {
+	return s.next
+}
+
+// closes the write ahead log file the subscription may be reading, every subscription has to be closed once it's no
+// longer needed. Next can still be called afterwards, it opens the file again if it has to
+func (s *ReplicationSubscription) Close() {
+	s.wal.close()
+}
+
+// Applies a batch streamed from the primary. Batches have to come in order, one that doesn't directly follow the last
+// sequence of the db fails with ErrSequenceGap. Works on read only dbs
+func (d *DiskStore) ApplyReplicatedBatch(batch ReplicatedBatch) error {
+	writeBatch, err := DecodeWriteBatch(batch.Data)
+	if err != nil {
+		return err
+	}
+	d.counters.recordUserWrite(writeBatch.bytes)
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	if last := d.LastSequence(); batch.Sequence != last+1 {
+		return fmt.Errorf("%w: got %d after %d", CustomError.ErrSequenceGap, batch.Sequence, last)
+	}
+	return d.commitLocked(writeBatch, batch.Sequence)
+}
+
+// the segments of the db as of one sequence, pinned till Release is called
+type ReplicationSnapshot struct {
+	Sequence uint64              // every batch up to this one is in the segments, none after it
+	Levels   [][]SegmentMetadata // segments of every level, in manifest order
+	d        *DiskStore
+	unpin    func()
+}
+
+// returns the path of the file of one of the snapshot's segments
+func (s *ReplicationSnapshot) SegmentPath(segmentId uint32) string {
+	return s.d.segmentFilePath(segmentId)
+}
+
+func (s *ReplicationSnapshot) Release() {
+	s.unpin()
+}
+
+// Flushes the memtable and returns the segments of the db, which then hold every committed batch
+func (d *DiskStore) CreateReplicationSnapshot() *ReplicationSnapshot {
+	d.writeMu.Lock()
+	d.flushLocked()
+	sequence := d.LastSequence()
+	manifest, unpin := d.pinCurrentSegments()
+	d.writeMu.Unlock()
+
+	snapshot := &ReplicationSnapshot{Sequence: sequence, d: d, unpin: unpin}
+	for _, level := range manifest.SegmentLevels {
+		snapshot.Levels = append(snapshot.Levels, level.Segments)
+	}
+	return snapshot
+}
+
+// Replaces everything in the db with the segment files, level by level as they were in the primary's snapshot, and
+// continues from its sequence. The files are linked into the db (copied across filesystems) and must not be changed
+// afterwards
+func (d *DiskStore) InstallSnapshot(sequence uint64, levels [][]string) error {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":         "InstallSnapshot",
+		"param_sequence": sequence,
+	})
+	l.Infoln("Attempting to install a snapshot")
+
+	newLevels := make([][]SegmentMetadata, len(levels))
+	for level, paths := range levels {
+		for _, path := range paths {
+			report, err := InspectSegmentFile(path)
+			if err != nil {
+				return err
+			}
+			if len(report.Problems) > 0 {
+				return fmt.Errorf("%s is not a valid segment: %s", path, report.Problems[0])
+			}
+			newLevels[level] = append(newLevels[level], SegmentMetadata{
+				Cardinality:  report.Records,
+				SmallestKey:  report.SmallestKey,
+				LargestKey:   report.LargestKey,
+				Size:         report.FileSize,
+				LastSequence: sequence,
+				Mu:           &sync.Mutex{},
+			})
+		}
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	d.WaitForAuxillaryMemtableFlush()
+	// compactions must not publish outputs made from the segments which are about to go away
+	d.CompactionScheduler.Pause()
+	d.CompactionScheduler.WaitForIdle()
+	defer func() {
+		d.CompactionScheduler.Resume()
+		d.CompactionScheduler.MaybeScheduleCompaction()
+	}()
+
+	var linked []SegmentMetadata
+	for level, paths := range levels {
+		for i, path := range paths {
+			newLevels[level][i].SegmentId = d.GetNewSegmentId()
+			if err := utils.LinkOrCopyFile(path, d.segmentFilePath(newLevels[level][i].SegmentId)); err != nil {
+				d.deleteSegmentFiles(linked)
+				l.Errorln(err)
+				return err
+			}
+			linked = append(linked, newLevels[level][i])
+		}
+	}
+	if err := utils.SyncDir(d.dirPath()); err != nil {
+		d.deleteSegmentFiles(linked)
+		return err
+	}
+	// the batches in the write ahead log are older than the snapshot. It goes before the manifest is written, a crash
+	// in between leaves the db as of its last flush
+	if err := d.wal.reset(sequence + 1); err != nil {
+		d.deleteSegmentFiles(linked)
+		l.Errorln(err)
+		return err
+	}
+
+	d.Manifest.Mu.Lock()
+	if len(newLevels) > 0 {
+		d.addLevelsUpTo(uint32(len(newLevels) - 1))
+	}
+	oldLevels := make([][]SegmentMetadata, len(d.Manifest.SegmentLevels))
+	var oldSegments []SegmentMetadata
+	// the levels are kept, only their segments change
+	for level := range d.Manifest.SegmentLevels {
+		d.Manifest.SegmentLevels[level].Mu.Lock()
+		oldLevels[level] = d.Manifest.SegmentLevels[level].Segments
+		oldSegments = append(oldSegments, oldLevels[level]...)
+		d.Manifest.SegmentLevels[level].Segments = []SegmentMetadata{}
+		if level < len(newLevels) && newLevels[level] != nil {
+			d.Manifest.SegmentLevels[level].Segments = newLevels[level]
+		}
+		d.Manifest.SegmentLevels[level].Mu.Unlock()
+	}
+	oldSequence := d.Manifest.LastSequence
+	d.Manifest.LastSequence = sequence
+	if err := d.persistManifest(); err != nil {
+		for level := range oldLevels {
+			d.Manifest.SegmentLevels[level].Segments = oldLevels[level]
+		}
+		d.Manifest.LastSequence = oldSequence
+		d.Manifest.Mu.Unlock()
+		d.deleteSegmentFiles(linked)
+		// the memtable is only in memory now, the db is back to its last flush if it crashes
+		if err := d.wal.reset(d.LastSequence() + 1); err != nil {
+			l.Errorln(err)
+		}
+		l.Errorln(err)
+		return err
+	}
+	memtable := d.newMemtable(int32(d.nextSegmentId()))
+	d.Manifest.Mu.Unlock()
+
+	// whatever the memtables hold is older than the snapshot
+	memtable.LastSequence = sequence
+	d.memtablesMu.Lock()
+	d.Memtable = memtable
+	d.AuxillaryMemtable = nil
+	d.memtablesMu.Unlock()
+	d.replication.reset(sequence)
+
+	d.deleteSegmentFiles(oldSegments)
+	for level, segments := range oldLevels {
+		for _, segment := range segments {
+			d.events.segmentDeleted(SegmentInfo{DbName: d.Manifest.DbName, SegmentId: segment.SegmentId, Level: uint32(level), Size: segment.Size})
+		}
+	}
+	for level, segments := range newLevels {
+		for _, segment := range segments {
+			d.events.segmentCreated(SegmentInfo{DbName: d.Manifest.DbName, SegmentId: segment.SegmentId, Level: uint32(level), Size: segment.Size})
+		}
+	}
+	l.Infof("Installed a snapshot of %d segments at sequence %d", len(linked), sequence)
+	return nil
+}
+
+// moves the sequence recorded in the manifest forward, caller must hold d.Manifest.Mu
+func (d *DiskStore) advanceLastSequence(sequence uint64) {
+	if sequence > d.Manifest.LastSequence {
+		d.Manifest.LastSequence = sequence
+	}
+}
@@ -0,0 +1,48 @@
+package disk_store
+
+import (
+	"strings"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+/*
+	- scans walk an Iterator, see iterator.go. They see a snapshot of the db taken when they began, writes made during
+	  the scan don't show up, and flushes and compactions are not held up by them
+*/
+
+// Calls fn for every live key in [start, end] in sorted order until fn returns false. Empty start or end means the
+// range is unbounded on that side. Sees the db as it was when the scan began
+func (d *DiskStore) Scan(start string, end string, fn func(key string, value string) bool) error {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":      "Scan",
+		"param_start": d.loggable(start),
+		"param_end":   d.loggable(end),
+	})
+	l.Infoln("Attempting to scan range")
+
+	it := d.NewIterator(start, end)
+	defer it.Close()
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	if err := it.Err(); err != nil {
+		l.Errorln(err)
+		return err
+	}
+	return nil
+}
+
+// Calls fn for every live key starting with prefix in sorted order until fn returns false
+func (d *DiskStore) ScanPrefix(prefix string, fn func(key string, value string) bool) error {
+	it := d.NewIterator(prefix, "")
+	defer it.Close()
+	for it.Next() && strings.HasPrefix(it.Key(), prefix) {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Err()
+}
@@ -0,0 +1,274 @@
+package disk_store
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statistics of a single level
+type LevelStats struct {
+	Level            uint32
+	NumberOfSegments int
+	Bytes            uint64 // total size of the segment files of the level
+	// compactions which wrote their output into this level
+	Compactions            uint64
+	CompactionBytesRead    uint64
+	CompactionBytesWritten uint64
+	CompactionTime         time.Duration
+}
+
+// point in time statistics of the db returned by DiskStore.Stats
+type Stats struct {
+	Levels []LevelStats
+
+	MemtableBytes          uint64
+	MemtableKeys           int
+	AuxillaryMemtableBytes uint64 // memtable which is being written to disk, 0 if there's none
+	AuxillaryMemtableKeys  int
+
+	TableCacheSegments int
+	TableCacheHits     uint64
+	TableCacheMisses   uint64
+	TableCacheHitRate  float64 // hits / (hits + misses), 0 if there were no lookups
+
+	Flushes                uint64
+	FlushBytesWritten      uint64
+	Compactions            uint64
+	CompactionBytesRead    uint64
+	CompactionBytesWritten uint64
+	UserBytesWritten       uint64  // size of keys and values passed to Put
+	WriteAmplification     float64 // bytes written to segment files / UserBytesWritten
+
+	Stalls    uint64        // number of times writes were stopped because level 0 had too many segments
+	StallTime time.Duration // total time writes spent waiting for flushes and compactions
+
+	CompactionRateLimit uint64 // bytes per second, 0 means unlimited
+
+	WALFiles int
+	WALBytes uint64 // total size of the write ahead log files, flushed batches kept for subscribers included
+
+	LastSequence    uint64 // sequence of the last committed write batch
+	PrimarySequence uint64 // followers only, the last sequence the primary reported
+	ReplicationLag  uint64 // followers only, number of the primary's batches not applied yet
+}
+
+// counters which are updated as the db goes, Stats takes a snapshot of them
+type storeCounters struct {
+	flushes           uint64
+	flushBytesWritten uint64
+	userBytesWritten  uint64
+	stalls            uint64
+	stallTime         time.Duration
+	levelCompactions  map[uint32]*LevelStats // keyed by output level, only the compaction fields are used
+	Mu                *sync.Mutex
+}
+
+func newStoreCounters() *storeCounters {
+	return &storeCounters{
+		levelCompactions: make(map[uint32]*LevelStats),
+		Mu:               &sync.Mutex{},
+	}
+}
+
+func (c *storeCounters) recordUserWrite(bytes int) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.userBytesWritten += uint64(bytes)
+}
+
+func (c *storeCounters) recordFlush(bytes uint64) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.flushes++
+	c.flushBytesWritten += bytes
+}
+
+func (c *storeCounters) recordCompaction(level uint32, stats CompactionStats) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	levelStats, ok := c.levelCompactions[level]
+	if !ok {
+		levelStats = &LevelStats{Level: level}
+		c.levelCompactions[level] = levelStats
+	}
+	levelStats.Compactions++
+	levelStats.CompactionBytesRead += stats.BytesRead
+	levelStats.CompactionBytesWritten += stats.BytesWritten
+	levelStats.CompactionTime += stats.Duration
+}
+
+func (c *storeCounters) recordStall(duration time.Duration, stoppedByLevel0 bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if stoppedByLevel0 {
+		c.stalls++
+	}
+	c.stallTime += duration
+}
+
+// Returns a snapshot of the runtime statistics of the db
+func (d *DiskStore) Stats() Stats {
+	var stats Stats
+
+	d.Manifest.Mu.Lock()
+	for i := range d.Manifest.SegmentLevels {
+		d.Manifest.SegmentLevels[i].Mu.Lock()
+		levelStats := LevelStats{
+			Level:            uint32(i),
+			NumberOfSegments: len(d.Manifest.SegmentLevels[i].Segments),
+		}
+		for _, segment := range d.Manifest.SegmentLevels[i].Segments {
+			levelStats.Bytes += d.segmentBytes(segment)
+		}
+		d.Manifest.SegmentLevels[i].Mu.Unlock()
+		stats.Levels = append(stats.Levels, levelStats)
+	}
+	d.Manifest.Mu.Unlock()
+
+	mt, auxMt := d.memtables()
+	stats.MemtableBytes = mt.SizeInBytes()
+	stats.MemtableKeys = mt.Size()
+	if auxMt != nil {
+		stats.AuxillaryMemtableBytes = auxMt.SizeInBytes()
+		stats.AuxillaryMemtableKeys = auxMt.Size()
+	}
+
+	stats.TableCacheSegments = d.TableCache.Len()
+	stats.TableCacheHits, stats.TableCacheMisses = d.TableCache.HitsAndMisses()
+	if lookups := stats.TableCacheHits + stats.TableCacheMisses; lookups > 0 {
+		stats.TableCacheHitRate = float64(stats.TableCacheHits) / float64(lookups)
+	}
+
+	d.counters.Mu.Lock()
+	stats.Flushes = d.counters.flushes
+	stats.FlushBytesWritten = d.counters.flushBytesWritten
+	stats.UserBytesWritten = d.counters.userBytesWritten
+	stats.Stalls = d.counters.stalls
+	stats.StallTime = d.counters.stallTime
+	for level, compactions := range d.counters.levelCompactions {
+		// levels which got emptied by compaction are still reported
+		for int(level) >= len(stats.Levels) {
+			stats.Levels = append(stats.Levels, LevelStats{Level: uint32(len(stats.Levels))})
+		}
+		stats.Levels[level].Compactions = compactions.Compactions
+		stats.Levels[level].CompactionBytesRead = compactions.CompactionBytesRead
+		stats.Levels[level].CompactionBytesWritten = compactions.CompactionBytesWritten
+		stats.Levels[level].CompactionTime = compactions.CompactionTime
+		stats.Compactions += compactions.Compactions
+		stats.CompactionBytesRead += compactions.CompactionBytesRead
+		stats.CompactionBytesWritten += compactions.CompactionBytesWritten
+	}
+	d.counters.Mu.Unlock()
+
+	if stats.UserBytesWritten > 0 {
+		stats.WriteAmplification = float64(stats.FlushBytesWritten+stats.CompactionBytesWritten) / float64(stats.UserBytesWritten)
+	}
+
+	stats.CompactionRateLimit = d.RateLimiter.GetBytesPerSecond()
+
+	stats.WALFiles, stats.WALBytes = d.wal.filesAndSize()
+
+	d.replication.Mu.Lock()
+	stats.LastSequence = d.replication.lastSequence
+	stats.PrimarySequence = d.replication.primarySequence
+	if stats.PrimarySequence > stats.LastSequence {
+		stats.ReplicationLag = stats.PrimarySequence - stats.LastSequence
+	}
+	d.replication.Mu.Unlock()
+
+	return stats
+}
+
+const PROPERTY_PREFIX = "caskdb."
+
+// Returns the value of a db property as a string, along with whether the property exists. Supported properties are
+//   - caskdb.stats: multi line summary of levels, compactions, memtables, cache and stalls
+//   - caskdb.num-files-at-level<N>: number of segments at level N
+//   - caskdb.sstables: segments of every level along with their key ranges
+//   - caskdb.approximate-memory-usage: bytes held by the memtables
+//   - caskdb.total-wal-size: bytes of write ahead log files
+func (d *DiskStore) GetProperty(name string) (string, bool) {
+	if !strings.HasPrefix(name, PROPERTY_PREFIX) {
+		return "", false
+	}
+	name = strings.TrimPrefix(name, PROPERTY_PREFIX)
+
+	switch {
+	case name == "stats":
+		return formatStats(d.Stats()), true
+	case strings.HasPrefix(name, "num-files-at-level"):
+		level, err := strconv.ParseUint(strings.TrimPrefix(name, "num-files-at-level"), 10, 32)
+		if err != nil {
+			return "", false
+		}
+		return strconv.Itoa(d.numberOfSegmentsInLevel(uint32(level))), true
+	case name == "sstables":
+		return d.formatSegments(), true
+	case name == "approximate-memory-usage":
+		stats := d.Stats()
+		return strconv.FormatUint(stats.MemtableBytes+stats.AuxillaryMemtableBytes, 10), true
+	case name == "total-wal-size":
+		_, size := d.wal.filesAndSize()
+		return strconv.FormatUint(size, 10), true
+	}
+	return "", false
+}
+
+func formatStats(stats Stats) string {
+	var buf bytes.Buffer
+	buf.WriteString("                               Compactions\n")
+	buf.WriteString("Level  Files Size(KB) Time(sec) Read(KB) Write(KB)\n")
+	buf.WriteString("--------------------------------------------------\n")
+	for _, level := range stats.Levels {
+		if level.NumberOfSegments == 0 && level.Compactions == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "%3d %8d %8.0f %9.0f %8.0f %9.0f\n",
+			level.Level,
+			level.NumberOfSegments,
+			float64(level.Bytes)/1024.0,
+			level.CompactionTime.Seconds(),
+			float64(level.CompactionBytesRead)/1024.0,
+			float64(level.CompactionBytesWritten)/1024.0)
+	}
+	fmt.Fprintf(&buf, "Memtable: %d keys, %d bytes\n", stats.MemtableKeys, stats.MemtableBytes)
+	fmt.Fprintf(&buf, "Auxillary memtable: %d keys, %d bytes\n", stats.AuxillaryMemtableKeys, stats.AuxillaryMemtableBytes)
+	fmt.Fprintf(&buf, "Table cache: %d segments, %d hits, %d misses, hit rate %.3f\n", stats.TableCacheSegments, stats.TableCacheHits, stats.TableCacheMisses, stats.TableCacheHitRate)
+	fmt.Fprintf(&buf, "Flushes: %d, %d bytes written\n", stats.Flushes, stats.FlushBytesWritten)
+	fmt.Fprintf(&buf, "Compactions: %d, %d bytes read, %d bytes written\n", stats.Compactions, stats.CompactionBytesRead, stats.CompactionBytesWritten)
+	fmt.Fprintf(&buf, "User bytes written: %d, write amplification %.2f\n", stats.UserBytesWritten, stats.WriteAmplification)
+	fmt.Fprintf(&buf, "Stalls: %d, stall time %.3f sec\n", stats.Stalls, stats.StallTime.Seconds())
+	fmt.Fprintf(&buf, "WAL: %d files, %d bytes\n", stats.WALFiles, stats.WALBytes)
+	fmt.Fprintf(&buf, "Last sequence: %d\n", stats.LastSequence)
+	if stats.PrimarySequence > 0 {
+		fmt.Fprintf(&buf, "Primary sequence: %d, replication lag %d batches\n", stats.PrimarySequence, stats.ReplicationLag)
+	}
+	return buf.String()
+}
+
+func (d *DiskStore) formatSegments() string {
+	var buf bytes.Buffer
+	d.Manifest.Mu.Lock()
+	defer d.Manifest.Mu.Unlock()
+	for i := range d.Manifest.SegmentLevels {
+		d.Manifest.SegmentLevels[i].Mu.Lock()
+		fmt.Fprintf(&buf, "--- level %d ---\n", i)
+		for _, segment := range d.Manifest.SegmentLevels[i].Segments {
+			fmt.Fprintf(&buf, " %d:%d[%q .. %q]\n", segment.SegmentId, d.segmentBytes(segment), segment.SmallestKey, segment.LargestKey)
+		}
+		d.Manifest.SegmentLevels[i].Mu.Unlock()
+	}
+	return buf.String()
+}
+
+// returns the size of the segment, from the manifest if it's known there or else from the file
+func (d *DiskStore) segmentBytes(segment SegmentMetadata) uint64 {
+	if segment.Size > 0 {
+		return segment.Size
+	}
+	return d.segmentFileSize(segment.SegmentId)
+}
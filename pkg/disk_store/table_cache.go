@@ -0,0 +1,97 @@
+package disk_store
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/memtable"
+)
+
+// LRU cache of segments loaded into memory, keyed by segment id. Segment files are never modified once written
+// (see crash safety in docs) so an entry can never go stale, it only has to be dropped once the segment is deleted
+type TableCache struct {
+	capacity int
+	entries  map[uint32]*list.Element
+	lru      *list.List // front is the most recently used
+	Hits     uint64
+	Misses   uint64
+	Mu       *sync.Mutex
+}
+
+type tableCacheEntry struct {
+	segmentId uint32
+	memtable  *memtable.MemTable
+}
+
+// returns a cache holding at most `capacity` segments, 0 disables caching
+func NewTableCache(capacity int) *TableCache {
+	return &TableCache{
+		capacity: capacity,
+		entries:  make(map[uint32]*list.Element),
+		lru:      list.New(),
+		Mu:       &sync.Mutex{},
+	}
+}
+
+func (c *TableCache) Get(segmentId uint32) (*memtable.MemTable, bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	element, ok := c.entries[segmentId]
+	if !ok {
+		c.Misses++
+		return nil, false
+	}
+	c.Hits++
+	c.lru.MoveToFront(element)
+	return element.Value.(*tableCacheEntry).memtable, true
+}
+
+func (c *TableCache) Add(segmentId uint32, mt *memtable.MemTable) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	if element, ok := c.entries[segmentId]; ok {
+		element.Value.(*tableCacheEntry).memtable = mt
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[segmentId] = c.lru.PushFront(&tableCacheEntry{segmentId: segmentId, memtable: mt})
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tableCacheEntry).segmentId)
+	}
+}
+
+func (c *TableCache) Evict(segmentId uint32) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if element, ok := c.entries[segmentId]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, segmentId)
+	}
+}
+
+// drops every entry, hit and miss counts are kept
+func (c *TableCache) Clear() {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.entries = make(map[uint32]*list.Element)
+	c.lru.Init()
+}
+
+// returns the number of cached segments
+func (c *TableCache) Len() int {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.lru.Len()
+}
+
+// returns the hits and misses so far
+func (c *TableCache) HitsAndMisses() (uint64, uint64) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Hits, c.Misses
+}
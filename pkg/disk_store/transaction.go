@@ -0,0 +1,233 @@
+package disk_store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/metrics"
+)
+
+/*
+	- optimistic: a transaction reads the db as it is, buffers its writes and only checks for conflicts on commit
+	- it remembers the sequence of the last batch committed when it began, the keys it read and the ranges it iterated.
+	  Commit goes through the batches committed since that sequence and fails with ErrConflict if one of them wrote a
+	  key it read. Writes of keys that were only written, not read, never conflict
+	- the batches come from the replication log, the ones it dropped already from the write ahead log (more than
+	  Options.ReplicationLogSize writes since Begin, or any at all if it is 0). Once neither has all of them (the write
+	  ahead log deleted flushed files beyond Options.WALRetentionSize, an ingest or a snapshot install happened since
+	  Begin) there is no telling, Commit fails with ErrConflict as well
+	- reads are not from a snapshot, Get and Iterator see the db as it is when they are called. A read might see a
+	  write committed after Begin, such a transaction always fails to commit, so a committed transaction only ever saw
+	  the db as of Begin
+	- the buffered writes are committed as one batch under the write lock, validation included
+*/
+
+type keyRange struct {
+	start string
+	end   string
+}
+
+func (r keyRange) contains(key string) bool {
+	return (r.start == "" || key >= r.start) && (r.end == "" || key <= r.end)
+}
+
+// a transaction of a db, not safe for concurrent use
+type Txn struct {
+	db            *DiskStore
+	startSequence uint64
+	writes        map[string]batchOperation // the last write of every key
+	reads         map[string]bool
+	ranges        []keyRange
+	done          bool
+}
+
+// starts a transaction, which has to be ended with Commit or Rollback
+func (d *DiskStore) Begin() *Txn {
+	return &Txn{
+		db:            d,
+		startSequence: d.LastSequence(),
+		writes:        make(map[string]batchOperation),
+		reads:         make(map[string]bool),
+	}
+}
+
+func (t *Txn) Get(key string) string {
+	value, _ := t.Lookup(key)
+	return value
+}
+
+// same as DiskStore.Lookup, sees the writes of the transaction
+func (t *Txn) Lookup(key string) (string, bool) {
+	if operation, ok := t.writes[key]; ok {
+		return operation.value, operation.kind != format.RECORD_KIND_TOMBSTONE
+	}
+	t.reads[key] = true
+	return t.db.Lookup(key)
+}
+
+func (t *Txn) Put(key string, value string) {
+	t.writes[key] = batchOperation{key: key, value: value, kind: format.RECORD_KIND_VALUE}
+}
+
+func (t *Txn) Delete(key string) {
+	t.writes[key] = batchOperation{key: key, kind: format.RECORD_KIND_TOMBSTONE}
+}
+
+// Returns an iterator over the keys in [start, end] (empty means unbounded) in sorted order, writes of the
+// transaction included. The whole range counts as read, a key written into it by someone else fails the commit
+func (t *Txn) Iterator(start string, end string) *TxnIterator {
+	r := keyRange{start: start, end: end}
+	t.ranges = append(t.ranges, r)
+
+	values := make(map[string]string)
+	err := t.db.Scan(start, end, func(key string, value string) bool {
+		values[key] = value
+		return true
+	})
+	for key, operation := range t.writes {
+		if !r.contains(key) {
+			continue
+		}
+		if operation.kind == format.RECORD_KIND_TOMBSTONE {
+			delete(values, key)
+		} else {
+			values[key] = operation.value
+		}
+	}
+
+	it := &TxnIterator{values: values, position: -1, err: err}
+	for key := range values {
+		it.keys = append(it.keys, key)
+	}
+	sort.Strings(it.keys)
+	return it
+}
+
+// Applies the writes as one batch if no key the transaction read was written since Begin, fails with ErrConflict
+// (wrapped) otherwise. The transaction is over either way
+func (t *Txn) Commit() error {
+	var l = t.db.Logger.WithFields(logger.Fields{
+		"method": "Commit",
+		"writes": len(t.writes),
+	})
+	l.Infoln("Attempting to commit a transaction")
+
+	if t.done {
+		return CustomError.ErrTxnClosed
+	}
+	t.done = true
+	if t.db.Options.ReadOnly {
+		return CustomError.ErrReadOnly
+	}
+
+	startTime := time.Now()
+	defer func() {
+		t.db.Metrics.ObserveOperation(metrics.OPERATION_TRANSACTION, time.Since(startTime))
+	}()
+
+	// sorted so that the batch doesn't depend on map order
+	keys := make([]string, 0, len(t.writes))
+	for key := range t.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	batch := NewWriteBatch()
+	for _, key := range keys {
+		operation := t.writes[key]
+		if operation.kind == format.RECORD_KIND_TOMBSTONE {
+			batch.Delete(key)
+		} else {
+			batch.Put(key, operation.value)
+		}
+	}
+
+	t.db.writeMu.Lock()
+	defer t.db.writeMu.Unlock()
+	if err := t.validateLocked(); err != nil {
+		l.Infoln(err)
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	t.db.counters.recordUserWrite(batch.bytes)
+	if err := t.db.commitLocked(batch, t.db.LastSequence()+1); err != nil {
+		l.Errorln(err)
+		return err
+	}
+	return nil
+}
+
+// drops the writes of the transaction
+func (t *Txn) Rollback() {
+	t.done = true
+}
+
+// checks the batches committed since Begin against the reads, caller must hold t.db.writeMu
+func (t *Txn) validateLocked() error {
+	if len(t.reads) == 0 && len(t.ranges) == 0 {
+		return nil
+	}
+	batches, err := t.db.batchesAfter(t.startSequence)
+	if err != nil {
+		return fmt.Errorf("%w: %v", CustomError.ErrConflict, err)
+	}
+	for _, replicated := range batches {
+		batch, err := DecodeWriteBatch(replicated.Data)
+		if err != nil {
+			return err
+		}
+		for _, operation := range batch.operations {
+			if t.readKey(operation.key) {
+				return fmt.Errorf("%w: key written by batch %d", CustomError.ErrConflict, replicated.Sequence)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Txn) readKey(key string) bool {
+	if t.reads[key] {
+		return true
+	}
+	for _, r := range t.ranges {
+		if r.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// walks the keys of Txn.Iterator, which were all read when it was created
+type TxnIterator struct {
+	keys     []string
+	values   map[string]string
+	position int
+	err      error
+}
+
+// moves to the next key, false once there are no more keys (or the scan failed, see Err)
+func (it *TxnIterator) Next() bool {
+	if it.err != nil || it.position+1 >= len(it.keys) {
+		return false
+	}
+	it.position++
+	return true
+}
+
+func (it *TxnIterator) Key() string {
+	return it.keys[it.position]
+}
+
+func (it *TxnIterator) Value() string {
+	return it.values[it.keys[it.position]]
+}
+
+// the error of the scan behind the iterator, if any
+func (it *TxnIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,420 @@
+package disk_store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/utils"
+)
+
+/*
+	- every write batch is appended to the write ahead log before it is applied to the memtable, the batches which
+	  didn't make it into a segment file yet are replayed from it when the db is opened
+	- the log is a directory of files named after the sequence they start at. A new file is started whenever the
+	  memtable is rotated and every time the db is opened
+	- a record is crc | length | sequence | type | data, written with a single write call. A crash in the middle of one
+	  leaves a torn record at the end of the file, replay and readers stop reading the file there
+	- records are handed to the os, they survive the process crashing. Options.SyncWAL fsyncs every record so that they
+	  survive the machine crashing as well, at the cost of much slower writes
+	- files whose batches are all in segment files are kept for subscribers which are behind, up to
+	  Options.WALRetentionSize bytes. The oldest ones are deleted beyond that, when the memtable is rotated
+	- ingested segments take a sequence of their own, a reset record marks it. Installing a snapshot deletes the whole
+	  log, the batches before the snapshot are gone for good
+*/
+
+const (
+	WAL_DIR_NAME           = "wal"
+	WAL_FILE_EXTENSION     = ".log"
+	WAL_RECORD_HEADER_SIZE = 17 // crc, length, sequence and type
+)
+
+type walRecordType byte
+
+const (
+	WAL_RECORD_BATCH walRecordType = 1 // data is WriteBatch.Encode of the batch
+	WAL_RECORD_RESET walRecordType = 2 // the sequence was taken by ingested segments, no data
+)
+
+type walRecord struct {
+	sequence   uint64
+	recordType walRecordType
+	data       []byte
+}
+
+type walFile struct {
+	firstSequence uint64 // records in the file have this sequence or a later one
+	size          uint64
+}
+
+type writeAheadLog struct {
+	dirPath    string
+	syncWrites bool      // fsync after every append
+	files      []walFile // oldest first, records are appended to the last one
+	file       *os.File  // nil till the log is started and once it is closed
+	err        error     // set when a failed append couldn't be undone, every append fails from then on
+	closed     bool
+	Mu         *sync.Mutex
+}
+
+// opens the log in dirPath, creating the directory if needed. Nothing can be appended till start is called
+func openWriteAheadLog(dirPath string, syncWrites bool) (*writeAheadLog, error) {
+	if err := os.MkdirAll(dirPath, 0777); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{dirPath: dirPath, syncWrites: syncWrites, Mu: &sync.Mutex{}}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, WAL_FILE_EXTENSION) {
+			continue
+		}
+		firstSequence, err := strconv.ParseUint(strings.TrimSuffix(name, WAL_FILE_EXTENSION), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		w.files = append(w.files, walFile{firstSequence: firstSequence, size: uint64(info.Size())})
+	}
+	sort.Slice(w.files, func(i, j int) bool {
+		return w.files[i].firstSequence < w.files[j].firstSequence
+	})
+	return w, nil
+}
+
+func (w *writeAheadLog) filePath(firstSequence uint64) string {
+	return fmt.Sprintf("%s/%020d%s", w.dirPath, firstSequence, WAL_FILE_EXTENSION)
+}
+
+func encodeWALRecord(record walRecord) []byte {
+	buf := make([]byte, WAL_RECORD_HEADER_SIZE+len(record.data))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(record.data)))
+	binary.LittleEndian.PutUint64(buf[8:16], record.sequence)
+	buf[16] = byte(record.recordType)
+	copy(buf[WAL_RECORD_HEADER_SIZE:], record.data)
+	// the crc covers everything after itself
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// reads the next record, io.EOF at the end of the file. A torn or corrupted record fails with ErrCorruptedWAL
+func readWALRecord(r io.Reader) (walRecord, error) {
+	header := make([]byte, WAL_RECORD_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return walRecord{}, io.EOF
+		}
+		return walRecord{}, fmt.Errorf("%w: torn header", CustomError.ErrCorruptedWAL)
+	}
+	length := binary.LittleEndian.Uint32(header[4:8])
+	// a garbled length must not turn into a huge allocation, the data is read as far as it goes
+	data, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return walRecord{}, err
+	}
+	if uint32(len(data)) != length {
+		return walRecord{}, fmt.Errorf("%w: torn record", CustomError.ErrCorruptedWAL)
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	if crc.Sum32() != binary.LittleEndian.Uint32(header[0:4]) {
+		return walRecord{}, fmt.Errorf("%w: crc mismatch", CustomError.ErrCorruptedWAL)
+	}
+	return walRecord{
+		sequence:   binary.LittleEndian.Uint64(header[8:16]),
+		recordType: walRecordType(header[16]),
+		data:       data,
+	}, nil
+}
+
+// Calls apply for every record after sequence `after`, in order, and returns the sequence of the last one (after if
+// there is none). Replay stops at the first gap in the sequences, files past it can't be continued from and are
+// deleted. Only called before the log is started, apply may rotate the memtable, which leaves the log alone till then
+func (w *writeAheadLog) replay(after uint64, apply func(record walRecord) error) (uint64, error) {
+	last := after
+	for i := 0; i < len(w.files); i++ {
+		if i+1 < len(w.files) && w.files[i+1].firstSequence <= last+1 {
+			// everything in the file is older than what is needed
+			continue
+		}
+		if w.files[i].firstSequence > last+1 {
+			return last, w.deleteFilesLocked(i)
+		}
+		gap, err := w.replayFileLocked(w.files[i].firstSequence, &last, apply)
+		if err != nil {
+			return last, err
+		}
+		if gap {
+			return last, w.deleteFilesLocked(i + 1)
+		}
+	}
+	return last, nil
+}
+
+// replays the records of one file after *last, returns true if it ran into a gap
+func (w *writeAheadLog) replayFileLocked(firstSequence uint64, last *uint64, apply func(record walRecord) error) (bool, error) {
+	f, err := os.Open(w.filePath(firstSequence))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for {
+		record, err := readWALRecord(reader)
+		if err == io.EOF || errors.Is(err, CustomError.ErrCorruptedWAL) {
+			// a torn record can only be the last one written before a crash
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if record.sequence <= *last {
+			continue
+		}
+		if record.recordType == WAL_RECORD_BATCH && record.sequence != *last+1 {
+			return true, nil
+		}
+		if err := apply(record); err != nil {
+			return false, err
+		}
+		*last = record.sequence
+	}
+}
+
+// deletes the files from index i on, caller must hold w.Mu (or be replaying)
+func (w *writeAheadLog) deleteFilesLocked(i int) error {
+	for _, file := range w.files[i:] {
+		if err := utils.DeleteFile(w.filePath(file.firstSequence)); err != nil {
+			return err
+		}
+	}
+	w.files = w.files[:i]
+	return utils.SyncDir(w.dirPath)
+}
+
+// starts a new file for the records from sequence `next` on
+func (w *writeAheadLog) start(next uint64) error {
+	w.Mu.Lock()
+	defer w.Mu.Unlock()
+	return w.startLocked(next)
+}
+
+// caller must hold w.Mu
+func (w *writeAheadLog) startLocked(next uint64) error {
+	// the current file is only closed once the new one is there, appends carry on with it otherwise
+	f, err := os.OpenFile(w.filePath(next), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if err := utils.SyncDir(w.dirPath); err != nil {
+		f.Close()
+		return err
+	}
+	// an empty file left behind for the same sequence was just truncated
+	if len(w.files) > 0 && w.files[len(w.files)-1].firstSequence == next {
+		w.files = w.files[:len(w.files)-1]
+	}
+	w.files = append(w.files, walFile{firstSequence: next})
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = f
+	return nil
+}
+
+func (w *writeAheadLog) append(record walRecord) error {
+	w.Mu.Lock()
+	defer w.Mu.Unlock()
+	if w.closed {
+		return CustomError.ErrDbClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.file == nil {
+		return errors.New("write ahead log is not started")
+	}
+	current := &w.files[len(w.files)-1]
+	_, err := w.file.Write(encodeWALRecord(record))
+	if err == nil && w.syncWrites {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// the record must not be replayed, its sequence goes to the next batch
+		if truncateErr := w.file.Truncate(int64(current.size)); truncateErr != nil {
+			w.err = fmt.Errorf("write ahead log can't be appended to anymore: %v", truncateErr)
+		}
+		return err
+	}
+	current.size += uint64(WAL_RECORD_HEADER_SIZE + len(record.data))
+	return nil
+}
+
+// Starts a new file from sequence `next` on and deletes the oldest files as long as all of their batches are in
+// segment files (up to flushedSequence) and the log is larger than retentionSize. Does nothing till the log is
+// started
+func (w *writeAheadLog) rotate(next uint64, flushedSequence uint64, retentionSize uint64) error {
+	w.Mu.Lock()
+	defer w.Mu.Unlock()
+	if w.file == nil || w.err != nil {
+		return w.err
+	}
+	if w.files[len(w.files)-1].firstSequence != next {
+		if err := w.startLocked(next); err != nil {
+			return err
+		}
+	}
+
+	size := w.sizeLocked()
+	deleted := 0
+	for len(w.files) > 1 && size > retentionSize {
+		// a file ends where the next one starts
+		if w.files[1].firstSequence-1 > flushedSequence {
+			break
+		}
+		if err := utils.DeleteFile(w.filePath(w.files[0].firstSequence)); err != nil {
+			return err
+		}
+		size -= w.files[0].size
+		w.files = w.files[1:]
+		deleted++
+	}
+	if deleted > 0 {
+		return utils.SyncDir(w.dirPath)
+	}
+	return nil
+}
+
+// deletes every file and starts over from sequence `next`
+func (w *writeAheadLog) reset(next uint64) error {
+	w.Mu.Lock()
+	defer w.Mu.Unlock()
+	if w.closed {
+		return CustomError.ErrDbClosed
+	}
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	if err := w.deleteFilesLocked(0); err != nil {
+		return err
+	}
+	w.err = nil
+	return w.startLocked(next)
+}
+
+func (w *writeAheadLog) close() {
+	w.Mu.Lock()
+	defer w.Mu.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	w.closed = true
+}
+
+// number of log files and their total size in bytes
+func (w *writeAheadLog) filesAndSize() (int, uint64) {
+	w.Mu.Lock()
+	defer w.Mu.Unlock()
+	return len(w.files), w.sizeLocked()
+}
+
+func (w *writeAheadLog) sizeLocked() uint64 {
+	var size uint64
+	for _, file := range w.files {
+		size += file.size
+	}
+	return size
+}
+
+// sequence the oldest file starts at, ok is false if there are no files
+func (w *writeAheadLog) firstSequence() (uint64, bool) {
+	w.Mu.Lock()
+	defer w.Mu.Unlock()
+	if len(w.files) == 0 {
+		return 0, false
+	}
+	return w.files[0].firstSequence, true
+}
+
+// the first sequence of the file which would hold the record of sequence, ok is false if no file does
+func (w *writeAheadLog) fileFor(sequence uint64) (uint64, bool) {
+	w.Mu.Lock()
+	defer w.Mu.Unlock()
+	i := sort.Search(len(w.files), func(i int) bool {
+		return w.files[i].firstSequence > sequence
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return w.files[i-1].firstSequence, true
+}
+
+// reads the batches of a subscription which the replication log doesn't have, one after the other
+type walReader struct {
+	wal           *writeAheadLog
+	file          *os.File
+	reader        *bufio.Reader
+	firstSequence uint64 // of the open file
+}
+
+// returns the batch of a committed sequence, fails with ErrSequenceUnavailable if the log doesn't have it
+func (r *walReader) read(sequence uint64) (ReplicatedBatch, error) {
+	for {
+		if r.file == nil {
+			firstSequence, ok := r.wal.fileFor(sequence)
+			if !ok {
+				return ReplicatedBatch{}, fmt.Errorf("%w: batch %d is not in the write ahead log", CustomError.ErrSequenceUnavailable, sequence)
+			}
+			f, err := os.Open(r.wal.filePath(firstSequence))
+			if err != nil {
+				// deleted in the meantime
+				return ReplicatedBatch{}, fmt.Errorf("%w: batch %d: %v", CustomError.ErrSequenceUnavailable, sequence, err)
+			}
+			r.file, r.reader, r.firstSequence = f, bufio.NewReader(f), firstSequence
+		}
+
+		record, err := readWALRecord(r.reader)
+		if err != nil {
+			// the end of the file, the batch can only be in a later one
+			exhausted := r.firstSequence
+			r.close()
+			if firstSequence, ok := r.wal.fileFor(sequence); !ok || firstSequence == exhausted {
+				return ReplicatedBatch{}, fmt.Errorf("%w: batch %d is not in the write ahead log", CustomError.ErrSequenceUnavailable, sequence)
+			}
+			continue
+		}
+		if record.sequence < sequence {
+			continue
+		}
+		if record.sequence > sequence || record.recordType != WAL_RECORD_BATCH {
+			r.close()
+			return ReplicatedBatch{}, fmt.Errorf("%w: batch %d is not in the write ahead log", CustomError.ErrSequenceUnavailable, sequence)
+		}
+		return ReplicatedBatch{Sequence: record.sequence, Data: record.data}, nil
+	}
+}
+
+func (r *walReader) close() {
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file, r.reader = nil, nil
+}
@@ -0,0 +1,209 @@
+package disk_store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/memtable"
+	"github.com/abesheknarayan/go-caskdb/pkg/metrics"
+)
+
+/*
+	- a batch is applied under the write lock, so no other write lands in between its operations
+	- all operations of a batch go to the same memtable under its lock, readers see either none or all of them. A
+	  memtable too full for the batch is rotated first, an empty memtable takes a batch of any size
+	- a batch is appended to the write ahead log as one record before it is applied, after a crash it is replayed
+	  either whole or not at all
+	- every committed batch gets the next sequence number, Put and Delete are batches of one
+	- encoded, a batch is its operations as segment records with timestamp 0, the same bytes a segment file would hold
+*/
+
+type batchOperation struct {
+	key       string
+	value     string
+	kind      format.RecordKind
+	expiresAt int64 // unix milliseconds, for RECORD_KIND_EXPIRING_VALUE
+}
+
+// puts, deletes and merges applied together by DiskStore.Write, in the order they were added
+type WriteBatch struct {
+	operations []batchOperation
+	bytes      int // size of the keys and values
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key string, value string) {
+	b.operations = append(b.operations, batchOperation{key: key, value: value, kind: format.RECORD_KIND_VALUE})
+	b.bytes += len(key) + len(value)
+}
+
+// puts a value which reads as deleted once ttl passed, counted from now rather than from when the batch is committed.
+// A ttl <= 0 puts a value that is already expired
+func (b *WriteBatch) PutWithTTL(key string, value string, ttl time.Duration) {
+	b.PutWithExpiry(key, value, time.Now().Add(ttl))
+}
+
+// puts a value which reads as deleted from expiresAt on
+func (b *WriteBatch) PutWithExpiry(key string, value string, expiresAt time.Time) {
+	b.putExpiring(key, value, expiresAt.UnixMilli())
+}
+
+func (b *WriteBatch) putExpiring(key string, value string, expiresAt int64) {
+	b.operations = append(b.operations, batchOperation{key: key, value: value, kind: format.RECORD_KIND_EXPIRING_VALUE, expiresAt: expiresAt})
+	b.bytes += len(key) + len(value)
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.operations = append(b.operations, batchOperation{key: key, kind: format.RECORD_KIND_TOMBSTONE})
+	b.bytes += len(key)
+}
+
+// adds a merge operand for the key, see DiskStore.Merge
+func (b *WriteBatch) Merge(key string, operand string) {
+	b.operations = append(b.operations, batchOperation{key: key, value: operand, kind: format.RECORD_KIND_MERGE_OPERAND})
+	b.bytes += len(key) + len(operand)
+}
+
+// returns the number of operations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.operations)
+}
+
+// empties the batch so that it can be reused
+func (b *WriteBatch) Clear() {
+	b.operations = b.operations[:0]
+	b.bytes = 0
+}
+
+// fails with ErrKeyTooLarge if one of the keys is too large to be written
+func (b *WriteBatch) Validate() error {
+	for _, operation := range b.operations {
+		if int64(len(operation.key)) > int64(format.MAX_KEY_SIZE) {
+			return CustomError.ErrKeyTooLarge
+		}
+	}
+	return nil
+}
+
+// returns the operations of the batch encoded as segment records
+func (b *WriteBatch) Encode() []byte {
+	var buf bytes.Buffer
+	for _, operation := range b.operations {
+		_, record := format.EncodeRecordWithExpiry(0, operation.kind, operation.expiresAt, operation.key, operation.value)
+		buf.Write(record)
+	}
+	return buf.Bytes()
+}
+
+// decodes a batch encoded by WriteBatch.Encode
+func DecodeWriteBatch(data []byte) (*WriteBatch, error) {
+	batch := NewWriteBatch()
+	reader := format.NewSegmentReader(bytes.NewReader(data))
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return batch, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch record.Kind {
+		case format.RECORD_KIND_VALUE:
+			batch.Put(record.Key, record.Value)
+		case format.RECORD_KIND_TOMBSTONE:
+			batch.Delete(record.Key)
+		case format.RECORD_KIND_EXPIRING_VALUE:
+			batch.putExpiring(record.Key, record.Value, record.ExpiresAt)
+		case format.RECORD_KIND_MERGE_OPERAND:
+			batch.Merge(record.Key, record.Value)
+		default:
+			return nil, fmt.Errorf("%w: record of kind %s in a batch", CustomError.ErrCorruptedSegment, record.Kind)
+		}
+	}
+}
+
+// Applies the operations of the batch in order. Nothing is applied if one of the keys is too large, or if the batch
+// has merges and the db has no merge operator
+func (d *DiskStore) Write(batch *WriteBatch) error {
+	var l = d.Logger.WithFields(logger.Fields{
+		"method":           "Write",
+		"param_operations": batch.Len(),
+	})
+	l.Infof("Attempting to write a batch")
+	d.counters.recordUserWrite(batch.bytes)
+
+	startTime := time.Now()
+	defer func() {
+		d.Metrics.ObserveOperation(metrics.OPERATION_WRITE_BATCH, time.Since(startTime))
+	}()
+
+	if err := d.commit(batch); err != nil {
+		l.Errorln(err)
+		return err
+	}
+	return nil
+}
+
+// commits the batch under the next sequence number
+func (d *DiskStore) commit(batch *WriteBatch) error {
+	if d.Options.ReadOnly {
+		return CustomError.ErrReadOnly
+	}
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	return d.commitLocked(batch, d.LastSequence()+1)
+}
+
+// appends the batch to the write ahead log and applies it, caller must hold d.writeMu
+func (d *DiskStore) commitLocked(batch *WriteBatch, sequence uint64) error {
+	// checked up front, a batch that is only partly applied must not get a sequence number
+	if err := batch.Validate(); err != nil {
+		return err
+	}
+	if d.Options.MergeOperator == nil {
+		for _, operation := range batch.operations {
+			if operation.kind == format.RECORD_KIND_MERGE_OPERAND {
+				return CustomError.ErrNoMergeOperator
+			}
+		}
+	}
+	data := batch.Encode()
+	if err := d.wal.append(walRecord{sequence: sequence, recordType: WAL_RECORD_BATCH, data: data}); err != nil {
+		return err
+	}
+	return d.applyLocked(batch, sequence, data)
+}
+
+// applies the batch to the memtable and appends it to the replication log, it can't fail once the batch is validated.
+// Caller must hold d.writeMu
+func (d *DiskStore) applyLocked(batch *WriteBatch, sequence uint64, data []byte) error {
+	writes := make([]memtable.BatchWrite, len(batch.operations))
+	for i, operation := range batch.operations {
+		writes[i] = memtable.BatchWrite{
+			Key:       operation.key,
+			Value:     operation.value,
+			Kind:      operation.kind,
+			ExpiresAt: operation.expiresAt,
+			Sequence:  sequence,
+		}
+	}
+	// the whole batch goes to one memtable, a full memtable is rotated before the batch is applied
+	err := d.writeToMemtableLocked(func(mt *memtable.MemTable) error {
+		return mt.ApplyBatch(writes, d.Options.MergeOperator)
+	})
+	if err != nil {
+		return err
+	}
+	d.Memtable.LastSequence = sequence
+	d.replication.append(sequence, data)
+	return nil
+}
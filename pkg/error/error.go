@@ -3,8 +3,31 @@ package error
 import "errors"
 
 var (
-	ErrKeyDoesNotExist    = errors.New("key does not exist")
-	ErrMaxSizeExceeded    = errors.New("maximum memtable size reached")
-	ErrOpeningSegmentFile = errors.New("error while opening segment file")
-	ErrSegmentLevelEmpty  = errors.New("requested segment level is empty")
+	ErrKeyDoesNotExist           = errors.New("key does not exist")
+	ErrKeyDeleted                = errors.New("key was deleted")
+	ErrKeyTooLarge               = errors.New("key is too large")
+	ErrMaxSizeExceeded           = errors.New("maximum memtable size reached")
+	ErrOpeningSegmentFile        = errors.New("error while opening segment file")
+	ErrSegmentLevelEmpty         = errors.New("requested segment level is empty")
+	ErrCorruptedSegment          = errors.New("segment file is corrupted")
+	ErrKeysNotSorted             = errors.New("keys are not in strictly increasing order")
+	ErrVerificationFailed        = errors.New("db verification failed")
+	ErrCompactionInputsChanged   = errors.New("inputs of compaction changed while it was running")
+	ErrCompactionSchedulerClosed = errors.New("compaction scheduler is closed")
+	ErrMetricAlreadyRegistered   = errors.New("metric with the same name is already registered")
+	ErrServerClosed              = errors.New("server closed")
+	ErrReadOnly                  = errors.New("db is read only")
+	ErrDbClosed                  = errors.New("db is closed")
+	ErrSequenceUnavailable       = errors.New("sequence is not in the replication log")
+	ErrSequenceGap               = errors.New("replicated batch is out of order")
+	ErrNotLeader                 = errors.New("node is not the raft leader")
+	ErrLeadershipLost            = errors.New("leadership was lost before the write was applied, it may or may not be applied")
+	ErrNodeStopped               = errors.New("raft node is stopped")
+	ErrPeerUnreachable           = errors.New("raft peer is unreachable")
+	ErrShardExists               = errors.New("shard already exists")
+	ErrNoShards                  = errors.New("sharded store has no shards")
+	ErrConflict                  = errors.New("transaction conflicts with a write committed after it began")
+	ErrTxnClosed                 = errors.New("transaction is already committed or rolled back")
+	ErrNoMergeOperator           = errors.New("db has no merge operator")
+	ErrCorruptedWAL              = errors.New("write ahead log record is corrupted")
 )
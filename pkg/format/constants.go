@@ -3,3 +3,23 @@ package format
 const HEADER_SIZE int32 = 16 // 8 + 4 + 4
 const HEADER_FORMAT string = "<LLL"
 const DEFAULT_WHENCE = 0
+
+// kind of a record, stored in the most significant byte of key_size. Records written before kinds existed have 0 there,
+// i.e. they are all values
+type RecordKind uint8
+
+const (
+	RECORD_KIND_VALUE          RecordKind = iota
+	RECORD_KIND_TOMBSTONE                 // key was deleted, value is empty
+	RECORD_KIND_EXPIRING_VALUE            // value with an expiry, which sits between the header and the key
+	RECORD_KIND_MERGE_OPERAND             // operand for the merge operator, applied to the older value of the key on read
+)
+
+// largest kind there is, anything above is corruption
+const MAX_RECORD_KIND = RECORD_KIND_MERGE_OPERAND
+
+// size of the expiry of RECORD_KIND_EXPIRING_VALUE records, unix milliseconds after which the value is gone
+const EXPIRY_SIZE int32 = 8
+
+const RECORD_KIND_SHIFT = 24
+const MAX_KEY_SIZE int32 = 1<<RECORD_KIND_SHIFT - 1 // rest of the bits of key_size are left for the key
@@ -17,3 +17,26 @@ func DecodeKeyValue(buf []byte) (int64, string, string) {
 	value := string(buf[HEADER_SIZE+key_size : HEADER_SIZE+key_size+value_size])
 	return timestamp, key, value
 }
+
+// splits key_size of a header into the kind of the record and the actual size of the key
+func SplitKeySize(key_size int32) (RecordKind, int32) {
+	return RecordKind(uint32(key_size) >> RECORD_KIND_SHIFT), key_size & MAX_KEY_SIZE
+}
+
+// decodes the expiry following the header of a RECORD_KIND_EXPIRING_VALUE record
+func DecodeExpiry(buf []byte) int64 {
+	return int64(binary.LittleEndian.Uint64(buf[:EXPIRY_SIZE]))
+}
+
+// the expiry of a RECORD_KIND_EXPIRING_VALUE record is skipped, see DecodeExpiry
+func DecodeRecord(buf []byte) (int64, RecordKind, string, string) {
+	timestamp, raw_key_size, value_size := DecodeHeader(buf[:HEADER_SIZE])
+	kind, key_size := SplitKeySize(raw_key_size)
+	start := HEADER_SIZE
+	if kind == RECORD_KIND_EXPIRING_VALUE {
+		start += EXPIRY_SIZE
+	}
+	key := string(buf[start : start+key_size])
+	value := string(buf[start+key_size : start+key_size+value_size])
+	return timestamp, kind, key, value
+}
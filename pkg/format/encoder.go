@@ -14,7 +14,20 @@ func encodeHeader(timestamp int64, key_size int32, value_size int32) bytes.Buffe
 }
 
 func EncodeKeyValue(timestamp int64, key string, value string) (int32, []byte) {
-	headerBuffer := encodeHeader(timestamp, int32(len(key)), int32(len(value)))
+	return EncodeRecord(timestamp, RECORD_KIND_VALUE, key, value)
+}
+
+// encodes a record of any kind but RECORD_KIND_EXPIRING_VALUE, key must not be longer than MAX_KEY_SIZE
+func EncodeRecord(timestamp int64, kind RecordKind, key string, value string) (int32, []byte) {
+	return EncodeRecordWithExpiry(timestamp, kind, 0, key, value)
+}
+
+// encodes a record of any kind, expiresAt is only written for RECORD_KIND_EXPIRING_VALUE
+func EncodeRecordWithExpiry(timestamp int64, kind RecordKind, expiresAt int64, key string, value string) (int32, []byte) {
+	headerBuffer := encodeHeader(timestamp, int32(kind)<<RECORD_KIND_SHIFT|int32(len(key)), int32(len(value)))
+	if kind == RECORD_KIND_EXPIRING_VALUE {
+		binary.Write(&headerBuffer, binary.LittleEndian, expiresAt)
+	}
 
 	var dataBuffer bytes.Buffer
 	dataBuffer.WriteString(key)
@@ -23,5 +36,5 @@ func EncodeKeyValue(timestamp int64, key string, value string) (int32, []byte) {
 	var byteArray []byte
 	byteArray = append(byteArray, headerBuffer.Bytes()...)
 	byteArray = append(byteArray, dataBuffer.Bytes()...)
-	return HEADER_SIZE + int32(dataBuffer.Len()), byteArray
+	return int32(len(byteArray)), byteArray
 }
@@ -1,9 +1,13 @@
 package format
 
 import (
+	"bytes"
+	"encoding/binary"
+	"math"
 	"math/rand"
 	"testing"
 
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,3 +34,95 @@ func TestEncodeAndDecodeKeyValue(t *testing.T) {
 	assert.Equal(t, key, d_key, "Keys are not equal!")
 	assert.Equal(t, value, d_value, "Values are not equal!")
 }
+
+func TestEncodeAndDecodeRecord(t *testing.T) {
+	timestamp := int64(rand.Int63())
+	_, buf := EncodeRecord(timestamp, RECORD_KIND_TOMBSTONE, "name", "")
+	d_timestamp, d_kind, d_key, d_value := DecodeRecord(buf)
+	assert.Equal(t, timestamp, d_timestamp, "Timestamps are not equal!")
+	assert.Equal(t, RECORD_KIND_TOMBSTONE, d_kind, "Kinds are not equal!")
+	assert.Equal(t, "name", d_key, "Keys are not equal!")
+	assert.Equal(t, "", d_value, "Values are not equal!")
+
+	// records written before kinds existed are values
+	_, buf = EncodeKeyValue(timestamp, "name", "abeshek")
+	_, d_kind, d_key, _ = DecodeRecord(buf)
+	assert.Equal(t, RECORD_KIND_VALUE, d_kind, "Kinds are not equal!")
+	assert.Equal(t, "name", d_key, "Keys are not equal!")
+
+	// the expiry sits between the header and the key
+	size, buf := EncodeRecordWithExpiry(timestamp, RECORD_KIND_EXPIRING_VALUE, 1234, "name", "abeshek")
+	assert.Equal(t, HEADER_SIZE+EXPIRY_SIZE+int32(len("nameabeshek")), size)
+	assert.Equal(t, int64(1234), DecodeExpiry(buf[HEADER_SIZE:]))
+	_, d_kind, d_key, d_value = DecodeRecord(buf)
+	assert.Equal(t, RECORD_KIND_EXPIRING_VALUE, d_kind, "Kinds are not equal!")
+	assert.Equal(t, "name", d_key, "Keys are not equal!")
+	assert.Equal(t, "abeshek", d_value, "Values are not equal!")
+}
+
+func TestSegmentReader(t *testing.T) {
+	var segment []byte
+	for _, key := range []string{"a", "b", "c"} {
+		_, data := EncodeKeyValue(1, key, "value")
+		segment = append(segment, data...)
+	}
+	_, data := EncodeRecord(2, RECORD_KIND_TOMBSTONE, "d", "")
+	segment = append(segment, data...)
+
+	var records []Record
+	err := ReadSegment(bytes.NewReader(segment), func(record Record) error {
+		records = append(records, record)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Len(t, records, 4)
+	assert.Equal(t, int64(0), records[0].Offset)
+	assert.Equal(t, records[0].Size(), records[1].Offset, "Offsets are not equal!")
+	assert.Equal(t, RECORD_KIND_TOMBSTONE, records[3].Kind)
+
+	// cut the last record short
+	err = ReadSegment(bytes.NewReader(segment[:len(segment)-1]), func(record Record) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, CustomError.ErrCorruptedSegment)
+
+	// a garbled value size is reported, not allocated
+	_, garbled := EncodeKeyValue(1, "a", "value")
+	binary.LittleEndian.PutUint32(garbled[12:16], math.MaxInt32)
+	_, err = NewSegmentReader(bytes.NewReader(garbled)).Next()
+	assert.ErrorIs(t, err, CustomError.ErrCorruptedSegment)
+	assert.Contains(t, err.Error(), "only 6 are left")
+}
+
+func TestSegmentWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewSegmentWriter(&buf)
+	assert.Nil(t, writer.Put("a", "1"))
+	assert.Nil(t, writer.Write(Record{Timestamp: 7, Kind: RECORD_KIND_VALUE, Key: "b", Value: "2"}))
+	assert.Nil(t, writer.Delete("c"))
+	assert.Nil(t, writer.Write(Record{Timestamp: 8, Kind: RECORD_KIND_EXPIRING_VALUE, ExpiresAt: 99, Key: "d", Value: "4"}))
+	assert.Nil(t, writer.Write(Record{Timestamp: 9, Kind: RECORD_KIND_MERGE_OPERAND, Key: "e", Value: "5"}))
+	assert.NotNil(t, writer.Write(Record{Kind: MAX_RECORD_KIND + 1, Key: "f"}))
+	assert.ErrorIs(t, writer.Put("c", "3"), CustomError.ErrKeysNotSorted)
+	assert.ErrorIs(t, writer.Put("0", "3"), CustomError.ErrKeysNotSorted)
+	assert.Nil(t, writer.Flush())
+
+	assert.Equal(t, uint32(5), writer.Records())
+	assert.Equal(t, uint64(buf.Len()), writer.Size())
+	smallestKey, largestKey := writer.KeyRange()
+	assert.Equal(t, "a", smallestKey)
+	assert.Equal(t, "e", largestKey)
+
+	var records []Record
+	err := ReadSegment(&buf, func(record Record) error {
+		records = append(records, record)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Len(t, records, 5)
+	assert.Equal(t, int64(7), records[1].Timestamp)
+	assert.Equal(t, RECORD_KIND_TOMBSTONE, records[2].Kind)
+	assert.Equal(t, Record{Offset: records[2].Offset + records[2].Size(), Timestamp: 8, Kind: RECORD_KIND_EXPIRING_VALUE, ExpiresAt: 99, Key: "d", Value: "4"}, records[3])
+	assert.Equal(t, RECORD_KIND_MERGE_OPERAND, records[4].Kind)
+	assert.Equal(t, "5", records[4].Value)
+}
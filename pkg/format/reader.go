@@ -0,0 +1,123 @@
+package format
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+)
+
+// a single record of a segment file along with where it starts in the file
+type Record struct {
+	Offset    int64
+	Timestamp int64
+	Kind      RecordKind
+	ExpiresAt int64 // unix milliseconds, only set for RECORD_KIND_EXPIRING_VALUE
+	Key       string
+	Value     string
+}
+
+// size of the record in the file, header included
+func (r Record) Size() int64 {
+	size := int64(HEADER_SIZE) + int64(len(r.Key)) + int64(len(r.Value))
+	if r.Kind == RECORD_KIND_EXPIRING_VALUE {
+		size += int64(EXPIRY_SIZE)
+	}
+	return size
+}
+
+func (k RecordKind) String() string {
+	switch k {
+	case RECORD_KIND_VALUE:
+		return "value"
+	case RECORD_KIND_TOMBSTONE:
+		return "tombstone"
+	case RECORD_KIND_EXPIRING_VALUE:
+		return "expiring value"
+	case RECORD_KIND_MERGE_OPERAND:
+		return "merge operand"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(k))
+}
+
+// reads the records of a segment file one by one
+type SegmentReader struct {
+	reader *bufio.Reader
+	offset int64
+}
+
+func NewSegmentReader(r io.Reader) *SegmentReader {
+	return &SegmentReader{reader: bufio.NewReader(r)}
+}
+
+// returns the next record, io.EOF once the segment ended cleanly and ErrCorruptedSegment (wrapped, with the offset) if
+// the segment ends in the middle of a record or a record doesn't make sense
+func (s *SegmentReader) Next() (Record, error) {
+	header := make([]byte, HEADER_SIZE)
+	n, err := io.ReadFull(s.reader, header)
+	if err == io.EOF {
+		return Record{}, io.EOF
+	}
+	if err != nil {
+		return Record{}, s.corrupted("header is cut short after %d bytes", n)
+	}
+
+	timestamp, rawKeySize, valueSize := DecodeHeader(header)
+	kind, keySize := SplitKeySize(rawKeySize)
+	if valueSize < 0 {
+		return Record{}, s.corrupted("negative value size %d", valueSize)
+	}
+	if kind > MAX_RECORD_KIND {
+		return Record{}, s.corrupted("unknown record kind %d", kind)
+	}
+	expiresAt := int64(0)
+	if kind == RECORD_KIND_EXPIRING_VALUE {
+		expiry := make([]byte, EXPIRY_SIZE)
+		if n, err = io.ReadFull(s.reader, expiry); err != nil {
+			return Record{}, s.corrupted("expiry is cut short after %d bytes", n)
+		}
+		expiresAt = DecodeExpiry(expiry)
+	}
+
+	// a garbled size must not turn into a huge allocation, the data is read as far as it goes
+	size := int64(keySize) + int64(valueSize)
+	data, err := io.ReadAll(io.LimitReader(s.reader, size))
+	if err != nil || int64(len(data)) != size {
+		return Record{}, s.corrupted("record needs %d bytes after the header, only %d are left", size, len(data))
+	}
+
+	record := Record{
+		Offset:    s.offset,
+		Timestamp: timestamp,
+		Kind:      kind,
+		ExpiresAt: expiresAt,
+		Key:       string(data[:keySize]),
+		Value:     string(data[keySize:]),
+	}
+	s.offset += record.Size()
+	return record, nil
+}
+
+func (s *SegmentReader) corrupted(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: at offset %d: %s", CustomError.ErrCorruptedSegment, s.offset, fmt.Sprintf(format, args...))
+}
+
+// reads all the records of a segment, fn is called for each of them. Stops at the first error (either from the segment
+// or returned by fn)
+func ReadSegment(r io.Reader, fn func(record Record) error) error {
+	reader := NewSegmentReader(r)
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package format
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+)
+
+// writes records in the segment file format, keys have to come in strictly increasing order
+type SegmentWriter struct {
+	writer      *bufio.Writer
+	records     uint32
+	size        uint64
+	smallestKey string
+	largestKey  string
+}
+
+func NewSegmentWriter(w io.Writer) *SegmentWriter {
+	return &SegmentWriter{writer: bufio.NewWriter(w)}
+}
+
+// adds a value for the key timestamped with the current time
+func (s *SegmentWriter) Put(key string, value string) error {
+	return s.Write(Record{Timestamp: time.Now().Unix(), Kind: RECORD_KIND_VALUE, Key: key, Value: value})
+}
+
+// adds a tombstone for the key timestamped with the current time
+func (s *SegmentWriter) Delete(key string) error {
+	return s.Write(Record{Timestamp: time.Now().Unix(), Kind: RECORD_KIND_TOMBSTONE, Key: key})
+}
+
+// adds the record as it is, its Offset is ignored. Returns ErrKeysNotSorted (wrapped) if the key isn't after the
+// previous one
+func (s *SegmentWriter) Write(record Record) error {
+	if int64(len(record.Key)) > int64(MAX_KEY_SIZE) {
+		return CustomError.ErrKeyTooLarge
+	}
+	if record.Kind > MAX_RECORD_KIND {
+		return fmt.Errorf("unknown record kind %d", record.Kind)
+	}
+	if s.records > 0 && record.Key <= s.largestKey {
+		return fmt.Errorf("%w: %q written after %q", CustomError.ErrKeysNotSorted, record.Key, s.largestKey)
+	}
+
+	_, data := EncodeRecordWithExpiry(record.Timestamp, record.Kind, record.ExpiresAt, record.Key, record.Value)
+	if _, err := s.writer.Write(data); err != nil {
+		return err
+	}
+	if s.records == 0 {
+		s.smallestKey = record.Key
+	}
+	s.largestKey = record.Key
+	s.records++
+	s.size += uint64(len(data))
+	return nil
+}
+
+// writes the buffered records to the underlying writer, has to be called once all the records are written
+func (s *SegmentWriter) Flush() error {
+	return s.writer.Flush()
+}
+
+// returns the number of records written
+func (s *SegmentWriter) Records() uint32 {
+	return s.records
+}
+
+// returns the number of bytes written, buffered ones included
+func (s *SegmentWriter) Size() uint64 {
+	return s.size
+}
+
+// returns the first and the last key written, both are empty if nothing was written
+func (s *SegmentWriter) KeyRange() (string, string) {
+	return s.smallestKey, s.largestKey
+}
@@ -0,0 +1,244 @@
+package http_server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+)
+
+// status code for errors returned by the db, only a key that is too large is the client's fault
+func dbErrorStatus(err error) int {
+	if errors.Is(err, CustomError.ErrKeyTooLarge) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// GET, PUT, DELETE (and HEAD) /v1/kv/{key}
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	key, err := keyFromPath(r)
+	if err == nil {
+		err = s.checkKey(key)
+	}
+	if err != nil {
+		s.writeError(w, requestErrorStatus(err), err)
+		return
+	}
+	encoding, err := requestEncoding(r)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		value, ok := s.Db.Lookup(key)
+		if !ok {
+			s.writeError(w, http.StatusNotFound, CustomError.ErrKeyDoesNotExist)
+			return
+		}
+		if encoding == ENCODING_BASE64 {
+			value = base64.StdEncoding.EncodeToString([]byte(value))
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", CONTENT_TYPE_OCTET_STREAM)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write([]byte(value))
+		}
+
+	case http.MethodPut:
+		body, err := s.readBody(r)
+		if err != nil {
+			s.writeError(w, requestErrorStatus(err), err)
+			return
+		}
+		if encoding == ENCODING_BASE64 {
+			if body, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(body))); err != nil {
+				s.writeError(w, http.StatusBadRequest, fmt.Errorf("value: %w", err))
+				return
+			}
+		}
+		// a batch of one, unlike Put it reports errors
+		batch := disk_store.NewWriteBatch()
+		batch.Put(key, string(body))
+		if err := s.Db.Write(batch); err != nil {
+			s.writeError(w, dbErrorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		// deleting a missing key is not an error, same as Delete
+		batch := disk_store.NewWriteBatch()
+		batch.Delete(key)
+		if err := s.Db.Write(batch); err != nil {
+			s.writeError(w, dbErrorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type scanResponse struct {
+	Items        []kvItem `json:"items"`
+	Next         string   `json:"next,omitempty"` // start of the next page, empty on the last one
+	NextEncoding string   `json:"next_encoding,omitempty"`
+}
+
+// GET /v1/kv?prefix=&start=&end=&limit=&encoding=. start and end are inclusive, with encoding=base64 prefix, start and
+// end are base64 encoded and so are the keys and values of every item. next has to be passed back as start together
+// with next_encoding as encoding
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	query := r.URL.Query()
+	encoding, err := requestEncoding(r)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var params [3]string
+	for i, name := range []string{"prefix", "start", "end"} {
+		params[i] = query.Get(name)
+		if encoding != ENCODING_BASE64 {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(params[i])
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		params[i] = string(decoded)
+	}
+	prefix, start, end := params[0], params[1], params[2]
+
+	limit := DEFAULT_SCAN_LIMIT
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be a positive integer"))
+			return
+		}
+	}
+	if limit > s.MaxScanLimit {
+		limit = s.MaxScanLimit
+	}
+
+	if prefix > start {
+		start = prefix
+	}
+	response := scanResponse{Items: []kvItem{}}
+	next := ""
+	err = s.Db.Scan(start, end, func(key string, value string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			// keys come sorted and start at the prefix, so every key from here on is past it
+			return false
+		}
+		if len(response.Items) == limit {
+			next = key
+			return false
+		}
+		response.Items = append(response.Items, newKvItem(key, value, encoding == ENCODING_BASE64))
+		return true
+	})
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if next != "" {
+		response.Next = next
+		if encoding == ENCODING_BASE64 || !utf8.ValidString(next) {
+			response.Next = base64.StdEncoding.EncodeToString([]byte(next))
+			response.NextEncoding = ENCODING_BASE64
+		}
+	}
+	s.writeJSON(w, http.StatusOK, response)
+}
+
+type batchOperation struct {
+	Op       string `json:"op"` // "put" or "delete"
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+type batchResponse struct {
+	Operations int `json:"operations"`
+}
+
+// POST /v1/batch, every operation is checked before any of them is applied
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	body, err := s.readBody(r)
+	if err != nil {
+		s.writeError(w, requestErrorStatus(err), err)
+		return
+	}
+	var request batchRequest
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(request.Operations) > s.MaxBatchSize {
+		s.writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("batch has %d operations, at most %d are allowed", len(request.Operations), s.MaxBatchSize))
+		return
+	}
+
+	batch := disk_store.NewWriteBatch()
+	for i, operation := range request.Operations {
+		key, value, err := decodeItem(operation.Key, operation.Value, operation.Encoding)
+		if err == nil {
+			err = s.checkKey(key)
+		}
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("operation %d: %w", i, err))
+			return
+		}
+		switch operation.Op {
+		case OPERATION_PUT:
+			batch.Put(key, value)
+		case OPERATION_DELETE:
+			batch.Delete(key)
+		default:
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("operation %d: unknown op %q", i, operation.Op))
+			return
+		}
+	}
+	if err := s.Db.Write(batch); err != nil {
+		s.writeError(w, dbErrorStatus(err), err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, batchResponse{Operations: batch.Len()})
+}
+
+// GET /v1/stats, durations are in nanoseconds
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	s.writeJSON(w, http.StatusOK, s.Db.Stats())
+}
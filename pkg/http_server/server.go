@@ -0,0 +1,209 @@
+package http_server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+/*
+	- json over http for services that can't embed the db:
+		GET/PUT/DELETE /v1/kv/{key}        single keys, the value is the raw request / response body
+		GET /v1/kv?prefix=&start=&limit=   scans, json items in key order plus the key to continue from
+		POST /v1/batch                     puts and deletes applied together through a WriteBatch
+		GET /v1/stats                      DiskStore.Stats as json
+	- keys are percent-encoded in the path, so any byte can be part of a key
+	- ?encoding=base64 makes single key requests read and write the value base64 encoded. json can only carry text, so
+	  scan items and batch operations whose key or value is not valid utf-8 are base64 encoded with "encoding": "base64"
+	- Server is an http.Handler, the caller runs it on an http.Server and owns its lifecycle
+*/
+
+const (
+	ENCODING_BASE64           = "base64"
+	DEFAULT_MAX_BODY_BYTES    = 4 << 20 // 4MB
+	DEFAULT_SCAN_LIMIT        = 100
+	DEFAULT_MAX_SCAN_LIMIT    = 1000
+	DEFAULT_MAX_BATCH_SIZE    = 10000
+	KV_PATH                   = "/v1/kv"
+	BATCH_PATH                = "/v1/batch"
+	STATS_PATH                = "/v1/stats"
+	CONTENT_TYPE_JSON         = "application/json"
+	CONTENT_TYPE_OCTET_STREAM = "application/octet-stream"
+	OPERATION_PUT             = "put"
+	OPERATION_DELETE          = "delete"
+)
+
+var (
+	errBodyTooLarge    = errors.New("request body is too large")
+	errUnknownEncoding = errors.New("unknown encoding")
+)
+
+type Server struct {
+	Db     *disk_store.DiskStore
+	Logger logger.Logger
+
+	MaxBodyBytes int64 // requests with larger bodies are rejected with 413
+	MaxKeyBytes  int
+	MaxScanLimit int // scans asking for more items get this many
+	MaxBatchSize int // number of operations in a batch
+}
+
+func NewServer(d *disk_store.DiskStore) *Server {
+	return &Server{
+		Db:           d,
+		Logger:       d.Logger,
+		MaxBodyBytes: DEFAULT_MAX_BODY_BYTES,
+		MaxKeyBytes:  int(format.MAX_KEY_SIZE),
+		MaxScanLimit: DEFAULT_MAX_SCAN_LIMIT,
+		MaxBatchSize: DEFAULT_MAX_BATCH_SIZE,
+	}
+}
+
+// routes by hand, http.ServeMux would redirect keys with "//" or ".." in them to a cleaned path
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case path == KV_PATH:
+		s.handleScan(w, r)
+	case strings.HasPrefix(path, KV_PATH+"/"):
+		s.handleKey(w, r)
+	case path == BATCH_PATH:
+		s.handleBatch(w, r)
+	case path == STATS_PATH:
+		s.handleStats(w, r)
+	default:
+		s.writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s", path))
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.Logger.WithFields(logger.Fields{"method": "writeJSON"}).Debugln(err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusInternalServerError {
+		s.Logger.WithFields(logger.Fields{"method": "writeError"}).Errorln(err)
+	}
+	s.writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// writes a 405 listing the methods the path supports, returns true if r's method is one of them
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	json.NewEncoder(w).Encode(errorResponse{Error: fmt.Sprintf("method %s is not allowed", r.Method)})
+	return false
+}
+
+// reads the whole body, fails with errBodyTooLarge past MaxBodyBytes
+func (s *Server) readBody(r *http.Request) ([]byte, error) {
+	if r.ContentLength > s.MaxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, s.MaxBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > s.MaxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// status code for errors of reading a request
+func requestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, CustomError.ErrKeyDoesNotExist):
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+func (s *Server) checkKey(key string) error {
+	if key == "" {
+		return errors.New("key is empty")
+	}
+	if len(key) > s.MaxKeyBytes {
+		return CustomError.ErrKeyTooLarge
+	}
+	return nil
+}
+
+// the ?encoding= of a request, "" for raw values
+func requestEncoding(r *http.Request) (string, error) {
+	encoding := r.URL.Query().Get("encoding")
+	if encoding != "" && encoding != ENCODING_BASE64 {
+		return "", fmt.Errorf("%w %q", errUnknownEncoding, encoding)
+	}
+	return encoding, nil
+}
+
+// key and value as they travel in json
+type kvItem struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// base64 encodes both key and value when forced or when either of them is not valid utf-8
+func newKvItem(key string, value string, forceBase64 bool) kvItem {
+	if !forceBase64 && utf8.ValidString(key) && utf8.ValidString(value) {
+		return kvItem{Key: key, Value: value}
+	}
+	return kvItem{
+		Key:      base64.StdEncoding.EncodeToString([]byte(key)),
+		Value:    base64.StdEncoding.EncodeToString([]byte(value)),
+		Encoding: ENCODING_BASE64,
+	}
+}
+
+// returns the raw key and value
+func decodeItem(key string, value string, encoding string) (string, string, error) {
+	switch encoding {
+	case "":
+		return key, value, nil
+	case ENCODING_BASE64:
+		decodedKey, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return "", "", fmt.Errorf("key: %w", err)
+		}
+		decodedValue, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", "", fmt.Errorf("value: %w", err)
+		}
+		return string(decodedKey), string(decodedValue), nil
+	}
+	return "", "", fmt.Errorf("%w %q", errUnknownEncoding, encoding)
+}
+
+// the key of a /v1/kv/{key} request, percent-encoded slashes are part of the key
+func keyFromPath(r *http.Request) (string, error) {
+	return url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), KV_PATH+"/"))
+}
@@ -0,0 +1,219 @@
+package http_server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/config"
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/stretchr/testify/assert"
+)
+
+// serves a fresh db, both are closed when the test ends
+func startServer(t *testing.T) (*Server, *httptest.Server) {
+	config.Config = config.NewDefaultConfig("Test", t.TempDir())
+	d, err := disk_store.InitDb("httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(d)
+	ts := httptest.NewServer(server)
+	t.Cleanup(func() {
+		ts.Close()
+		d.CloseDB()
+	})
+	return server, ts
+}
+
+func do(t *testing.T, method string, url string, body string) (*http.Response, string) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, string(responseBody)
+}
+
+func TestKeys(t *testing.T) {
+	_, ts := startServer(t)
+
+	response, _ := do(t, http.MethodPut, ts.URL+"/v1/kv/harry", "potter")
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, body := do(t, http.MethodGet, ts.URL+"/v1/kv/harry", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "potter", body)
+
+	response, body = do(t, http.MethodGet, ts.URL+"/v1/kv/voldemort", "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	assert.JSONEq(t, `{"error": "key does not exist"}`, body)
+
+	// empty values are still values
+	do(t, http.MethodPut, ts.URL+"/v1/kv/empty", "")
+	response, body = do(t, http.MethodGet, ts.URL+"/v1/kv/empty", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "", body)
+
+	response, _ = do(t, http.MethodDelete, ts.URL+"/v1/kv/harry", "")
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, _ = do(t, http.MethodGet, ts.URL+"/v1/kv/harry", "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	// any byte can be part of a key once percent-encoded, paths are not cleaned
+	for _, key := range []string{"a/b", "a//../b", "sp ace", "\x00\xff"} {
+		escaped := url.PathEscape(key)
+		response, _ = do(t, http.MethodPut, ts.URL+"/v1/kv/"+escaped, key)
+		assert.Equal(t, http.StatusNoContent, response.StatusCode, key)
+		response, body = do(t, http.MethodGet, ts.URL+"/v1/kv/"+escaped, "")
+		assert.Equal(t, http.StatusOK, response.StatusCode, key)
+		assert.Equal(t, key, body)
+	}
+
+	// binary values, raw and base64
+	binary := "\x00\x01\xfe\xff"
+	do(t, http.MethodPut, ts.URL+"/v1/kv/raw", binary)
+	_, body = do(t, http.MethodGet, ts.URL+"/v1/kv/raw", "")
+	assert.Equal(t, binary, body)
+	_, body = do(t, http.MethodGet, ts.URL+"/v1/kv/raw?encoding=base64", "")
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte(binary)), body)
+	response, _ = do(t, http.MethodPut, ts.URL+"/v1/kv/encoded?encoding=base64", base64.StdEncoding.EncodeToString([]byte(binary)))
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	_, body = do(t, http.MethodGet, ts.URL+"/v1/kv/encoded", "")
+	assert.Equal(t, binary, body)
+	response, _ = do(t, http.MethodPut, ts.URL+"/v1/kv/encoded?encoding=base64", "not base64!")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	response, _ = do(t, http.MethodGet, ts.URL+"/v1/kv/raw?encoding=hex", "")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response, _ = do(t, http.MethodPost, ts.URL+"/v1/kv/harry", "potter")
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+	assert.Contains(t, response.Header.Get("Allow"), http.MethodPut)
+	response, _ = do(t, http.MethodGet, ts.URL+"/v1/kv/", "")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode, "Empty key was accepted")
+	response, _ = do(t, http.MethodGet, ts.URL+"/v2/kv/harry", "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestLimits(t *testing.T) {
+	server, ts := startServer(t)
+	server.MaxBodyBytes = 16
+	server.MaxKeyBytes = 8
+	server.MaxBatchSize = 2
+
+	response, _ := do(t, http.MethodPut, ts.URL+"/v1/kv/key", strings.Repeat("v", 16))
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, _ = do(t, http.MethodPut, ts.URL+"/v1/kv/key", strings.Repeat("v", 17))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+	response, _ = do(t, http.MethodPut, ts.URL+"/v1/kv/"+strings.Repeat("k", 9), "v")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response, _ = do(t, http.MethodPost, ts.URL+"/v1/batch", `{"operations": [{"op": "delete", "key": "a"}, {"op": "delete", "key": "b"}, {"op": "delete", "key": "c"}]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+}
+
+func TestScan(t *testing.T) {
+	_, ts := startServer(t)
+
+	do(t, http.MethodPost, ts.URL+"/v1/batch", `{"operations": [
+		{"op": "put", "key": "a", "value": "1"},
+		{"op": "put", "key": "user:1", "value": "harry"},
+		{"op": "put", "key": "user:2", "value": "ron"},
+		{"op": "put", "key": "user:3", "value": "hermione"},
+		{"op": "put", "key": "z", "value": "26"}
+	]}`)
+
+	scan := func(query string) scanResponse {
+		response, body := do(t, http.MethodGet, ts.URL+"/v1/kv?"+query, "")
+		assert.Equal(t, http.StatusOK, response.StatusCode, body)
+		var result scanResponse
+		assert.Nil(t, json.Unmarshal([]byte(body), &result))
+		return result
+	}
+
+	result := scan("")
+	assert.Len(t, result.Items, 5)
+	assert.Equal(t, "", result.Next)
+
+	result = scan("prefix=user:&limit=2")
+	assert.Equal(t, []kvItem{{Key: "user:1", Value: "harry"}, {Key: "user:2", Value: "ron"}}, result.Items)
+	assert.Equal(t, "user:3", result.Next)
+	result = scan("prefix=user:&limit=2&start=" + result.Next)
+	assert.Equal(t, []kvItem{{Key: "user:3", Value: "hermione"}}, result.Items)
+	assert.Equal(t, "", result.Next, "Prefix scan ran past the prefix")
+
+	result = scan("start=b&end=user:2")
+	assert.Len(t, result.Items, 2)
+
+	// non utf-8 data comes back base64 encoded
+	do(t, http.MethodPut, ts.URL+"/v1/kv/bin", "\xff")
+	result = scan("prefix=bin")
+	assert.Equal(t, []kvItem{{Key: "Ymlu", Value: "/w==", Encoding: ENCODING_BASE64}}, result.Items)
+	result = scan("prefix=" + url.QueryEscape(base64.StdEncoding.EncodeToString([]byte("user:"))) + "&encoding=base64&limit=1")
+	assert.Equal(t, ENCODING_BASE64, result.Items[0].Encoding)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("user:2")), result.Next)
+	assert.Equal(t, ENCODING_BASE64, result.NextEncoding)
+
+	response, _ := do(t, http.MethodGet, ts.URL+"/v1/kv?limit=0", "")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
+
+func TestBatch(t *testing.T) {
+	_, ts := startServer(t)
+	do(t, http.MethodPut, ts.URL+"/v1/kv/old", "value")
+
+	response, body := do(t, http.MethodPost, ts.URL+"/v1/batch", `{"operations": [
+		{"op": "put", "key": "new", "value": "value"},
+		{"op": "put", "key": "/w==", "value": "AA==", "encoding": "base64"},
+		{"op": "delete", "key": "old"}
+	]}`)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.JSONEq(t, `{"operations": 3}`, body)
+	_, body = do(t, http.MethodGet, ts.URL+"/v1/kv/new", "")
+	assert.Equal(t, "value", body)
+	_, body = do(t, http.MethodGet, ts.URL+"/v1/kv/%FF", "")
+	assert.Equal(t, "\x00", body)
+	response, _ = do(t, http.MethodGet, ts.URL+"/v1/kv/old", "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	// a bad operation fails the whole batch before anything is written
+	for _, bad := range []string{
+		`{"operations": [{"op": "put", "key": "first", "value": "1"}, {"op": "upsert", "key": "k"}]}`,
+		`{"operations": [{"op": "put", "key": "first", "value": "1"}, {"op": "put", "key": ""}]}`,
+		`{"operations": [{"op": "put", "key": "first", "value": "1"}, {"op": "put", "key": "k", "encoding": "hex"}]}`,
+		`{"operations": [{"op": "put", "key": "first", "value": "1", "ttl": 5}]}`,
+		`not json`,
+	} {
+		response, _ = do(t, http.MethodPost, ts.URL+"/v1/batch", bad)
+		assert.Equal(t, http.StatusBadRequest, response.StatusCode, bad)
+	}
+	response, _ = do(t, http.MethodGet, ts.URL+"/v1/kv/first", "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response, _ = do(t, http.MethodGet, ts.URL+"/v1/batch", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+}
+
+func TestStats(t *testing.T) {
+	_, ts := startServer(t)
+	do(t, http.MethodPut, ts.URL+"/v1/kv/harry", "potter")
+
+	response, body := do(t, http.MethodGet, ts.URL+"/v1/stats", "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, CONTENT_TYPE_JSON, response.Header.Get("Content-Type"))
+	var stats disk_store.Stats
+	assert.Nil(t, json.Unmarshal([]byte(body), &stats))
+	assert.Equal(t, 1, stats.MemtableKeys)
+}
@@ -1,6 +1,18 @@
 package key_entry
 
+import "github.com/abesheknarayan/go-caskdb/pkg/format"
+
 type KeyEntry struct {
 	Timestamp int64
 	Value     string
+	Kind      format.RecordKind // RECORD_KIND_TOMBSTONE for deleted keys
+	ExpiresAt int64             // unix milliseconds, only set for RECORD_KIND_EXPIRING_VALUE
+	// sequence of the write batch which wrote the entry, for entries read from a segment the last sequence the segment
+	// holds. Only kept in memory, segment files don't have it
+	Sequence uint64
+}
+
+// whether the entry is a value which expired at or before now (unix milliseconds)
+func (e KeyEntry) Expired(now int64) bool {
+	return e.Kind == format.RECORD_KIND_EXPIRING_VALUE && e.ExpiresAt <= now
 }
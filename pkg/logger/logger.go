@@ -0,0 +1,53 @@
+package logger
+
+import "github.com/sirupsen/logrus"
+
+/*
+	- the db logs through this interface so that it can be plugged into whatever logging the application uses
+	- no-op by default, use NewLogrusLogger or NewSlogLogger (go 1.21+) to get logs out
+	- only the methods the db actually uses, fatal and panic levels are not part of it as a library shouldn't exit the process
+*/
+
+type Fields map[string]interface{}
+
+type Logger interface {
+	WithFields(fields Fields) Logger
+	Debugf(format string, args ...interface{})
+	Debugln(args ...interface{})
+	Infof(format string, args ...interface{})
+	Infoln(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Warnln(args ...interface{})
+	Errorf(format string, args ...interface{})
+	Errorln(args ...interface{})
+}
+
+type nopLogger struct{}
+
+// returns a logger which drops everything
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+func (n nopLogger) WithFields(fields Fields) Logger         { return n }
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Debugln(args ...interface{})               {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Infoln(args ...interface{})                {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Warnln(args ...interface{})                {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+func (nopLogger) Errorln(args ...interface{})               {}
+
+type logrusLogger struct {
+	*logrus.Entry
+}
+
+// adapts a logrus logger, level, formatter and output are whatever l is configured with
+func NewLogrusLogger(l *logrus.Logger) Logger {
+	return logrusLogger{logrus.NewEntry(l)}
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{l.Entry.WithFields(logrus.Fields(fields))}
+}
@@ -0,0 +1,31 @@
+package logger
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNopLogger(t *testing.T) {
+	l := NewNopLogger().WithFields(Fields{"method": "Test"})
+	l.Infof("nothing %s", "happens")
+	l.Errorln("at all")
+}
+
+func TestLogrusLoggerKeepsFields(t *testing.T) {
+	var buf bytes.Buffer
+	logrusLogger := logrus.New()
+	logrusLogger.SetOutput(&buf)
+	logrusLogger.SetFormatter(&logrus.TextFormatter{DisableColors: true, DisableTimestamp: true})
+	logrusLogger.SetLevel(logrus.InfoLevel)
+
+	l := NewLogrusLogger(logrusLogger).WithFields(Fields{"method": "Test"})
+	l.Debugln("dropped")
+	l.Infof("kept %d", 1)
+
+	assert.NotContains(t, buf.String(), "dropped", "Level of the logrus logger was ignored")
+	assert.Contains(t, buf.String(), "kept 1")
+	assert.Contains(t, buf.String(), "method=Test")
+}
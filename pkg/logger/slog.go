@@ -0,0 +1,84 @@
+//go:build go1.21
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// adapts a log/slog logger, fields become attributes
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+func (s slogLogger) WithFields(fields Fields) Logger {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := make([]interface{}, 0, 2*len(keys))
+	for _, key := range keys {
+		args = append(args, key, fields[key])
+	}
+	return slogLogger{s.l.With(args...)}
+}
+
+func (s slogLogger) log(level slog.Level, msg string) {
+	s.l.Log(context.Background(), level, strings.TrimSuffix(msg, "\n"))
+}
+
+func (s slogLogger) Debugf(format string, args ...interface{}) {
+	s.logf(slog.LevelDebug, format, args...)
+}
+
+func (s slogLogger) Debugln(args ...interface{}) {
+	s.logln(slog.LevelDebug, args...)
+}
+
+func (s slogLogger) Infof(format string, args ...interface{}) {
+	s.logf(slog.LevelInfo, format, args...)
+}
+
+func (s slogLogger) Infoln(args ...interface{}) {
+	s.logln(slog.LevelInfo, args...)
+}
+
+func (s slogLogger) Warnf(format string, args ...interface{}) {
+	s.logf(slog.LevelWarn, format, args...)
+}
+
+func (s slogLogger) Warnln(args ...interface{}) {
+	s.logln(slog.LevelWarn, args...)
+}
+
+func (s slogLogger) Errorf(format string, args ...interface{}) {
+	s.logf(slog.LevelError, format, args...)
+}
+
+func (s slogLogger) Errorln(args ...interface{}) {
+	s.logln(slog.LevelError, args...)
+}
+
+// formatting is skipped when the level is disabled anyway
+func (s slogLogger) logf(level slog.Level, format string, args ...interface{}) {
+	if !s.l.Enabled(context.Background(), level) {
+		return
+	}
+	s.log(level, fmt.Sprintf(format, args...))
+}
+
+func (s slogLogger) logln(level slog.Level, args ...interface{}) {
+	if !s.l.Enabled(context.Background(), level) {
+		return
+	}
+	s.log(level, fmt.Sprintln(args...))
+}
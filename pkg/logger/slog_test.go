@@ -0,0 +1,24 @@
+//go:build go1.21
+
+package logger
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLoggerKeepsFields(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+
+	l := NewSlogLogger(slog.New(handler)).WithFields(Fields{"method": "Test"})
+	l.Debugf("dropped %d", 1)
+	l.Infoln("kept")
+
+	assert.NotContains(t, buf.String(), "dropped", "Level of the slog handler was ignored")
+	assert.Contains(t, buf.String(), "msg=kept")
+	assert.Contains(t, buf.String(), "method=Test")
+}
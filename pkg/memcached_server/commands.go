@@ -0,0 +1,362 @@
+package memcached_server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+)
+
+// runs the command and writes its reply, returns true if the connection has to be closed afterwards
+func (s *Server) execute(fields []string, reader *bufio.Reader, w *bufio.Writer) bool {
+	name, args := fields[0], fields[1:]
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	reply := func(line string) {
+		if !noreply {
+			w.WriteString(line + "\r\n")
+		}
+	}
+
+	switch name {
+	case "get", "gets":
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+			return false
+		}
+		s.get(args, name == "gets", w)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return s.storage(name, args, reader, reply)
+	case "delete":
+		// "delete <key> 0" is still sent by old clients
+		if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "0") {
+			reply("CLIENT_ERROR bad command line format")
+			return false
+		}
+		reply(s.delete(args[0]))
+	case "incr", "decr":
+		if len(args) != 2 {
+			w.WriteString("ERROR\r\n")
+			return false
+		}
+		reply(s.incrDecr(args[0], args[1], name == "incr"))
+	case "flush_all":
+		if len(args) > 1 {
+			w.WriteString("ERROR\r\n")
+			return false
+		}
+		if len(args) == 1 && args[0] != "0" {
+			reply("SERVER_ERROR delayed flush_all is not supported")
+			return false
+		}
+		reply(s.flushAll())
+	case "stats":
+		s.stats(args, w)
+	case "version":
+		w.WriteString("VERSION " + MEMCACHED_VERSION + "\r\n")
+	case "verbosity":
+		reply("OK")
+	case "quit":
+		return true
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return false
+}
+
+// an item with non-zero flags is stored as ITEM_FLAGS_PREFIX, the flags (4 bytes, big endian) and then the data. Items
+// without flags are stored as they are, which is what the other servers see
+const ITEM_FLAGS_PREFIX = "\x00memcached-flags\x00"
+
+func encodeItem(flags uint32, data string) string {
+	if flags == 0 {
+		return data
+	}
+	encodedFlags := make([]byte, 4)
+	binary.BigEndian.PutUint32(encodedFlags, flags)
+	return ITEM_FLAGS_PREFIX + string(encodedFlags) + data
+}
+
+// returns the flags and the data of a stored value
+func decodeItem(value string) (uint32, string) {
+	if !strings.HasPrefix(value, ITEM_FLAGS_PREFIX) || len(value) < len(ITEM_FLAGS_PREFIX)+4 {
+		return 0, value
+	}
+	value = value[len(ITEM_FLAGS_PREFIX):]
+	return binary.BigEndian.Uint32([]byte(value[:4])), value[4:]
+}
+
+// a batch of one, unlike Put and Delete Db.Write reports errors
+func itemBatch(key string, value string, remove bool, expiresAt time.Time) *disk_store.WriteBatch {
+	batch := disk_store.NewWriteBatch()
+	switch {
+	case remove:
+		batch.Delete(key)
+	case expiresAt.IsZero():
+		batch.Put(key, value)
+	default:
+		batch.PutWithExpiry(key, value, expiresAt)
+	}
+	return batch
+}
+
+// reads the key and commits the batch update returns for it, as long as nothing wrote the key in between. Otherwise
+// it starts over. update returns the reply instead of a batch if nothing is to be written
+func (s *Server) readModifyWrite(key string, update func(current disk_store.VersionedValue, exists bool) (*disk_store.WriteBatch, string)) (string, error) {
+	for {
+		current, exists := s.Db.LookupVersion(key)
+		batch, reply := update(current, exists)
+		if batch == nil {
+			return reply, nil
+		}
+		// version 0 means the key has to be still missing
+		written, err := s.Db.WriteIfVersion(key, current.Version, batch)
+		if err != nil {
+			return "", err
+		}
+		if written {
+			return reply, nil
+		}
+	}
+}
+
+// when an item stored with exptime expires, zero if it never does. Up to MAX_RELATIVE_EXPTIME exptime is in seconds
+// from now, past it a unix timestamp. Negative means expired right away
+func expiresAt(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now()
+	case exptime > MAX_RELATIVE_EXPTIME:
+		return time.Unix(exptime, 0)
+	}
+	return time.Now().Add(time.Duration(exptime) * time.Second)
+}
+
+func (s *Server) get(keys []string, withCas bool, w *bufio.Writer) {
+	for _, key := range keys {
+		if len(key) > MAX_KEY_LENGTH {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+	for _, key := range keys {
+		atomic.AddUint64(&s.cmdGet, 1)
+		item, ok := s.Db.LookupVersion(key)
+		if !ok {
+			atomic.AddUint64(&s.getMisses, 1)
+			continue
+		}
+		atomic.AddUint64(&s.getHits, 1)
+		flags, data := decodeItem(item.Value)
+		if withCas {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, flags, len(data), item.Version)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, flags, len(data))
+		}
+		w.WriteString(data + "\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// <command> <key> <flags> <exptime> <bytes> [<cas unique>] followed by the data block
+func (s *Server) storage(name string, args []string, reader *bufio.Reader, reply func(string)) bool {
+	numberOfArgs := 4
+	if name == "cas" {
+		numberOfArgs = 5
+	}
+	if len(args) != numberOfArgs {
+		// without the size the data block can't be skipped
+		reply("CLIENT_ERROR bad command line format")
+		return true
+	}
+	key := args[0]
+	flags, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[2], 10, 64)
+	size, sizeErr := strconv.Atoi(args[3])
+	var unique uint64
+	var uniqueErr error
+	if name == "cas" {
+		unique, uniqueErr = strconv.ParseUint(args[4], 10, 64)
+	}
+	if sizeErr != nil || size < 0 {
+		reply("CLIENT_ERROR bad command line format")
+		return true
+	}
+	if size > s.MaxValueSize {
+		if _, err := io.CopyN(io.Discard, reader, int64(size)+2); err != nil {
+			return true
+		}
+		reply("SERVER_ERROR object too large for cache")
+		return false
+	}
+	data, err := readData(reader, size)
+	if err != nil {
+		reply("CLIENT_ERROR bad data chunk")
+		return true
+	}
+	if len(key) > MAX_KEY_LENGTH || flagsErr != nil || exptimeErr != nil || uniqueErr != nil {
+		reply("CLIENT_ERROR bad command line format")
+		return false
+	}
+	atomic.AddUint64(&s.cmdSet, 1)
+	reply(s.store(name, key, uint32(flags), string(data), expiresAt(exptime), unique))
+	return false
+}
+
+func (s *Server) store(name string, key string, flags uint32, data string, expiry time.Time, unique uint64) string {
+	if name == "set" {
+		// an item which expires right away is stored and gone
+		if err := s.Db.Write(itemBatch(key, encodeItem(flags, data), false, expiry)); err != nil {
+			return "SERVER_ERROR " + err.Error()
+		}
+		return "STORED"
+	}
+
+	reply, err := s.readModifyWrite(key, func(current disk_store.VersionedValue, exists bool) (*disk_store.WriteBatch, string) {
+		value := encodeItem(flags, data)
+		expiresAt := expiry
+		switch name {
+		case "add":
+			if exists {
+				return nil, "NOT_STORED"
+			}
+		case "replace":
+			if !exists {
+				return nil, "NOT_STORED"
+			}
+		case "append", "prepend":
+			if !exists {
+				return nil, "NOT_STORED"
+			}
+			// the flags and exptime of append and prepend are ignored, the item keeps its own
+			currentFlags, currentData := decodeItem(current.Value)
+			if name == "append" {
+				value = encodeItem(currentFlags, currentData+data)
+			} else {
+				value = encodeItem(currentFlags, data+currentData)
+			}
+			expiresAt = current.ExpiresAt
+		case "cas":
+			if !exists {
+				return nil, "NOT_FOUND"
+			}
+			if current.Version != unique {
+				return nil, "EXISTS"
+			}
+		}
+		return itemBatch(key, value, false, expiresAt), "STORED"
+	})
+	if err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+	return reply
+}
+
+func (s *Server) delete(key string) string {
+	reply, err := s.readModifyWrite(key, func(current disk_store.VersionedValue, exists bool) (*disk_store.WriteBatch, string) {
+		if !exists {
+			return nil, "NOT_FOUND"
+		}
+		return itemBatch(key, "", true, time.Time{}), "DELETED"
+	})
+	if err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+	return reply
+}
+
+// incr wraps around at 2^64, decr stops at 0
+func (s *Server) incrDecr(key string, deltaArg string, incr bool) string {
+	delta, err := strconv.ParseUint(deltaArg, 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR invalid numeric delta argument"
+	}
+
+	reply, err := s.readModifyWrite(key, func(current disk_store.VersionedValue, exists bool) (*disk_store.WriteBatch, string) {
+		if !exists {
+			return nil, "NOT_FOUND"
+		}
+		flags, data := decodeItem(current.Value)
+		number, err := strconv.ParseUint(data, 10, 64)
+		if err != nil {
+			return nil, "CLIENT_ERROR cannot increment or decrement non-numeric value"
+		}
+		switch {
+		case incr:
+			number += delta
+		case delta > number:
+			number = 0
+		default:
+			number -= delta
+		}
+		value := strconv.FormatUint(number, 10)
+		return itemBatch(key, encodeItem(flags, value), false, current.ExpiresAt), value
+	})
+	if err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+	return reply
+}
+
+// deletes every key, FLUSH_ALL_BATCH_SIZE keys per batch so a large db doesn't end up in memory or in one wal record.
+// The scan sees the db as it was when flush_all began, keys written meanwhile survive
+func (s *Server) flushAll() string {
+	batch := disk_store.NewWriteBatch()
+	var writeErr error
+	err := s.Db.Scan("", "", func(key string, value string) bool {
+		batch.Delete(key)
+		if batch.Len() < FLUSH_ALL_BATCH_SIZE {
+			return true
+		}
+		writeErr = s.Db.Write(batch)
+		batch.Clear()
+		return writeErr == nil
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil && batch.Len() > 0 {
+		err = s.Db.Write(batch)
+	}
+	if err != nil {
+		return "SERVER_ERROR " + err.Error()
+	}
+	return "OK"
+}
+
+// only the general purpose statistics, "stats <group>" replies with no statistics
+func (s *Server) stats(args []string, w *bufio.Writer) {
+	if len(args) == 0 {
+		currConnections, totalConnections := s.Connections()
+		for _, stat := range []struct {
+			name  string
+			value interface{}
+		}{
+			{"pid", os.Getpid()},
+			{"uptime", int64(time.Since(s.startTime).Seconds())},
+			{"time", time.Now().Unix()},
+			{"version", MEMCACHED_VERSION},
+			{"curr_connections", currConnections},
+			{"total_connections", totalConnections},
+			{"cmd_get", atomic.LoadUint64(&s.cmdGet)},
+			{"cmd_set", atomic.LoadUint64(&s.cmdSet)},
+			{"get_hits", atomic.LoadUint64(&s.getHits)},
+			{"get_misses", atomic.LoadUint64(&s.getMisses)},
+			{"limit_maxbytes", 0},
+		} {
+			fmt.Fprintf(w, "STAT %s %v\r\n", stat.name, stat.value)
+		}
+	}
+	w.WriteString("END\r\n")
+}
@@ -0,0 +1,121 @@
+package memcached_server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/abesheknarayan/go-caskdb/pkg/tcp_server"
+)
+
+/*
+	- serves a single DiskStore over the memcached text protocol
+	  (https://github.com/memcached/memcached/blob/master/doc/protocol.txt)
+	- values are stored as they are so that the other servers see the same data. Only items with non-zero client flags
+	  are stored with a prefix holding the flags, the other servers see that prefix
+	- the cas unique of an item is the version of its key (DiskStore.LookupVersion), which changes with every write of
+	  the key, whichever server it comes through. A flush or compaction may change it as well, cas then replies EXISTS
+	  and the client has to gets the item again
+	- exptime is stored as the expiry of the value, append, prepend, incr and decr keep the expiry the item had
+	- commands which read before writing (add, replace, append, prepend, cas, delete, incr, decr) write with
+	  DiskStore.WriteIfVersion and start over if the key was written in between, by any server
+*/
+
+const (
+	MEMCACHED_VERSION      = "1.6.0" // what "version" and "stats" report
+	MAX_KEY_LENGTH         = 250
+	MAX_LINE_LENGTH        = 2048 // a get line has room for a few keys
+	DEFAULT_MAX_VALUE_SIZE = 1 << 20
+	MAX_RELATIVE_EXPTIME   = 60 * 60 * 24 * 30 // larger exptimes are unix timestamps
+	FLUSH_ALL_BATCH_SIZE   = 1000              // keys deleted per write batch by flush_all
+)
+
+var errLineTooLong = errors.New("line too long")
+
+type Server struct {
+	// atomic counters, first so that they are 64-bit aligned on 32-bit platforms
+	cmdGet    uint64
+	cmdSet    uint64
+	getHits   uint64
+	getMisses uint64
+
+	*tcp_server.Server
+	Db           *disk_store.DiskStore
+	MaxValueSize int // larger values are refused with SERVER_ERROR
+
+	startTime time.Time
+}
+
+func NewServer(d *disk_store.DiskStore) *Server {
+	s := &Server{
+		Db:           d,
+		MaxValueSize: DEFAULT_MAX_VALUE_SIZE,
+		startTime:    time.Now(),
+	}
+	s.Server = tcp_server.NewServer("memcached protocol", d.Logger, s.serveConnection)
+	return s
+}
+
+// reads the next line without its line ending, memcached accepts a bare \n too
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > MAX_LINE_LENGTH {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func (s *Server) serveConnection(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for !s.IsShuttingDown() {
+		line, err := readLine(reader)
+		if err != nil {
+			if errors.Is(err, errLineTooLong) {
+				writer.WriteString("CLIENT_ERROR line too long\r\n")
+				writer.Flush()
+			}
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			writer.WriteString("ERROR\r\n")
+		} else if quit := s.execute(fields, reader, writer); quit {
+			writer.Flush()
+			return
+		}
+
+		// pipelined commands get their replies in one write
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	writer.Flush()
+}
+
+// reads the data block of a storage command, which is followed by \r\n
+func readData(reader *bufio.Reader, size int) ([]byte, error) {
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	if string(data[size:]) != "\r\n" {
+		return nil, errors.New("bad data chunk")
+	}
+	return data[:size], nil
+}
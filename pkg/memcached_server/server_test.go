@@ -0,0 +1,268 @@
+package memcached_server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/config"
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/stretchr/testify/assert"
+)
+
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// sends the raw request and returns the reply, for get and stats everything up to END
+func (c *client) do(t *testing.T, request string) string {
+	c.conn.Write([]byte(request))
+	var reply strings.Builder
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply.WriteString(line)
+		switch {
+		case strings.HasPrefix(line, "VALUE "):
+			// the data block, which can't contain a line ending in these tests
+			data, err := c.reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply.WriteString(data)
+		case strings.HasPrefix(line, "STAT "):
+		default:
+			return reply.String()
+		}
+	}
+}
+
+// starts a server on a fresh db, both are shut down when the test ends
+func startServer(t *testing.T) (*Server, string, chan error) {
+	config.Config = config.NewDefaultConfig("Test", t.TempDir())
+	d, err := disk_store.InitDb("memcacheddb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(d)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		d.CloseDB()
+	})
+	return server, listener.Addr().String(), served
+}
+
+func TestStorageCommands(t *testing.T) {
+	s, addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	assert.Equal(t, "STORED\r\n", c.do(t, "set harry 0 0 6\r\npotter\r\n"))
+	assert.Equal(t, "VALUE harry 0 6\r\npotter\r\nEND\r\n", c.do(t, "get harry\r\n"))
+	assert.Equal(t, "END\r\n", c.do(t, "get voldemort\r\n"))
+	assert.Equal(t, "VALUE harry 0 6\r\npotter\r\nEND\r\n", c.do(t, "get voldemort harry\r\n"))
+
+	// data blocks are read by size, they may contain anything
+	assert.Equal(t, "STORED\r\n", c.do(t, "set binary 0 0 5\r\n\x00\r\xff x\r\n"))
+	assert.Equal(t, "VALUE binary 0 5\r\n\x00\r\xff x\r\nEND\r\n", c.do(t, "get binary\r\n"))
+
+	assert.Equal(t, "NOT_STORED\r\n", c.do(t, "add harry 0 0 3\r\nron\r\n"))
+	assert.Equal(t, "STORED\r\n", c.do(t, "add ron 0 0 7\r\nweasley\r\n"))
+	assert.Equal(t, "NOT_STORED\r\n", c.do(t, "replace hermione 0 0 7\r\ngranger\r\n"))
+	assert.Equal(t, "STORED\r\n", c.do(t, "replace ron 0 0 8\r\nweasley!\r\n"))
+	assert.Equal(t, "STORED\r\n", c.do(t, "append ron 0 0 1\r\n?\r\n"))
+	assert.Equal(t, "STORED\r\n", c.do(t, "prepend ron 0 0 1\r\n(\r\n"))
+	assert.Equal(t, "VALUE ron 0 10\r\n(weasley!?\r\nEND\r\n", c.do(t, "get ron\r\n"))
+	assert.Equal(t, "NOT_STORED\r\n", c.do(t, "append hermione 0 0 1\r\n!\r\n"))
+
+	assert.Equal(t, "DELETED\r\n", c.do(t, "delete ron\r\n"))
+	assert.Equal(t, "NOT_FOUND\r\n", c.do(t, "delete ron\r\n"))
+	assert.Equal(t, "END\r\n", c.do(t, "get ron\r\n"))
+
+	// a negative exptime means expired right away
+	assert.Equal(t, "STORED\r\n", c.do(t, "set harry 0 -1 1\r\nx\r\n"))
+	assert.Equal(t, "END\r\n", c.do(t, "get harry\r\n"))
+
+	// flags are kept, append and incr keep the flags the item had
+	assert.Equal(t, "STORED\r\n", c.do(t, "set flagged 4294967295 0 1\r\n1\r\n"))
+	assert.Equal(t, "STORED\r\n", c.do(t, "append flagged 7 0 1\r\n2\r\n"))
+	assert.Equal(t, "13\r\n", c.do(t, "incr flagged 1\r\n"))
+	assert.Equal(t, "VALUE flagged 4294967295 2\r\n13\r\nEND\r\n", c.do(t, "get flagged\r\n"))
+	assert.Equal(t, "STORED\r\n", c.do(t, "set flagged 0 0 1\r\nx\r\n"))
+	assert.Equal(t, "x", s.Db.Get("flagged"), "Item without flags isn't stored as it is")
+	assert.Equal(t, "CLIENT_ERROR bad command line format\r\n", c.do(t, "set flagged 4294967296 0 1\r\nx\r\n"))
+
+	// relative and absolute exptimes, appending keeps the expiry
+	assert.Equal(t, "STORED\r\n", c.do(t, "set expiring 0 100 1\r\nx\r\n"))
+	assert.Equal(t, "STORED\r\n", c.do(t, "append expiring 0 0 1\r\ny\r\n"))
+	assert.Equal(t, "VALUE expiring 0 2\r\nxy\r\nEND\r\n", c.do(t, "get expiring\r\n"))
+	ttl, ok := s.Db.TTL("expiring")
+	assert.True(t, ok)
+	assert.True(t, ttl > 99*time.Second && ttl <= 100*time.Second, "unexpected ttl %v", ttl)
+	assert.Equal(t, "STORED\r\n", c.do(t, fmt.Sprintf("set past 0 %d 1\r\nx\r\n", time.Now().Add(-time.Hour).Unix())))
+	assert.Equal(t, "END\r\n", c.do(t, "get past\r\n"))
+
+	// noreply commands answer nothing, the version reply is the first thing that comes back
+	assert.Equal(t, "VERSION "+MEMCACHED_VERSION+"\r\n", c.do(t, "set quiet 0 0 1 noreply\r\nq\r\nversion\r\n"))
+	assert.Equal(t, "VALUE quiet 0 1\r\nq\r\nEND\r\n", c.do(t, "get quiet\r\n"))
+
+	assert.Equal(t, "ERROR\r\n", c.do(t, "frobnicate\r\n"))
+	assert.Equal(t, "CLIENT_ERROR bad command line format\r\n", c.do(t, "get "+strings.Repeat("k", MAX_KEY_LENGTH+1)+"\r\n"))
+
+	c.conn.Write([]byte("quit\r\n"))
+	_, err := c.reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err, "Connection wasn't closed after quit")
+}
+
+func TestCas(t *testing.T) {
+	s, addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	assert.Equal(t, "NOT_FOUND\r\n", c.do(t, "cas harry 0 0 1 1\r\nx\r\n"))
+	c.do(t, "set harry 0 0 6\r\npotter\r\n")
+	var unique uint64
+	reply := c.do(t, "gets harry\r\n")
+	fmt.Sscanf(reply, "VALUE harry 0 6 %d", &unique)
+	assert.NotZero(t, unique)
+
+	assert.Equal(t, "EXISTS\r\n", c.do(t, fmt.Sprintf("cas harry 0 0 1 %d\r\nx\r\n", unique+1)))
+	assert.Equal(t, "STORED\r\n", c.do(t, fmt.Sprintf("cas harry 0 0 5\t%d\r\nhello\r\n", unique)))
+	assert.Equal(t, "EXISTS\r\n", c.do(t, fmt.Sprintf("cas harry 0 0 5 %d\r\nworld\r\n", unique)), "Stale cas unique was accepted")
+	assert.Equal(t, "VALUE harry 0 5\r\nhello\r\nEND\r\n", c.do(t, "get harry\r\n"))
+
+	// the value changed and changed back by another server in between
+	reply = c.do(t, "gets harry\r\n")
+	fmt.Sscanf(reply, "VALUE harry 0 5 %d", &unique)
+	for _, value := range []string{"other", "hello"} {
+		batch := disk_store.NewWriteBatch()
+		batch.Put("harry", value)
+		assert.Nil(t, s.Db.Write(batch))
+	}
+	assert.Equal(t, "EXISTS\r\n", c.do(t, fmt.Sprintf("cas harry 0 0 5 %d\r\nworld\r\n", unique)), "Value changed and changed back went unnoticed")
+}
+
+func TestIncrDecr(t *testing.T) {
+	s, addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	assert.Equal(t, "NOT_FOUND\r\n", c.do(t, "incr counter 1\r\n"))
+	c.do(t, "set counter 0 0 2\r\n10\r\n")
+	assert.Equal(t, "15\r\n", c.do(t, "incr counter 5\r\n"))
+	assert.Equal(t, "3\r\n", c.do(t, "decr counter 12\r\n"))
+	assert.Equal(t, "0\r\n", c.do(t, "decr counter 100\r\n"), "decr went below 0")
+	c.do(t, "set counter 0 0 20\r\n18446744073709551615\r\n")
+	assert.Equal(t, "1\r\n", c.do(t, "incr counter 2\r\n"), "incr didn't wrap around")
+
+	c.do(t, "set name 0 0 5\r\nharry\r\n")
+	assert.Equal(t, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n", c.do(t, "incr name 1\r\n"))
+	assert.Equal(t, "CLIENT_ERROR invalid numeric delta argument\r\n", c.do(t, "incr counter -1\r\n"))
+
+	// concurrent increments don't get lost
+	var wg sync.WaitGroup
+	c.do(t, "set counter 0 0 1\r\n0\r\n")
+	for client := 0; client < 8; client++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := dial(t, addr)
+			for i := 0; i < 50; i++ {
+				c.conn.Write([]byte("incr counter 1\r\n"))
+				if _, err := c.reader.ReadString('\n'); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	// and neither do the ones made through the db directly, as the other servers do
+	for writer := 0; writer < 2; writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				for {
+					current := s.Db.Get("counter")
+					n, _ := strconv.Atoi(current)
+					if ok, err := s.Db.CompareAndSwap("counter", current, strconv.Itoa(n+1)); err != nil || ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "VALUE counter 0 3\r\n500\r\nEND\r\n", c.do(t, "get counter\r\n"))
+}
+
+func TestFlushAllAndStats(t *testing.T) {
+	server, addr, _ := startServer(t)
+	server.MaxValueSize = 8
+	c := dial(t, addr)
+
+	c.do(t, "set a 0 0 1\r\n1\r\n")
+	c.do(t, "set b 0 0 1\r\n2\r\n")
+	c.do(t, "get a b missing\r\n")
+	assert.Equal(t, "SERVER_ERROR object too large for cache\r\n", c.do(t, "set big 0 0 9\r\n123456789\r\n"))
+	assert.Equal(t, "OK\r\n", c.do(t, "flush_all\r\n"))
+	assert.Equal(t, "END\r\n", c.do(t, "get a b\r\n"))
+
+	// more keys than fit in one batch
+	for i := 0; i < FLUSH_ALL_BATCH_SIZE*2+10; i++ {
+		server.Db.Put(fmt.Sprintf("key:%04d", i), "value")
+	}
+	assert.Equal(t, "OK\r\n", c.do(t, "flush_all\r\n"))
+	remaining := 0
+	assert.Nil(t, server.Db.Scan("", "", func(key string, value string) bool {
+		remaining++
+		return true
+	}))
+	assert.Equal(t, 0, remaining)
+
+	stats := c.do(t, "stats\r\n")
+	assert.Contains(t, stats, "STAT cmd_set 2\r\n")
+	assert.Contains(t, stats, "STAT get_hits 2\r\n")
+	assert.Contains(t, stats, "STAT get_misses 3\r\n")
+	assert.Contains(t, stats, "STAT curr_connections 1\r\n")
+	assert.True(t, strings.HasSuffix(stats, "END\r\n"))
+	assert.Equal(t, "OK\r\n", c.do(t, "verbosity 1\r\n"))
+}
+
+func TestShutdown(t *testing.T) {
+	server, addr, served := startServer(t)
+	c := dial(t, addr)
+	assert.Equal(t, "END\r\n", c.do(t, "get a\r\n"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, server.Shutdown(ctx))
+	assert.ErrorIs(t, <-served, CustomError.ErrServerClosed)
+	_, err := c.reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err, "Idle connection wasn't closed")
+}
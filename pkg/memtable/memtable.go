@@ -14,8 +14,10 @@ import (
 	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
 	"github.com/abesheknarayan/go-caskdb/pkg/format"
 	KeyEntry "github.com/abesheknarayan/go-caskdb/pkg/key_entry"
-	"github.com/abesheknarayan/go-caskdb/pkg/utils"
-	"github.com/sirupsen/logrus"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/merge_operator"
+	"github.com/abesheknarayan/go-caskdb/pkg/metrics"
+	"github.com/abesheknarayan/go-caskdb/pkg/rate_limiter"
 )
 
 /*
@@ -41,8 +43,12 @@ type MemTable struct {
 	BytesOccupied uint64 // total nunber of bytes occupied
 	Map           *HashMap
 	SegmentId     int32
+	LastSequence  uint64 // sequence of the last write batch applied to the memtable
 	Mu            *sync.Mutex
 	ExWaitGroup   *ExclusiveWaitGroup
+	RateLimiter   *rate_limiter.RateLimiter // throttles WriteMemtableToDisk when set, nil means unthrottled
+	Metrics       *metrics.Metrics          // WriteMemtableToDisk is recorded as a flush when set
+	Logger        logger.Logger
 }
 
 func GetNewMemTable(dbName string, SegmentId int32) *MemTable {
@@ -54,24 +60,69 @@ func GetNewMemTable(dbName string, SegmentId int32) *MemTable {
 		Mu:            &sync.Mutex{},
 		ExWaitGroup:   &ExclusiveWaitGroup{Wg: &sync.WaitGroup{}, Mu: &sync.Mutex{}},
 		SegmentId:     int32(SegmentId),
+		Logger:        logger.NewNopLogger(),
 	}
 
 	return memtable
 }
 
 func (mt *MemTable) Get(key string) (string, error) {
+	kv, err := mt.GetEntry(key)
+	return kv.Value, err
+}
+
+// same as Get, but returns the whole entry of the key. A merge operand is returned as it is, it still has to be
+// applied to the older entries of the key
+func (mt *MemTable) GetEntry(key string) (KeyEntry.KeyEntry, error) {
 	mt.Map.Mu.Lock()
 	defer mt.Map.Mu.Unlock()
 	kv, exist := mt.Map.M[key]
 
 	if !exist {
-		return "", CustomError.ErrKeyDoesNotExist
+		return KeyEntry.KeyEntry{}, CustomError.ErrKeyDoesNotExist
+	}
+	if kv.Kind == format.RECORD_KIND_TOMBSTONE || kv.Expired(time.Now().UnixMilli()) {
+		// older values of the key in segment files must not be looked at
+		return KeyEntry.KeyEntry{}, CustomError.ErrKeyDeleted
 	}
 
-	return kv.Value, nil
+	return kv, nil
+}
+
+// one write of a batch applied with ApplyBatch
+type BatchWrite struct {
+	Key       string
+	Value     string // the operand for RECORD_KIND_MERGE_OPERAND
+	Kind      format.RecordKind
+	ExpiresAt int64 // unix milliseconds, for RECORD_KIND_EXPIRING_VALUE
+	Sequence  uint64
 }
 
 func (mt *MemTable) Put(key string, value string) error {
+	return mt.ApplyBatch([]BatchWrite{{Key: key, Value: value, Kind: format.RECORD_KIND_VALUE}}, nil)
+}
+
+// puts a value which is treated as deleted from expiresAt (unix milliseconds) on
+func (mt *MemTable) PutWithExpiry(key string, value string, expiresAt int64) error {
+	return mt.ApplyBatch([]BatchWrite{{Key: key, Value: value, Kind: format.RECORD_KIND_EXPIRING_VALUE, ExpiresAt: expiresAt}}, nil)
+}
+
+// writes a tombstone for the key, which hides it from reads until it's put again
+func (mt *MemTable) Delete(key string) error {
+	return mt.ApplyBatch([]BatchWrite{{Key: key, Kind: format.RECORD_KIND_TOMBSTONE}}, nil)
+}
+
+// Applies the writes in order, either all of them or none if they don't fit in the memtable (ErrMaxSizeExceeded). An
+// empty memtable takes the writes whatever their size, so a batch is never split over two memtables. Readers see
+// none or all of the writes. The memtable keeps a single entry per key, so a merge operand is combined right away with
+// the entry the memtable already has of the key, if any, using operator
+func (mt *MemTable) ApplyBatch(writes []BatchWrite, operator merge_operator.MergeOperator) error {
+	for _, write := range writes {
+		if int64(len(write.Key)) > int64(format.MAX_KEY_SIZE) {
+			return CustomError.ErrKeyTooLarge
+		}
+	}
+
 	mt.Mu.Lock()
 	mt.Map.Mu.Lock()
 	defer func() {
@@ -79,36 +130,64 @@ func (mt *MemTable) Put(key string, value string) error {
 		mt.Mu.Unlock()
 	}()
 
-	oldKeyEntry, alreadyExists := mt.Map.M[key]
-
-	oldBytes := 0
-
-	if alreadyExists {
-		oldBytes = len(key) + len(oldKeyEntry.Value) + 8
+	now := time.Now()
+	// new entries of the keys, only put in the map once the whole batch is known to fit
+	staged := make(map[string]KeyEntry.KeyEntry, len(writes))
+	for _, write := range writes {
+		entry := KeyEntry.KeyEntry{
+			Timestamp: now.Unix(),
+			Value:     write.Value,
+			Kind:      write.Kind,
+			ExpiresAt: write.ExpiresAt,
+			Sequence:  write.Sequence,
+		}
+		if write.Kind == format.RECORD_KIND_MERGE_OPERAND {
+			oldEntry, exists := staged[write.Key]
+			if !exists {
+				oldEntry, exists = mt.Map.M[write.Key]
+			}
+			if exists {
+				entry = merge_operator.Apply(operator, write.Key, entry, oldEntry, true, now.UnixMilli())
+			}
+		}
+		staged[write.Key] = entry
 	}
-	newBytes := len(key) + len(value) + 8
 
-	if mt.BytesOccupied+uint64(newBytes-oldBytes) > config.Config.MemtableSizeLimit {
+	// 8 for timestamp
+	newBytesOccupied := int64(mt.BytesOccupied)
+	for key, entry := range staged {
+		if oldEntry, exists := mt.Map.M[key]; exists {
+			newBytesOccupied -= int64(entryBytes(key, oldEntry))
+		}
+		newBytesOccupied += int64(entryBytes(key, entry))
+	}
+	if len(mt.Map.M) > 0 && uint64(newBytesOccupied) > config.Config.MemtableSizeLimit {
 		// copy all the memtable to segment file --> disk write
 		return CustomError.ErrMaxSizeExceeded
 	}
 
-	mt.Map.M[key] = KeyEntry.KeyEntry{
-		Timestamp: time.Now().Unix(),
-		Value:     value,
+	for key, entry := range staged {
+		mt.Map.M[key] = entry
 	}
-	// l.Debugf("Stored value to map at %d", mt.Map.M[key].Timestamp)
-	mt.BytesOccupied += uint64(newBytes - oldBytes) // 8 for timestamp
-
+	mt.BytesOccupied = uint64(newBytesOccupied)
 	return nil
 }
 
+// bytes an entry takes up in the memtable, 8 for the timestamp
+func entryBytes(key string, entry KeyEntry.KeyEntry) int {
+	size := len(key) + len(entry.Value) + 8
+	if entry.Kind == format.RECORD_KIND_EXPIRING_VALUE {
+		size += int(format.EXPIRY_SIZE)
+	}
+	return size
+}
+
 func (mt *MemTable) LoadFromSegmentFile(SegmentId uint32) error {
 
 	mt.Mu.Lock()
 	defer mt.Mu.Unlock()
 
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = mt.Logger.WithFields(logger.Fields{
 		"method": "LoadFromSegmentFile",
 	})
 	l.Infof("Attempting to load segment file with id %d of db %s", SegmentId, mt.DbName)
@@ -121,7 +200,9 @@ func (mt *MemTable) LoadFromSegmentFile(SegmentId uint32) error {
 
 	if err != nil {
 		l.Errorf("Error while opening segment file for db %s: %v", mt.DbName, err)
+		return CustomError.ErrOpeningSegmentFile
 	}
+	defer f.Close()
 
 	reader := bufio.NewReader(f)
 
@@ -131,7 +212,17 @@ func (mt *MemTable) LoadFromSegmentFile(SegmentId uint32) error {
 		if err != nil {
 			break
 		}
-		timestamp, key_size, value_size := format.DecodeHeader(header)
+		timestamp, raw_key_size, value_size := format.DecodeHeader(header)
+		kind, key_size := format.SplitKeySize(raw_key_size)
+		expiresAt := int64(0)
+		if kind == format.RECORD_KIND_EXPIRING_VALUE {
+			expiry := make([]byte, format.EXPIRY_SIZE)
+			if _, err = io.ReadFull(reader, expiry); err != nil {
+				return err
+			}
+			expiresAt = format.DecodeExpiry(expiry)
+			mt.BytesOccupied += uint64(format.EXPIRY_SIZE)
+		}
 		keyBuf := make([]byte, key_size)
 		valueBuf := make([]byte, value_size)
 
@@ -154,6 +245,8 @@ func (mt *MemTable) LoadFromSegmentFile(SegmentId uint32) error {
 		kv := KeyEntry.KeyEntry{
 			Timestamp: timestamp,
 			Value:     value,
+			Kind:      kind,
+			ExpiresAt: expiresAt,
 		}
 		mt.Map.M[key] = kv
 	}
@@ -164,10 +257,11 @@ func (mt *MemTable) LoadFromSegmentFile(SegmentId uint32) error {
 // returns the (written segment file name, whether it already existed, cardinality of segment) along with error
 func (mt *MemTable) WriteMemtableToDisk() (uint32, bool, error) {
 
-	var l = utils.Logger.WithFields(logrus.Fields{
+	var l = mt.Logger.WithFields(logger.Fields{
 		"method": "WriteMemtableToDisk",
 	})
 	l.Infof("Writing Memtable %d to Segment file !!", mt.SegmentId)
+	startTime := time.Now()
 
 	mt.Mu.Lock()
 	defer func() {
@@ -196,7 +290,10 @@ func (mt *MemTable) WriteMemtableToDisk() (uint32, bool, error) {
 	}
 
 	// truncate the file
-	f.Truncate(0)
+	if err = f.Truncate(0); err != nil {
+		f.Close()
+		return 0, exists, err
+	}
 
 	// Golang map doesnt print the elements in the order of sorted keys
 	// Get all keys, sort it yourself and then retrieve the corresponding values from map
@@ -214,15 +311,28 @@ func (mt *MemTable) WriteMemtableToDisk() (uint32, bool, error) {
 
 	for _, key := range sortedKeys {
 		kv := mt.Map.M[key]
-		_, data := format.EncodeKeyValue(kv.Timestamp, key, kv.Value)
+		_, data := format.EncodeRecordWithExpiry(kv.Timestamp, kv.Kind, kv.ExpiresAt, key, kv.Value)
 		bytesArr = append(bytesArr, data...)
 	}
 
-	f.Write(bytesArr)
-	f.Sync() // to flush from OS buffer to disk
+	var writer io.Writer = f
+	if mt.RateLimiter != nil {
+		writer = mt.RateLimiter.Writer(f)
+	}
+
+	_, err = writer.Write(bytesArr)
+	if err == nil {
+		err = f.Sync() // to flush from OS buffer to disk
+	}
 	f.Close()
 
+	if err != nil {
+		l.Errorf("Error in writing segment file %s : %v", segmentFilePath, err)
+		return 0, exists, err
+	}
+
 	l.Debugf("Successfully written memtable to segfile %s with cardinality: %d", segmentFileName, uint32(len(sortedKeys)))
+	mt.Metrics.ObserveFlush(uint64(len(bytesArr)), time.Since(startTime))
 
 	return uint32(len(sortedKeys)), exists, nil
 }
@@ -259,3 +369,44 @@ func (mt *MemTable) Clear() {
 	}
 	mt.BytesOccupied = 0
 }
+
+// returns the number of keys in the memtable
+func (mt *MemTable) Size() int {
+	mt.Map.Mu.Lock()
+	defer mt.Map.Mu.Unlock()
+	return len(mt.Map.M)
+}
+
+// returns the number of bytes occupied by the memtable
+func (mt *MemTable) SizeInBytes() uint64 {
+	mt.Map.Mu.Lock()
+	defer mt.Map.Mu.Unlock()
+	return mt.BytesOccupied
+}
+
+// returns the smallest and the largest key of the memtable, both are empty if the memtable is empty
+func (mt *MemTable) KeyRange() (string, string) {
+	mt.Map.Mu.Lock()
+	defer mt.Map.Mu.Unlock()
+	smallestKey, largestKey := "", ""
+	first := true
+	for key := range mt.Map.M {
+		if first || key < smallestKey {
+			smallestKey = key
+		}
+		if first || key > largestKey {
+			largestKey = key
+		}
+		first = false
+	}
+	return smallestKey, largestKey
+}
+
+// calls fn for every entry of the memtable (tombstones included) in no particular order, fn must not modify the memtable
+func (mt *MemTable) ForEach(fn func(key string, entry KeyEntry.KeyEntry)) {
+	mt.Map.Mu.Lock()
+	defer mt.Map.Mu.Unlock()
+	for key, entry := range mt.Map.M {
+		fn(key, entry)
+	}
+}
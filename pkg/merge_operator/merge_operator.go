@@ -0,0 +1,120 @@
+package merge_operator
+
+import (
+	"strconv"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	KeyEntry "github.com/abesheknarayan/go-caskdb/pkg/key_entry"
+)
+
+/*
+	- DiskStore.Merge stores an operand instead of reading the value, modifying it and putting it back
+	- operands are only combined with the value of the key when something needs the result: a read, the memtable
+	  already having an entry of the key, or a compaction meeting the older entries of the key
+	- two operands have to combine into one without knowing the value below them (PartialMerge), so operators must be
+	  associative. Older operands always stay on the left
+	- operators can't fail, a value an operator can't make sense of is handled the way the operator documents
+*/
+
+// combines the values of keys with the operands passed to DiskStore.Merge
+type MergeOperator interface {
+	// returns the value after applying operand to value, exists is false if the key has no value (it's missing,
+	// deleted or expired)
+	FullMerge(key string, value string, exists bool, operand string) string
+	// combines two operands into one which has the same effect as applying older and then newer
+	PartialMerge(key string, older string, newer string) string
+}
+
+// Applies the merge operand newer to the entry below it. A tombstone, an expired value or !olderExists means there is
+// no value, the result is a plain value then. An operand on top of an operand stays an operand, a value with an
+// expiry keeps it. The result has the sequence of newer
+func Apply(operator MergeOperator, key string, newer KeyEntry.KeyEntry, older KeyEntry.KeyEntry, olderExists bool, now int64) KeyEntry.KeyEntry {
+	if olderExists && older.Kind == format.RECORD_KIND_MERGE_OPERAND {
+		return KeyEntry.KeyEntry{
+			Timestamp: newer.Timestamp,
+			Value:     operator.PartialMerge(key, older.Value, newer.Value),
+			Kind:      format.RECORD_KIND_MERGE_OPERAND,
+			Sequence:  newer.Sequence,
+		}
+	}
+	if olderExists && older.Kind != format.RECORD_KIND_TOMBSTONE && !older.Expired(now) {
+		return KeyEntry.KeyEntry{
+			Timestamp: newer.Timestamp,
+			Value:     operator.FullMerge(key, older.Value, true, newer.Value),
+			Kind:      older.Kind,
+			ExpiresAt: older.ExpiresAt,
+			Sequence:  newer.Sequence,
+		}
+	}
+	return KeyEntry.KeyEntry{
+		Timestamp: newer.Timestamp,
+		Value:     operator.FullMerge(key, "", false, newer.Value),
+		Sequence:  newer.Sequence,
+	}
+}
+
+// adds operands to values, both decimal uint64s. Anything that doesn't parse counts as 0 and sums wrap around on
+// overflow, like memcached's incr
+type uint64AddOperator struct{}
+
+func NewUint64AddOperator() MergeOperator {
+	return uint64AddOperator{}
+}
+
+func (uint64AddOperator) FullMerge(key string, value string, exists bool, operand string) string {
+	return uint64AddOperator{}.PartialMerge(key, value, operand)
+}
+
+func (uint64AddOperator) PartialMerge(key string, older string, newer string) string {
+	return strconv.FormatUint(parseUint64(older)+parseUint64(newer), 10)
+}
+
+func parseUint64(s string) uint64 {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// appends operands to values with a delimiter in between
+type stringAppendOperator struct {
+	delimiter string
+}
+
+func NewStringAppendOperator(delimiter string) MergeOperator {
+	return stringAppendOperator{delimiter: delimiter}
+}
+
+func (o stringAppendOperator) FullMerge(key string, value string, exists bool, operand string) string {
+	if !exists {
+		return operand
+	}
+	return o.PartialMerge(key, value, operand)
+}
+
+func (o stringAppendOperator) PartialMerge(key string, older string, newer string) string {
+	return older + o.delimiter + newer
+}
+
+// keeps the larger of the value and the operand, compared byte by byte, so numbers have to be zero padded to the
+// same width
+type maxOperator struct{}
+
+func NewMaxOperator() MergeOperator {
+	return maxOperator{}
+}
+
+func (maxOperator) FullMerge(key string, value string, exists bool, operand string) string {
+	if !exists {
+		return operand
+	}
+	return maxOperator{}.PartialMerge(key, value, operand)
+}
+
+func (maxOperator) PartialMerge(key string, older string, newer string) string {
+	if older > newer {
+		return older
+	}
+	return newer
+}
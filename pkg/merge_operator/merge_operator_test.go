@@ -0,0 +1,50 @@
+package merge_operator
+
+import (
+	"testing"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	KeyEntry "github.com/abesheknarayan/go-caskdb/pkg/key_entry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltinOperators(t *testing.T) {
+	add := NewUint64AddOperator()
+	assert.Equal(t, "5", add.FullMerge("k", "", false, "5"))
+	assert.Equal(t, "12", add.FullMerge("k", "7", true, "5"))
+	assert.Equal(t, "5", add.FullMerge("k", "not a number", true, "5"))
+	assert.Equal(t, "9", add.PartialMerge("k", "4", "5"))
+	assert.Equal(t, "0", add.PartialMerge("k", "18446744073709551615", "1"))
+
+	appendOperator := NewStringAppendOperator(",")
+	assert.Equal(t, "a", appendOperator.FullMerge("k", "", false, "a"))
+	assert.Equal(t, "a,b", appendOperator.FullMerge("k", "a", true, "b"))
+	assert.Equal(t, ",b", appendOperator.FullMerge("k", "", true, "b"))
+	assert.Equal(t, "b,c", appendOperator.PartialMerge("k", "b", "c"))
+
+	keepMax := NewMaxOperator()
+	assert.Equal(t, "b", keepMax.FullMerge("k", "", false, "b"))
+	assert.Equal(t, "c", keepMax.FullMerge("k", "c", true, "b"))
+	assert.Equal(t, "d", keepMax.PartialMerge("k", "c", "d"))
+	assert.Equal(t, "9", keepMax.PartialMerge("k", "9", "10"))
+}
+
+func TestApply(t *testing.T) {
+	operator := NewStringAppendOperator(",")
+	operand := KeyEntry.KeyEntry{Timestamp: 5, Value: "new", Kind: format.RECORD_KIND_MERGE_OPERAND}
+	now := int64(1000)
+
+	assert.Equal(t, KeyEntry.KeyEntry{Timestamp: 5, Value: "new"}, Apply(operator, "k", operand, KeyEntry.KeyEntry{}, false, now))
+	assert.Equal(t, KeyEntry.KeyEntry{Timestamp: 5, Value: "old,new"}, Apply(operator, "k", operand, KeyEntry.KeyEntry{Timestamp: 1, Value: "old"}, true, now))
+	assert.Equal(t, KeyEntry.KeyEntry{Timestamp: 5, Value: "new"}, Apply(operator, "k", operand, KeyEntry.KeyEntry{Timestamp: 1, Kind: format.RECORD_KIND_TOMBSTONE}, true, now))
+
+	// operands stay operands, nothing is known about the value below them
+	older := KeyEntry.KeyEntry{Timestamp: 1, Value: "older", Kind: format.RECORD_KIND_MERGE_OPERAND}
+	assert.Equal(t, KeyEntry.KeyEntry{Timestamp: 5, Value: "older,new", Kind: format.RECORD_KIND_MERGE_OPERAND}, Apply(operator, "k", operand, older, true, now))
+
+	// the expiry of the value is kept, unless it already passed
+	expiring := KeyEntry.KeyEntry{Timestamp: 1, Value: "old", Kind: format.RECORD_KIND_EXPIRING_VALUE, ExpiresAt: 2000}
+	assert.Equal(t, KeyEntry.KeyEntry{Timestamp: 5, Value: "old,new", Kind: format.RECORD_KIND_EXPIRING_VALUE, ExpiresAt: 2000}, Apply(operator, "k", operand, expiring, true, now))
+	expiring.ExpiresAt = 1000
+	assert.Equal(t, KeyEntry.KeyEntry{Timestamp: 5, Value: "new"}, Apply(operator, "k", operand, expiring, true, now))
+}
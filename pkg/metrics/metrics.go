@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	OPERATION_PUT         = "put"
+	OPERATION_GET         = "get"
+	OPERATION_DELETE      = "delete"
+	OPERATION_WRITE_BATCH = "write_batch"
+	OPERATION_CONDITIONAL = "conditional_write" // CompareAndSwap, PutIfAbsent and DeleteIfEquals
+	OPERATION_TRANSACTION = "transaction"       // Txn.Commit
+	OPERATION_MERGE       = "merge"
+)
+
+// metrics of a single db. DiskStore and the memtable call the Observe* methods, every one of them is a no-op on a nil
+// *Metrics so the db doesn't have to check whether metrics are enabled
+type Metrics struct {
+	Registry             *Registry
+	OperationLatency     *HistogramVec // caskdb_operation_duration_seconds{operation}
+	MemtableFlushes      *CounterVec   // caskdb_memtable_flushes_total
+	MemtableFlushLatency *HistogramVec // caskdb_memtable_flush_duration_seconds
+	Compactions          *CounterVec   // caskdb_compactions_total{level}, level is the output level of the compaction
+	CompactionLatency    *HistogramVec // caskdb_compaction_duration_seconds{level}
+	CompactionBytesRead  *CounterVec   // caskdb_compaction_read_bytes_total{level}
+	BytesWritten         *CounterVec   // caskdb_written_bytes_total{level}, flushes count towards level 0
+	TableCacheHits       *CounterVec   // caskdb_table_cache_hits_total
+	TableCacheMisses     *CounterVec   // caskdb_table_cache_misses_total
+	WriteStalls          *CounterVec   // caskdb_write_stalls_total
+	WriteStallTime       *CounterVec   // caskdb_write_stall_seconds_total
+}
+
+// returns metrics registered on a new registry
+func New() *Metrics {
+	m, err := NewWithRegistry(NewRegistry())
+	if err != nil {
+		// a new registry is empty, names can't clash
+		panic(err)
+	}
+	return m
+}
+
+// registers the metrics on r, fails if r already has metrics with the same names (like another db's)
+func NewWithRegistry(r *Registry) (*Metrics, error) {
+	m := &Metrics{Registry: r}
+	var err error
+	counters := []struct {
+		counter    **CounterVec
+		name       string
+		help       string
+		labelNames []string
+	}{
+		{&m.MemtableFlushes, "caskdb_memtable_flushes_total", "Number of memtables written to level 0.", nil},
+		{&m.Compactions, "caskdb_compactions_total", "Number of merge compactions by output level.", []string{"level"}},
+		{&m.CompactionBytesRead, "caskdb_compaction_read_bytes_total", "Bytes of segment files read by merge compactions by output level.", []string{"level"}},
+		{&m.BytesWritten, "caskdb_written_bytes_total", "Bytes of segment files written by flushes and compactions by level.", []string{"level"}},
+		{&m.TableCacheHits, "caskdb_table_cache_hits_total", "Segment lookups served by the table cache.", nil},
+		{&m.TableCacheMisses, "caskdb_table_cache_misses_total", "Segment lookups which had to load the segment file.", nil},
+		{&m.WriteStalls, "caskdb_write_stalls_total", "Number of times writes were stopped because level 0 had too many segments.", nil},
+		{&m.WriteStallTime, "caskdb_write_stall_seconds_total", "Time writes spent waiting for flushes and compactions.", nil},
+	}
+	for _, c := range counters {
+		*c.counter, err = r.NewCounterVec(c.name, c.help, c.labelNames...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.OperationLatency, err = r.NewHistogramVec("caskdb_operation_duration_seconds", "Latency of Put, Get and Delete calls.", nil, "operation")
+	if err != nil {
+		return nil, err
+	}
+	m.MemtableFlushLatency, err = r.NewHistogramVec("caskdb_memtable_flush_duration_seconds", "Time taken to write a memtable to disk.", nil)
+	if err != nil {
+		return nil, err
+	}
+	m.CompactionLatency, err = r.NewHistogramVec("caskdb_compaction_duration_seconds", "Time taken by merge compactions by output level.", nil, "level")
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// returns the handler serving the metrics, e.g. http.Handle("/metrics", m.Handler())
+func (m *Metrics) Handler() http.Handler {
+	return m.Registry.Handler()
+}
+
+func (m *Metrics) ObserveOperation(operation string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.OperationLatency.Observe(duration.Seconds(), operation)
+}
+
+func (m *Metrics) ObserveFlush(bytesWritten uint64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.MemtableFlushes.Inc()
+	m.MemtableFlushLatency.Observe(duration.Seconds())
+	m.BytesWritten.Add(float64(bytesWritten), "0")
+}
+
+func (m *Metrics) ObserveCompaction(level uint32, bytesRead uint64, bytesWritten uint64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	levelLabel := strconv.FormatUint(uint64(level), 10)
+	m.Compactions.Inc(levelLabel)
+	m.CompactionLatency.Observe(duration.Seconds(), levelLabel)
+	m.CompactionBytesRead.Add(float64(bytesRead), levelLabel)
+	m.BytesWritten.Add(float64(bytesWritten), levelLabel)
+}
+
+func (m *Metrics) ObserveTableCacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.TableCacheHits.Inc()
+	} else {
+		m.TableCacheMisses.Inc()
+	}
+}
+
+// stoppedByLevel0 tells whether writes were stopped because of level 0, otherwise they only waited for the previous flush
+func (m *Metrics) ObserveStall(duration time.Duration, stoppedByLevel0 bool) {
+	if m == nil {
+		return
+	}
+	if stoppedByLevel0 {
+		m.WriteStalls.Inc()
+	}
+	m.WriteStallTime.Add(duration.Seconds())
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterExposition(t *testing.T) {
+	r := NewRegistry()
+	c, err := r.NewCounterVec("test_requests_total", "Requests.", "code")
+	assert.Nil(t, err)
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc("a\"b")
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	expected := "# HELP test_requests_total Requests.\n" +
+		"# TYPE test_requests_total counter\n" +
+		"test_requests_total{code=\"200\"} 3\n" +
+		"test_requests_total{code=\"a\\\"b\"} 1\n"
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestHistogramBucketsAreCumulative(t *testing.T) {
+	r := NewRegistry()
+	h, err := r.NewHistogramVec("test_latency_seconds", "Latency.", []float64{1, 0.1})
+	assert.Nil(t, err)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	expected := "# HELP test_latency_seconds Latency.\n" +
+		"# TYPE test_latency_seconds histogram\n" +
+		"test_latency_seconds_bucket{le=\"0.1\"} 1\n" +
+		"test_latency_seconds_bucket{le=\"1\"} 2\n" +
+		"test_latency_seconds_bucket{le=\"+Inf\"} 3\n" +
+		"test_latency_seconds_sum 2.55\n" +
+		"test_latency_seconds_count 3\n"
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestDuplicateMetricName(t *testing.T) {
+	r := NewRegistry()
+	_, err := r.NewCounterVec("test_total", "")
+	assert.Nil(t, err)
+	_, err = r.NewHistogramVec("test_total", "", nil)
+	assert.ErrorIs(t, err, CustomError.ErrMetricAlreadyRegistered)
+}
+
+func TestNilMetricsIsNoop(t *testing.T) {
+	var m *Metrics
+	m.ObserveOperation(OPERATION_PUT, time.Millisecond)
+	m.ObserveFlush(10, time.Millisecond)
+	m.ObserveCompaction(1, 10, 10, time.Millisecond)
+	m.ObserveTableCacheLookup(true)
+	m.ObserveStall(time.Millisecond, true)
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.ObserveOperation(OPERATION_GET, time.Millisecond)
+	m.ObserveCompaction(2, 100, 50, time.Second)
+
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, CONTENT_TYPE, recorder.Header().Get("Content-Type"))
+	body, _ := io.ReadAll(recorder.Body)
+	assert.Contains(t, string(body), "caskdb_operation_duration_seconds_count{operation=\"get\"} 1\n")
+	assert.Contains(t, string(body), "caskdb_written_bytes_total{level=\"2\"} 50\n")
+	assert.Contains(t, string(body), "caskdb_compactions_total{level=\"2\"} 1\n")
+}
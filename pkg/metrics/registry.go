@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+)
+
+/*
+	- minimal implementation of the prometheus text exposition format (version 0.0.4), just counters and histograms
+	- a metric can have labels, every distinct set of label values is its own series
+	- https://prometheus.io/docs/instrumenting/exposition_formats/
+*/
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// default histogram buckets in seconds, from 10µs to 10s
+var DEFAULT_LATENCY_BUCKETS = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+type collector interface {
+	metricName() string
+	writeTo(w io.Writer)
+}
+
+type Registry struct {
+	collectors map[string]collector
+	Mu         *sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]collector),
+		Mu:         &sync.Mutex{},
+	}
+}
+
+func (r *Registry) register(c collector) error {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if _, exists := r.collectors[c.metricName()]; exists {
+		return CustomError.ErrMetricAlreadyRegistered
+	}
+	r.collectors[c.metricName()] = c
+	return nil
+}
+
+// writes every registered metric in the text exposition format, sorted by name so that the output is stable
+func (r *Registry) Write(w io.Writer) {
+	r.Mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.Mu.Unlock()
+
+	for _, c := range collectors {
+		c.writeTo(w)
+	}
+}
+
+// returns a handler serving the metrics of the registry, meant to be mounted at /metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		r.Write(&buf)
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		w.Write(buf.Bytes())
+	})
+}
+
+// counter with labels, counters only ever go up
+type CounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	series     map[string]*counterSeries
+	Mu         *sync.Mutex
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) (*CounterVec, error) {
+	c := &CounterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		series:     make(map[string]*counterSeries),
+		Mu:         &sync.Mutex{},
+	}
+	return c, r.register(c)
+}
+
+// adds v to the series with the given label values, which have to be in the order of the label names
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		// counters can't go down
+		return
+	}
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	key := seriesKey(c.labelNames, labelValues)
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: append([]string{}, labelValues...)}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// returns the current value of a series, 0 if it was never updated
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if s, ok := c.series[seriesKey(c.labelNames, labelValues)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *CounterVec) metricName() string {
+	return c.name
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedSeriesKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labelNames, s.labelValues, "", ""), formatFloat(s.value))
+	}
+}
+
+// histogram with labels, observations are counted into cumulative buckets by their upper bound
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64 // upper bounds, sorted
+	series     map[string]*histogramSeries
+	Mu         *sync.Mutex
+}
+
+type histogramSeries struct {
+	labelValues  []string
+	bucketCounts []uint64 // not cumulative, the last one is +Inf
+	sum          float64
+	count        uint64
+}
+
+// nil buckets means DEFAULT_LATENCY_BUCKETS
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) (*HistogramVec, error) {
+	if buckets == nil {
+		buckets = DEFAULT_LATENCY_BUCKETS
+	}
+	sortedBuckets := append([]float64{}, buckets...)
+	sort.Float64s(sortedBuckets)
+	h := &HistogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    sortedBuckets,
+		series:     make(map[string]*histogramSeries),
+		Mu:         &sync.Mutex{},
+	}
+	return h, r.register(h)
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	key := seriesKey(h.labelNames, labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: append([]string{}, labelValues...), bucketCounts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.bucketCounts[sort.SearchFloat64s(h.buckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+// returns the number of observations of a series
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	if s, ok := h.series[seriesKey(h.labelNames, labelValues)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) metricName() string {
+	return h.name
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedSeriesKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.bucketCounts {
+			cumulative += count
+			upperBound := math.Inf(1)
+			if i < len(h.buckets) {
+				upperBound = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, s.labelValues, "le", formatFloat(upperBound)), cumulative)
+		}
+		labels := formatLabels(h.labelNames, s.labelValues, "", "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.count)
+	}
+}
+
+// missing label values are treated as empty, extra ones are dropped
+func seriesKey(labelNames []string, labelValues []string) string {
+	values := make([]string, len(labelNames))
+	copy(values, labelValues)
+	return strings.Join(values, "\xff")
+}
+
+func sortedSeriesKeys[T any](series map[string]T) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+// formats {name="value",...}, extraName/extraValue is appended when set (used for the le label of histogram buckets)
+func formatLabels(labelNames []string, labelValues []string, extraName string, extraValue string) string {
+	if len(labelNames) == 0 && extraName == "" {
+		return ""
+	}
+	var parts []string
+	for i, name := range labelNames {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(value)))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,93 @@
+package raft
+
+import (
+	"context"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+// applies committed entries to the db in order, and compacts the log every SnapshotThreshold entries
+func (n *Node) applyEntries() {
+	defer n.wg.Done()
+	var l = n.Logger.WithFields(logger.Fields{
+		"method": "applyEntries",
+		"node":   n.Id,
+	})
+
+	for {
+		n.Mu.Lock()
+		err := n.waitLocked(context.Background(), func() bool {
+			return n.commitIndex > n.lastApplied
+		})
+		if err != nil || n.stopped {
+			n.Mu.Unlock()
+			return
+		}
+		entries := n.log.slice(n.lastApplied+1, n.config.MaxEntriesPerMessage)
+		for len(entries) > 0 && entries[len(entries)-1].Index > n.commitIndex {
+			entries = entries[:len(entries)-1]
+		}
+		n.Mu.Unlock()
+
+		n.applyMu.Lock()
+		for _, entry := range entries {
+			// a snapshot installed in the meantime has it
+			if entry.Index <= n.Db.LastSequence() {
+				continue
+			}
+			err := n.Db.ApplyReplicatedBatch(disk_store.ReplicatedBatch{Sequence: entry.Index, Data: entry.Data})
+			if err != nil {
+				// every node applies the same entries, the state machine can't go on without this one
+				l.Errorln(err)
+				panic(err)
+			}
+		}
+
+		n.Mu.Lock()
+		applied := n.Db.LastSequence()
+		if applied > n.lastApplied {
+			n.lastApplied = applied
+		}
+		for _, entry := range entries {
+			if w, ok := n.waiters[entry.Index]; ok {
+				if w.term == entry.Term {
+					w.result <- nil
+				} else {
+					w.result <- CustomError.ErrLeadershipLost
+				}
+				delete(n.waiters, entry.Index)
+			}
+		}
+		n.notifyLocked()
+		compact := n.lastApplied-n.log.state.SnapshotIndex >= n.config.SnapshotThreshold
+		n.Mu.Unlock()
+
+		if compact {
+			n.compactLog()
+		}
+		n.applyMu.Unlock()
+	}
+}
+
+// drops the applied entries from the log once the db has them on disk, caller must hold n.applyMu
+func (n *Node) compactLog() {
+	var l = n.Logger.WithFields(logger.Fields{
+		"method": "compactLog",
+		"node":   n.Id,
+	})
+
+	n.Db.Flush()
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if n.stopped {
+		return
+	}
+	term, _ := n.log.term(n.lastApplied)
+	if err := n.log.compact(n.lastApplied, term); err != nil {
+		l.Errorln(err)
+		return
+	}
+	l.Infof("Compacted the raft log up to %d", n.lastApplied)
+}
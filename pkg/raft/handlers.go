@@ -0,0 +1,185 @@
+package raft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+// rpcs coming in from the transport
+
+func (n *Node) HandleRequestVote(args *RequestVoteArgs) (*RequestVoteReply, error) {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if n.stopped {
+		return nil, CustomError.ErrNodeStopped
+	}
+	n.observeTermLocked(args.Term)
+	reply := &RequestVoteReply{Term: n.term()}
+	if args.Term < n.term() {
+		return reply, nil
+	}
+
+	// only a candidate with every entry this node has can get its vote
+	upToDate := args.LastLogTerm > n.log.lastTerm() || (args.LastLogTerm == n.log.lastTerm() && args.LastLogIndex >= n.log.lastIndex())
+	votedFor := n.log.state.VotedFor
+	if (votedFor == "" || votedFor == args.CandidateId) && upToDate {
+		if err := n.log.setTermAndVote(n.term(), args.CandidateId); err != nil {
+			return nil, err
+		}
+		reply.VoteGranted = true
+		n.resetElectionDeadlineLocked()
+	}
+	return reply, nil
+}
+
+func (n *Node) HandleAppendEntries(args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if n.stopped {
+		return nil, CustomError.ErrNodeStopped
+	}
+	n.observeTermLocked(args.Term)
+	reply := &AppendEntriesReply{Term: n.term()}
+	if args.Term < n.term() {
+		return reply, nil
+	}
+	// a candidate of the same term lost the election
+	n.becomeFollowerLocked()
+	n.leaderId = args.LeaderId
+	n.resetElectionDeadlineLocked()
+
+	prevLogIndex, prevLogTerm, entries := args.PrevLogIndex, args.PrevLogTerm, args.Entries
+	if snapshotIndex := n.log.state.SnapshotIndex; prevLogIndex < snapshotIndex {
+		// entries up to the snapshot are committed, they can only match
+		skip := snapshotIndex - prevLogIndex
+		if uint64(len(entries)) <= skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prevLogIndex, prevLogTerm = snapshotIndex, n.log.state.SnapshotTerm
+	}
+	if prevLogIndex > n.log.lastIndex() {
+		reply.ConflictIndex = n.log.lastIndex() + 1
+		return reply, nil
+	}
+	if term, _ := n.log.term(prevLogIndex); term != prevLogTerm {
+		reply.ConflictIndex = n.log.firstIndexOfTerm(prevLogIndex)
+		return reply, nil
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.log.lastIndex() {
+			if term, _ := n.log.term(entry.Index); term == entry.Term {
+				continue
+			}
+			if entry.Index <= n.commitIndex {
+				return nil, fmt.Errorf("leader %s disagrees with committed entry %d", args.LeaderId, entry.Index)
+			}
+			if err := n.log.truncateFrom(entry.Index); err != nil {
+				return nil, err
+			}
+		}
+		if err := n.log.append(entries[i:]); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		// only what is known to match the leader's log can be committed
+		commit := args.PrevLogIndex + uint64(len(args.Entries))
+		if args.LeaderCommit < commit {
+			commit = args.LeaderCommit
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.notifyLocked()
+		}
+	}
+	reply.Success = true
+	return reply, nil
+}
+
+// replaces the db with the leader's snapshot unless it already has everything in it
+func (n *Node) HandleInstallSnapshot(args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+	var l = n.Logger.WithFields(logger.Fields{
+		"method":                  "HandleInstallSnapshot",
+		"node":                    n.Id,
+		"param_lastIncludedIndex": args.LastIncludedIndex,
+	})
+
+	n.Mu.Lock()
+	if n.stopped {
+		n.Mu.Unlock()
+		return nil, CustomError.ErrNodeStopped
+	}
+	n.observeTermLocked(args.Term)
+	reply := &InstallSnapshotReply{Term: n.term()}
+	if args.Term < n.term() || args.LastIncludedIndex <= n.lastApplied {
+		n.Mu.Unlock()
+		return reply, nil
+	}
+	n.becomeFollowerLocked()
+	n.leaderId = args.LeaderId
+	n.resetElectionDeadlineLocked()
+	n.Mu.Unlock()
+
+	dir, err := os.MkdirTemp("", "caskdb-raft-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	levels := make([][]string, len(args.Levels))
+	for level, segments := range args.Levels {
+		for i, data := range segments {
+			path := filepath.Join(dir, fmt.Sprintf("%d-%d.seg", level, i))
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				return nil, err
+			}
+			levels[level] = append(levels[level], path)
+		}
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.Mu.Lock()
+	if n.stopped {
+		n.Mu.Unlock()
+		return nil, CustomError.ErrNodeStopped
+	}
+	if args.LastIncludedIndex <= n.lastApplied {
+		n.Mu.Unlock()
+		return reply, nil
+	}
+	// recorded first, a node that goes down while installing can tell whether the db got the snapshot
+	err = n.log.beginSnapshot(args.LastIncludedIndex, args.LastIncludedTerm)
+	n.Mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	installErr := n.Db.InstallSnapshot(args.LastIncludedIndex, levels)
+
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if err := n.log.finishSnapshot(installErr == nil); err != nil {
+		l.Errorln(err)
+		return nil, err
+	}
+	if installErr != nil {
+		l.Errorln(installErr)
+		return nil, installErr
+	}
+	n.lastApplied = args.LastIncludedIndex
+	if n.commitIndex < n.lastApplied {
+		n.commitIndex = n.lastApplied
+	}
+	n.notifyLocked()
+	l.Infof("Installed a snapshot at %d", args.LastIncludedIndex)
+	return reply, nil
+}
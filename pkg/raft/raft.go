@@ -0,0 +1,404 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+/*
+	- a node runs a DiskStore as the state machine of a raft log (https://raft.github.io/raft.pdf). Every entry is an
+	  encoded write batch and entry i is applied as the batch with sequence i, so the db's last sequence is the last
+	  applied index, also across restarts
+	- the db has to be opened read only, ApplyReplicatedBatch and InstallSnapshot are the only writes it takes
+	- a new leader appends an empty batch first, committing it commits everything of earlier terms
+	- writes and reads go through the leader. A read notes the commit index, makes sure a majority still follows the
+	  leader with heartbeats sent after the read started, waits till the db applied up to the noted index and reads
+	- the db is the snapshot: compacting the log flushes the db first and a follower too far behind gets the segment
+	  files of a checkpoint of the leader's db
+	- membership is fixed, every node is configured with the ids of all of them
+*/
+
+type Role uint8
+
+const (
+	ROLE_FOLLOWER Role = iota
+	ROLE_CANDIDATE
+	ROLE_LEADER
+)
+
+func (r Role) String() string {
+	switch r {
+	case ROLE_FOLLOWER:
+		return "follower"
+	case ROLE_CANDIDATE:
+		return "candidate"
+	case ROLE_LEADER:
+		return "leader"
+	}
+	return fmt.Sprintf("Role(%d)", uint8(r))
+}
+
+const (
+	DEFAULT_ELECTION_TIMEOUT        = 300 * time.Millisecond
+	DEFAULT_HEARTBEAT_INTERVAL      = 50 * time.Millisecond
+	DEFAULT_SNAPSHOT_THRESHOLD      = 10000
+	DEFAULT_MAX_ENTRIES_PER_MESSAGE = 256
+	// snapshots carry whole segment files, they get more time than the other rpcs
+	SNAPSHOT_TIMEOUT_FACTOR = 10
+)
+
+type Config struct {
+	Id    string
+	Peers []string // ids of every node of the cluster, this one included
+	Dir   string   // where the raft log and state are kept, not the db directory
+	// a follower which hears nothing from a leader for a random time between this and twice this starts an election
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// the log is compacted once this many entries were applied since the last compaction
+	SnapshotThreshold    uint64
+	MaxEntriesPerMessage int
+}
+
+func DefaultConfig(id string, peers []string, dir string) Config {
+	return Config{
+		Id:                   id,
+		Peers:                peers,
+		Dir:                  dir,
+		ElectionTimeout:      DEFAULT_ELECTION_TIMEOUT,
+		HeartbeatInterval:    DEFAULT_HEARTBEAT_INTERVAL,
+		SnapshotThreshold:    DEFAULT_SNAPSHOT_THRESHOLD,
+		MaxEntriesPerMessage: DEFAULT_MAX_ENTRIES_PER_MESSAGE,
+	}
+}
+
+type Status struct {
+	Id            string
+	Role          Role
+	Term          uint64
+	LeaderId      string // empty if no leader is known
+	CommitIndex   uint64
+	LastApplied   uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+}
+
+// a write waiting for its entry to be applied
+type waiter struct {
+	term   uint64
+	result chan error
+}
+
+type Node struct {
+	Id        string
+	Db        *disk_store.DiskStore
+	Transport Transport
+	Logger    logger.Logger
+	config    Config
+	peers     []string // everyone but this node
+
+	Mu               *sync.Mutex
+	role             Role
+	leaderId         string
+	log              *raftLog
+	commitIndex      uint64
+	lastApplied      uint64
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	acknowledgedAt   map[string]time.Time // when the last request the peer answered as a follower of this leader was sent
+	electionDeadline time.Time
+	waiters          map[uint64]waiter
+	changed          chan struct{} // closed and replaced whenever the state changes
+	stopped          bool
+
+	applyMu  *sync.Mutex // held while entries are applied, the log is compacted or a snapshot is taken or installed
+	triggers map[string]chan struct{}
+	stop     chan struct{}
+	wg       *sync.WaitGroup
+}
+
+// Starts a node on a db opened read only and the raft state in config.Dir. The db must not have batches the raft log
+// doesn't know of, a new cluster starts from empty dbs
+func NewNode(config Config, d *disk_store.DiskStore, transport Transport) (*Node, error) {
+	if !d.Options.ReadOnly {
+		return nil, errors.New("the db of a raft node has to be opened read only")
+	}
+	log, err := openRaftLog(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if log.state.PendingSnapshotIndex != 0 {
+		// the node went down while installing a snapshot
+		if err := log.finishSnapshot(d.LastSequence() >= log.state.PendingSnapshotIndex); err != nil {
+			log.close()
+			return nil, err
+		}
+	}
+	applied := d.LastSequence()
+	if applied < log.state.SnapshotIndex || applied > log.lastIndex() {
+		log.close()
+		return nil, fmt.Errorf("db is at sequence %d, the raft log has entries %d to %d", applied, log.state.SnapshotIndex, log.lastIndex())
+	}
+
+	n := &Node{
+		Id:             config.Id,
+		Db:             d,
+		Transport:      transport,
+		Logger:         d.Logger,
+		config:         config,
+		Mu:             &sync.Mutex{},
+		log:            log,
+		commitIndex:    applied,
+		lastApplied:    applied,
+		nextIndex:      make(map[string]uint64),
+		matchIndex:     make(map[string]uint64),
+		acknowledgedAt: make(map[string]time.Time),
+		waiters:        make(map[uint64]waiter),
+		changed:        make(chan struct{}),
+		applyMu:        &sync.Mutex{},
+		triggers:       make(map[string]chan struct{}),
+		stop:           make(chan struct{}),
+		wg:             &sync.WaitGroup{},
+	}
+	for _, peer := range config.Peers {
+		if peer != config.Id {
+			n.peers = append(n.peers, peer)
+			n.triggers[peer] = make(chan struct{}, 1)
+		}
+	}
+	n.resetElectionDeadlineLocked()
+
+	n.wg.Add(2 + len(n.peers))
+	go n.tick()
+	go n.applyEntries()
+	for _, peer := range n.peers {
+		go n.replicate(peer)
+	}
+	return n, nil
+}
+
+// Stops the node, writes waiting for their entries fail with ErrNodeStopped. The db stays open
+func (n *Node) Stop() {
+	n.Mu.Lock()
+	if n.stopped {
+		n.Mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	n.failWaitersLocked(CustomError.ErrNodeStopped)
+	n.notifyLocked()
+	n.Mu.Unlock()
+
+	n.wg.Wait()
+	n.Mu.Lock()
+	n.log.close()
+	n.Mu.Unlock()
+}
+
+func (n *Node) Status() Status {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	return Status{
+		Id:            n.Id,
+		Role:          n.role,
+		Term:          n.term(),
+		LeaderId:      n.leaderId,
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastIndex:     n.log.lastIndex(),
+		SnapshotIndex: n.log.state.SnapshotIndex,
+	}
+}
+
+// Replicates the batch and returns once the leader applied it. Fails with ErrNotLeader on any other node, with
+// ErrLeadershipLost if the node stopped being the leader before the batch was applied
+func (n *Node) Write(ctx context.Context, batch *disk_store.WriteBatch) error {
+	if err := batch.Validate(); err != nil {
+		return err
+	}
+	data := batch.Encode()
+
+	n.Mu.Lock()
+	if n.stopped {
+		n.Mu.Unlock()
+		return CustomError.ErrNodeStopped
+	}
+	if n.role != ROLE_LEADER {
+		err := n.notLeaderErrorLocked()
+		n.Mu.Unlock()
+		return err
+	}
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.term(), Data: data}
+	if err := n.log.append([]Entry{entry}); err != nil {
+		n.Mu.Unlock()
+		return err
+	}
+	result := make(chan error, 1)
+	n.waiters[entry.Index] = waiter{term: entry.Term, result: result}
+	n.advanceCommitLocked()
+	n.triggerReplicationLocked()
+	n.Mu.Unlock()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *Node) Put(ctx context.Context, key string, value string) error {
+	batch := disk_store.NewWriteBatch()
+	batch.Put(key, value)
+	return n.Write(ctx, batch)
+}
+
+func (n *Node) Delete(ctx context.Context, key string) error {
+	batch := disk_store.NewWriteBatch()
+	batch.Delete(key)
+	return n.Write(ctx, batch)
+}
+
+// Returns once the db has every write committed before the call, reads of the db right after it are linearizable.
+// Only works on the leader
+func (n *Node) ReadBarrier(ctx context.Context) error {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if n.stopped {
+		return CustomError.ErrNodeStopped
+	}
+	if n.role != ROLE_LEADER {
+		return n.notLeaderErrorLocked()
+	}
+	term := n.term()
+	stillLeader := func() bool {
+		return n.role == ROLE_LEADER && n.term() == term
+	}
+
+	// the commit index is only known to be the latest once an entry of the leader's own term is committed
+	err := n.waitLocked(ctx, func() bool {
+		commitTerm, _ := n.log.term(n.commitIndex)
+		return !stillLeader() || commitTerm == term
+	})
+	if err != nil {
+		return err
+	}
+	if !stillLeader() {
+		return n.notLeaderErrorLocked()
+	}
+
+	readIndex := n.commitIndex
+	startTime := time.Now()
+	n.triggerReplicationLocked()
+	err = n.waitLocked(ctx, func() bool {
+		acknowledged := 1
+		for _, peer := range n.peers {
+			if !n.acknowledgedAt[peer].Before(startTime) {
+				acknowledged++
+			}
+		}
+		return !stillLeader() || acknowledged >= n.majority()
+	})
+	if err != nil {
+		return err
+	}
+	if !stillLeader() {
+		return n.notLeaderErrorLocked()
+	}
+	return n.waitLocked(ctx, func() bool {
+		return n.lastApplied >= readIndex
+	})
+}
+
+// a linearizable read of the key, see ReadBarrier
+func (n *Node) Lookup(ctx context.Context, key string) (string, bool, error) {
+	if err := n.ReadBarrier(ctx); err != nil {
+		return "", false, err
+	}
+	value, ok := n.Db.Lookup(key)
+	return value, ok, nil
+}
+
+func (n *Node) term() uint64 {
+	return n.log.state.CurrentTerm
+}
+
+func (n *Node) majority() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) notLeaderErrorLocked() error {
+	if n.leaderId == "" || n.leaderId == n.Id {
+		return fmt.Errorf("%w, no leader is known", CustomError.ErrNotLeader)
+	}
+	return fmt.Errorf("%w, the leader is %s", CustomError.ErrNotLeader, n.leaderId)
+}
+
+// wakes up everyone waiting for the state to change, caller must hold n.Mu
+func (n *Node) notifyLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// Waits till done returns true, which is called with n.Mu held. Fails once ctx is done or the node stops. Caller must
+// hold n.Mu, which is held again when waitLocked returns
+func (n *Node) waitLocked(ctx context.Context, done func() bool) error {
+	for !done() {
+		if n.stopped {
+			return CustomError.ErrNodeStopped
+		}
+		changed := n.changed
+		n.Mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			n.Mu.Lock()
+			return ctx.Err()
+		}
+		n.Mu.Lock()
+	}
+	return nil
+}
+
+func (n *Node) failWaitersLocked(err error) {
+	for index, w := range n.waiters {
+		w.result <- err
+		delete(n.waiters, index)
+	}
+}
+
+func (n *Node) resetElectionDeadlineLocked() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// steps down if term is newer than the node's, returns true if it was
+func (n *Node) observeTermLocked(term uint64) bool {
+	if term <= n.term() {
+		return false
+	}
+	if err := n.log.setTermAndVote(term, ""); err != nil {
+		n.Logger.Errorf("Error while saving the raft state %v", err)
+	}
+	n.leaderId = ""
+	n.becomeFollowerLocked()
+	return true
+}
+
+func (n *Node) becomeFollowerLocked() {
+	if n.role == ROLE_LEADER {
+		n.failWaitersLocked(CustomError.ErrLeadershipLost)
+	}
+	if n.role != ROLE_FOLLOWER {
+		n.role = ROLE_FOLLOWER
+		n.notifyLocked()
+	}
+}
@@ -0,0 +1,430 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/config"
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTimeout = 10 * time.Second
+
+// nodes on a simulated network, every node has its own db and raft directory
+type cluster struct {
+	t         *testing.T
+	network   *Network
+	ids       []string
+	dir       string
+	nodes     map[string]*Node
+	dbs       map[string]*disk_store.DiskStore
+	configure func(config *Config)
+}
+
+func newCluster(t *testing.T, size int, configure func(config *Config)) *cluster {
+	dir := t.TempDir()
+	config.Config = config.NewDefaultConfig("Test", dir)
+	c := &cluster{
+		t:         t,
+		network:   NewNetwork(),
+		dir:       dir,
+		nodes:     make(map[string]*Node),
+		dbs:       make(map[string]*disk_store.DiskStore),
+		configure: configure,
+	}
+	for i := 1; i <= size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("node%d", i))
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, id := range c.ids {
+			if c.nodes[id] != nil {
+				c.stop(id)
+			}
+		}
+	})
+	return c
+}
+
+func testConfig(id string, peers []string, dir string) Config {
+	config := DefaultConfig(id, peers, dir)
+	config.ElectionTimeout = 150 * time.Millisecond
+	config.HeartbeatInterval = 20 * time.Millisecond
+	return config
+}
+
+func (c *cluster) start(id string) {
+	options := disk_store.DefaultOptions()
+	options.ReadOnly = true
+	d, err := disk_store.InitDbWithOptions(id, options)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	config := testConfig(id, c.ids, filepath.Join(c.dir, "raft-"+id))
+	if c.configure != nil {
+		c.configure(&config)
+	}
+	node, err := NewNode(config, d, c.network.Transport(id))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.network.Register(node)
+	c.nodes[id] = node
+	c.dbs[id] = d
+}
+
+func (c *cluster) stop(id string) {
+	c.nodes[id].Stop()
+	c.dbs[id].CloseDB()
+	c.nodes[id] = nil
+	c.dbs[id] = nil
+}
+
+// waits for one of the nodes to be the leader of a term the others (but the excluded ones) follow
+func (c *cluster) waitForLeader(excluded ...string) *Node {
+	var leader *Node
+	assert.Eventually(c.t, func() bool {
+		leader = nil
+		var term uint64
+		for _, id := range c.ids {
+			if contains(excluded, id) || c.nodes[id] == nil {
+				continue
+			}
+			status := c.nodes[id].Status()
+			if status.Role == ROLE_LEADER {
+				leader, term = c.nodes[id], status.Term
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, id := range c.ids {
+			if contains(excluded, id) || c.nodes[id] == nil {
+				continue
+			}
+			if status := c.nodes[id].Status(); status.Term != term || status.LeaderId != leader.Id {
+				return false
+			}
+		}
+		return true
+	}, testTimeout, 10*time.Millisecond)
+	if leader == nil {
+		c.t.Fatal("no leader was elected")
+	}
+	return leader
+}
+
+// waits till the node applied everything up to index
+func (c *cluster) waitForApplied(id string, index uint64) {
+	assert.Eventually(c.t, func() bool {
+		return c.nodes[id].Status().LastApplied >= index
+	}, testTimeout, 10*time.Millisecond)
+}
+
+func contains(ids []string, id string) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+func writeKeys(t *testing.T, leader *Node, prefix string, count int) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for i := 0; i < count; i++ {
+		assert.Nil(t, leader.Put(ctx, fmt.Sprintf("%s%04d", prefix, i), fmt.Sprintf("value%d", i)))
+	}
+}
+
+func TestReplicationAndFailover(t *testing.T) {
+	c := newCluster(t, 3, nil)
+	leader := c.waitForLeader()
+
+	writeKeys(t, leader, "first", 100)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	batch := disk_store.NewWriteBatch()
+	batch.Put("batched", "yes")
+	batch.Delete("first0000")
+	assert.Nil(t, leader.Write(ctx, batch))
+
+	// every db ends up with the same writes
+	commitIndex := leader.Status().CommitIndex
+	for _, id := range c.ids {
+		c.waitForApplied(id, commitIndex)
+		assert.Equal(t, "value42", c.dbs[id].Get("first0042"))
+		assert.Equal(t, "yes", c.dbs[id].Get("batched"))
+		_, ok := c.dbs[id].Lookup("first0000")
+		assert.False(t, ok)
+	}
+
+	// followers point at the leader
+	for _, id := range c.ids {
+		if id != leader.Id {
+			err := c.nodes[id].Put(ctx, "key", "value")
+			assert.ErrorIs(t, err, CustomError.ErrNotLeader)
+			assert.Contains(t, err.Error(), leader.Id)
+			_, _, err = c.nodes[id].Lookup(ctx, "batched")
+			assert.ErrorIs(t, err, CustomError.ErrNotLeader)
+		}
+	}
+
+	// the two left elect a new leader and keep serving
+	oldLeader := leader
+	oldTerm := oldLeader.Status().Term
+	c.network.Disconnect(oldLeader.Id)
+	leader = c.waitForLeader(oldLeader.Id)
+	assert.NotEqual(t, oldLeader.Id, leader.Id)
+	assert.Greater(t, leader.Status().Term, oldTerm)
+	writeKeys(t, leader, "second", 50)
+	value, ok, err := leader.Lookup(ctx, "second0042")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value42", value)
+	value, _, err = leader.Lookup(ctx, "batched")
+	assert.Nil(t, err)
+	assert.Equal(t, "yes", value)
+
+	// the old leader can't reach a majority, it must not serve reads or take writes
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer shortCancel()
+	_, _, err = oldLeader.Lookup(shortCtx, "second0042")
+	assert.NotNil(t, err)
+	assert.NotNil(t, oldLeader.Put(shortCtx, "lost", "write"))
+
+	// and catches up once it is back
+	c.network.Connect(oldLeader.Id)
+	leader = c.waitForLeader()
+	writeKeys(t, leader, "third", 10)
+	commitIndex = leader.Status().CommitIndex
+	for _, id := range c.ids {
+		c.waitForApplied(id, commitIndex)
+		assert.Equal(t, "value42", c.dbs[id].Get("second0042"))
+		assert.Equal(t, "value9", c.dbs[id].Get("third0009"))
+	}
+	value, ok, err = leader.Lookup(ctx, "lost")
+	assert.Nil(t, err)
+	assert.False(t, ok, "A write without a majority was applied")
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newCluster(t, 3, func(config *Config) {
+		config.SnapshotThreshold = 50
+		config.MaxEntriesPerMessage = 16
+	})
+	leader := c.waitForLeader()
+	var follower string
+	for _, id := range c.ids {
+		if id != leader.Id {
+			follower = id
+			break
+		}
+	}
+
+	c.network.Disconnect(follower)
+	writeKeys(t, leader, "key", 300)
+	assert.Greater(t, leader.Status().SnapshotIndex, uint64(0))
+
+	// the leader's log doesn't have what the follower is missing anymore
+	c.network.Connect(follower)
+	commitIndex := leader.Status().CommitIndex
+	c.waitForApplied(follower, commitIndex)
+	assert.Greater(t, c.nodes[follower].Status().SnapshotIndex, uint64(0))
+	for i := 0; i < 300; i++ {
+		assert.Equal(t, fmt.Sprintf("value%d", i), c.dbs[follower].Get(fmt.Sprintf("key%04d", i)))
+	}
+
+	// and it keeps replicating after the snapshot
+	writeKeys(t, leader, "after", 10)
+	c.waitForApplied(follower, leader.Status().CommitIndex)
+	assert.Equal(t, "value9", c.dbs[follower].Get("after0009"))
+}
+
+func TestRestart(t *testing.T) {
+	c := newCluster(t, 3, func(config *Config) {
+		config.SnapshotThreshold = 100
+	})
+	leader := c.waitForLeader()
+	writeKeys(t, leader, "first", 150)
+
+	// a follower which restarts picks up from its log
+	var follower string
+	for _, id := range c.ids {
+		if id != leader.Id {
+			follower = id
+			break
+		}
+	}
+	c.stop(follower)
+	writeKeys(t, leader, "second", 20)
+	c.start(follower)
+	c.waitForApplied(follower, leader.Status().CommitIndex)
+	assert.Equal(t, "value19", c.dbs[follower].Get("second0019"))
+
+	// so does the whole cluster
+	term := leader.Status().Term
+	for _, id := range c.ids {
+		c.stop(id)
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	leader = c.waitForLeader()
+	assert.Greater(t, leader.Status().Term, term)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	value, ok, err := leader.Lookup(ctx, "first0149")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value149", value)
+	writeKeys(t, leader, "third", 10)
+	for _, id := range c.ids {
+		c.waitForApplied(id, leader.Status().CommitIndex)
+		assert.Equal(t, "value19", c.dbs[id].Get("second0019"))
+		assert.Equal(t, "value9", c.dbs[id].Get("third0009"))
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	c := newCluster(t, 1, nil)
+	leader := c.waitForLeader()
+	writeKeys(t, leader, "key", 10)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	value, ok, err := leader.Lookup(ctx, "key0009")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "value9", value)
+}
+
+func TestNodeNeedsReadOnlyDb(t *testing.T) {
+	config.Config = config.NewDefaultConfig("Test", t.TempDir())
+	d, err := disk_store.InitDb("writable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.CloseDB()
+	_, err = NewNode(testConfig("node1", []string{"node1"}, t.TempDir()), d, NewNetwork().Transport("node1"))
+	assert.NotNil(t, err)
+}
+
+func TestRPCTransport(t *testing.T) {
+	config.Config = config.NewDefaultConfig("Test", t.TempDir())
+	ids := []string{"node1", "node2", "node3"}
+	listeners := make(map[string]net.Listener)
+	addresses := make(map[string]string)
+	for _, id := range ids {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[id] = listener
+		addresses[id] = listener.Addr().String()
+	}
+
+	var nodes []*Node
+	for _, id := range ids {
+		options := disk_store.DefaultOptions()
+		options.ReadOnly = true
+		d, err := disk_store.InitDbWithOptions(id, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := NewRPCTransport(addresses)
+		node, err := NewNode(testConfig(id, ids, filepath.Join(t.TempDir(), "raft")), d, transport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := NewRPCServer(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(listeners[id])
+		t.Cleanup(func() {
+			server.Shutdown(context.Background())
+			node.Stop()
+			transport.Close()
+			d.CloseDB()
+		})
+		nodes = append(nodes, node)
+	}
+
+	var leader *Node
+	assert.Eventually(t, func() bool {
+		for _, node := range nodes {
+			if node.Status().Role == ROLE_LEADER {
+				leader = node
+				return true
+			}
+		}
+		return false
+	}, testTimeout, 10*time.Millisecond)
+	if leader == nil {
+		t.Fatal("no leader was elected")
+	}
+	writeKeys(t, leader, "key", 20)
+	for _, node := range nodes {
+		assert.Eventually(t, func() bool {
+			return node.Db.Get("key0019") == "value19"
+		}, testTimeout, 10*time.Millisecond)
+	}
+}
+
+func TestLogRecovery(t *testing.T) {
+	dir := t.TempDir()
+	log, err := openRaftLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		assert.Nil(t, log.append([]Entry{{Index: i, Term: 1 + i/5, Data: []byte(fmt.Sprintf("entry %d", i))}}))
+	}
+	assert.Nil(t, log.setTermAndVote(3, "node2"))
+	assert.Nil(t, log.truncateFrom(9))
+	assert.Equal(t, uint64(5), log.firstIndexOfTerm(7))
+	log.close()
+
+	// a torn record at the end is cut off
+	f, err := os.OpenFile(filepath.Join(dir, LOG_FILE_NAME), os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeLogRecord(Entry{Index: 9, Term: 3, Data: []byte("torn")})[:10])
+	f.Close()
+
+	log, err = openRaftLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(8), log.lastIndex())
+	assert.Equal(t, uint64(3), log.state.CurrentTerm)
+	assert.Equal(t, "node2", log.state.VotedFor)
+	assert.Nil(t, log.append([]Entry{{Index: 9, Term: 3}}))
+
+	assert.Nil(t, log.compact(6, 2))
+	term, ok := log.term(6)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), term)
+	_, ok = log.term(5)
+	assert.False(t, ok)
+	log.close()
+
+	log, err = openRaftLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+	assert.Equal(t, uint64(9), log.lastIndex())
+	assert.Equal(t, "entry 7", string(log.slice(7, 1)[0].Data))
+}
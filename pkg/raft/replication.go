@@ -0,0 +1,323 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+// sends heartbeats as the leader and starts elections otherwise
+func (n *Node) tick() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.Mu.Lock()
+		if n.stopped {
+			n.Mu.Unlock()
+			return
+		}
+		if n.role == ROLE_LEADER {
+			n.triggerReplicationLocked()
+		} else if time.Now().After(n.electionDeadline) {
+			n.startElectionLocked()
+		}
+		n.Mu.Unlock()
+	}
+}
+
+func (n *Node) startElectionLocked() {
+	var l = n.Logger.WithFields(logger.Fields{
+		"method": "startElection",
+		"node":   n.Id,
+	})
+
+	n.resetElectionDeadlineLocked()
+	if err := n.log.setTermAndVote(n.term()+1, n.Id); err != nil {
+		l.Errorf("Error while saving the raft state %v", err)
+		return
+	}
+	n.role = ROLE_CANDIDATE
+	n.leaderId = ""
+	n.notifyLocked()
+	term := n.term()
+	l.Infof("Starting an election for term %d", term)
+
+	votes := 1
+	if votes >= n.majority() {
+		n.becomeLeaderLocked()
+		return
+	}
+	args := &RequestVoteArgs{
+		Term:         term,
+		CandidateId:  n.Id,
+		LastLogIndex: n.log.lastIndex(),
+		LastLogTerm:  n.log.lastTerm(),
+	}
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go func(peer string) {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+			defer cancel()
+			reply, err := n.Transport.RequestVote(ctx, peer, args)
+			if err != nil {
+				return
+			}
+
+			n.Mu.Lock()
+			defer n.Mu.Unlock()
+			if n.stopped || n.observeTermLocked(reply.Term) {
+				return
+			}
+			if n.role != ROLE_CANDIDATE || n.term() != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.majority() {
+				n.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+func (n *Node) becomeLeaderLocked() {
+	var l = n.Logger.WithFields(logger.Fields{
+		"method": "becomeLeader",
+		"node":   n.Id,
+	})
+
+	n.role = ROLE_LEADER
+	n.leaderId = n.Id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.log.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		delete(n.acknowledgedAt, peer)
+	}
+	// committing an entry of its own term commits whatever earlier leaders left uncommitted
+	if err := n.log.append([]Entry{{Index: n.log.lastIndex() + 1, Term: n.term()}}); err != nil {
+		l.Errorln(err)
+		n.becomeFollowerLocked()
+		return
+	}
+	l.Infof("Became the leader of term %d", n.term())
+	n.advanceCommitLocked()
+	n.triggerReplicationLocked()
+	n.notifyLocked()
+}
+
+// makes every replicator send what its peer is missing, or a heartbeat
+func (n *Node) triggerReplicationLocked() {
+	for _, trigger := range n.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// commits the last entry of the current term a majority has, caller must hold n.Mu
+func (n *Node) advanceCommitLocked() {
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		// entries of earlier terms are only committed along with one of the current term
+		if term, _ := n.log.term(index); term != n.term() {
+			return
+		}
+		replicas := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				replicas++
+			}
+		}
+		if replicas >= n.majority() {
+			n.commitIndex = index
+			n.notifyLocked()
+			return
+		}
+	}
+}
+
+// one per peer, keeps sending it entries whenever triggered while the node is the leader
+func (n *Node) replicate(peer string) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.triggers[peer]:
+		}
+		for n.replicateOnce(peer) {
+		}
+	}
+}
+
+// sends the peer the entries it is missing (or a heartbeat), returns true if there is more to send right away
+func (n *Node) replicateOnce(peer string) bool {
+	n.Mu.Lock()
+	if n.stopped || n.role != ROLE_LEADER {
+		n.Mu.Unlock()
+		return false
+	}
+	term := n.term()
+	next := n.nextIndex[peer]
+	if next <= n.log.state.SnapshotIndex {
+		n.Mu.Unlock()
+		return n.sendSnapshot(peer, term)
+	}
+	prevLogTerm, _ := n.log.term(next - 1)
+	args := &AppendEntriesArgs{
+		Term:         term,
+		LeaderId:     n.Id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  prevLogTerm,
+		Entries:      n.log.slice(next, n.config.MaxEntriesPerMessage),
+		LeaderCommit: n.commitIndex,
+	}
+	n.Mu.Unlock()
+
+	sentAt := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+	reply, err := n.Transport.AppendEntries(ctx, peer, args)
+	cancel()
+	if err != nil {
+		return false
+	}
+
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if n.stopped || n.observeTermLocked(reply.Term) || n.role != ROLE_LEADER || n.term() != term {
+		return false
+	}
+	n.acknowledgedLocked(peer, sentAt)
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+			n.advanceCommitLocked()
+		}
+		n.nextIndex[peer] = match + 1
+	} else {
+		// the peer's log ends before, or disagrees at, the previous entry
+		next := reply.ConflictIndex
+		if next == 0 || next > args.PrevLogIndex {
+			next = args.PrevLogIndex
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[peer] = next
+	}
+	return n.nextIndex[peer] <= n.log.lastIndex()
+}
+
+func (n *Node) acknowledgedLocked(peer string, sentAt time.Time) {
+	if sentAt.After(n.acknowledgedAt[peer]) {
+		n.acknowledgedAt[peer] = sentAt
+		n.notifyLocked()
+	}
+}
+
+// sends the peer a snapshot of the db, it is missing entries the log doesn't have anymore
+func (n *Node) sendSnapshot(peer string, term uint64) bool {
+	var l = n.Logger.WithFields(logger.Fields{
+		"method": "sendSnapshot",
+		"node":   n.Id,
+		"peer":   peer,
+	})
+
+	args, err := n.createSnapshot(term)
+	if err != nil {
+		l.Errorln(err)
+		return false
+	}
+	l.Infof("Sending a snapshot at %d", args.LastIncludedIndex)
+
+	sentAt := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), SNAPSHOT_TIMEOUT_FACTOR*n.config.ElectionTimeout)
+	reply, err := n.Transport.InstallSnapshot(ctx, peer, args)
+	cancel()
+	if err != nil {
+		l.Warnf("Snapshot was not installed: %v", err)
+		return false
+	}
+
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	if n.stopped || n.observeTermLocked(reply.Term) || n.role != ROLE_LEADER || n.term() != term {
+		return false
+	}
+	n.acknowledgedLocked(peer, sentAt)
+	if args.LastIncludedIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = args.LastIncludedIndex
+		n.advanceCommitLocked()
+	}
+	n.nextIndex[peer] = args.LastIncludedIndex + 1
+	return n.nextIndex[peer] <= n.log.lastIndex()
+}
+
+// checkpoints the db and reads the segment files of the checkpoint
+func (n *Node) createSnapshot(term uint64) (*InstallSnapshotArgs, error) {
+	dir, err := os.MkdirTemp("", "caskdb-raft-checkpoint-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	checkpointDir := filepath.Join(dir, "checkpoint")
+
+	// no entry gets applied and the log isn't compacted till the term of the checkpoint's last entry is known
+	n.applyMu.Lock()
+	err = n.Db.Checkpoint(checkpointDir)
+	var manifest *disk_store.Manifest
+	if err == nil {
+		manifest, err = readManifest(checkpointDir, n.Logger)
+	}
+	if err != nil {
+		n.applyMu.Unlock()
+		return nil, err
+	}
+	n.Mu.Lock()
+	lastIncludedTerm, ok := n.log.term(manifest.LastSequence)
+	n.Mu.Unlock()
+	n.applyMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("checkpoint is at %d, which is not in the raft log", manifest.LastSequence)
+	}
+
+	args := &InstallSnapshotArgs{
+		Term:              term,
+		LeaderId:          n.Id,
+		LastIncludedIndex: manifest.LastSequence,
+		LastIncludedTerm:  lastIncludedTerm,
+	}
+	for _, level := range manifest.SegmentLevels {
+		var segments [][]byte
+		for _, segment := range level.Segments {
+			data, err := os.ReadFile(filepath.Join(checkpointDir, fmt.Sprintf("%d%s", segment.SegmentId, disk_store.SEGMENT_FILE_EXTENSION)))
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, data)
+		}
+		args.Levels = append(args.Levels, segments)
+	}
+	return args, nil
+}
+
+func readManifest(dir string, log logger.Logger) (*disk_store.Manifest, error) {
+	f, err := os.Open(filepath.Join(dir, disk_store.MANIFEST_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return disk_store.LoadManifest(f, log), nil
+}
@@ -0,0 +1,161 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/tcp_server"
+)
+
+// the name the rpcs of a node are registered under
+const RPC_SERVICE_NAME = "Raft"
+
+// serves the rpcs of a node over tcp with net/rpc, for RPCTransports of the other nodes
+type RPCServer struct {
+	*tcp_server.Server
+	rpcServer *rpc.Server
+}
+
+func NewRPCServer(n *Node) (*RPCServer, error) {
+	s := &RPCServer{rpcServer: rpc.NewServer()}
+	if err := s.rpcServer.RegisterName(RPC_SERVICE_NAME, &rpcService{node: n}); err != nil {
+		return nil, err
+	}
+	s.Server = tcp_server.NewServer("raft", n.Logger, func(conn net.Conn) {
+		s.rpcServer.ServeConn(conn)
+	})
+	return s, nil
+}
+
+// net/rpc wants methods of the form Method(args, reply) error
+type rpcService struct {
+	node *Node
+}
+
+func (s *rpcService) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	r, err := s.node.HandleRequestVote(args)
+	if err == nil {
+		*reply = *r
+	}
+	return err
+}
+
+func (s *rpcService) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	r, err := s.node.HandleAppendEntries(args)
+	if err == nil {
+		*reply = *r
+	}
+	return err
+}
+
+func (s *rpcService) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	r, err := s.node.HandleInstallSnapshot(args)
+	if err == nil {
+		*reply = *r
+	}
+	return err
+}
+
+// sends rpcs to the RPCServers of the peers, keeping one connection per peer
+type RPCTransport struct {
+	Addresses map[string]string // tcp address of every peer by id
+
+	Mu      *sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+func NewRPCTransport(addresses map[string]string) *RPCTransport {
+	return &RPCTransport{
+		Addresses: addresses,
+		Mu:        &sync.Mutex{},
+		clients:   make(map[string]*rpc.Client),
+	}
+}
+
+func (t *RPCTransport) RequestVote(ctx context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	reply := &RequestVoteReply{}
+	return reply, t.call(ctx, peer, "RequestVote", args, reply)
+}
+
+func (t *RPCTransport) AppendEntries(ctx context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	reply := &AppendEntriesReply{}
+	return reply, t.call(ctx, peer, "AppendEntries", args, reply)
+}
+
+func (t *RPCTransport) InstallSnapshot(ctx context.Context, peer string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+	reply := &InstallSnapshotReply{}
+	return reply, t.call(ctx, peer, "InstallSnapshot", args, reply)
+}
+
+// closes the connections to the peers
+func (t *RPCTransport) Close() {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	for peer, client := range t.clients {
+		client.Close()
+		delete(t.clients, peer)
+	}
+}
+
+func (t *RPCTransport) call(ctx context.Context, peer string, method string, args interface{}, reply interface{}) error {
+	client, err := t.client(ctx, peer)
+	if err != nil {
+		return err
+	}
+	call := client.Go(RPC_SERVICE_NAME+"."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		// the reply might still come, the connection is dropped so that it doesn't
+		t.dropClient(peer, client)
+		return ctx.Err()
+	}
+	var serverError rpc.ServerError
+	if call.Error != nil && !errors.As(call.Error, &serverError) {
+		t.dropClient(peer, client)
+	}
+	return call.Error
+}
+
+func (t *RPCTransport) client(ctx context.Context, peer string) (*rpc.Client, error) {
+	t.Mu.Lock()
+	client, ok := t.clients[peer]
+	address, known := t.Addresses[peer]
+	t.Mu.Unlock()
+	if ok {
+		return client, nil
+	}
+	if !known {
+		return nil, fmt.Errorf("%w: no address for %s", CustomError.ErrPeerUnreachable, peer)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", CustomError.ErrPeerUnreachable, err)
+	}
+	client = rpc.NewClient(conn)
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	if existing, ok := t.clients[peer]; ok {
+		// dialed at the same time by another rpc
+		client.Close()
+		return existing, nil
+	}
+	t.clients[peer] = client
+	return client, nil
+}
+
+func (t *RPCTransport) dropClient(peer string, client *rpc.Client) {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	if t.clients[peer] == client {
+		delete(t.clients, peer)
+	}
+	client.Close()
+}
@@ -0,0 +1,363 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/utils"
+)
+
+/*
+	- the term, the vote and where the log starts are kept in a small json file which is replaced atomically, the
+	  entries are appended to a log file and synced before anyone hears about them
+	- a log record is crc32 (of the rest), index, term, data length and the data. A torn record at the end is what a
+	  crash in the middle of an append leaves behind, it is cut off when the log is opened
+	- dropping a suffix truncates the file, dropping a prefix (after a snapshot) rewrites it
+*/
+
+const (
+	STATE_FILE_NAME      = "raft_state.json"
+	STATE_TEMP_FILE_NAME = "raft_state.json.tmp"
+	LOG_FILE_NAME        = "raft.log"
+	LOG_TEMP_FILE_NAME   = "raft.log.tmp"
+	LOG_RECORD_HEADER    = 4 + 8 + 8 + 4
+)
+
+// one command of the replicated log, an encoded write batch
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+type persistentState struct {
+	CurrentTerm   uint64
+	VotedFor      string
+	SnapshotIndex uint64 // entries up to here are in the db and not in the log anymore
+	SnapshotTerm  uint64
+	// a snapshot which was being installed into the db, if the db got it the log is cut as if the install finished
+	PendingSnapshotIndex uint64
+	PendingSnapshotTerm  uint64
+}
+
+type raftLog struct {
+	dir     string
+	state   persistentState
+	entries []Entry // the ones after state.SnapshotIndex
+	offsets []int64 // of every entry in the log file
+	file    *os.File
+	size    int64
+}
+
+func openRaftLog(dir string) (*raftLog, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	r := &raftLog{dir: dir}
+
+	content, err := os.ReadFile(filepath.Join(dir, STATE_FILE_NAME))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &r.state); err != nil {
+			return nil, fmt.Errorf("raft state file is corrupted: %v", err)
+		}
+	}
+
+	r.file, err = os.OpenFile(filepath.Join(dir, LOG_FILE_NAME), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(); err != nil {
+		r.file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// reads the entries of the log file, cutting off a torn record at the end
+func (r *raftLog) load() error {
+	reader := bufio.NewReader(r.file)
+	var stale bool
+	for {
+		header := make([]byte, LOG_RECORD_HEADER)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		entry := Entry{
+			Index: binary.LittleEndian.Uint64(header[4:12]),
+			Term:  binary.LittleEndian.Uint64(header[12:20]),
+			Data:  make([]byte, binary.LittleEndian.Uint32(header[20:24])),
+		}
+		if _, err := io.ReadFull(reader, entry.Data); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(append(header[4:], entry.Data...)) != binary.LittleEndian.Uint32(header[:4]) {
+			break
+		}
+		recordSize := int64(LOG_RECORD_HEADER + len(entry.Data))
+		if entry.Index <= r.state.SnapshotIndex {
+			// left over from a compaction which didn't get to rewrite the file
+			stale = true
+			r.size += recordSize
+			continue
+		}
+		if entry.Index != r.lastIndex()+1 {
+			return fmt.Errorf("raft log is corrupted: entry %d follows %d", entry.Index, r.lastIndex())
+		}
+		r.entries = append(r.entries, entry)
+		r.offsets = append(r.offsets, r.size)
+		r.size += recordSize
+	}
+
+	if stale {
+		return r.rewrite()
+	}
+	if err := r.file.Truncate(r.size); err != nil {
+		return err
+	}
+	_, err := r.file.Seek(r.size, io.SeekStart)
+	return err
+}
+
+func (r *raftLog) close() error {
+	return r.file.Close()
+}
+
+func (r *raftLog) lastIndex() uint64 {
+	if len(r.entries) == 0 {
+		return r.state.SnapshotIndex
+	}
+	return r.entries[len(r.entries)-1].Index
+}
+
+func (r *raftLog) lastTerm() uint64 {
+	if len(r.entries) == 0 {
+		return r.state.SnapshotTerm
+	}
+	return r.entries[len(r.entries)-1].Term
+}
+
+// term of the entry at index, false if the log doesn't have it (anymore)
+func (r *raftLog) term(index uint64) (uint64, bool) {
+	if index == r.state.SnapshotIndex {
+		return r.state.SnapshotTerm, true
+	}
+	if index < r.state.SnapshotIndex || index > r.lastIndex() {
+		return 0, false
+	}
+	return r.entries[index-r.state.SnapshotIndex-1].Term, true
+}
+
+// entries from index `from` on, at most max of them. from must be past the snapshot
+func (r *raftLog) slice(from uint64, max int) []Entry {
+	if from > r.lastIndex() {
+		return nil
+	}
+	entries := r.entries[from-r.state.SnapshotIndex-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+// index of the first entry of the term the entry at index belongs to
+func (r *raftLog) firstIndexOfTerm(index uint64) uint64 {
+	term, _ := r.term(index)
+	for index > r.state.SnapshotIndex+1 {
+		if previous, _ := r.term(index - 1); previous != term {
+			break
+		}
+		index--
+	}
+	return index
+}
+
+func encodeLogRecord(entry Entry) []byte {
+	record := make([]byte, LOG_RECORD_HEADER, LOG_RECORD_HEADER+len(entry.Data))
+	binary.LittleEndian.PutUint64(record[4:12], entry.Index)
+	binary.LittleEndian.PutUint64(record[12:20], entry.Term)
+	binary.LittleEndian.PutUint32(record[20:24], uint32(len(entry.Data)))
+	record = append(record, entry.Data...)
+	binary.LittleEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// appends entries which directly follow the last one and syncs them
+func (r *raftLog) append(entries []Entry) error {
+	var buf []byte
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		offsets = append(offsets, r.size+int64(len(buf)))
+		buf = append(buf, encodeLogRecord(entry)...)
+	}
+	_, err := r.file.Write(buf)
+	if err == nil {
+		err = r.file.Sync()
+	}
+	if err != nil {
+		// whatever made it to the file is cut off again
+		r.file.Truncate(r.size)
+		r.file.Seek(r.size, io.SeekStart)
+		return err
+	}
+	r.entries = append(r.entries, entries...)
+	r.offsets = append(r.offsets, offsets...)
+	r.size += int64(len(buf))
+	return nil
+}
+
+// drops the entry at index and every one after it
+func (r *raftLog) truncateFrom(index uint64) error {
+	position := index - r.state.SnapshotIndex - 1
+	if position >= uint64(len(r.entries)) {
+		return nil
+	}
+	size := r.offsets[position]
+	if err := r.file.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := r.file.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	if err := r.file.Sync(); err != nil {
+		return err
+	}
+	r.entries = r.entries[:position]
+	r.offsets = r.offsets[:position]
+	r.size = size
+	return nil
+}
+
+func (r *raftLog) setTermAndVote(term uint64, votedFor string) error {
+	state := r.state
+	state.CurrentTerm = term
+	state.VotedFor = votedFor
+	return r.saveState(state)
+}
+
+// the db has every entry up to index, they are dropped from the log
+func (r *raftLog) compact(index uint64, term uint64) error {
+	state := r.state
+	state.SnapshotIndex = index
+	state.SnapshotTerm = term
+	if err := r.saveState(state); err != nil {
+		return err
+	}
+	return r.rewrite()
+}
+
+// records a snapshot which is about to be installed into the db
+func (r *raftLog) beginSnapshot(index uint64, term uint64) error {
+	state := r.state
+	state.PendingSnapshotIndex = index
+	state.PendingSnapshotTerm = term
+	return r.saveState(state)
+}
+
+// The log starts after the pending snapshot if it was installed, entries after it are kept if the log agrees with the
+// snapshot on its last entry
+func (r *raftLog) finishSnapshot(installed bool) error {
+	state := r.state
+	index, term := state.PendingSnapshotIndex, state.PendingSnapshotTerm
+	state.PendingSnapshotIndex = 0
+	state.PendingSnapshotTerm = 0
+	if !installed {
+		return r.saveState(state)
+	}
+
+	if existing, ok := r.term(index); !ok || existing != term {
+		r.entries = nil
+		r.offsets = nil
+	}
+	state.SnapshotIndex = index
+	state.SnapshotTerm = term
+	if err := r.saveState(state); err != nil {
+		return err
+	}
+	return r.rewrite()
+}
+
+// atomically replaces the state file
+func (r *raftLog) saveState(state persistentState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tempFile := filepath.Join(r.dir, STATE_TEMP_FILE_NAME)
+	f, err := os.OpenFile(tempFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, filepath.Join(r.dir, STATE_FILE_NAME)); err != nil {
+		return err
+	}
+	if err := utils.SyncDir(r.dir); err != nil {
+		return err
+	}
+	r.state = state
+	return nil
+}
+
+// writes the entries after the snapshot to a new log file which replaces the old one
+func (r *raftLog) rewrite() error {
+	var kept []Entry
+	for _, entry := range r.entries {
+		if entry.Index > r.state.SnapshotIndex {
+			kept = append(kept, entry)
+		}
+	}
+
+	tempFile := filepath.Join(r.dir, LOG_TEMP_FILE_NAME)
+	f, err := os.OpenFile(tempFile, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	var size int64
+	offsets := make([]int64, 0, len(kept))
+	for _, entry := range kept {
+		offsets = append(offsets, size)
+		record := encodeLogRecord(entry)
+		writer.Write(record)
+		size += int64(len(record))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tempFile, filepath.Join(r.dir, LOG_FILE_NAME))
+	}
+	if err == nil {
+		err = utils.SyncDir(r.dir)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.file.Close()
+	r.file = f
+	r.entries = kept
+	r.offsets = offsets
+	r.size = size
+	_, err = r.file.Seek(size, io.SeekStart)
+	return err
+}
@@ -0,0 +1,163 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+)
+
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateId  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderId     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+	// on failure, where the leader should continue from: past the end of a short log or at the start of the
+	// conflicting term
+	ConflictIndex uint64
+}
+
+type InstallSnapshotArgs struct {
+	Term              uint64
+	LeaderId          string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Levels            [][][]byte // contents of the segment files of every level, in manifest order
+}
+
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+// carries rpcs from a node to its peers, peers are addressed by their ids
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error)
+	AppendEntries(ctx context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error)
+	InstallSnapshot(ctx context.Context, peer string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error)
+}
+
+// An in process network between nodes for tests. Nodes can be disconnected from all the others, rpcs from or to a
+// disconnected node fail with ErrPeerUnreachable
+type Network struct {
+	Latency time.Duration // added to every rpc
+
+	Mu           *sync.Mutex
+	nodes        map[string]*Node
+	disconnected map[string]bool
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		Mu:           &sync.Mutex{},
+		nodes:        make(map[string]*Node),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// returns the transport for the node with id `from`
+func (n *Network) Transport(from string) Transport {
+	return &networkTransport{network: n, from: from}
+}
+
+// makes the node reachable, replacing an earlier node with the same id
+func (n *Network) Register(node *Node) {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	n.nodes[node.Id] = node
+}
+
+func (n *Network) Disconnect(id string) {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	n.disconnected[id] = true
+}
+
+func (n *Network) Connect(id string) {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	delete(n.disconnected, id)
+}
+
+// returns the node `to` if both ends are connected
+func (n *Network) route(from string, to string) (*Node, error) {
+	n.Mu.Lock()
+	defer n.Mu.Unlock()
+	node, ok := n.nodes[to]
+	if !ok || n.disconnected[from] || n.disconnected[to] {
+		return nil, fmt.Errorf("%w: %s", CustomError.ErrPeerUnreachable, to)
+	}
+	return node, nil
+}
+
+// delivers one rpc, the reply is lost if either end got disconnected while it was being handled
+func (n *Network) deliver(ctx context.Context, from string, to string, handle func(node *Node) error) error {
+	node, err := n.route(from, to)
+	if err != nil {
+		return err
+	}
+	if n.Latency > 0 {
+		select {
+		case <-time.After(n.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := handle(node); err != nil {
+		return err
+	}
+	_, err = n.route(from, to)
+	return err
+}
+
+type networkTransport struct {
+	network *Network
+	from    string
+}
+
+func (t *networkTransport) RequestVote(ctx context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	var reply *RequestVoteReply
+	err := t.network.deliver(ctx, t.from, peer, func(node *Node) (err error) {
+		reply, err = node.HandleRequestVote(args)
+		return err
+	})
+	return reply, err
+}
+
+func (t *networkTransport) AppendEntries(ctx context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	var reply *AppendEntriesReply
+	err := t.network.deliver(ctx, t.from, peer, func(node *Node) (err error) {
+		reply, err = node.HandleAppendEntries(args)
+		return err
+	})
+	return reply, err
+}
+
+func (t *networkTransport) InstallSnapshot(ctx context.Context, peer string, args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+	var reply *InstallSnapshotReply
+	err := t.network.deliver(ctx, t.from, peer, func(node *Node) (err error) {
+		reply, err = node.HandleInstallSnapshot(args)
+		return err
+	})
+	return reply, err
+}
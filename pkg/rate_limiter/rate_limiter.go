@@ -0,0 +1,208 @@
+package rate_limiter
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+	- token bucket which refills at `bytesPerSecond` and holds at most 100ms worth of tokens
+	- used to throttle background writes (memtable flushes and merge compaction) so that they don't starve foreground reads
+	- rate can be changed at runtime, or auto tuned by feeding it foreground latencies
+*/
+
+const (
+	BURST_DURATION = 100 * time.Millisecond // bucket size in terms of time at the current rate
+	MIN_BURST      = 4 * 1024               // never hand out less than a page at once
+
+	AUTO_TUNE_INTERVAL        = 100 * time.Millisecond // how often the rate is re-evaluated when auto tuning
+	AUTO_TUNE_DECREASE_FACTOR = 0.8                    // applied when foreground latency is above the target
+	AUTO_TUNE_INCREASE_FACTOR = 1.05                   // applied when foreground latency is below the target
+	LATENCY_SMOOTHING_FACTOR  = 0.2                    // weight of a new sample in the moving average of foreground latency
+)
+
+type autoTuneConfig struct {
+	enabled          bool
+	targetLatency    time.Duration
+	minBytesPerSec   uint64
+	maxBytesPerSec   uint64
+	averageLatency   float64 // exponential moving average in nanoseconds
+	lastAdjustedTime time.Time
+}
+
+type RateLimiter struct {
+	bytesPerSecond uint64 // 0 means unlimited
+	tokens         float64
+	lastRefillTime time.Time
+	autoTune       autoTuneConfig
+	Mu             *sync.Mutex
+}
+
+// returns a rate limiter allowing `bytesPerSecond` bytes per second, 0 means unlimited
+func NewRateLimiter(bytesPerSecond uint64) *RateLimiter {
+	return &RateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		lastRefillTime: time.Now(),
+		Mu:             &sync.Mutex{},
+	}
+}
+
+// changes the allowed rate, takes effect for the next request. 0 means unlimited
+func (r *RateLimiter) SetBytesPerSecond(bytesPerSecond uint64) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.refill(time.Now())
+	r.bytesPerSecond = bytesPerSecond
+	if r.tokens > r.burst() {
+		r.tokens = r.burst()
+	}
+}
+
+func (r *RateLimiter) GetBytesPerSecond() uint64 {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	return r.bytesPerSecond
+}
+
+// blocks until `n` bytes can be written
+func (r *RateLimiter) Request(n int) {
+	remaining := float64(n)
+	for remaining > 0 {
+		r.Mu.Lock()
+		if r.bytesPerSecond == 0 {
+			r.Mu.Unlock()
+			return
+		}
+		now := time.Now()
+		r.refill(now)
+
+		// requests bigger than the bucket are handed out in pieces
+		chunk := remaining
+		if chunk > r.burst() {
+			chunk = r.burst()
+		}
+		if r.tokens >= chunk {
+			r.tokens -= chunk
+			remaining -= chunk
+			r.Mu.Unlock()
+			continue
+		}
+		wait := time.Duration((chunk - r.tokens) / float64(r.bytesPerSecond) * float64(time.Second))
+		r.Mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// adds the tokens accumulated since the last refill. Caller must hold r.Mu
+func (r *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(r.lastRefillTime)
+	r.lastRefillTime = now
+	if r.bytesPerSecond == 0 {
+		return
+	}
+	r.tokens += elapsed.Seconds() * float64(r.bytesPerSecond)
+	if r.tokens > r.burst() {
+		r.tokens = r.burst()
+	}
+}
+
+// maximum number of tokens the bucket can hold. Caller must hold r.Mu
+func (r *RateLimiter) burst() float64 {
+	burst := float64(r.bytesPerSecond) * BURST_DURATION.Seconds()
+	if burst < MIN_BURST {
+		return MIN_BURST
+	}
+	return burst
+}
+
+// Makes the limiter adjust its own rate between minBytesPerSec and maxBytesPerSec, backing off whenever the
+// latency reported through RecordForegroundLatency goes above targetLatency and speeding up again when it's below
+func (r *RateLimiter) EnableAutoTune(targetLatency time.Duration, minBytesPerSec uint64, maxBytesPerSec uint64) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.autoTune = autoTuneConfig{
+		enabled:          true,
+		targetLatency:    targetLatency,
+		minBytesPerSec:   minBytesPerSec,
+		maxBytesPerSec:   maxBytesPerSec,
+		lastAdjustedTime: time.Now(),
+	}
+	if r.bytesPerSecond == 0 || r.bytesPerSecond > maxBytesPerSec {
+		r.bytesPerSecond = maxBytesPerSec
+	}
+	if r.bytesPerSecond < minBytesPerSec {
+		r.bytesPerSecond = minBytesPerSec
+	}
+}
+
+func (r *RateLimiter) DisableAutoTune() {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.autoTune.enabled = false
+}
+
+// feeds the latency of a foreground operation (like a Get) to the auto tuner, no-op if auto tuning is disabled
+func (r *RateLimiter) RecordForegroundLatency(latency time.Duration) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if !r.autoTune.enabled {
+		return
+	}
+
+	a := &r.autoTune
+	if a.averageLatency == 0 {
+		a.averageLatency = float64(latency)
+	} else {
+		a.averageLatency = LATENCY_SMOOTHING_FACTOR*float64(latency) + (1-LATENCY_SMOOTHING_FACTOR)*a.averageLatency
+	}
+
+	now := time.Now()
+	if now.Sub(a.lastAdjustedTime) < AUTO_TUNE_INTERVAL {
+		return
+	}
+	a.lastAdjustedTime = now
+
+	r.refill(now)
+	newRate := float64(r.bytesPerSecond)
+	if a.averageLatency > float64(a.targetLatency) {
+		newRate *= AUTO_TUNE_DECREASE_FACTOR
+	} else {
+		newRate *= AUTO_TUNE_INCREASE_FACTOR
+	}
+	if newRate < float64(a.minBytesPerSec) {
+		newRate = float64(a.minBytesPerSec)
+	}
+	if newRate > float64(a.maxBytesPerSec) {
+		newRate = float64(a.maxBytesPerSec)
+	}
+	r.bytesPerSecond = uint64(newRate)
+}
+
+type limitedWriter struct {
+	w io.Writer
+	r *RateLimiter
+}
+
+// wraps w so that every write through it waits for the rate limiter first
+func (r *RateLimiter) Writer(w io.Writer) io.Writer {
+	return &limitedWriter{w: w, r: r}
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		// write in small pieces so that the disk sees a smooth stream instead of bursts
+		end := written + MIN_BURST
+		if end > len(p) {
+			end = len(p)
+		}
+		lw.r.Request(end - written)
+		n, err := lw.w.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
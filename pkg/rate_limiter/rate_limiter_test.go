@@ -0,0 +1,64 @@
+package rate_limiter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnlimitedDoesNotBlock(t *testing.T) {
+	r := NewRateLimiter(0)
+	start := time.Now()
+	r.Request(100 * 1024 * 1024)
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "Unlimited rate limiter blocked")
+}
+
+func TestRequestIsThrottled(t *testing.T) {
+	r := NewRateLimiter(1024 * 1024)
+	start := time.Now()
+	// the bucket starts empty, so 256KB at 1MB/s needs roughly 250ms
+	r.Request(256 * 1024)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "Rate limiter didn't throttle")
+}
+
+func TestSetBytesPerSecondAtRuntime(t *testing.T) {
+	r := NewRateLimiter(1024)
+	r.SetBytesPerSecond(0)
+	start := time.Now()
+	r.Request(1024 * 1024)
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "Rate change was not applied")
+	assert.Equal(t, uint64(0), r.GetBytesPerSecond())
+}
+
+func TestWriterPassesDataThrough(t *testing.T) {
+	r := NewRateLimiter(10 * 1024 * 1024)
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("caskdb"), 10000)
+	n, err := r.Writer(&buf).Write(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, data, buf.Bytes(), "Data got modified by the rate limited writer")
+}
+
+func TestAutoTuneBacksOffOnHighLatency(t *testing.T) {
+	r := NewRateLimiter(0)
+	r.EnableAutoTune(time.Millisecond, 1024, 1024*1024)
+	assert.Equal(t, uint64(1024*1024), r.GetBytesPerSecond())
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(AUTO_TUNE_INTERVAL)
+		r.RecordForegroundLatency(10 * time.Millisecond)
+	}
+	assert.Less(t, r.GetBytesPerSecond(), uint64(1024*1024), "Rate was not lowered")
+
+	// bring the moving average below the target before the next adjustment is due
+	lowered := r.GetBytesPerSecond()
+	for i := 0; i < 30; i++ {
+		r.RecordForegroundLatency(0)
+	}
+	time.Sleep(AUTO_TUNE_INTERVAL)
+	r.RecordForegroundLatency(0)
+	assert.Greater(t, r.GetBytesPerSecond(), lowered, "Rate was not raised again")
+}
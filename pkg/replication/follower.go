@@ -0,0 +1,155 @@
+package replication
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+// keeps a read only db in sync with a primary
+type Follower struct {
+	Db               *disk_store.DiskStore
+	PrimaryAddr      string
+	Logger           logger.Logger
+	RetryInterval    time.Duration // wait between reconnects
+	HeartbeatTimeout time.Duration // reconnects if the primary is silent for this long
+}
+
+func NewFollower(d *disk_store.DiskStore, primaryAddr string) *Follower {
+	return &Follower{
+		Db:               d,
+		PrimaryAddr:      primaryAddr,
+		Logger:           d.Logger,
+		RetryInterval:    DEFAULT_RETRY_INTERVAL,
+		HeartbeatTimeout: MISSED_HEARTBEATS * DEFAULT_HEARTBEAT_INTERVAL,
+	}
+}
+
+// Replicates from the primary till ctx is done, reconnecting whenever the connection breaks
+func (f *Follower) Run(ctx context.Context) error {
+	var l = f.Logger.WithFields(logger.Fields{
+		"method":  "Run",
+		"primary": f.PrimaryAddr,
+	})
+	for {
+		if err := f.replicate(ctx); err != nil && ctx.Err() == nil {
+			l.Warnf("Replication stopped, reconnecting: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.RetryInterval):
+		}
+	}
+}
+
+// one connection to the primary, returns once it breaks
+func (f *Follower) replicate(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", f.PrimaryAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if err := gob.NewEncoder(conn).Encode(request{FromSequence: f.Db.LastSequence() + 1}); err != nil {
+		return err
+	}
+
+	decoder := gob.NewDecoder(conn)
+	var snapshot *stagedSnapshot
+	defer func() {
+		if snapshot != nil {
+			snapshot.remove()
+		}
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(f.HeartbeatTimeout))
+		var msg message
+		if err := decoder.Decode(&msg); err != nil {
+			return err
+		}
+
+		switch msg.Kind {
+		case MESSAGE_KIND_BATCH:
+			if err := f.Db.ApplyReplicatedBatch(disk_store.ReplicatedBatch{Sequence: msg.Sequence, Data: msg.Data}); err != nil {
+				return err
+			}
+		case MESSAGE_KIND_HEARTBEAT:
+		case MESSAGE_KIND_SNAPSHOT:
+			if snapshot != nil {
+				snapshot.remove()
+			}
+			if snapshot, err = newStagedSnapshot(); err != nil {
+				return err
+			}
+		case MESSAGE_KIND_SEGMENT:
+			if snapshot == nil {
+				return fmt.Errorf("segment outside of a snapshot")
+			}
+			if err := snapshot.add(msg.Level, msg.Data); err != nil {
+				return err
+			}
+		case MESSAGE_KIND_SNAPSHOT_END:
+			if snapshot == nil {
+				return fmt.Errorf("snapshot end without a snapshot")
+			}
+			if err := f.Db.InstallSnapshot(msg.Sequence, snapshot.levels); err != nil {
+				return err
+			}
+			snapshot.remove()
+			snapshot = nil
+		default:
+			return fmt.Errorf("unknown message kind %d", msg.Kind)
+		}
+		f.Db.ReportPrimarySequence(msg.PrimarySequence)
+	}
+}
+
+// segment files of a snapshot being received, kept in a temporary directory till they are installed
+type stagedSnapshot struct {
+	dir    string
+	levels [][]string
+	count  int
+}
+
+func newStagedSnapshot() (*stagedSnapshot, error) {
+	dir, err := os.MkdirTemp("", "caskdb-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	return &stagedSnapshot{dir: dir}, nil
+}
+
+func (s *stagedSnapshot) add(level uint32, data []byte) error {
+	path := filepath.Join(s.dir, fmt.Sprintf("%d.seg", s.count))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	s.count++
+	for uint32(len(s.levels)) <= level {
+		s.levels = append(s.levels, nil)
+	}
+	s.levels[level] = append(s.levels[level], path)
+	return nil
+}
+
+func (s *stagedSnapshot) remove() {
+	os.RemoveAll(s.dir)
+}
@@ -0,0 +1,142 @@
+package replication
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+	"github.com/abesheknarayan/go-caskdb/pkg/tcp_server"
+)
+
+// streams the write batches of a db to its followers
+type Primary struct {
+	*tcp_server.Server
+	Db                *disk_store.DiskStore
+	HeartbeatInterval time.Duration
+}
+
+func NewPrimary(d *disk_store.DiskStore) *Primary {
+	p := &Primary{
+		Db:                d,
+		HeartbeatInterval: DEFAULT_HEARTBEAT_INTERVAL,
+	}
+	p.Server = tcp_server.NewServer("replication", d.Logger, p.serveFollower)
+	return p
+}
+
+func (p *Primary) serveFollower(conn net.Conn) {
+	var l = p.Logger.WithFields(logger.Fields{
+		"method": "serveFollower",
+		"remote": conn.RemoteAddr().String(),
+	})
+
+	var req request
+	conn.SetReadDeadline(time.Now().Add(MISSED_HEARTBEATS * p.HeartbeatInterval))
+	if err := gob.NewDecoder(conn).Decode(&req); err != nil {
+		l.Debugln(err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	l.Infof("Follower asked for batches from %d", req.FromSequence)
+
+	// the follower never sends anything after its request, a read only returns once the connection is gone
+	gone := make(chan struct{})
+	go func() {
+		conn.Read(make([]byte, 1))
+		close(gone)
+	}()
+
+	encoder := gob.NewEncoder(conn)
+	from := req.FromSequence
+	for !p.IsShuttingDown() {
+		subscription, err := p.Db.SubscribeReplication(from)
+		if errors.Is(err, CustomError.ErrSequenceUnavailable) {
+			l.Infof("Sending a snapshot: %v", err)
+			sequence, err := p.sendSnapshot(encoder)
+			if err != nil {
+				l.Errorln(err)
+				return
+			}
+			from = sequence + 1
+			continue
+		}
+		if err != nil {
+			l.Errorln(err)
+			return
+		}
+
+		err = p.stream(subscription, encoder, gone)
+		subscription.Close()
+		if errors.Is(err, CustomError.ErrSequenceUnavailable) {
+			// fell behind the log while streaming
+			from = subscription.NextSequence()
+			continue
+		}
+		if err != nil && !errors.Is(err, CustomError.ErrDbClosed) {
+			l.Debugln(err)
+		}
+		return
+	}
+}
+
+// sends batches as they are committed till the follower goes away, the server shuts down or the subscription fails
+func (p *Primary) stream(subscription *disk_store.ReplicationSubscription, encoder *gob.Encoder, gone chan struct{}) error {
+	for !p.IsShuttingDown() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.HeartbeatInterval)
+		go func() {
+			select {
+			case <-gone:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		batch, err := subscription.Next(ctx)
+		cancel()
+
+		select {
+		case <-gone:
+			return nil
+		default:
+		}
+		msg := message{Kind: MESSAGE_KIND_HEARTBEAT}
+		if err == nil {
+			msg = message{Kind: MESSAGE_KIND_BATCH, Sequence: batch.Sequence, Data: batch.Data}
+		} else if !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		msg.PrimarySequence = p.Db.LastSequence()
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sends every segment of a fresh snapshot, returns the sequence the snapshot is at
+func (p *Primary) sendSnapshot(encoder *gob.Encoder) (uint64, error) {
+	snapshot := p.Db.CreateReplicationSnapshot()
+	defer snapshot.Release()
+
+	if err := encoder.Encode(message{Kind: MESSAGE_KIND_SNAPSHOT, Sequence: snapshot.Sequence, PrimarySequence: p.Db.LastSequence()}); err != nil {
+		return 0, err
+	}
+	for level, segments := range snapshot.Levels {
+		for _, segment := range segments {
+			data, err := os.ReadFile(snapshot.SegmentPath(segment.SegmentId))
+			if err != nil {
+				return 0, err
+			}
+			if err := encoder.Encode(message{Kind: MESSAGE_KIND_SEGMENT, Level: uint32(level), Data: data}); err != nil {
+				return 0, err
+			}
+		}
+	}
+	msg := message{Kind: MESSAGE_KIND_SNAPSHOT_END, Sequence: snapshot.Sequence, PrimarySequence: p.Db.LastSequence()}
+	return snapshot.Sequence, encoder.Encode(msg)
+}
@@ -0,0 +1,41 @@
+package replication
+
+import "time"
+
+/*
+	- a follower connects and sends a request with the first sequence it is missing, from there on only the primary
+	  talks: gob encoded messages, one after the other
+	- if the primary's replication log still has that sequence it streams batches right away, otherwise it sends a
+	  snapshot first (snapshot, a segment message per segment file, snapshot end) and streams from after it
+	- heartbeats go out whenever there was nothing to send for a while, they carry the primary's last sequence for the
+	  follower's lag and let it notice a dead primary
+*/
+
+type messageKind uint8
+
+const (
+	MESSAGE_KIND_BATCH messageKind = iota
+	MESSAGE_KIND_HEARTBEAT
+	MESSAGE_KIND_SNAPSHOT     // begins a snapshot, segment messages follow
+	MESSAGE_KIND_SEGMENT      // the contents of one segment file of the snapshot
+	MESSAGE_KIND_SNAPSHOT_END // the follower installs the snapshot once it has all the segments
+)
+
+const (
+	DEFAULT_HEARTBEAT_INTERVAL = time.Second
+	DEFAULT_RETRY_INTERVAL     = time.Second
+	// a follower which doesn't hear from the primary for this many heartbeat intervals reconnects
+	MISSED_HEARTBEATS = 5
+)
+
+type request struct {
+	FromSequence uint64
+}
+
+type message struct {
+	Kind            messageKind
+	Sequence        uint64 // of the batch, or the sequence a snapshot is at
+	PrimarySequence uint64 // last sequence of the primary as the message was sent
+	Level           uint32 // level of a segment
+	Data            []byte // encoded batch or segment file contents
+}
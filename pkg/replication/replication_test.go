@@ -0,0 +1,162 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/config"
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/stretchr/testify/assert"
+)
+
+const testHeartbeatInterval = 50 * time.Millisecond
+
+func openDb(t *testing.T, name string, options disk_store.Options) *disk_store.DiskStore {
+	d, err := disk_store.InitDbWithOptions(name, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// starts a primary on a fresh db, both are shut down when the test ends
+func startPrimary(t *testing.T, options disk_store.Options) (*disk_store.DiskStore, string) {
+	config.Config = config.NewDefaultConfig("Test", t.TempDir())
+	config.Config.MemtableSizeLimit = 4 * 1024
+	d := openDb(t, "primary", options)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := NewPrimary(d)
+	primary.HeartbeatInterval = testHeartbeatInterval
+	go primary.Serve(listener)
+	t.Cleanup(func() {
+		primary.Shutdown(context.Background())
+		d.CloseDB()
+	})
+	return d, listener.Addr().String()
+}
+
+// runs a follower on db till the returned stop is called
+func startFollower(d *disk_store.DiskStore, addr string) (stop func()) {
+	follower := NewFollower(d, addr)
+	follower.RetryInterval = 10 * time.Millisecond
+	follower.HeartbeatTimeout = MISSED_HEARTBEATS * testHeartbeatInterval
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		follower.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func followerOptions() disk_store.Options {
+	options := disk_store.DefaultOptions()
+	options.ReadOnly = true
+	return options
+}
+
+func waitForSequence(t *testing.T, d *disk_store.DiskStore, sequence uint64) {
+	assert.Eventually(t, func() bool {
+		return d.LastSequence() == sequence
+	}, 10*time.Second, 5*time.Millisecond)
+}
+
+func TestStreaming(t *testing.T) {
+	primary, addr := startPrimary(t, disk_store.DefaultOptions())
+	follower := openDb(t, "follower", followerOptions())
+	defer follower.CloseDB()
+	stop := startFollower(follower, addr)
+	defer stop()
+
+	for i := 0; i < 500; i++ {
+		primary.Put(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i))
+	}
+	primary.Delete("key007")
+	batch := disk_store.NewWriteBatch()
+	batch.Put("key008", "batched")
+	batch.Delete("key009")
+	assert.Nil(t, primary.Write(batch))
+
+	waitForSequence(t, follower, primary.LastSequence())
+	assert.Equal(t, "value0", follower.Get("key000"))
+	assert.Equal(t, "value499", follower.Get("key499"))
+	assert.Equal(t, "batched", follower.Get("key008"))
+	_, ok := follower.Lookup("key007")
+	assert.False(t, ok)
+	_, ok = follower.Lookup("key009")
+	assert.False(t, ok)
+
+	stats := follower.Stats()
+	assert.Equal(t, primary.LastSequence(), stats.LastSequence)
+	assert.Eventually(t, func() bool {
+		stats := follower.Stats()
+		return stats.PrimarySequence == primary.LastSequence() && stats.ReplicationLag == 0
+	}, 10*time.Second, 5*time.Millisecond)
+
+	// only replication writes to a follower
+	assert.ErrorIs(t, follower.Write(batch), CustomError.ErrReadOnly)
+}
+
+func TestCatchUpWithSnapshot(t *testing.T) {
+	options := disk_store.DefaultOptions()
+	options.ReplicationLogSize = 10
+	primary, addr := startPrimary(t, options)
+
+	// far more than the log keeps, the follower has to start from a snapshot
+	for i := 0; i < 1000; i++ {
+		primary.Put(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", i))
+	}
+	primary.Delete("key0500")
+
+	follower := openDb(t, "follower", followerOptions())
+	defer follower.CloseDB()
+	stop := startFollower(follower, addr)
+	defer stop()
+	waitForSequence(t, follower, primary.LastSequence())
+
+	// and streams after it
+	primary.Put("after", "snapshot")
+	waitForSequence(t, follower, primary.LastSequence())
+
+	assert.Equal(t, "value0", follower.Get("key0000"))
+	assert.Equal(t, "value999", follower.Get("key0999"))
+	assert.Equal(t, "snapshot", follower.Get("after"))
+	_, ok := follower.Lookup("key0500")
+	assert.False(t, ok)
+}
+
+func TestFollowerRestart(t *testing.T) {
+	primary, addr := startPrimary(t, disk_store.DefaultOptions())
+	follower := openDb(t, "follower", followerOptions())
+	stop := startFollower(follower, addr)
+	for i := 0; i < 100; i++ {
+		primary.Put(fmt.Sprintf("key%03d", i), "first")
+	}
+	waitForSequence(t, follower, primary.LastSequence())
+	stop()
+	follower.CloseDB()
+
+	for i := 0; i < 100; i++ {
+		primary.Put(fmt.Sprintf("key%03d", i), "second")
+	}
+
+	// picks up from the last sequence which made it to disk
+	follower = openDb(t, "follower", followerOptions())
+	defer follower.CloseDB()
+	stop = startFollower(follower, addr)
+	defer stop()
+	waitForSequence(t, follower, primary.LastSequence())
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "second", follower.Get(fmt.Sprintf("key%03d", i)))
+	}
+}
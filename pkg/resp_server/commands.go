@@ -0,0 +1,321 @@
+package resp_server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+)
+
+const (
+	REDIS_VERSION      = "7.0.0" // what INFO reports, clients look at it to decide which commands they can use
+	DEFAULT_SCAN_COUNT = 10
+)
+
+type command struct {
+	minArgs int // command name included
+	maxArgs int // -1 for no limit
+	run     func(s *Server, args []string, w *replyWriter)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":    {1, 2, ping},
+		"ECHO":    {2, 2, echo},
+		"GET":     {2, 2, get},
+		"SET":     {3, 5, set},
+		"TTL":     {2, 2, ttl},
+		"PTTL":    {2, 2, ttl},
+		"DEL":     {2, -1, del},
+		"EXISTS":  {2, -1, exists},
+		"MGET":    {2, -1, mget},
+		"MSET":    {3, -1, mset},
+		"SCAN":    {2, -1, scan},
+		"DBSIZE":  {1, 1, dbsize},
+		"INFO":    {1, 2, info},
+		"SELECT":  {2, 2, selectDb},
+		"COMMAND": {1, -1, commandInfo},
+	}
+}
+
+// runs the command and writes its reply, returns true if the connection has to be closed afterwards
+func (s *Server) execute(args []string, w *replyWriter) bool {
+	name := strings.ToUpper(args[0])
+	if name == "QUIT" {
+		w.simpleString("OK")
+		return true
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		w.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	cmd.run(s, args, w)
+	return false
+}
+
+func ping(s *Server, args []string, w *replyWriter) {
+	if len(args) == 2 {
+		w.bulkString(args[1])
+		return
+	}
+	w.simpleString("PONG")
+}
+
+func echo(s *Server, args []string, w *replyWriter) {
+	w.bulkString(args[1])
+}
+
+func get(s *Server, args []string, w *replyWriter) {
+	value, ok := s.Db.Lookup(args[1])
+	if !ok {
+		w.nullBulkString()
+		return
+	}
+	w.bulkString(value)
+}
+
+// SET key value [EX seconds | PX milliseconds]
+func set(s *Server, args []string, w *replyWriter) {
+	// a batch of one, unlike Put it reports errors (read only db, key too large)
+	batch := disk_store.NewWriteBatch()
+	switch len(args) {
+	case 3:
+		batch.Put(args[1], args[2])
+	case 5:
+		unit := time.Second
+		switch strings.ToUpper(args[3]) {
+		case "EX":
+		case "PX":
+			unit = time.Millisecond
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil || n <= 0 {
+			w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		batch.PutWithTTL(args[1], args[2], time.Duration(n)*unit)
+	default:
+		w.error("ERR syntax error")
+		return
+	}
+	if err := s.Db.Write(batch); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simpleString("OK")
+}
+
+// remaining lifetime in seconds (TTL) or milliseconds (PTTL), -1 for keys which never expire and -2 for missing keys
+func ttl(s *Server, args []string, w *replyWriter) {
+	remaining, ok := s.Db.TTL(args[1])
+	switch {
+	case !ok:
+		w.integer(-2)
+	case remaining == disk_store.NO_EXPIRY:
+		w.integer(-1)
+	case strings.EqualFold(args[0], "PTTL"):
+		w.integer(remaining.Milliseconds())
+	default:
+		w.integer(int64(remaining.Round(time.Second) / time.Second))
+	}
+}
+
+// counts under the write lock, so a key deleted by someone else in between isn't counted
+func del(s *Server, args []string, w *replyWriter) {
+	deleted, err := s.Db.DeleteExisting(args[1:]...)
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.integer(int64(deleted))
+}
+
+func exists(s *Server, args []string, w *replyWriter) {
+	found := int64(0)
+	for _, key := range args[1:] {
+		if _, ok := s.Db.Lookup(key); ok {
+			found++
+		}
+	}
+	w.integer(found)
+}
+
+func mget(s *Server, args []string, w *replyWriter) {
+	w.arrayHeader(len(args) - 1)
+	for _, key := range args[1:] {
+		value, ok := s.Db.Lookup(key)
+		if !ok {
+			w.nullBulkString()
+			continue
+		}
+		w.bulkString(value)
+	}
+}
+
+func mset(s *Server, args []string, w *replyWriter) {
+	if len(args)%2 != 1 {
+		w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	batch := disk_store.NewWriteBatch()
+	for i := 1; i < len(args); i += 2 {
+		batch.Put(args[i], args[i+1])
+	}
+	if err := s.Db.Write(batch); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simpleString("OK")
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]. The cursor is the hex encoded key the next call starts
+// from, 0 starts and ends the iteration. Like redis, COUNT is the number of keys looked at, not returned
+func scan(s *Server, args []string, w *replyWriter) {
+	start := ""
+	if args[1] != "0" {
+		decoded, err := hex.DecodeString(args[1])
+		if err != nil {
+			w.error("ERR invalid cursor")
+			return
+		}
+		start = string(decoded)
+	}
+
+	pattern := ""
+	count := DEFAULT_SCAN_COUNT
+	onlyStrings := true
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+			count = n
+		case "TYPE":
+			// every value is a string
+			onlyStrings = strings.EqualFold(args[i+1], "string")
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	// the iterator only reads the segments overlapping [start, ...), so a page costs the same wherever it starts
+	it := s.Db.NewIterator(start, "")
+	defer it.Close()
+	var keys []string
+	next := "0"
+	looked := 0
+	for it.Next() {
+		if looked == count {
+			next = hex.EncodeToString([]byte(it.Key()))
+			break
+		}
+		looked++
+		if onlyStrings && (pattern == "" || matchGlob(pattern, it.Key())) {
+			keys = append(keys, it.Key())
+		}
+	}
+	if err := it.Err(); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+
+	w.arrayHeader(2)
+	w.bulkString(next)
+	w.arrayHeader(len(keys))
+	for _, key := range keys {
+		w.bulkString(key)
+	}
+}
+
+// counts the live keys, streams the whole db through an iterator
+func (s *Server) numberOfKeys() (int64, error) {
+	it := s.Db.NewIterator("", "")
+	defer it.Close()
+	keys := int64(0)
+	for it.Next() {
+		keys++
+	}
+	return keys, it.Err()
+}
+
+func dbsize(s *Server, args []string, w *replyWriter) {
+	keys, err := s.numberOfKeys()
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.integer(keys)
+}
+
+func info(s *Server, args []string, w *replyWriter) {
+	section := "default"
+	if len(args) == 2 {
+		section = strings.ToLower(args[1])
+	}
+	all := section == "default" || section == "all" || section == "everything"
+
+	connectedClients, totalConnections := s.Connections()
+	totalCommands := atomic.LoadUint64(&s.totalCommands)
+
+	var b strings.Builder
+	if all || section == "server" {
+		fmt.Fprintf(&b, "# Server\r\nredis_version:%s\r\nredis_mode:standalone\r\nprocess_id:%d\r\nuptime_in_seconds:%d\r\n\r\n",
+			REDIS_VERSION, os.Getpid(), int64(time.Since(s.startTime).Seconds()))
+	}
+	if all || section == "clients" {
+		fmt.Fprintf(&b, "# Clients\r\nconnected_clients:%d\r\n\r\n", connectedClients)
+	}
+	if all || section == "stats" {
+		fmt.Fprintf(&b, "# Stats\r\ntotal_connections_received:%d\r\ntotal_commands_processed:%d\r\n\r\n", totalConnections, totalCommands)
+	}
+	if all || section == "keyspace" {
+		keys, err := s.numberOfKeys()
+		if err != nil {
+			w.error("ERR " + err.Error())
+			return
+		}
+		b.WriteString("# Keyspace\r\n")
+		if keys > 0 {
+			fmt.Fprintf(&b, "db0:keys=%d,expires=0,avg_ttl=0\r\n", keys)
+		}
+	}
+	w.bulkString(b.String())
+}
+
+func selectDb(s *Server, args []string, w *replyWriter) {
+	if args[1] != "0" {
+		w.error("ERR DB index is out of range")
+		return
+	}
+	w.simpleString("OK")
+}
+
+// redis-cli asks for the command docs on start, an empty reply makes it fall back to its built in ones
+func commandInfo(s *Server, args []string, w *replyWriter) {
+	w.arrayHeader(0)
+}
@@ -0,0 +1,96 @@
+package resp_server
+
+// matches the key against a redis style glob: * matches any sequence, ? any single byte, [abc], [^abc] and [a-z]
+// match a class of bytes and \ escapes the next byte
+func matchGlob(pattern string, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchGlob(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			matched, rest, ok := matchClass(pattern[1:], key[0])
+			if !ok {
+				// unterminated class, the bracket is taken literally
+				if key[0] != '[' {
+					return false
+				}
+				key = key[1:]
+				pattern = pattern[1:]
+				continue
+			}
+			if !matched {
+				return false
+			}
+			key = key[1:]
+			pattern = rest
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+// matches c against the class starting right after '[', returns whether it matched, the pattern after the closing
+// ']' and false if the class is never closed
+func matchClass(pattern string, c byte) (bool, string, bool) {
+	negate := false
+	if len(pattern) > 0 && (pattern[0] == '^' || pattern[0] == '!') {
+		negate = true
+		pattern = pattern[1:]
+	}
+	matched := false
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == ']' && i > 0:
+			return matched != negate, pattern[i+1:], true
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			if pattern[i] == c {
+				matched = true
+			}
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			low, high := pattern[i], pattern[i+2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				matched = true
+			}
+			i += 2
+		default:
+			if pattern[i] == c {
+				matched = true
+			}
+		}
+	}
+	return false, "", false
+}
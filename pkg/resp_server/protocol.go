@@ -0,0 +1,151 @@
+package resp_server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+	- RESP2: clients send arrays of bulk strings, inline commands (space separated words on a line) work too so that
+	  the server can be poked with telnet
+	- replies are buffered and flushed once there are no more pipelined commands to read
+*/
+
+const (
+	MAX_BULK_LENGTH   = 512 * 1024 * 1024 // same limit as redis
+	MAX_ARRAY_LENGTH  = 1024 * 1024
+	MAX_INLINE_LENGTH = 64 * 1024
+)
+
+var errProtocol = errors.New("protocol error")
+
+// reads commands sent by a client
+type commandReader struct {
+	reader *bufio.Reader
+}
+
+func newCommandReader(r io.Reader) *commandReader {
+	return &commandReader{reader: bufio.NewReader(r)}
+}
+
+// returns the next command as its arguments, the command name first. Errors wrapping errProtocol mean the client
+// sent garbage and the connection has to be closed
+func (c *commandReader) readCommand() ([]string, error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count > MAX_ARRAY_LENGTH {
+			return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+		}
+		if count <= 0 {
+			continue
+		}
+		args := make([]string, count)
+		for i := range args {
+			if args[i], err = c.readBulkString(); err != nil {
+				return nil, err
+			}
+		}
+		return args, nil
+	}
+}
+
+func (c *commandReader) readBulkString() (string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return "", fmt.Errorf("%w: expected '$', got %q", errProtocol, line)
+	}
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 || length > MAX_BULK_LENGTH {
+		return "", fmt.Errorf("%w: invalid bulk length", errProtocol)
+	}
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return "", err
+	}
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string isn't terminated by CRLF", errProtocol)
+	}
+	return string(data[:length]), nil
+}
+
+// returns the next line without the line ending
+func (c *commandReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := c.reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > MAX_INLINE_LENGTH {
+			return "", fmt.Errorf("%w: too big inline request", errProtocol)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// true if a pipelined command is already waiting to be read
+func (c *commandReader) buffered() bool {
+	return c.reader.Buffered() > 0
+}
+
+// writes replies to a client
+type replyWriter struct {
+	writer *bufio.Writer
+}
+
+func newReplyWriter(w io.Writer) *replyWriter {
+	return &replyWriter{writer: bufio.NewWriter(w)}
+}
+
+func (r *replyWriter) simpleString(s string) {
+	r.writer.WriteString("+" + s + "\r\n")
+}
+
+func (r *replyWriter) error(message string) {
+	r.writer.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(message) + "\r\n")
+}
+
+func (r *replyWriter) integer(n int64) {
+	r.writer.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (r *replyWriter) bulkString(s string) {
+	r.writer.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (r *replyWriter) nullBulkString() {
+	r.writer.WriteString("$-1\r\n")
+}
+
+// has to be followed by n replies
+func (r *replyWriter) arrayHeader(n int) {
+	r.writer.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (r *replyWriter) flush() error {
+	return r.writer.Flush()
+}
@@ -0,0 +1,66 @@
+package resp_server
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	"github.com/abesheknarayan/go-caskdb/pkg/tcp_server"
+)
+
+/*
+	- serves a single DiskStore over the redis protocol, every connection gets its own goroutine
+	- there is a single keyspace, SELECT only accepts db 0
+	- Shutdown stops accepting, lets every connection finish the command it is running and closes it, the db is left
+	  open for the caller to close
+*/
+
+type Server struct {
+	totalCommands uint64 // atomic, first field so that it is 64-bit aligned on 32-bit platforms
+
+	*tcp_server.Server
+	Db *disk_store.DiskStore
+
+	startTime time.Time
+}
+
+func NewServer(d *disk_store.DiskStore) *Server {
+	s := &Server{
+		Db:        d,
+		startTime: time.Now(),
+	}
+	s.Server = tcp_server.NewServer("redis protocol", d.Logger, s.serveConnection)
+	return s
+}
+
+func (s *Server) serveConnection(conn net.Conn) {
+	reader := newCommandReader(conn)
+	writer := newReplyWriter(conn)
+	for !s.IsShuttingDown() {
+		args, err := reader.readCommand()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				writer.error("ERR Protocol error: " + strings.TrimPrefix(err.Error(), errProtocol.Error()+": "))
+				writer.flush()
+			}
+			return
+		}
+
+		atomic.AddUint64(&s.totalCommands, 1)
+		quit := s.execute(args, writer)
+
+		// pipelined commands get their replies in one write
+		if quit || !reader.buffered() {
+			if err := writer.flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+	writer.flush()
+}
@@ -0,0 +1,294 @@
+package resp_server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/config"
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/format"
+	"github.com/stretchr/testify/assert"
+)
+
+// just enough of a redis client to talk to the server
+type respClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *respClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) {
+	buf := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		buf += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.Write([]byte(buf))
+}
+
+// returns simple strings and bulk strings as string, errors as error, integers as int64, nil bulk strings as nil and
+// arrays as []interface{}
+func (c *respClient) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return fmt.Errorf("%s", line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, _ := strconv.Atoi(line[1:])
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		length, _ := strconv.Atoi(line[1:])
+		array := make([]interface{}, length)
+		for i := range array {
+			if array[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *respClient) do(t *testing.T, args ...string) interface{} {
+	c.send(args...)
+	reply, err := c.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// starts a server on a fresh db, both are shut down when the test ends
+func startServer(t *testing.T) (*Server, string, chan error) {
+	return startServerWithOptions(t, disk_store.DefaultOptions())
+}
+
+func startServerWithOptions(t *testing.T, options disk_store.Options) (*Server, string, chan error) {
+	config.Config = config.NewDefaultConfig("Test", t.TempDir())
+	config.Config.MemtableSizeLimit = 4 * 1024
+	d, err := disk_store.InitDbWithOptions("respdb", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(d)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		d.CloseDB()
+	})
+	return server, listener.Addr().String(), served
+}
+
+func TestCommands(t *testing.T) {
+	_, addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	assert.Equal(t, "PONG", c.do(t, "PING"))
+	assert.Equal(t, "hello", c.do(t, "ping", "hello"))
+	assert.Equal(t, "OK", c.do(t, "SET", "harry", "potter"))
+	assert.Equal(t, "potter", c.do(t, "GET", "harry"))
+	assert.Nil(t, c.do(t, "GET", "voldemort"))
+	assert.Equal(t, "OK", c.do(t, "SET", "empty", ""))
+	assert.Equal(t, "", c.do(t, "GET", "empty"), "Empty value is not a missing key")
+
+	assert.Equal(t, "OK", c.do(t, "SET", "session", "token", "EX", "100"))
+	assert.Equal(t, int64(100), c.do(t, "TTL", "session"))
+	assert.Equal(t, int64(-1), c.do(t, "TTL", "harry"))
+	assert.Equal(t, int64(-2), c.do(t, "PTTL", "voldemort"))
+	assert.Equal(t, "OK", c.do(t, "SET", "session", "gone", "PX", "1"))
+	assert.Eventually(t, func() bool { return c.do(t, "GET", "session") == nil }, time.Second, 5*time.Millisecond)
+	assert.EqualError(t, c.do(t, "SET", "session", "token", "KEEPTTL", "1").(error), "ERR syntax error")
+	assert.EqualError(t, c.do(t, "SET", "session", "token", "EX", "0").(error), "ERR invalid expire time in 'set' command")
+
+	assert.Equal(t, "OK", c.do(t, "MSET", "a", "1", "b", "2", "c", "3"))
+	assert.Equal(t, []interface{}{"1", nil, "3"}, c.do(t, "MGET", "a", "missing", "c"))
+	assert.Equal(t, int64(3), c.do(t, "EXISTS", "a", "empty", "missing", "a"))
+	assert.Equal(t, int64(2), c.do(t, "DEL", "a", "b", "missing", "a"))
+	assert.Equal(t, int64(0), c.do(t, "EXISTS", "a", "b"))
+	assert.Equal(t, int64(3), c.do(t, "DBSIZE"))
+
+	for i := 0; i < 25; i++ {
+		c.do(t, "SET", fmt.Sprintf("key:%02d", i), "value")
+	}
+	// walk the whole keyspace a few keys at a time
+	var keys []interface{}
+	cursor := "0"
+	for {
+		reply := c.do(t, "SCAN", cursor, "MATCH", "key:*", "COUNT", "4").([]interface{})
+		keys = append(keys, reply[1].([]interface{})...)
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Len(t, keys, 25)
+	assert.Equal(t, "key:00", keys[0])
+	assert.Equal(t, "key:24", keys[24])
+
+	assert.Contains(t, c.do(t, "INFO"), "db0:keys=28")
+	assert.Contains(t, c.do(t, "INFO", "clients"), "connected_clients:1")
+	assert.Equal(t, "OK", c.do(t, "SELECT", "0"))
+	assert.Error(t, c.do(t, "SELECT", "1").(error))
+	assert.Error(t, c.do(t, "FLUSHALL").(error))
+	assert.Error(t, c.do(t, "GET").(error), "Missing argument wasn't reported")
+	assert.Error(t, c.do(t, "MSET", "a").(error))
+
+	// inline commands for telnet users
+	c.conn.Write([]byte("SET inline value\r\nGET inline\r\n"))
+	reply, _ := c.read()
+	assert.Equal(t, "OK", reply)
+	reply, _ = c.read()
+	assert.Equal(t, "value", reply)
+
+	assert.Equal(t, "OK", c.do(t, "QUIT"))
+	_, err := c.read()
+	assert.Equal(t, io.EOF, err, "Connection wasn't closed after QUIT")
+}
+
+func TestFailedWrites(t *testing.T) {
+	_, addr, _ := startServer(t)
+	c := dial(t, addr)
+	largeKey := strings.Repeat("k", int(format.MAX_KEY_SIZE)+1)
+	assert.EqualError(t, c.do(t, "SET", largeKey, "value").(error), "ERR "+CustomError.ErrKeyTooLarge.Error())
+	assert.Error(t, c.do(t, "SET", largeKey, "value", "EX", "10").(error))
+	assert.Error(t, c.do(t, "MSET", "a", "1", largeKey, "2").(error))
+	assert.Nil(t, c.do(t, "GET", "a"), "Batch with a failed write was partially applied")
+}
+
+// a follower started with --replicate-from
+func TestReadOnlyDb(t *testing.T) {
+	options := disk_store.DefaultOptions()
+	options.ReadOnly = true
+	_, addr, _ := startServerWithOptions(t, options)
+	c := dial(t, addr)
+	assert.EqualError(t, c.do(t, "SET", "a", "1").(error), "ERR "+CustomError.ErrReadOnly.Error())
+	assert.EqualError(t, c.do(t, "MSET", "a", "1").(error), "ERR "+CustomError.ErrReadOnly.Error())
+	assert.EqualError(t, c.do(t, "DEL", "a").(error), "ERR "+CustomError.ErrReadOnly.Error())
+	assert.Nil(t, c.do(t, "GET", "a"))
+}
+
+func TestPipelining(t *testing.T) {
+	_, addr, _ := startServer(t)
+	c := dial(t, addr)
+
+	for i := 0; i < 100; i++ {
+		c.send("SET", fmt.Sprintf("key:%d", i), fmt.Sprint(i))
+		c.send("GET", fmt.Sprintf("key:%d", i))
+	}
+	for i := 0; i < 100; i++ {
+		reply, err := c.read()
+		assert.Nil(t, err)
+		assert.Equal(t, "OK", reply)
+		reply, err = c.read()
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint(i), reply)
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	_, addr, _ := startServer(t)
+
+	var wg sync.WaitGroup
+	for client := 0; client < 8; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			c := dial(t, addr)
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("client:%d:%d", client, i)
+				c.send("SET", key, key)
+				if reply, _ := c.read(); reply != "OK" {
+					t.Errorf("SET %s replied %v", key, reply)
+					return
+				}
+				c.send("GET", key)
+				if reply, _ := c.read(); reply != key {
+					t.Errorf("GET %s replied %v", key, reply)
+					return
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(8*200), dial(t, addr).do(t, "DBSIZE"))
+}
+
+func TestShutdown(t *testing.T) {
+	server, addr, served := startServer(t)
+	c := dial(t, addr)
+	assert.Equal(t, "PONG", c.do(t, "PING"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, server.Shutdown(ctx))
+	assert.ErrorIs(t, <-served, CustomError.ErrServerClosed)
+
+	_, err := c.read()
+	assert.Equal(t, io.EOF, err, "Idle connection wasn't closed")
+	_, err = net.Dial("tcp", addr)
+	assert.NotNil(t, err, "Server still accepts connections")
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"a/*", "a/b/c", true},
+		{"\\*", "*", true},
+		{"\\*", "x", false},
+		{"[", "[", true},
+	} {
+		assert.Equal(t, test.match, matchGlob(test.pattern, test.key), "%q against %q", test.pattern, test.key)
+	}
+}
@@ -0,0 +1,234 @@
+package sharded_store
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RESP_SCAN_COUNT = 100
+	DEFAULT_DIAL_TIMEOUT    = 5 * time.Second
+	MAX_IDLE_CONNECTIONS    = 16
+)
+
+// a DiskStore served by caskdb-server (or anything else speaking the redis protocol with the same SCAN cursors)
+type RespShard struct {
+	Addr      string
+	ScanCount int // keys asked for with every SCAN
+
+	Mu   *sync.Mutex
+	idle []*respConn
+}
+
+func NewRespShard(addr string) *RespShard {
+	return &RespShard{
+		Addr:      addr,
+		ScanCount: DEFAULT_RESP_SCAN_COUNT,
+		Mu:        &sync.Mutex{},
+	}
+}
+
+type respConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// an error reply of the server, the connection is still fine after it
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// closes the idle connections
+func (s *RespShard) Close() {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	for _, c := range s.idle {
+		c.conn.Close()
+	}
+	s.idle = nil
+}
+
+func (s *RespShard) Put(key string, value string) error {
+	_, err := s.do("SET", key, value)
+	return err
+}
+
+func (s *RespShard) Lookup(key string) (string, bool, error) {
+	reply, err := s.do("GET", key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, fmt.Errorf("unexpected reply to GET: %v", reply)
+	}
+	return value, true, nil
+}
+
+func (s *RespShard) Delete(key string) error {
+	_, err := s.do("DEL", key)
+	return err
+}
+
+// walks the keys with SCAN, whose cursor is the hex encoded key to continue from, and fetches the values with MGET.
+// Keys deleted in between are skipped
+func (s *RespShard) Scan(start string, end string, fn func(key string, value string) bool) error {
+	cursor := "0"
+	if start != "" {
+		cursor = hex.EncodeToString([]byte(start))
+	}
+	for {
+		reply, err := s.do("SCAN", cursor, "COUNT", strconv.Itoa(s.ScanCount))
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("unexpected reply to SCAN: %v", reply)
+		}
+		next, _ := parts[0].(string)
+		replyKeys, _ := parts[1].([]interface{})
+
+		args := []string{"MGET"}
+		done := next == "0"
+		for _, replyKey := range replyKeys {
+			key, _ := replyKey.(string)
+			if end != "" && key > end {
+				done = true
+				break
+			}
+			args = append(args, key)
+		}
+		if len(args) > 1 {
+			reply, err := s.do(args...)
+			if err != nil {
+				return err
+			}
+			values, ok := reply.([]interface{})
+			if !ok || len(values) != len(args)-1 {
+				return fmt.Errorf("unexpected reply to MGET: %v", reply)
+			}
+			for i, value := range values {
+				if value == nil {
+					continue
+				}
+				if !fn(args[i+1], value.(string)) {
+					return nil
+				}
+			}
+		}
+		if done {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// sends one command and reads its reply: strings, int64s, nil for nil bulk strings and []interface{} for arrays
+func (s *RespShard) do(args ...string) (interface{}, error) {
+	c, err := s.connection()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	err = c.writer.Flush()
+	var reply interface{}
+	if err == nil {
+		reply, err = readReply(c.reader)
+	}
+	var replyErr respError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.conn.Close()
+		return nil, err
+	}
+	s.release(c)
+	return reply, err
+}
+
+func (s *RespShard) connection() (*respConn, error) {
+	s.Mu.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.Mu.Unlock()
+		return c, nil
+	}
+	s.Mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", s.Addr, DEFAULT_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return &respConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}, nil
+}
+
+func (s *RespShard) release(c *respConn) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if len(s.idle) >= MAX_IDLE_CONNECTIONS {
+		c.conn.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+func readReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		array := make([]interface{}, length)
+		for i := range array {
+			if array[i], err = readReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("malformed reply %q", line)
+}
@@ -0,0 +1,107 @@
+package sharded_store
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// number of points every shard gets on the ring, more of them spread the keys more evenly
+const DEFAULT_VIRTUAL_NODES = 128
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// A consistent hash ring, a key belongs to the node of the first point at or after the key's hash. Adding a node
+// only moves keys to the new node
+type HashRing struct {
+	VirtualNodes int
+	points       []ringPoint // sorted by hash, then node
+	nodes        map[string]bool
+}
+
+func NewHashRing(virtualNodes int) *HashRing {
+	return &HashRing{
+		VirtualNodes: virtualNodes,
+		nodes:        make(map[string]bool),
+	}
+}
+
+// fnv-1a, with the bits mixed afterwards since keys and point names often differ only in their last bytes
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (r *HashRing) Add(node string) {
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+	for i := 0; i < r.VirtualNodes; i++ {
+		r.points = append(r.points, ringPoint{hash: hashKey(node + "#" + strconv.Itoa(i)), node: node})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+}
+
+func (r *HashRing) Remove(node string) {
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, point := range r.points {
+		if point.node != node {
+			points = append(points, point)
+		}
+	}
+	r.points = points
+}
+
+// returns the node the key belongs to, empty if the ring has no nodes
+func (r *HashRing) Locate(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// returns the nodes in sorted order
+func (r *HashRing) Nodes() []string {
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (r *HashRing) clone() *HashRing {
+	c := NewHashRing(r.VirtualNodes)
+	c.points = append([]ringPoint(nil), r.points...)
+	for node := range r.nodes {
+		c.nodes[node] = true
+	}
+	return c
+}
@@ -0,0 +1,45 @@
+package sharded_store
+
+import (
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+)
+
+// one store the keys are spread over
+type Shard interface {
+	Put(key string, value string) error
+	Lookup(key string) (string, bool, error)
+	Delete(key string) error
+	// calls fn for every key in [start, end] in sorted order until fn returns false, empty means unbounded
+	Scan(start string, end string, fn func(key string, value string) bool) error
+}
+
+// a DiskStore of the same process
+type LocalShard struct {
+	Db *disk_store.DiskStore
+}
+
+func NewLocalShard(d *disk_store.DiskStore) *LocalShard {
+	return &LocalShard{Db: d}
+}
+
+// a batch of one, unlike DiskStore.Put it reports errors
+func (s *LocalShard) Put(key string, value string) error {
+	batch := disk_store.NewWriteBatch()
+	batch.Put(key, value)
+	return s.Db.Write(batch)
+}
+
+func (s *LocalShard) Lookup(key string) (string, bool, error) {
+	value, ok := s.Db.Lookup(key)
+	return value, ok, nil
+}
+
+func (s *LocalShard) Delete(key string) error {
+	batch := disk_store.NewWriteBatch()
+	batch.Delete(key)
+	return s.Db.Write(batch)
+}
+
+func (s *LocalShard) Scan(start string, end string, fn func(key string, value string) bool) error {
+	return s.Db.Scan(start, end, fn)
+}
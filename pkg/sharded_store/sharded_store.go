@@ -0,0 +1,352 @@
+package sharded_store
+
+import (
+	"fmt"
+	"sync"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+/*
+	- a key lives on the shard the hash ring maps it to, lookups and writes go straight there
+	- a scan runs on every shard at once and merges the streams by key. Every stream only passes on the keys its shard
+	  owns, so leftovers of a migration are never seen
+	- adding a shard copies the keys it takes over while writes keep going:
+		1. writes of keys the new shard takes over go to both the old owner and the new shard from now on
+		2. the keys are copied over in chunks, every key re-read under its key lock so it can't race a write
+		3. the ring is switched, once the scans still running on the old ring are done
+		4. the moved keys are deleted from the old owners
+	- every write of a key holds its key lock, which is one of KEY_LOCK_STRIPES mutexes
+*/
+
+const (
+	KEY_LOCK_STRIPES     = 256
+	MIGRATION_CHUNK_SIZE = 1000
+	SCAN_BUFFER_SIZE     = 64 // keys a shard can be ahead of the merge of a scan
+)
+
+type migration struct {
+	name  string
+	shard Shard
+	ring  *HashRing // the ring once the shard is added
+}
+
+// spreads keys over a set of shards with a consistent hash ring
+type ShardedStore struct {
+	Logger logger.Logger
+
+	ringMu    *sync.RWMutex // guards ring, shards and migration
+	ring      *HashRing
+	shards    map[string]Shard
+	migration *migration
+
+	keyLocks  []*sync.Mutex
+	addMu     *sync.Mutex   // one AddShard at a time
+	cleanupMu *sync.RWMutex // held by scans, so the ring isn't switched under them
+}
+
+// virtualNodes <= 0 means DEFAULT_VIRTUAL_NODES
+func NewShardedStore(shards map[string]Shard, virtualNodes int) *ShardedStore {
+	if virtualNodes <= 0 {
+		virtualNodes = DEFAULT_VIRTUAL_NODES
+	}
+	s := &ShardedStore{
+		Logger:    logger.NewNopLogger(),
+		ringMu:    &sync.RWMutex{},
+		ring:      NewHashRing(virtualNodes),
+		shards:    make(map[string]Shard),
+		addMu:     &sync.Mutex{},
+		cleanupMu: &sync.RWMutex{},
+	}
+	for name, shard := range shards {
+		s.ring.Add(name)
+		s.shards[name] = shard
+	}
+	for i := 0; i < KEY_LOCK_STRIPES; i++ {
+		s.keyLocks = append(s.keyLocks, &sync.Mutex{})
+	}
+	return s
+}
+
+func (s *ShardedStore) keyLock(key string) *sync.Mutex {
+	return s.keyLocks[hashKey(key)%KEY_LOCK_STRIPES]
+}
+
+// returns the name of the shard the key lives on
+func (s *ShardedStore) Owner(key string) string {
+	s.ringMu.RLock()
+	defer s.ringMu.RUnlock()
+	return s.ring.Locate(key)
+}
+
+// returns the names of the shards in sorted order
+func (s *ShardedStore) Shards() []string {
+	s.ringMu.RLock()
+	defer s.ringMu.RUnlock()
+	return s.ring.Nodes()
+}
+
+func (s *ShardedStore) Put(key string, value string) error {
+	return s.write(key, func(shard Shard) error {
+		return shard.Put(key, value)
+	})
+}
+
+func (s *ShardedStore) Delete(key string) error {
+	return s.write(key, func(shard Shard) error {
+		return shard.Delete(key)
+	})
+}
+
+func (s *ShardedStore) write(key string, apply func(shard Shard) error) error {
+	s.ringMu.RLock()
+	defer s.ringMu.RUnlock()
+	owner := s.ring.Locate(key)
+	if owner == "" {
+		return CustomError.ErrNoShards
+	}
+
+	mu := s.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := apply(s.shards[owner]); err != nil {
+		return fmt.Errorf("shard %s: %w", owner, err)
+	}
+	if m := s.migration; m != nil && m.ring.Locate(key) == m.name {
+		if err := apply(m.shard); err != nil {
+			return fmt.Errorf("shard %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// returns an empty string if the key doesn't exist
+func (s *ShardedStore) Get(key string) (string, error) {
+	value, _, err := s.Lookup(key)
+	return value, err
+}
+
+func (s *ShardedStore) Lookup(key string) (string, bool, error) {
+	// held while reading so the key isn't deleted from its old owner in between
+	s.ringMu.RLock()
+	defer s.ringMu.RUnlock()
+	owner := s.ring.Locate(key)
+	if owner == "" {
+		return "", false, CustomError.ErrNoShards
+	}
+	value, ok, err := s.shards[owner].Lookup(key)
+	if err != nil {
+		return "", false, fmt.Errorf("shard %s: %w", owner, err)
+	}
+	return value, ok, nil
+}
+
+type scanEntry struct {
+	key   string
+	value string
+}
+
+type scanStream struct {
+	name    string
+	entries chan scanEntry
+	errc    chan error
+	head    scanEntry
+	ok      bool
+}
+
+// Calls fn for every key in [start, end] across all shards in sorted order until fn returns false, empty means
+// unbounded. fn must not call AddShard
+func (s *ShardedStore) Scan(start string, end string, fn func(key string, value string) bool) error {
+	s.cleanupMu.RLock()
+	defer s.cleanupMu.RUnlock()
+
+	s.ringMu.RLock()
+	ring := s.ring.clone()
+	shards := make(map[string]Shard, len(s.shards))
+	for name, shard := range s.shards {
+		shards[name] = shard
+	}
+	s.ringMu.RUnlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	var streams []*scanStream
+	for _, name := range ring.Nodes() {
+		stream := &scanStream{
+			name:    name,
+			entries: make(chan scanEntry, SCAN_BUFFER_SIZE),
+			errc:    make(chan error, 1),
+		}
+		streams = append(streams, stream)
+		go func(shard Shard) {
+			err := shard.Scan(start, end, func(key string, value string) bool {
+				if ring.Locate(key) != stream.name {
+					return true
+				}
+				select {
+				case stream.entries <- scanEntry{key: key, value: value}:
+					return true
+				case <-done:
+					return false
+				}
+			})
+			stream.errc <- err
+			close(stream.entries)
+		}(shards[name])
+	}
+
+	advance := func(stream *scanStream) error {
+		stream.head, stream.ok = <-stream.entries
+		if !stream.ok {
+			if err := <-stream.errc; err != nil {
+				return fmt.Errorf("shard %s: %w", stream.name, err)
+			}
+		}
+		return nil
+	}
+	for _, stream := range streams {
+		if err := advance(stream); err != nil {
+			return err
+		}
+	}
+	for {
+		var next *scanStream
+		for _, stream := range streams {
+			if stream.ok && (next == nil || stream.head.key < next.head.key) {
+				next = stream
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		if !fn(next.head.key, next.head.value) {
+			return nil
+		}
+		if err := advance(next); err != nil {
+			return err
+		}
+	}
+}
+
+// Adds a shard and moves the keys it takes over to it, reads and writes keep going meanwhile. On error the shard
+// isn't added, whatever was already copied to it stays there. If only deleting the moved keys from their old
+// shards fails the shard is added anyway and the error returned, the leftovers are never read
+func (s *ShardedStore) AddShard(name string, shard Shard) error {
+	var l = s.Logger.WithFields(logger.Fields{
+		"method":     "AddShard",
+		"param_name": name,
+	})
+
+	s.addMu.Lock()
+	defer s.addMu.Unlock()
+
+	s.ringMu.Lock()
+	if _, ok := s.shards[name]; ok {
+		s.ringMu.Unlock()
+		return fmt.Errorf("%w: %s", CustomError.ErrShardExists, name)
+	}
+	ring := s.ring.clone()
+	ring.Add(name)
+	s.migration = &migration{name: name, shard: shard, ring: ring}
+	sources := make(map[string]Shard, len(s.shards))
+	for source, sourceShard := range s.shards {
+		sources[source] = sourceShard
+	}
+	s.ringMu.Unlock()
+
+	copied := 0
+	for source, sourceShard := range sources {
+		err := s.migrateChunks(sourceShard, ring, name, func(keys []string) error {
+			for _, key := range keys {
+				if err := s.copyKey(key, sourceShard, shard); err != nil {
+					return err
+				}
+			}
+			copied += len(keys)
+			return nil
+		})
+		if err != nil {
+			l.Errorf("Error while copying keys from %s %v", source, err)
+			s.ringMu.Lock()
+			s.migration = nil
+			s.ringMu.Unlock()
+			return fmt.Errorf("copying keys from shard %s: %w", source, err)
+		}
+	}
+	l.Infof("Copied %d keys", copied)
+
+	s.cleanupMu.Lock()
+	s.ringMu.Lock()
+	s.ring = ring
+	s.shards[name] = shard
+	s.migration = nil
+	s.ringMu.Unlock()
+	s.cleanupMu.Unlock()
+
+	// nothing writes the moved keys to their old shards anymore
+	for source, sourceShard := range sources {
+		err := s.migrateChunks(sourceShard, ring, name, func(keys []string) error {
+			for _, key := range keys {
+				if err := sourceShard.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			l.Errorf("Error while deleting moved keys from %s %v", source, err)
+			return fmt.Errorf("deleting moved keys from shard %s: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// walks the keys of source that ring maps to target, handing them to fn in chunks. No scan is open while fn runs
+func (s *ShardedStore) migrateChunks(source Shard, ring *HashRing, target string, fn func(keys []string) error) error {
+	start := ""
+	for {
+		var keys []string
+		last := ""
+		more := false
+		err := source.Scan(start, "", func(key string, value string) bool {
+			if len(keys) == MIGRATION_CHUNK_SIZE {
+				more = true
+				return false
+			}
+			last = key
+			if ring.Locate(key) == target {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if !more {
+			return nil
+		}
+		// the smallest key after last
+		start = last + "\x00"
+	}
+}
+
+// re-reads the key under its key lock, a write racing the copy either went to the target too or comes after it
+func (s *ShardedStore) copyKey(key string, source Shard, target Shard) error {
+	mu := s.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	value, ok, err := source.Lookup(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return target.Delete(key)
+	}
+	return target.Put(key, value)
+}
@@ -0,0 +1,266 @@
+package sharded_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/abesheknarayan/go-caskdb/pkg/config"
+	"github.com/abesheknarayan/go-caskdb/pkg/disk_store"
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/resp_server"
+	"github.com/stretchr/testify/assert"
+)
+
+func openShard(t *testing.T, name string) *LocalShard {
+	d, err := disk_store.InitDbWithOptions(name, disk_store.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.CloseDB)
+	return NewLocalShard(d)
+}
+
+// a store over shards named shard-0, shard-1 ...
+func newStore(t *testing.T, n int) *ShardedStore {
+	config.Config = config.NewDefaultConfig("Test", t.TempDir())
+	shards := make(map[string]Shard)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("shard-%d", i)
+		shards[name] = openShard(t, name)
+	}
+	return NewShardedStore(shards, 0)
+}
+
+func scanAll(t *testing.T, s *ShardedStore, start string, end string) []string {
+	var keys []string
+	err := s.Scan(start, end, func(key string, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Nil(t, err)
+	return keys
+}
+
+func TestHashRing(t *testing.T) {
+	ring := NewHashRing(DEFAULT_VIRTUAL_NODES)
+	assert.Equal(t, "", ring.Locate("key"))
+	for i := 0; i < 4; i++ {
+		ring.Add(fmt.Sprintf("node-%d", i))
+	}
+
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = ring.Locate(key)
+		counts[owners[key]]++
+	}
+	for node, count := range counts {
+		// 2500 each if perfectly even
+		assert.Greater(t, count, 1500, node)
+		assert.Less(t, count, 3500, node)
+	}
+
+	// keys either stay or move to the new node
+	bigger := ring.clone()
+	bigger.Add("node-4")
+	moved := 0
+	for key, owner := range owners {
+		if now := bigger.Locate(key); now != owner {
+			assert.Equal(t, "node-4", now)
+			moved++
+		}
+	}
+	assert.Greater(t, moved, 1000)
+	assert.Less(t, moved, 3000)
+
+	bigger.Remove("node-4")
+	for key, owner := range owners {
+		assert.Equal(t, owner, bigger.Locate(key))
+	}
+	assert.Equal(t, []string{"node-0", "node-1", "node-2", "node-3"}, bigger.Nodes())
+}
+
+func TestPutGetDeleteScan(t *testing.T) {
+	s := newStore(t, 3)
+	var keys []string
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		keys = append(keys, key)
+		assert.Nil(t, s.Put(key, "value-"+key))
+	}
+
+	// every shard got some keys
+	perShard := make(map[string]int)
+	for _, key := range keys {
+		perShard[s.Owner(key)]++
+	}
+	assert.Equal(t, 3, len(perShard))
+
+	value, err := s.Get("key-042")
+	assert.Nil(t, err)
+	assert.Equal(t, "value-key-042", value)
+	assert.Nil(t, s.Delete("key-042"))
+	_, ok, err := s.Lookup("key-042")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	expected := append(append([]string{}, keys[:42]...), keys[43:]...)
+	assert.Equal(t, expected, scanAll(t, s, "", ""))
+	assert.Equal(t, []string{"key-040", "key-041", "key-043", "key-044"}, scanAll(t, s, "key-040", "key-044"))
+
+	var seen []string
+	err = s.Scan("key-100", "", func(key string, value string) bool {
+		assert.Equal(t, "value-"+key, value)
+		seen = append(seen, key)
+		return len(seen) < 5
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, keys[100:105], seen)
+
+	empty := NewShardedStore(nil, 0)
+	assert.True(t, errors.Is(empty.Put("key", "value"), CustomError.ErrNoShards))
+	assert.Nil(t, empty.Scan("", "", func(key string, value string) bool { return true }))
+}
+
+func TestAddShard(t *testing.T) {
+	s := newStore(t, 2)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, s.Put(fmt.Sprintf("key-%04d", i), "old"))
+	}
+	before := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		before[key] = s.Owner(key)
+	}
+
+	// writers keep going while the keys are moved
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 2000; i += 4 {
+				key := fmt.Sprintf("key-%04d", i)
+				if i%10 == 0 {
+					assert.Nil(t, s.Delete(key))
+				} else {
+					assert.Nil(t, s.Put(key, "new"))
+				}
+			}
+		}(w)
+	}
+	added := openShard(t, "shard-2")
+	assert.Nil(t, s.AddShard("shard-2", added))
+	wg.Wait()
+
+	assert.True(t, errors.Is(s.AddShard("shard-2", added), CustomError.ErrShardExists))
+	assert.Equal(t, []string{"shard-0", "shard-1", "shard-2"}, s.Shards())
+
+	var expected []string
+	moved := 0
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		value, ok, err := s.Lookup(key)
+		assert.Nil(t, err)
+		if i%10 == 0 {
+			assert.False(t, ok, key)
+		} else {
+			assert.Equal(t, "new", value, key)
+			expected = append(expected, key)
+		}
+
+		owner := s.Owner(key)
+		if owner == "shard-2" {
+			moved++
+			// gone from the old shard
+			_, ok, _ := s.shards[before[key]].Lookup(key)
+			assert.False(t, ok, key)
+		} else {
+			assert.Equal(t, before[key], owner)
+		}
+	}
+	assert.Greater(t, moved, 0)
+	assert.Equal(t, expected, scanAll(t, s, "", ""))
+}
+
+// serves the db over the redis protocol until the test ends
+func serveShard(t *testing.T, d *disk_store.DiskStore) *RespShard {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := resp_server.NewServer(d)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	remote := NewRespShard(listener.Addr().String())
+	t.Cleanup(remote.Close)
+	return remote
+}
+
+func TestRespShard(t *testing.T) {
+	config.Config = config.NewDefaultConfig("Test", t.TempDir())
+	remote := serveShard(t, openShard(t, "remote").Db)
+	remote.ScanCount = 7
+
+	s := NewShardedStore(map[string]Shard{
+		"local":  openShard(t, "local"),
+		"remote": remote,
+	}, 0)
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		keys = append(keys, key)
+		assert.Nil(t, s.Put(key, "value-"+key))
+	}
+	sort.Strings(keys)
+
+	value, err := s.Get("key-077")
+	assert.Nil(t, err)
+	assert.Equal(t, "value-key-077", value)
+	assert.Equal(t, keys, scanAll(t, s, "", ""))
+	assert.Equal(t, keys[10:21], scanAll(t, s, "key-010", "key-020"))
+
+	assert.Nil(t, s.Delete("key-077"))
+	_, ok, err := remote.Lookup("key-077")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// some keys made it to the remote db
+	remoteKeys := 0
+	assert.Nil(t, remote.Scan("", "", func(key string, value string) bool {
+		remoteKeys++
+		return true
+	}))
+	assert.Greater(t, remoteKeys, 0)
+	assert.Less(t, remoteKeys, 100)
+}
+
+// writes to a follower fail, they must not be dropped on the way
+func TestReadOnlyRespShard(t *testing.T) {
+	config.Config = config.NewDefaultConfig("Test", t.TempDir())
+	options := disk_store.DefaultOptions()
+	options.ReadOnly = true
+	d, err := disk_store.InitDbWithOptions("follower", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.CloseDB)
+	remote := serveShard(t, d)
+
+	err = remote.Put("key", "value")
+	assert.ErrorContains(t, err, CustomError.ErrReadOnly.Error())
+	assert.ErrorContains(t, remote.Delete("key"), CustomError.ErrReadOnly.Error())
+	_, ok, err := remote.Lookup("key")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	s := NewShardedStore(map[string]Shard{"remote": remote}, 0)
+	assert.Error(t, s.Put("key", "value"))
+}
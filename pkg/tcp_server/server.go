@@ -0,0 +1,171 @@
+package tcp_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	CustomError "github.com/abesheknarayan/go-caskdb/pkg/error"
+	"github.com/abesheknarayan/go-caskdb/pkg/logger"
+)
+
+/*
+	- listener and connection bookkeeping shared by the protocol servers, every connection gets its own goroutine
+	  running Handler
+	- Shutdown stops accepting and wakes up connections blocked on a read by setting a read deadline, handlers are
+	  expected to check IsShuttingDown between requests and return
+*/
+
+type Server struct {
+	Name    string // what is being served, only used in logs
+	Handler func(conn net.Conn)
+	Logger  logger.Logger
+
+	Mu               *sync.Mutex
+	listeners        map[net.Listener]bool
+	connections      map[net.Conn]bool
+	shuttingDown     bool
+	handlers         *sync.WaitGroup
+	totalConnections uint64
+}
+
+func NewServer(name string, log logger.Logger, handler func(conn net.Conn)) *Server {
+	return &Server{
+		Name:        name,
+		Handler:     handler,
+		Logger:      log,
+		Mu:          &sync.Mutex{},
+		listeners:   make(map[net.Listener]bool),
+		connections: make(map[net.Conn]bool),
+		handlers:    &sync.WaitGroup{},
+	}
+}
+
+// listens on the tcp address and serves connections until Shutdown is called
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// serves the connections of the listener until Shutdown is called, then returns ErrServerClosed
+func (s *Server) Serve(listener net.Listener) error {
+	var l = s.Logger.WithFields(logger.Fields{
+		"method": "Serve",
+		"addr":   listener.Addr().String(),
+	})
+
+	s.Mu.Lock()
+	if s.shuttingDown {
+		s.Mu.Unlock()
+		listener.Close()
+		return CustomError.ErrServerClosed
+	}
+	s.listeners[listener] = true
+	s.Mu.Unlock()
+	l.Infof("Serving %s", s.Name)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.IsShuttingDown() {
+				return CustomError.ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			l.Errorln(err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if !s.trackConnection(conn) {
+			conn.Close()
+			continue
+		}
+		go s.serveConnection(conn)
+	}
+}
+
+// Stops accepting connections and waits for the open ones to finish their current request. Connections still open
+// when ctx is done are closed right away and ctx's error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Mu.Lock()
+	s.shuttingDown = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	// wakes up connections waiting for their next request
+	for conn := range s.connections {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.Mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Mu.Lock()
+		for conn := range s.connections {
+			conn.Close()
+		}
+		s.Mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Server) IsShuttingDown() bool {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	return s.shuttingDown
+}
+
+// returns the number of open connections and the number of connections accepted so far
+func (s *Server) Connections() (int, uint64) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	return len(s.connections), s.totalConnections
+}
+
+// returns false if the server is shutting down and the connection must not be served
+func (s *Server) trackConnection(conn net.Conn) bool {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.connections[conn] = true
+	s.totalConnections++
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Server) untrackConnection(conn net.Conn) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	delete(s.connections, conn)
+	s.handlers.Done()
+}
+
+func (s *Server) serveConnection(conn net.Conn) {
+	var l = s.Logger.WithFields(logger.Fields{
+		"method": "serveConnection",
+		"remote": conn.RemoteAddr().String(),
+	})
+	l.Debugln("Connection opened")
+	defer func() {
+		conn.Close()
+		s.untrackConnection(conn)
+		l.Debugln("Connection closed")
+	}()
+	s.Handler(conn)
+}
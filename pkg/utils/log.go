@@ -4,12 +4,13 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/abesheknarayan/go-caskdb/pkg/config"
 	"github.com/sirupsen/logrus"
 )
 
-// instance
+// instance used by main.go, the db itself logs through the logger passed in its options (see pkg/logger)
 var Logger *logrus.Logger
 
 func InitLogger() {
@@ -33,16 +34,24 @@ func InitLogger() {
 
 	if config.Config.Stage != "Test" {
 		var err error
-		f, err = os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+		if err = os.MkdirAll(filepath.Dir(filename), 0777); err == nil {
+			f, err = os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+		}
 		if err != nil {
-			log.Fatalf(err.Error())
+			// logging to stdout is better than not starting at all
+			log.Printf("Failed to open log file %s, logging to stdout: %v", filename, err)
+			f = os.Stdout
 		}
 	}
 
 	switch config.Config.Stage {
 	case "Dev":
 		{
-			writer = io.MultiWriter(f, os.Stdout)
+			if f == os.Stdout {
+				writer = os.Stdout
+			} else {
+				writer = io.MultiWriter(f, os.Stdout)
+			}
 		}
 	case "Test":
 		{
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"io"
 	"math/rand"
 	"os"
 	"time"
@@ -27,3 +28,37 @@ func DeleteFile(filePath string) error {
 	err := os.Remove(filePath)
 	return err
 }
+
+// fsyncs a directory so that file creations, renames and deletions inside it are durable
+func SyncDir(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// hard links src to dst, copies it when linking fails (e.g. dst is on another filesystem)
+func LinkOrCopyFile(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}